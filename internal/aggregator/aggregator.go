@@ -0,0 +1,135 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+// Aggregator reduces the points of a series received during a flush interval to a single point.
+// It isn't safe for concurrent use, the nozzle calls it with the metrics map locked.
+type Aggregator struct {
+	rules []rule
+	// functions caches the aggregation function of each metric name, nil if the metric isn't aggregated
+	functions map[string]aggregate
+	states    map[metric.MetricKey]*state
+}
+
+type rule struct {
+	name     *filter.Pattern
+	function aggregate
+}
+
+// aggregate computes the value of the single point of a series from its state
+type aggregate func(s *state) float64
+
+// state summarizes the points of a series since the last flush
+type state struct {
+	last  float64
+	min   float64
+	max   float64
+	sum   float64
+	count float64
+}
+
+var functions = map[string]aggregate{
+	"last":  func(s *state) float64 { return s.last },
+	"min":   func(s *state) float64 { return s.min },
+	"max":   func(s *state) float64 { return s.max },
+	"sum":   func(s *state) float64 { return s.sum },
+	"count": func(s *state) float64 { return s.count },
+	"avg":   func(s *state) float64 { return s.sum / s.count },
+}
+
+// New compiles the aggregation rules, the first rule matching a metric name applies
+func New(configs []config.MetricAggregation) (*Aggregator, error) {
+	rules := make([]rule, 0, len(configs))
+	for _, c := range configs {
+		function, ok := functions[c.Function]
+		if !ok {
+			return nil, fmt.Errorf("unknown aggregation function %s", c.Function)
+		}
+		name, err := filter.CompilePattern(c.Name)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule{name: name, function: function})
+	}
+	return &Aggregator{
+		rules:     rules,
+		functions: make(map[string]aggregate),
+		states:    make(map[metric.MetricKey]*state),
+	}, nil
+}
+
+// Add adds the points of a series to the metrics map, aggregated with the previous ones if a rule matches its name.
+// Distributions are never aggregated, the distribution endpoint needs all their values.
+func (a *Aggregator) Add(metrics metric.MetricsMap, key metric.MetricKey, value metric.MetricValue) {
+	var function aggregate
+	if value.Type != metric.Distribution {
+		function = a.function(key.Name)
+	}
+	if function == nil {
+		metrics.Add(key, value)
+		return
+	}
+
+	s, ok := a.states[key]
+	var timestamp int64
+	if ok {
+		timestamp = metrics[key].Points[0].Timestamp
+	}
+	for _, point := range value.Points {
+		if math.IsNaN(point.Value) {
+			continue
+		}
+		if !ok {
+			s = &state{min: point.Value, max: point.Value}
+			a.states[key] = s
+			ok = true
+		}
+		s.last = point.Value
+		s.min = math.Min(s.min, point.Value)
+		s.max = math.Max(s.max, point.Value)
+		s.sum += point.Value
+		s.count++
+		if point.Timestamp > timestamp {
+			timestamp = point.Timestamp
+		}
+	}
+	if !ok {
+		// Only NaN values so far
+		return
+	}
+
+	value.Points = []metric.Point{{Timestamp: timestamp, Value: function(s)}}
+	metrics[key] = value
+}
+
+// Reset forgets the aggregated series, it is called when the metrics map is flushed
+func (a *Aggregator) Reset() {
+	if len(a.states) > 0 {
+		a.states = make(map[metric.MetricKey]*state)
+	}
+}
+
+func (a *Aggregator) function(name string) aggregate {
+	if len(a.rules) == 0 {
+		return nil
+	}
+	function, ok := a.functions[name]
+	if ok {
+		return function
+	}
+	for _, r := range a.rules {
+		if r.name.Match(name) {
+			function = r.function
+			break
+		}
+	}
+	a.functions[name] = function
+	return function
+}
@@ -0,0 +1,13 @@
+package aggregator
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Aggregator Suite")
+}
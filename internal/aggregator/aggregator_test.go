@@ -0,0 +1,100 @@
+package aggregator
+
+import (
+	"math"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+var _ = Describe("Aggregator", func() {
+	var (
+		a       *Aggregator
+		metrics metric.MetricsMap
+	)
+
+	BeforeEach(func() {
+		var err error
+		a, err = New([]config.MetricAggregation{
+			{Name: "cpu.*", Function: "avg"},
+			{Name: "*.max", Function: "max"},
+			{Name: "*.min", Function: "min"},
+			{Name: "requests", Function: "sum"},
+			{Name: "events", Function: "count"},
+			{Name: "/^queue\\./", Function: "last"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		metrics = make(metric.MetricsMap)
+	})
+
+	add := func(name string, values ...float64) metric.MetricKey {
+		key := metric.MetricKey{Name: name, TagsHash: "hash"}
+		for i, v := range values {
+			a.Add(metrics, key, metric.MetricValue{
+				Tags:   []string{"job:router"},
+				Points: []metric.Point{{Timestamp: int64(100 + i), Value: v}},
+				Host:   "host",
+				Type:   metric.Gauge,
+			})
+		}
+		return key
+	}
+
+	It("keeps every point of the metrics without rule", func() {
+		key := add("latency", 1, 2, 3)
+		Expect(metrics[key].Points).To(HaveLen(3))
+	})
+
+	It("keeps every point of the distributions", func() {
+		key := metric.MetricKey{Name: "cpu.user", TagsHash: "hash"}
+		for i := 0; i < 3; i++ {
+			a.Add(metrics, key, metric.MetricValue{
+				Points: []metric.Point{{Timestamp: 100, Value: float64(i)}},
+				Type:   metric.Distribution,
+			})
+		}
+		Expect(metrics[key].Points).To(HaveLen(3))
+	})
+
+	It("keeps one point per series with the aggregated value and the latest timestamp", func() {
+		expectations := map[string]float64{
+			"cpu.user":    2,
+			"latency.max": 3,
+			"latency.min": 1,
+			"requests":    6,
+			"events":      3,
+			"queue.depth": 3,
+		}
+		for name, expected := range expectations {
+			key := add(name, 1, 2, 3)
+			Expect(metrics[key].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: expected}}), name)
+			Expect(metrics[key].Tags).To(Equal([]string{"job:router"}))
+			Expect(metrics[key].Host).To(Equal("host"))
+		}
+	})
+
+	It("ignores NaN values", func() {
+		key := add("cpu.user", math.NaN())
+		Expect(metrics).ToNot(HaveKey(key))
+
+		add("cpu.user", 4, math.NaN(), 2)
+		Expect(metrics[key].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: 3}}))
+	})
+
+	It("starts over after a reset", func() {
+		key := add("requests", 1, 2, 3)
+		metrics = make(metric.MetricsMap)
+		a.Reset()
+
+		add("requests", 10)
+		Expect(metrics[key].Points).To(Equal([]metric.Point{{Timestamp: 100, Value: 10}}))
+	})
+
+	It("fails on unknown functions", func() {
+		_, err := New([]config.MetricAggregation{{Name: "*", Function: "median"}})
+		Expect(err).To(HaveOccurred())
+	})
+})
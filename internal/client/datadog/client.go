@@ -2,10 +2,12 @@ package datadog
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"code.cloudfoundry.org/localip"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/spool"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
 	"github.com/cloudfoundry/gosteno"
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
@@ -21,6 +24,10 @@ import (
 
 const DefaultAPIURL = "https://app.datadoghq.com/api/v1"
 
+// maxReplayedPayloads is the maximum number of spooled payloads sent on each flush, so that
+// replaying a large spool does not delay the next flushes too much
+const maxReplayedPayloads = 50
+
 type Client struct {
 	apiURL       string
 	apiKey       string
@@ -32,12 +39,35 @@ type Client struct {
 	maxPostBytes uint32
 	log          *gosteno.Logger
 	formatter    Formatter
+	spool        *spool.Spool
+	// dogStatsD is set when the metrics are sent to DogStatsD instead of the API
+	dogStatsD *dogStatsDConn
 }
 
 type Payload struct {
 	Series []metric.Series `json:"series"`
 }
 
+// PayloadV2 is the payload of the v2 series API
+type PayloadV2 struct {
+	Series []metric.SeriesV2 `json:"series"`
+}
+
+type DistributionPayload struct {
+	Series []metric.DistributionSeries `json:"series"`
+}
+
+// responseError is returned when datadog answers with a non 2xx status code
+type responseError struct {
+	status string
+	code   int
+	body   []byte
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("datadog request returned HTTP response: %s\nResponse Body: %s", e.status, e.body)
+}
+
 type Proxy struct {
 	HTTP    string
 	HTTPS   string
@@ -57,6 +87,24 @@ func New(
 	customTags []string,
 	proxy *Proxy,
 ) *Client {
+	return &Client{
+		apiURL:       apiURL,
+		apiKey:       apiKey,
+		prefix:       prefix,
+		deployment:   deployment,
+		ip:           ip,
+		log:          logger,
+		customTags:   customTags,
+		httpClient:   newHTTPClient(writeTimeout, flushDuration, logger, proxy),
+		maxPostBytes: maxPostBytes,
+		formatter: Formatter{
+			log:      logger,
+			interval: int64(flushDuration / time.Second),
+		},
+	}
+}
+
+func newHTTPClient(writeTimeout time.Duration, flushDuration time.Duration, logger *gosteno.Logger, proxy *Proxy) *retryablehttp.Client {
 	httpClient := retryablehttp.NewClient()
 	httpClient.HTTPClient = &http.Client{
 		Timeout: writeTimeout,
@@ -88,20 +136,7 @@ func New(
 		logger.Debug(msg)
 	}
 
-	return &Client{
-		apiURL:       apiURL,
-		apiKey:       apiKey,
-		prefix:       prefix,
-		deployment:   deployment,
-		ip:           ip,
-		log:          logger,
-		customTags:   customTags,
-		httpClient:   httpClient,
-		maxPostBytes: maxPostBytes,
-		formatter: Formatter{
-			log: logger,
-		},
-	}
+	return httpClient
 }
 
 func NewClients(config *config.Config, log *gosteno.Logger) ([]*Client, error) {
@@ -110,30 +145,39 @@ func NewClients(config *config.Config, log *gosteno.Logger) ([]*Client, error) {
 		panic(err)
 	}
 
-	var proxy *Proxy
-	if config.HTTPProxyURL != "" || config.HTTPSProxyURL != "" {
-		proxy = &Proxy{
-			HTTP:    config.HTTPProxyURL,
-			HTTPS:   config.HTTPSProxyURL,
-			NoProxy: config.NoProxy,
-		}
-	}
+	proxy := newProxy(config)
 
-	// Instantiating Datadog primary client
+	// Instantiating Datadog primary client, sending to DogStatsD if configured
 	var ddClients []*Client
-	ddClients = append(ddClients, New(
-		config.DataDogURL,
-		config.DataDogAPIKey,
-		config.MetricPrefix,
-		config.Deployment,
-		ipAddress,
-		time.Duration(config.DataDogTimeoutSeconds)*time.Second,
-		time.Duration(config.FlushDurationSeconds)*time.Second,
-		config.FlushMaxBytes,
-		log,
-		config.CustomTags,
-		proxy,
-	))
+	if config.DogStatsDAddress != "" {
+		client, err := NewDogStatsD(
+			config.DogStatsDAddress,
+			config.MetricPrefix,
+			config.Deployment,
+			ipAddress,
+			time.Duration(config.FlushDurationSeconds)*time.Second,
+			log,
+			config.CustomTags,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ddClients = append(ddClients, client)
+	} else {
+		ddClients = append(ddClients, New(
+			config.DataDogURL,
+			config.DataDogAPIKey,
+			config.MetricPrefix,
+			config.Deployment,
+			ipAddress,
+			time.Duration(config.DataDogTimeoutSeconds)*time.Second,
+			time.Duration(config.FlushDurationSeconds)*time.Second,
+			config.FlushMaxBytes,
+			log,
+			config.CustomTags,
+			proxy,
+		))
+	}
 	// Instantiating Additional Datadog endpoints
 	for endpoint, keys := range config.DataDogAdditionalEndpoints {
 		for keyIndex := range keys {
@@ -153,36 +197,225 @@ func NewClients(config *config.Config, log *gosteno.Logger) ([]*Client, error) {
 		}
 	}
 
+	// The metrics named after an unprefixed alias keep their name
+	unprefixed := config.MetricNaming.UnprefixedNames()
+	seriesV2Encoding := seriesV2Encoding(config)
+	for _, client := range ddClients {
+		client.formatter.unprefixed = unprefixed
+		if client.dogStatsD == nil {
+			client.formatter.seriesV2Encoding = seriesV2Encoding
+		}
+	}
+
+	if config.SpoolDirectory != "" {
+		for _, client := range ddClients {
+			if client.dogStatsD != nil {
+				// The datagrams sent to DogStatsD aren't acknowledged, there is nothing to spool
+				continue
+			}
+			client.spool, err = spool.New(
+				filepath.Join(config.SpoolDirectory, client.spoolName()),
+				int64(config.SpoolMaxBytes),
+				int64(config.SpoolSegmentMaxBytes),
+				time.Duration(config.SpoolMaxAgeSeconds)*time.Second,
+				log,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return ddClients, nil
 }
 
+// seriesV2Encoding returns the encoding of the v2 series payloads, or an empty string when posting to the v1 series API
+func seriesV2Encoding(c *config.Config) string {
+	if c.DataDogSeriesAPIVersion != config.SeriesAPIV2 {
+		return ""
+	}
+	return c.DataDogSeriesEncoding
+}
+
+func newProxy(config *config.Config) *Proxy {
+	if config.HTTPProxyURL == "" && config.HTTPSProxyURL == "" {
+		return nil
+	}
+	return &Proxy{
+		HTTP:    config.HTTPProxyURL,
+		HTTPS:   config.HTTPSProxyURL,
+		NoProxy: config.NoProxy,
+	}
+}
+
 func (c *Client) PostMetrics(metrics metric.MetricsMap) error {
-	c.log.Infof("Posting %d metrics to account %s", len(metrics), c.apiKey[len(c.apiKey)-4:])
+	if c.dogStatsD != nil {
+		return c.postDogStatsD(metrics)
+	}
 
-	seriesBytes := c.formatter.Format(c.prefix, c.maxPostBytes, metrics)
-	for _, data := range seriesBytes {
+	c.log.Infof("Posting %d metrics to account %s", len(metrics), c.Account())
+
+	series, distributions := splitDistributions(metrics)
+	seriesBytes := c.formatter.Format(c.prefix, c.maxPostBytes, series)
+	for i, data := range seriesBytes {
 		if uint32(len(data)) > c.maxPostBytes {
 			c.log.Infof("Throwing out metric that exceeds %d bytes", c.maxPostBytes)
 			continue
 		}
 
-		if err := c.postMetrics(data); err != nil {
+		if err := c.postMetrics(c.seriesURL(), c.formatter.seriesContentType(), data); err != nil {
+			if c.spool != nil && isTransient(err) {
+				// Keep this payload and the remaining ones to send them once datadog is reachable again
+				c.spoolPayloads(seriesBytes[i:])
+			}
 			return err
 		}
 	}
 
+	err := c.postDistributions(distributions)
+	c.replaySpool()
+	return err
+}
+
+// postDistributions sends the distributions to the distribution endpoint. They are not spooled, as the points of a
+// distribution are only worth something together.
+func (c *Client) postDistributions(distributions metric.MetricsMap) error {
+	distributionsBytes := c.formatter.FormatDistributions(c.prefix, c.maxPostBytes, distributions)
+	for _, data := range distributionsBytes {
+		if uint32(len(data)) > c.maxPostBytes {
+			c.log.Infof("Throwing out distribution that exceeds %d bytes", c.maxPostBytes)
+			continue
+		}
+
+		if err := c.postMetrics(c.distributionsURL(), "application/json", data); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (c *Client) postMetrics(seriesBytes []byte) error {
-	url := c.seriesURL()
+// splitDistributions separates the distributions from the other metrics, they are sent to another endpoint
+func splitDistributions(metrics metric.MetricsMap) (series metric.MetricsMap, distributions metric.MetricsMap) {
+	series = make(metric.MetricsMap, len(metrics))
+	distributions = make(metric.MetricsMap)
+	for k, v := range metrics {
+		if v.Type == metric.Distribution {
+			distributions[k] = v
+		} else {
+			series[k] = v
+		}
+	}
+	return series, distributions
+}
+
+// Endpoint returns the URL metrics are posted to, or the DogStatsD address
+func (c *Client) Endpoint() string {
+	return c.apiURL
+}
+
+// APIKey returns the API key metrics are posted with
+func (c *Client) APIKey() string {
+	return c.apiKey
+}
 
+// Account returns the last characters of the API key, enough to tell the clients apart without leaking the key
+func (c *Client) Account() string {
+	if len(c.apiKey) < 4 {
+		// No API key is needed to send to DogStatsD
+		return ""
+	}
+	return c.apiKey[len(c.apiKey)-4:]
+}
+
+// SpoolDepth returns the number of payloads waiting in the spool
+func (c *Client) SpoolDepth() uint64 {
+	if c.spool == nil {
+		return 0
+	}
+	return c.spool.Depth()
+}
+
+// SpoolDroppedBytes returns the number of bytes dropped by the spool because of its size or age limits
+func (c *Client) SpoolDroppedBytes() uint64 {
+	if c.spool == nil {
+		return 0
+	}
+	return c.spool.DroppedBytes()
+}
+
+// HasSpool returns true if payloads failing to be posted are spooled on disk
+func (c *Client) HasSpool() bool {
+	return c.spool != nil
+}
+
+func (c *Client) spoolPayloads(payloads [][]byte) {
+	for _, data := range payloads {
+		if uint32(len(data)) > c.maxPostBytes {
+			continue
+		}
+		if err := c.spool.Write(data); err != nil {
+			c.log.Errorf("Error spooling metrics payload: %v", err)
+		}
+	}
+	c.log.Infof("Spooled %d metrics payloads, %d payloads waiting to be sent", len(payloads), c.spool.Depth())
+}
+
+// replaySpool sends the spooled payloads, oldest first, until one of them fails
+func (c *Client) replaySpool() {
+	if c.spool == nil {
+		return
+	}
+
+	for i := 0; i < maxReplayedPayloads; i++ {
+		data, err := c.spool.Peek()
+		if err != nil {
+			c.log.Errorf("Error reading spooled metrics payload: %v", err)
+			return
+		}
+		if data == nil {
+			return
+		}
+
+		err = c.postMetrics(c.seriesURL(), c.formatter.seriesContentType(), data)
+		if err != nil && isTransient(err) {
+			c.log.Errorf("Error replaying spooled metrics payload: %v", err)
+			return
+		}
+		if err != nil {
+			// Datadog will never accept this payload, there is no point in keeping it
+			c.log.Errorf("Dropping spooled metrics payload rejected by datadog: %v", err)
+		}
+		if err := c.spool.Ack(); err != nil {
+			c.log.Errorf("Error removing replayed metrics payload from the spool: %v", err)
+			return
+		}
+	}
+}
+
+// spoolName returns the name of the spool directory of the client, unique per endpoint, api key and series format, so
+// that the payloads are not replayed in another format after a configuration change
+func (c *Client) spoolName() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(c.apiURL+c.apiKey+c.formatter.seriesV2Encoding)))
+}
+
+// isTransient returns false if the error comes from datadog rejecting the payload, in which case
+// sending it again would fail the same way
+func isTransient(err error) bool {
+	respErr, ok := err.(*responseError)
+	if !ok {
+		return true
+	}
+	return respErr.code >= 500 || respErr.code == http.StatusRequestTimeout || respErr.code == http.StatusTooManyRequests
+}
+
+func (c *Client) postMetrics(url string, contentType string, seriesBytes []byte) error {
 	req, err := retryablehttp.NewRequest("POST", url, seriesBytes)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Content-Encoding", "deflate") // Additional header for zlib compression
+	req.Header.Set("DD-API-KEY", c.apiKey)        // The v2 API only takes the API key from the headers
 
 	// If an error is returned by the client (connection errors, etc.), or if a 500-range
 	// response code is received, then a retry is invoked on this request after a wait period
@@ -198,17 +431,34 @@ func (c *Client) postMetrics(seriesBytes []byte) error {
 		if err != nil {
 			body = []byte("failed to read body")
 		}
-		return fmt.Errorf("datadog request returned HTTP response: %s\nResponse Body: %s", resp.Status, body)
+		return &responseError{
+			status: resp.Status,
+			code:   resp.StatusCode,
+			body:   body,
+		}
 	}
 
 	return nil
 }
 
 func (c *Client) seriesURL() string {
+	if c.formatter.seriesV2() {
+		return c.apiURL
+	}
 	url := fmt.Sprintf("%s?api_key=%s", c.apiURL, c.apiKey)
 	return url
 }
 
+// distributionsURL returns the distribution endpoint next to the series endpoint the client is configured with
+func (c *Client) distributionsURL() string {
+	apiURL := strings.TrimSuffix(strings.TrimSuffix(c.apiURL, "/"), "/series")
+	if c.formatter.seriesV2() {
+		// There is no v2 distribution endpoint
+		apiURL = strings.TrimSuffix(apiURL, "/v2") + "/v1"
+	}
+	return fmt.Sprintf("%s/distribution_points?api_key=%s", apiURL, c.apiKey)
+}
+
 func (c *Client) MakeInternalMetric(name string, value uint64, timestamp int64) (metric.MetricKey, metric.MetricValue) {
 	point := metric.Point{
 		Timestamp: timestamp,
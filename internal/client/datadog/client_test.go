@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"time"
 
@@ -15,7 +17,9 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/spool"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
 	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
 )
@@ -320,6 +324,214 @@ var _ = Describe("DatadogClient", func() {
 		Expect(m.Tags).To(Equal(defaultTags))
 	})
 
+	It("posts distributions to the distribution endpoint, grouped by timestamp", func() {
+		k, v := makeFakeMetric("valueName", 1, 5, events.Envelope_ValueMetric, defaultTags)
+		metricsMap.Add(k, v)
+		for i, value := range []uint64{5, 6, 7} {
+			k, v = makeFakeMetric("app.distribution.cpu.pct", uint64(1+i/2), value, events.Envelope_ContainerMetric, defaultTags)
+			v.Type = metric.Distribution
+			v.Host = ""
+			metricsMap.Add(k, v)
+		}
+
+		err := c.PostMetrics(metricsMap)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(reqs).To(HaveLen(2))
+		var req *http.Request
+		Eventually(reqs).Should(Receive(&req))
+		Expect(req.URL.Path).To(Equal("/"))
+		Eventually(reqs).Should(Receive(&req))
+		Expect(req.URL.Path).To(Equal("/distribution_points"))
+		Expect(req.URL.Query().Get("api_key")).To(Equal("dummykey"))
+
+		var payload Payload
+		err = json.Unmarshal(helper.Decompress(bodies[0]), &payload)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(payload.Series).To(HaveLen(1))
+		Expect(payload.Series[0].Metric).To(Equal("datadog.nozzle.valueName"))
+
+		var distributions struct {
+			Series []struct {
+				Metric string
+				Points [][]interface{}
+				Tags   []string
+				Host   string
+			}
+		}
+		err = json.Unmarshal(helper.Decompress(bodies[1]), &distributions)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(distributions.Series).To(HaveLen(1))
+
+		d := distributions.Series[0]
+		Expect(d.Metric).To(Equal("datadog.nozzle.app.distribution.cpu.pct"))
+		Expect(d.Host).To(BeEmpty())
+		Expect(d.Tags).To(Equal(defaultTags))
+		Expect(d.Points).To(Equal([][]interface{}{
+			{1.0, []interface{}{5.0, 6.0}},
+			{2.0, []interface{}{7.0}},
+		}))
+	})
+
+	It("derives the distribution endpoint from the series endpoint", func() {
+		c.apiURL = "https://app.datadoghq.com/api/v1/series"
+		Expect(c.distributionsURL()).To(Equal("https://app.datadoghq.com/api/v1/distribution_points?api_key=dummykey"))
+	})
+
+	Context("with the v2 series API", func() {
+		BeforeEach(func() {
+			c = New(
+				ts.URL+"/api/v2/series",
+				"dummykey",
+				"datadog.nozzle.",
+				"test-deployment",
+				"dummy-ip",
+				time.Second,
+				2*time.Second,
+				2000,
+				gosteno.NewLogger("datadogclient test"),
+				[]string{},
+				nil,
+			)
+			c.formatter.seriesV2Encoding = config.SeriesEncodingJSON
+		})
+
+		It("posts the series with their type, interval, unit, host resource and precise values", func() {
+			metricsMap[metric.MetricKey{Name: "gauge", TagsHash: "a"}] = metric.MetricValue{
+				Tags:   defaultTags,
+				Points: []metric.Point{{Timestamp: 1, Value: 0.000000123}, {Timestamp: 2, Value: 12345678901234567}},
+				Host:   "dummy-host",
+				Type:   metric.Gauge,
+				Unit:   "millisecond",
+			}
+			metricsMap[metric.MetricKey{Name: "count", TagsHash: "b"}] = metric.MetricValue{
+				Points: []metric.Point{{Timestamp: 1, Value: 3}},
+				Type:   metric.Count,
+			}
+
+			Expect(c.PostMetrics(metricsMap)).To(Succeed())
+
+			var req *http.Request
+			Eventually(reqs).Should(Receive(&req))
+			Expect(req.URL.Path).To(Equal("/api/v2/series"))
+			Expect(req.URL.Query().Get("api_key")).To(BeEmpty())
+			Expect(req.Header.Get("DD-API-KEY")).To(Equal("dummykey"))
+			Expect(req.Header.Get("Content-Encoding")).To(Equal("deflate"))
+
+			var payload PayloadV2
+			Expect(json.Unmarshal(helper.Decompress(bodies[0]), &payload)).To(Succeed())
+			Expect(payload.Series).To(ConsistOf(
+				metric.SeriesV2{
+					Metric:    "datadog.nozzle.gauge",
+					Type:      metric.TypeV2Gauge,
+					Unit:      "millisecond",
+					Points:    []metric.PointV2{{Timestamp: 1, Value: 0.000000123}, {Timestamp: 2, Value: 12345678901234567}},
+					Resources: []metric.ResourceV2{{Name: "dummy-host", Type: "host"}},
+					Tags:      defaultTags,
+				},
+				metric.SeriesV2{
+					Metric:   "datadog.nozzle.count",
+					Type:     metric.TypeV2Count,
+					Interval: 2,
+					Points:   []metric.PointV2{{Timestamp: 1, Value: 3}},
+				},
+			))
+		})
+
+		It("posts the series encoded in protobuf", func() {
+			c.formatter.seriesV2Encoding = config.SeriesEncodingProtobuf
+			metricsMap[metric.MetricKey{Name: "count", TagsHash: "a"}] = metric.MetricValue{
+				Tags:   defaultTags,
+				Points: []metric.Point{{Timestamp: 1, Value: 0.000000123}, {Timestamp: 2, Value: 0}},
+				Host:   "dummy-host",
+				Type:   metric.Count,
+				Unit:   "millisecond",
+			}
+
+			Expect(c.PostMetrics(metricsMap)).To(Succeed())
+
+			var req *http.Request
+			Eventually(reqs).Should(Receive(&req))
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+			Expect(req.Header.Get("DD-API-KEY")).To(Equal("dummykey"))
+
+			series := helper.DecodeProtobufFields(helper.Decompress(bodies[0]))[payloadSeries]
+			Expect(series).To(HaveLen(1))
+			fields := helper.DecodeProtobufFields(series[0].([]byte))
+			Expect(fields[seriesMetric]).To(Equal([]interface{}{[]byte("datadog.nozzle.count")}))
+			Expect(fields[seriesType]).To(Equal([]interface{}{uint64(metric.TypeV2Count)}))
+			Expect(fields[seriesInterval]).To(Equal([]interface{}{uint64(2)}))
+			Expect(fields[seriesUnit]).To(Equal([]interface{}{[]byte("millisecond")}))
+			Expect(fields[seriesTags]).To(HaveLen(len(defaultTags)))
+			for i, tag := range defaultTags {
+				Expect(fields[seriesTags][i]).To(Equal([]byte(tag)))
+			}
+
+			Expect(fields[seriesResources]).To(HaveLen(1))
+			resource := helper.DecodeProtobufFields(fields[seriesResources][0].([]byte))
+			Expect(resource[resourceType]).To(Equal([]interface{}{[]byte("host")}))
+			Expect(resource[resourceName]).To(Equal([]interface{}{[]byte("dummy-host")}))
+
+			Expect(fields[seriesPoints]).To(HaveLen(2))
+			point := helper.DecodeProtobufFields(fields[seriesPoints][0].([]byte))
+			Expect(math.Float64frombits(point[pointValue][0].(uint64))).To(Equal(0.000000123))
+			Expect(point[pointTimestamp]).To(Equal([]interface{}{uint64(1)}))
+			// The zero value is left out, like proto3 does
+			point = helper.DecodeProtobufFields(fields[seriesPoints][1].([]byte))
+			Expect(point).ToNot(HaveKey(uint64(pointValue)))
+			Expect(point[pointTimestamp]).To(Equal([]interface{}{uint64(2)}))
+		})
+
+		It("breaks up a message that exceeds the FlushMaxBytes", func() {
+			for i := 0; i < 1000; i++ {
+				k, v := makeFakeMetric("metricName", 1000, uint64(i), events.Envelope_ValueMetric, defaultTags)
+				metricsMap.Add(k, v)
+			}
+
+			Expect(c.PostMetrics(metricsMap)).To(Succeed())
+			Expect(len(bodies)).To(BeNumerically(">", 1))
+
+			var points int
+			for _, body := range bodies {
+				Expect(len(body)).To(BeNumerically("<=", 2000))
+				var payload PayloadV2
+				Expect(json.Unmarshal(helper.Decompress(body), &payload)).To(Succeed())
+				points += len(payload.Series[0].Points)
+			}
+			Expect(points).To(Equal(1000))
+		})
+
+		It("posts the distributions to the v1 distribution endpoint", func() {
+			Expect(c.distributionsURL()).To(Equal(ts.URL + "/api/v1/distribution_points?api_key=dummykey"))
+		})
+
+		It("is chosen by the configuration, whatever the URL", func() {
+			clients, err := NewClients(&config.Config{
+				DataDogURL:                 "https://proxy.example.com/datadog",
+				DataDogAPIKey:              "1234567890",
+				DataDogAdditionalEndpoints: map[string][]string{"https://api.datadoghq.eu/api/v2/series": {"0987654321"}},
+				DataDogSeriesAPIVersion:    config.SeriesAPIV2,
+				DataDogSeriesEncoding:      config.SeriesEncodingProtobuf,
+				FlushDurationSeconds:       10,
+			}, gosteno.NewLogger("datadogclient test"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(clients).To(HaveLen(2))
+			for _, client := range clients {
+				Expect(client.formatter.seriesV2Encoding).To(Equal(config.SeriesEncodingProtobuf))
+				Expect(client.seriesURL()).To(Equal(client.Endpoint()))
+			}
+
+			clients, err = NewClients(&config.Config{
+				DataDogURL:              "https://api.datadoghq.com/api/v2/series",
+				DataDogAPIKey:           "1234567890",
+				DataDogSeriesAPIVersion: config.SeriesAPIV1,
+				FlushDurationSeconds:    10,
+			}, gosteno.NewLogger("datadogclient test"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(clients[0].formatter.seriesV2Encoding).To(BeEmpty())
+		})
+	})
+
 	It("breaks up a message that exceeds the FlushMaxBytes", func() {
 		for i := 0; i < 1000; i++ {
 			k, v := makeFakeMetric("metricName", 1000, uint64(i), events.Envelope_ValueMetric, defaultTags)
@@ -374,6 +586,70 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
+	Context("with a spool", func() {
+		var spoolDir string
+
+		BeforeEach(func() {
+			var err error
+			spoolDir, err = ioutil.TempDir("", "client-spool")
+			Expect(err).ToNot(HaveOccurred())
+
+			c = New(
+				ts.URL,
+				"dummykey",
+				"datadog.nozzle.",
+				"test-deployment",
+				"dummy-ip",
+				time.Second,
+				100*time.Millisecond,
+				2000,
+				gosteno.NewLogger("datadogclient test"),
+				[]string{},
+				nil,
+			)
+			c.spool, err = spool.New(spoolDir, 1024*1024, 1024, time.Hour, gosteno.NewLogger("datadogclient test"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			c.spool.Close()
+			os.RemoveAll(spoolDir)
+		})
+
+		It("spools payloads when datadog is unavailable and replays them once it recovers", func() {
+			k, v := makeFakeMetric("metricName", 1000, 5, events.Envelope_ValueMetric, defaultTags)
+			metricsMap.Add(k, v)
+
+			responseCode = http.StatusServiceUnavailable
+			err := c.PostMetrics(metricsMap)
+			Expect(err).To(HaveOccurred())
+			Expect(c.SpoolDepth()).To(BeEquivalentTo(1))
+			spooled := bodies[len(bodies)-1]
+
+			responseCode = http.StatusOK
+			bodies = nil
+			metricsMap = make(metric.MetricsMap)
+			k, v = makeFakeMetric("otherMetricName", 1000, 5, events.Envelope_ValueMetric, defaultTags)
+			metricsMap.Add(k, v)
+			err = c.PostMetrics(metricsMap)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(bodies).To(HaveLen(2))
+			Expect(bodies[1]).To(Equal(spooled))
+			Expect(c.SpoolDepth()).To(BeEquivalentTo(0))
+		})
+
+		It("does not spool payloads rejected by datadog", func() {
+			k, v := makeFakeMetric("metricName", 1000, 5, events.Envelope_ValueMetric, defaultTags)
+			metricsMap.Add(k, v)
+
+			responseCode = http.StatusBadRequest
+			err := c.PostMetrics(metricsMap)
+			Expect(err).To(HaveOccurred())
+			Expect(c.SpoolDepth()).To(BeEquivalentTo(0))
+		})
+	})
+
 	It("parses proxy URLs correctly & chooses the correct proxy to use by scheme", func() {
 		println("proxy test")
 		proxy := &Proxy{
@@ -0,0 +1,177 @@
+package datadog
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/cloudfoundry/gosteno"
+)
+
+// The largest datagrams sent to DogStatsD: UDP datagrams fit in the MTU of most networks, the Agent reads up to 8KB
+// from its Unix socket
+const (
+	maxUDPDatagramBytes = 1432
+	maxUDSDatagramBytes = 8192
+)
+
+// dogStatsDConn sends the metrics to a DogStatsD server, e.g. the local Datadog Agent, over UDP or a Unix socket
+type dogStatsDConn struct {
+	network          string
+	address          string
+	maxDatagramBytes int
+	conn             net.Conn
+}
+
+// newDogStatsDConn parses a udp://host:port or unix:///path/to/socket address. The connection is opened on the first
+// write, so that the nozzle starts even if the Agent isn't listening yet.
+func newDogStatsDConn(address string) (*dogStatsDConn, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the DogStatsD address %s: %v", address, err)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &dogStatsDConn{network: "udp", address: u.Host, maxDatagramBytes: maxUDPDatagramBytes}, nil
+	case "unix":
+		return &dogStatsDConn{network: "unixgram", address: u.Path, maxDatagramBytes: maxUDSDatagramBytes}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported DogStatsD address %s, must be udp://host:port or unix:///path/to/socket", address)
+	}
+}
+
+// write sends a datagram, reconnecting if the previous write failed
+func (d *dogStatsDConn) write(datagram []byte) error {
+	if d.conn == nil {
+		conn, err := net.Dial(d.network, d.address)
+		if err != nil {
+			return err
+		}
+		d.conn = conn
+	}
+	if _, err := d.conn.Write(datagram); err != nil {
+		d.conn.Close()
+		d.conn = nil
+		return err
+	}
+	return nil
+}
+
+// NewDogStatsD creates a client sending the metrics to DogStatsD instead of the Datadog API
+func NewDogStatsD(
+	address string,
+	prefix string,
+	deployment string,
+	ip string,
+	flushDuration time.Duration,
+	logger *gosteno.Logger,
+	customTags []string,
+) (*Client, error) {
+	conn, err := newDogStatsDConn(address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		apiURL:     address,
+		prefix:     prefix,
+		deployment: deployment,
+		ip:         ip,
+		log:        logger,
+		customTags: customTags,
+		dogStatsD:  conn,
+		formatter: Formatter{
+			log:      logger,
+			interval: int64(flushDuration / time.Second),
+		},
+	}, nil
+}
+
+// postDogStatsD sends the metrics as DogStatsD datagrams, packing as many lines as possible in each datagram. The Agent
+// aggregates them over its own flush interval: it keeps the last value of the gauges, and sums the counts.
+func (c *Client) postDogStatsD(metrics metric.MetricsMap) error {
+	c.log.Infof("Sending %d metrics to DogStatsD at %s", len(metrics), c.apiURL)
+
+	var datagram bytes.Buffer
+	var err error
+	flush := func() {
+		if datagram.Len() == 0 {
+			return
+		}
+		if writeErr := c.dogStatsD.write(datagram.Bytes()); writeErr != nil {
+			err = writeErr
+		}
+		datagram.Reset()
+	}
+
+	for key, value := range metrics {
+		name := c.formatter.metricName(c.prefix, key.Name)
+		for _, line := range c.formatter.formatDogStatsD(name, value) {
+			if len(line) > c.dogStatsD.maxDatagramBytes {
+				c.log.Infof("Throwing out metric %s that exceeds %d bytes", name, c.dogStatsD.maxDatagramBytes)
+				continue
+			}
+			if datagram.Len() > 0 && datagram.Len()+1+len(line) > c.dogStatsD.maxDatagramBytes {
+				flush()
+			}
+			if datagram.Len() > 0 {
+				datagram.WriteByte('\n')
+			}
+			datagram.WriteString(line)
+		}
+	}
+	flush()
+
+	if err != nil {
+		return fmt.Errorf("Error sending metrics to DogStatsD at %s: %v", c.apiURL, err)
+	}
+	return nil
+}
+
+// formatDogStatsD returns the DogStatsD lines of the points of a metric. Rates are per second values, so they are sent
+// as gauges. The host of the metric is sent as the host tag, which the Agent uses as the hostname of the metric.
+func (f Formatter) formatDogStatsD(name string, value metric.MetricValue) []string {
+	var statsdType string
+	switch value.Type {
+	case metric.Count:
+		statsdType = "c"
+	case metric.Distribution:
+		statsdType = "d"
+	default:
+		statsdType = "g"
+	}
+
+	tags := make([]string, 0, len(value.Tags)+1)
+	for _, tag := range value.Tags {
+		tags = append(tags, sanitizeDogStatsD(tag))
+	}
+	if value.Host != "" {
+		tags = append(tags, "host:"+sanitizeDogStatsD(value.Host))
+	}
+	suffix := "|" + statsdType
+	if len(tags) > 0 {
+		suffix += "|#" + strings.Join(tags, ",")
+	}
+
+	name = strings.Replace(sanitizeDogStatsD(name), ":", "_", -1)
+	var lines []string
+	for _, point := range f.removeNANs(value.Points, name, value.Tags) {
+		lines = append(lines, name+":"+strconv.FormatFloat(point.Value, 'f', -1, 64)+suffix)
+	}
+	return lines
+}
+
+// sanitizeDogStatsD replaces the characters separating the fields of the DogStatsD lines
+func sanitizeDogStatsD(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', ',', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
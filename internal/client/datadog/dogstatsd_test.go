@@ -0,0 +1,194 @@
+package datadog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+var _ = Describe("DogStatsD client", func() {
+	var (
+		listener  net.PacketConn
+		dogStatsD *Client
+		metrics   metric.MetricsMap
+	)
+
+	add := func(name string, metricType string, host string, tags []string, values ...float64) {
+		var points []metric.Point
+		for i, v := range values {
+			points = append(points, metric.Point{Timestamp: int64(i + 1), Value: v})
+		}
+		metrics[metric.MetricKey{Name: name, TagsHash: util.HashTags(tags)}] = metric.MetricValue{
+			Tags:   tags,
+			Points: points,
+			Host:   host,
+			Type:   metricType,
+		}
+	}
+
+	// receive returns the datagrams received until none comes for a while
+	receive := func(conn net.PacketConn) []string {
+		var datagrams []string
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return datagrams
+			}
+			datagrams = append(datagrams, string(buf[:n]))
+		}
+	}
+
+	lines := func(datagrams []string) []string {
+		var lines []string
+		for _, d := range datagrams {
+			lines = append(lines, strings.Split(d, "\n")...)
+		}
+		return lines
+	}
+
+	newClient := func(address string) *Client {
+		client, err := NewDogStatsD(address, "datadog.nozzle.", "test-deployment", "dummy-ip", 10*time.Second,
+			gosteno.NewLogger("dogstatsd test"), nil)
+		Expect(err).ToNot(HaveOccurred())
+		return client
+	}
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		dogStatsD = newClient("udp://" + listener.LocalAddr().String())
+		metrics = make(metric.MetricsMap)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("sends the gauges, counts and distributions with their tags", func() {
+		add("gorouter.latency", metric.Gauge, "router-0", []string{"deployment:cf", "job:router"}, 1.5, 2)
+		add("gorouter.requests", metric.Count, "", []string{"deployment:cf"}, 10)
+		add("app.cpu", metric.Distribution, "", nil, 0.25)
+		add("rep.rate", metric.Rate, "", nil, 3)
+
+		Expect(dogStatsD.PostMetrics(metrics)).To(Succeed())
+
+		Expect(lines(receive(listener))).To(ConsistOf(
+			"datadog.nozzle.gorouter.latency:1.5|g|#deployment:cf,job:router,host:router-0",
+			"datadog.nozzle.gorouter.latency:2|g|#deployment:cf,job:router,host:router-0",
+			"datadog.nozzle.gorouter.requests:10|c|#deployment:cf",
+			"datadog.nozzle.app.cpu:0.25|d",
+			"datadog.nozzle.rep.rate:3|g",
+		))
+	})
+
+	It("replaces the separators of the protocol", func() {
+		add("weird:name|metric", metric.Gauge, "", []string{"path:/a,b|c"}, 1)
+
+		Expect(dogStatsD.PostMetrics(metrics)).To(Succeed())
+
+		Expect(lines(receive(listener))).To(ConsistOf("datadog.nozzle.weird_name_metric:1|g|#path:/a_b_c"))
+	})
+
+	It("packs the lines in datagrams not larger than an UDP packet", func() {
+		for i := 0; i < 200; i++ {
+			add("metric", metric.Gauge, "", []string{fmt.Sprintf("index:%d", i), "deployment:cf"}, float64(i))
+		}
+
+		Expect(dogStatsD.PostMetrics(metrics)).To(Succeed())
+
+		datagrams := receive(listener)
+		Expect(len(datagrams)).To(BeNumerically(">", 1))
+		for _, d := range datagrams {
+			Expect(len(d)).To(BeNumerically("<=", maxUDPDatagramBytes))
+		}
+		Expect(lines(datagrams)).To(HaveLen(200))
+	})
+
+	It("doesn't send the NaN points", func() {
+		add("gauge", metric.Gauge, "", nil, math.NaN(), 1)
+
+		Expect(dogStatsD.PostMetrics(metrics)).To(Succeed())
+
+		Expect(lines(receive(listener))).To(ConsistOf("datadog.nozzle.gauge:1|g"))
+	})
+
+	It("makes internal metrics without an API key", func() {
+		Expect(dogStatsD.Account()).To(Equal(""))
+		Expect(dogStatsD.Endpoint()).To(Equal("udp://" + listener.LocalAddr().String()))
+
+		k, v := dogStatsD.MakeInternalMetric("totalMetricsSent", 5, 1)
+		metrics[k] = v
+		Expect(dogStatsD.PostMetrics(metrics)).To(Succeed())
+
+		Expect(lines(receive(listener))).To(ConsistOf("datadog.nozzle.totalMetricsSent:5|g|#deployment:test-deployment,ip:dummy-ip"))
+	})
+
+	Context("over a Unix socket", func() {
+		var dir, socket string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "dogstatsd")
+			Expect(err).ToNot(HaveOccurred())
+			socket = filepath.Join(dir, "dsd.socket")
+			add("gauge", metric.Gauge, "", []string{"deployment:cf"}, 1)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("sends the metrics once the Agent listens", func() {
+			client := newClient("unix://" + socket)
+			Expect(client.PostMetrics(metrics)).ToNot(Succeed())
+
+			conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			Expect(client.PostMetrics(metrics)).To(Succeed())
+			Expect(lines(receive(conn))).To(ConsistOf("datadog.nozzle.gauge:1|g|#deployment:cf"))
+		})
+	})
+
+	It("rejects the unsupported addresses", func() {
+		_, err := NewDogStatsD("tcp://localhost:8125", "", "", "", time.Second, gosteno.NewLogger("dogstatsd test"), nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("replaces the main endpoint when configured", func() {
+		spoolDir, err := ioutil.TempDir("", "spool")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(spoolDir)
+
+		clients, err := NewClients(&config.Config{
+			DataDogURL:                 "https://app.datadoghq.com/api/v1/series",
+			DataDogAPIKey:              "1234567890",
+			DataDogAdditionalEndpoints: map[string][]string{"https://app.datadoghq.eu/api/v1/series": {"0987654321"}},
+			DogStatsDAddress:           "udp://" + listener.LocalAddr().String(),
+			FlushDurationSeconds:       10,
+			SpoolDirectory:             spoolDir,
+		}, gosteno.NewLogger("dogstatsd test"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clients).To(HaveLen(2))
+		Expect(clients[0].Endpoint()).To(Equal("udp://" + listener.LocalAddr().String()))
+		Expect(clients[0].HasSpool()).To(BeFalse())
+		Expect(clients[1].Endpoint()).To(Equal("https://app.datadoghq.eu/api/v1/series"))
+	})
+})
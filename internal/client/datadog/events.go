@@ -0,0 +1,86 @@
+package datadog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/event"
+	"github.com/cloudfoundry/gosteno"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// EventsClient posts events to the Datadog events API
+type EventsClient struct {
+	eventsURL  string
+	apiKey     string
+	httpClient *retryablehttp.Client
+	log        *gosteno.Logger
+}
+
+// NewEventsClient creates a new EventsClient
+func NewEventsClient(
+	eventsURL string,
+	apiKey string,
+	writeTimeout time.Duration,
+	flushDuration time.Duration,
+	logger *gosteno.Logger,
+	proxy *Proxy,
+) *EventsClient {
+	return &EventsClient{
+		eventsURL:  eventsURL,
+		apiKey:     apiKey,
+		httpClient: newHTTPClient(writeTimeout, flushDuration, logger, proxy),
+		log:        logger,
+	}
+}
+
+// NewEventsClientFromConfig creates the EventsClient targeting the configured events API with the primary API key
+func NewEventsClientFromConfig(config *config.Config, log *gosteno.Logger) *EventsClient {
+	return NewEventsClient(
+		config.DataDogEventsURL,
+		config.DataDogAPIKey,
+		time.Duration(config.DataDogTimeoutSeconds)*time.Second,
+		time.Duration(config.FlushDurationSeconds)*time.Second,
+		log,
+		newProxy(config),
+	)
+}
+
+// PostEvent posts an event, the events API only accepts one event per request
+func (c *EventsClient) PostEvent(e event.Event) error {
+	c.log.Debugf("Posting event %s", e.Title)
+
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("Error marshalling event: %v", err)
+	}
+
+	req, err := retryablehttp.NewRequest("POST", fmt.Sprintf("%s?api_key=%s", c.eventsURL, c.apiKey), encoded)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			body = []byte("failed to read body")
+		}
+		return &responseError{
+			status: resp.Status,
+			code:   resp.StatusCode,
+			body:   body,
+		}
+	}
+
+	return nil
+}
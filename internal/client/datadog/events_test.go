@@ -0,0 +1,80 @@
+package datadog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/event"
+)
+
+var _ = Describe("EventsClient", func() {
+	var eventsClient *EventsClient
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusAccepted
+		responseBody = []byte("{}")
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+
+		eventsClient = NewEventsClient(
+			ts.URL,
+			"dummykey",
+			time.Second,
+			2*time.Second,
+			gosteno.NewLogger("eventsclient test"),
+			nil,
+		)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("posts events as JSON with the api key", func() {
+		e := event.Event{
+			Title:          "App my-app crashed",
+			Text:           "App instance exited",
+			Timestamp:      1000,
+			Tags:           []string{"app_name:my-app"},
+			AlertType:      "error",
+			AggregationKey: "crash:app-id",
+			SourceTypeName: "cloudfoundry",
+		}
+		err := eventsClient.PostEvent(e)
+		Expect(err).ToNot(HaveOccurred())
+
+		var req *http.Request
+		Eventually(reqs).Should(Receive(&req))
+		Expect(req.Method).To(Equal("POST"))
+		Expect(req.URL.Query().Get("api_key")).To(Equal("dummykey"))
+		Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		Expect(bodies).To(HaveLen(1))
+		var payload map[string]interface{}
+		err = json.Unmarshal(bodies[0], &payload)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(payload).To(Equal(map[string]interface{}{
+			"title":            "App my-app crashed",
+			"text":             "App instance exited",
+			"date_happened":    1000.0,
+			"tags":             []interface{}{"app_name:my-app"},
+			"alert_type":       "error",
+			"aggregation_key":  "crash:app-id",
+			"source_type_name": "cloudfoundry",
+		}))
+	})
+
+	It("returns an error when the event is rejected", func() {
+		responseCode = http.StatusForbidden
+		err := eventsClient.PostEvent(event.Event{Title: "title"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("403"))
+	})
+})
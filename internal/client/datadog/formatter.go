@@ -8,29 +8,66 @@ import (
 	"math"
 	"strings"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/cloudfoundry/gosteno"
 )
 
 type Formatter struct {
-	log *gosteno.Logger
+	log      *gosteno.Logger
+	interval int64
+	// unprefixed are the name prefixes of the metrics sent without the metric prefix, e.g. the BOSH health monitor aliases
+	unprefixed []string
+	// seriesV2Encoding is the encoding of the payloads of the v2 series API, protobuf or json. The payloads of the v1
+	// series API are made when it is empty.
+	seriesV2Encoding string
 }
 
 func (f Formatter) Format(prefix string, maxPostBytes uint32, data map[metric.MetricKey]metric.MetricValue) [][]byte {
+	if f.seriesV2() {
+		return f.format(prefix, maxPostBytes, data, f.formatSeriesV2)
+	}
+	return f.format(prefix, maxPostBytes, data, f.formatMetrics)
+}
+
+// seriesV2 returns true if the series are formatted for the v2 series API
+func (f Formatter) seriesV2() bool {
+	return f.seriesV2Encoding != ""
+}
+
+// seriesContentType returns the content type of the series payloads
+func (f Formatter) seriesContentType() string {
+	if f.seriesV2Encoding == config.SeriesEncodingProtobuf {
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+// FormatDistributions makes the payloads of the distribution endpoint
+func (f Formatter) FormatDistributions(prefix string, maxPostBytes uint32, data map[metric.MetricKey]metric.MetricValue) [][]byte {
+	return f.format(prefix, maxPostBytes, data, f.formatDistributions)
+}
+
+func (f Formatter) format(
+	prefix string,
+	maxPostBytes uint32,
+	data map[metric.MetricKey]metric.MetricValue,
+	formatMetrics func(string, map[metric.MetricKey]metric.MetricValue) ([]byte, error),
+) [][]byte {
 	if len(data) == 0 {
 		return nil
 	}
 
 	var result [][]byte
-	compressedSeriesBytes, err := f.formatMetrics(prefix, data)
+	compressedSeriesBytes, err := formatMetrics(prefix, data)
 	if err != nil {
 		f.log.Errorf("Error formatting metrics payload: %v", err)
 		return result
 	}
 	if uint32(len(compressedSeriesBytes)) > maxPostBytes && canSplit(data) {
 		metricsA, metricsB := splitPoints(data)
-		result = append(result, f.Format(prefix, maxPostBytes, metricsA)...)
-		result = append(result, f.Format(prefix, maxPostBytes, metricsB)...)
+		result = append(result, f.format(prefix, maxPostBytes, metricsA, formatMetrics)...)
+		result = append(result, f.format(prefix, maxPostBytes, metricsB, formatMetrics)...)
 
 		return result
 	}
@@ -42,21 +79,23 @@ func (f Formatter) Format(prefix string, maxPostBytes uint32, data map[metric.Me
 func (f Formatter) formatMetrics(prefix string, data map[metric.MetricKey]metric.MetricValue) ([]byte, error) {
 	s := []metric.Series{}
 	for key, mVal := range data {
-		// dogate feature
-		if strings.HasPrefix(key.Name, "bosh.healthmonitor") {
-			prefix = ""
-		}
-
-		name := prefix + key.Name
+		name := f.metricName(prefix, key.Name)
 		points := f.removeNANs(mVal.Points, name, mVal.Tags)
 
 		m := metric.Series{
 			Metric: name,
 			Points: points,
-			Type:   "gauge",
+			Type:   mVal.Type,
 			Tags:   mVal.Tags,
 			Host:   mVal.Host,
 		}
+		if m.Type == "" {
+			m.Type = metric.Gauge
+		}
+		if m.Type != metric.Gauge {
+			// Counts and rates are reported over the flush interval
+			m.Interval = f.interval
+		}
 		s = append(s, m)
 	}
 
@@ -71,6 +110,105 @@ func (f Formatter) formatMetrics(prefix string, data map[metric.MetricKey]metric
 	return compressedPayload, nil
 }
 
+// formatSeriesV2 makes the payloads of the v2 series API, with the host as a resource of the series
+func (f Formatter) formatSeriesV2(prefix string, data map[metric.MetricKey]metric.MetricValue) ([]byte, error) {
+	s := []metric.SeriesV2{}
+	for key, mVal := range data {
+		name := f.metricName(prefix, key.Name)
+
+		m := metric.SeriesV2{
+			Metric: name,
+			Type:   typeV2(mVal.Type),
+			Unit:   mVal.Unit,
+			Tags:   mVal.Tags,
+		}
+		for _, p := range f.removeNANs(mVal.Points, name, mVal.Tags) {
+			m.Points = append(m.Points, metric.PointV2{Timestamp: p.Timestamp, Value: p.Value})
+		}
+		if mVal.Host != "" {
+			m.Resources = []metric.ResourceV2{{Name: mVal.Host, Type: "host"}}
+		}
+		if m.Type != metric.TypeV2Gauge {
+			// Counts and rates are reported over the flush interval
+			m.Interval = f.interval
+		}
+		s = append(s, m)
+	}
+
+	var encodedMetric []byte
+	var err error
+	if f.seriesV2Encoding == config.SeriesEncodingProtobuf {
+		encodedMetric, err = marshalPayloadV2(s)
+	} else {
+		encodedMetric, err = json.Marshal(PayloadV2{Series: s})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling metrics: %v", err)
+	}
+	compressedPayload, err := compress(encodedMetric)
+	if err != nil {
+		return nil, fmt.Errorf("Error compressing payload: %v", err)
+	}
+	return compressedPayload, nil
+}
+
+func typeV2(metricType string) int {
+	switch metricType {
+	case metric.Count:
+		return metric.TypeV2Count
+	case metric.Rate:
+		return metric.TypeV2Rate
+	default:
+		return metric.TypeV2Gauge
+	}
+}
+
+// formatDistributions groups the values of each distribution by timestamp
+func (f Formatter) formatDistributions(prefix string, data map[metric.MetricKey]metric.MetricValue) ([]byte, error) {
+	s := []metric.DistributionSeries{}
+	for key, mVal := range data {
+		name := f.metricName(prefix, key.Name)
+
+		var points []metric.DistributionPoint
+		indexes := make(map[int64]int)
+		for _, p := range f.removeNANs(mVal.Points, name, mVal.Tags) {
+			i, ok := indexes[p.Timestamp]
+			if !ok {
+				i = len(points)
+				indexes[p.Timestamp] = i
+				points = append(points, metric.DistributionPoint{Timestamp: p.Timestamp})
+			}
+			points[i].Values = append(points[i].Values, p.Value)
+		}
+
+		s = append(s, metric.DistributionSeries{
+			Metric: name,
+			Points: points,
+			Tags:   mVal.Tags,
+			Host:   mVal.Host,
+		})
+	}
+
+	encodedMetric, err := json.Marshal(DistributionPayload{Series: s})
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling distributions: %v", err)
+	}
+	compressedPayload, err := compress(encodedMetric)
+	if err != nil {
+		return nil, fmt.Errorf("Error compressing payload: %v", err)
+	}
+	return compressedPayload, nil
+}
+
+func (f Formatter) metricName(prefix string, name string) string {
+	for _, unprefixed := range f.unprefixed {
+		if strings.HasPrefix(name, unprefixed) {
+			return name
+		}
+	}
+	return prefix + name
+}
+
 func (f Formatter) removeNANs(points []metric.Point, metricName string, tags []string) []metric.Point {
 	var sanitizedPoints []metric.Point
 	for _, point := range points {
@@ -103,6 +241,9 @@ func splitPoints(data map[metric.MetricKey]metric.MetricValue) (a, b map[metric.
 			a[k] = metric.MetricValue{
 				Tags:   v.Tags,
 				Points: v.Points,
+				Host:   v.Host,
+				Type:   v.Type,
+				Unit:   v.Unit,
 			}
 			continue
 		}
@@ -110,10 +251,16 @@ func splitPoints(data map[metric.MetricKey]metric.MetricValue) (a, b map[metric.
 		a[k] = metric.MetricValue{
 			Tags:   v.Tags,
 			Points: v.Points[:split],
+			Host:   v.Host,
+			Type:   v.Type,
+			Unit:   v.Unit,
 		}
 		b[k] = metric.MetricValue{
 			Tags:   v.Tags,
 			Points: v.Points[split:],
+			Host:   v.Host,
+			Type:   v.Type,
+			Unit:   v.Unit,
 		}
 	}
 	return a, b
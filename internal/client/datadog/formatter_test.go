@@ -15,7 +15,7 @@ var _ = Describe("Formatter", func() {
 	)
 
 	BeforeEach(func() {
-		formatter = Formatter{gosteno.NewLogger("test")}
+		formatter = Formatter{log: gosteno.NewLogger("test"), interval: 15, unprefixed: []string{"bosh.healthmonitor"}}
 	})
 
 	It("does not return empty data", func() {
@@ -34,6 +34,52 @@ var _ = Describe("Formatter", func() {
 		Expect(string(helper.Decompress(result[0]))).To(Equal(`{"series":[{"metric":"foobar","points":[[0,9.000000]],"type":"gauge"}]}`))
 	})
 
+	It("sends the metric type along with the interval for counts and rates", func() {
+		m := make(map[metric.MetricKey]metric.MetricValue)
+		m[metric.MetricKey{Name: "count"}] = metric.MetricValue{
+			Points: []metric.Point{{
+				Value: 3,
+			}},
+			Type: metric.Count,
+		}
+		m[metric.MetricKey{Name: "rate"}] = metric.MetricValue{
+			Points: []metric.Point{{
+				Value: 0.5,
+			}},
+			Type: metric.Rate,
+		}
+		m[metric.MetricKey{Name: "gauge"}] = metric.MetricValue{
+			Points: []metric.Point{{
+				Value: 9,
+			}},
+			Type: metric.Gauge,
+		}
+		result := formatter.Format("", 1024, m)
+
+		payload := string(helper.Decompress(result[0]))
+		Expect(payload).To(ContainSubstring(`{"metric":"count","points":[[0,3.000000]],"type":"count","interval":15}`))
+		Expect(payload).To(ContainSubstring(`{"metric":"rate","points":[[0,0.500000]],"type":"rate","interval":15}`))
+		Expect(payload).To(ContainSubstring(`{"metric":"gauge","points":[[0,9.000000]],"type":"gauge"}`))
+	})
+
+	It("keeps the metric type when splitting", func() {
+		m := make(map[metric.MetricKey]metric.MetricValue)
+		m[metric.MetricKey{Name: "count"}] = metric.MetricValue{
+			Points: []metric.Point{{
+				Value: 3,
+			}, {
+				Value: 4,
+			}},
+			Type: metric.Count,
+		}
+		result := formatter.Format("", 1, m)
+
+		Expect(result).To(HaveLen(2))
+		for _, r := range result {
+			Expect(string(helper.Decompress(r))).To(ContainSubstring(`"type":"count","interval":15`))
+		}
+	})
+
 	It("does not 'delete' points when trying to split", func() {
 		m := make(map[metric.MetricKey]metric.MetricValue)
 		m[metric.MetricKey{Name: "a"}] = metric.MetricValue{
@@ -58,6 +104,20 @@ var _ = Describe("Formatter", func() {
 		Expect(string(helper.Decompress(result[0]))).To(ContainSubstring(`"metric":"bosh.healthmonitor.foo"`))
 	})
 
+	It("still prepends the prefix to the other metrics", func() {
+		m := make(map[metric.MetricKey]metric.MetricValue)
+		m[metric.MetricKey{Name: "bosh.healthmonitor.foo"}] = metric.MetricValue{
+			Points: []metric.Point{{Value: 9}},
+		}
+		m[metric.MetricKey{Name: "bar"}] = metric.MetricValue{
+			Points: []metric.Point{{Value: 9}},
+		}
+		for i := 0; i < 10; i++ {
+			result := formatter.Format("some-prefix.", 1024, m)
+			Expect(string(helper.Decompress(result[0]))).To(ContainSubstring(`"metric":"some-prefix.bar"`))
+		}
+	})
+
 	It("drops metrics that have a NAN value", func() {
 		m := make(map[metric.MetricKey]metric.MetricValue)
 		m[metric.MetricKey{Name: "bosh.healthmonitor.foo"}] = metric.MetricValue{
@@ -0,0 +1,141 @@
+package datadog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
+	"github.com/cloudfoundry/gosteno"
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// maxLogsPerPayload is the maximum number of logs accepted by the intake in one request
+const maxLogsPerPayload = 1000
+
+// LogsClient posts logs to the Datadog logs intake
+type LogsClient struct {
+	logsURL      string
+	apiKey       string
+	httpClient   *retryablehttp.Client
+	maxPostBytes uint32
+	log          *gosteno.Logger
+}
+
+// NewLogsClient creates a new LogsClient
+func NewLogsClient(
+	logsURL string,
+	apiKey string,
+	writeTimeout time.Duration,
+	flushDuration time.Duration,
+	maxPostBytes uint32,
+	logger *gosteno.Logger,
+	proxy *Proxy,
+) *LogsClient {
+	return &LogsClient{
+		logsURL:      logsURL,
+		apiKey:       apiKey,
+		httpClient:   newHTTPClient(writeTimeout, flushDuration, logger, proxy),
+		maxPostBytes: maxPostBytes,
+		log:          logger,
+	}
+}
+
+// NewLogsClientFromConfig creates the LogsClient targeting the configured logs intake with the primary API key
+func NewLogsClientFromConfig(config *config.Config, log *gosteno.Logger) *LogsClient {
+	return NewLogsClient(
+		config.DataDogLogsURL,
+		config.DataDogAPIKey,
+		time.Duration(config.DataDogTimeoutSeconds)*time.Second,
+		time.Duration(config.LogsFlushDurationSeconds)*time.Second,
+		config.LogsFlushMaxBytes,
+		log,
+		newProxy(config),
+	)
+}
+
+// PostLogs posts logs to the intake, split in as many payloads as needed to respect the intake limits
+func (c *LogsClient) PostLogs(entries []logs.Log) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	c.log.Debugf("Posting %d logs", len(entries))
+
+	// Each payload is a JSON array: 2 bytes for the brackets and one for each comma
+	payload := []json.RawMessage{}
+	payloadSize := 2
+	for _, entry := range entries {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			c.log.Errorf("Error marshalling log: %v", err)
+			continue
+		}
+		if uint32(len(encoded)+2) > c.maxPostBytes {
+			c.log.Infof("Throwing out log that exceeds %d bytes", c.maxPostBytes)
+			continue
+		}
+
+		if len(payload) == maxLogsPerPayload || uint32(payloadSize+len(encoded)+1) > c.maxPostBytes {
+			if err := c.postLogs(payload); err != nil {
+				return err
+			}
+			payload = []json.RawMessage{}
+			payloadSize = 2
+		}
+		payload = append(payload, encoded)
+		payloadSize += len(encoded) + 1
+	}
+
+	if len(payload) == 0 {
+		return nil
+	}
+	return c.postLogs(payload)
+}
+
+func (c *LogsClient) postLogs(payload []json.RawMessage) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Error marshalling logs: %v", err)
+	}
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(encoded); err != nil {
+		return fmt.Errorf("Error compressing logs: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Error compressing logs: %v", err)
+	}
+
+	req, err := retryablehttp.NewRequest("POST", c.logsURL, compressed.Bytes())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("DD-API-KEY", c.apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			body = []byte("failed to read body")
+		}
+		return &responseError{
+			status: resp.Status,
+			code:   resp.StatusCode,
+			body:   body,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package datadog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
+	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
+)
+
+var _ = Describe("LogsClient", func() {
+	var logsClient *LogsClient
+
+	BeforeEach(func() {
+		bodies = nil
+		reqs = make(chan *http.Request, 1000)
+		responseCode = http.StatusOK
+		responseBody = []byte("{}")
+		ts = httptest.NewServer(http.HandlerFunc(handlePost))
+
+		logsClient = NewLogsClient(
+			ts.URL,
+			"dummykey",
+			time.Second,
+			2*time.Second,
+			1024,
+			gosteno.NewLogger("logsclient test"),
+			nil,
+		)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("posts logs as a gzipped JSON array with the api key header", func() {
+		err := logsClient.PostLogs([]logs.Log{
+			{Message: "hello", Source: "cloudfoundry", Status: "info", Timestamp: 1000},
+			{Message: "world", Source: "cloudfoundry", Status: "error", Tags: "app_name:foo", Timestamp: 2000},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		var req *http.Request
+		Eventually(reqs).Should(Receive(&req))
+		Expect(req.Method).To(Equal("POST"))
+		Expect(req.Header.Get("DD-API-KEY")).To(Equal("dummykey"))
+		Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(req.Header.Get("Content-Encoding")).To(Equal("gzip"))
+
+		Expect(bodies).To(HaveLen(1))
+		var payload []logs.Log
+		err = json.Unmarshal(helper.DecompressGzip(bodies[0]), &payload)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(payload).To(Equal([]logs.Log{
+			{Message: "hello", Source: "cloudfoundry", Status: "info", Timestamp: 1000},
+			{Message: "world", Source: "cloudfoundry", Status: "error", Tags: "app_name:foo", Timestamp: 2000},
+		}))
+	})
+
+	It("does not post anything when there are no logs", func() {
+		err := logsClient.PostLogs(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(reqs).ShouldNot(Receive())
+	})
+
+	It("splits logs in payloads smaller than the max size", func() {
+		var entries []logs.Log
+		for i := 0; i < 20; i++ {
+			entries = append(entries, logs.Log{Message: strings.Repeat("a", 100), Source: "cloudfoundry", Status: "info"})
+		}
+		err := logsClient.PostLogs(entries)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(len(bodies)).To(BeNumerically(">", 1))
+		total := 0
+		for _, body := range bodies {
+			decompressed := helper.DecompressGzip(body)
+			Expect(len(decompressed)).To(BeNumerically("<=", 1024))
+			var payload []logs.Log
+			Expect(json.Unmarshal(decompressed, &payload)).To(Succeed())
+			total += len(payload)
+		}
+		Expect(total).To(Equal(20))
+	})
+
+	It("throws out logs that exceed the max size", func() {
+		err := logsClient.PostLogs([]logs.Log{
+			{Message: strings.Repeat("a", 2048), Source: "cloudfoundry", Status: "info"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(reqs).ShouldNot(Receive())
+	})
+
+	It("returns an error when the intake responds with a non 200 response code", func() {
+		responseCode = http.StatusForbidden
+		err := logsClient.PostLogs([]logs.Log{{Message: "hello"}})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("403 Forbidden"))
+	})
+})
@@ -0,0 +1,77 @@
+package datadog
+
+import (
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/protobuf"
+	"github.com/gogo/protobuf/proto"
+)
+
+// The field numbers of the messages of the MetricPayload protobuf of the v2 series API
+const (
+	payloadSeries   = 1
+	seriesResources = 1
+	seriesMetric    = 2
+	seriesTags      = 3
+	seriesPoints    = 4
+	seriesType      = 5
+	seriesUnit      = 6
+	seriesInterval  = 8
+	pointValue      = 1
+	pointTimestamp  = 2
+	resourceType    = 1
+	resourceName    = 2
+)
+
+// marshalPayloadV2 encodes the series as a MetricPayload
+func marshalPayloadV2(series []metric.SeriesV2) ([]byte, error) {
+	payload := proto.NewBuffer(nil)
+	for _, s := range series {
+		buf := proto.NewBuffer(nil)
+		for _, r := range s.Resources {
+			resource := proto.NewBuffer(nil)
+			if err := protobuf.EncodeString(resource, resourceType, r.Type); err != nil {
+				return nil, err
+			}
+			if err := protobuf.EncodeString(resource, resourceName, r.Name); err != nil {
+				return nil, err
+			}
+			if err := protobuf.EncodeMessage(buf, seriesResources, resource); err != nil {
+				return nil, err
+			}
+		}
+		if err := protobuf.EncodeString(buf, seriesMetric, s.Metric); err != nil {
+			return nil, err
+		}
+		for _, tag := range s.Tags {
+			if err := protobuf.EncodeString(buf, seriesTags, tag); err != nil {
+				return nil, err
+			}
+		}
+		for _, p := range s.Points {
+			point := proto.NewBuffer(nil)
+			if err := protobuf.EncodeDouble(point, pointValue, p.Value); err != nil {
+				return nil, err
+			}
+			if err := protobuf.EncodeInt(point, pointTimestamp, p.Timestamp); err != nil {
+				return nil, err
+			}
+			if err := protobuf.EncodeMessage(buf, seriesPoints, point); err != nil {
+				return nil, err
+			}
+		}
+		if err := protobuf.EncodeInt(buf, seriesType, int64(s.Type)); err != nil {
+			return nil, err
+		}
+		if err := protobuf.EncodeString(buf, seriesUnit, s.Unit); err != nil {
+			return nil, err
+		}
+		if err := protobuf.EncodeInt(buf, seriesInterval, s.Interval); err != nil {
+			return nil, err
+		}
+
+		if err := protobuf.EncodeMessage(payload, payloadSeries, buf); err != nil {
+			return nil, err
+		}
+	}
+	return payload.Bytes(), nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -11,11 +12,73 @@ import (
 
 const (
 	defaultGrabInterval         int    = 10
+	defaultFullResyncInterval   int    = 60
+	defaultAppLookupsPerSecond  int    = 10
 	defaultWorkers              int    = 4
+	defaultSendQueueSize        int    = 10
 	defaultIdleTimeoutSeconds   uint32 = 60
 	defaultWorkerTimeoutSeconds uint32 = 10
+	defaultCounterType          string = "count"
+	defaultSourceType           string = "firehose"
+	defaultSpoolMaxBytes        uint32 = 1024 * 1024 * 1024
+	defaultSpoolSegmentMaxBytes uint32 = 16 * 1024 * 1024
+	// Datadog does not accept points older than one hour
+	defaultSpoolMaxAgeSeconds uint32 = 3600
+	defaultLogsURL            string = "https://http-intake.logs.datadoghq.com/v1/input"
+	defaultLogsFlushSeconds   uint32 = 5
+	// The logs intake accepts payloads up to 5MB
+	defaultLogsFlushMaxBytes uint32 = 4 * 1024 * 1024
+	defaultLogsBufferSize    int    = 10000
+	defaultEventsURL         string = "https://app.datadoghq.com/api/v1/events"
+	defaultEventsDedupWindow uint32 = 300
+	defaultUnknownAppTTL     uint32 = 300
+	// The sinks time out even when the Datadog clients don't
+	defaultSinkTimeoutSeconds uint32 = 10
+	// e.g. a cell with 4 CPUs and 32GB of memory
+	defaultMemoryMBPerCPU int = 8192
 )
 
+// Naming modes of the infra metrics: new-style names, legacy names prefixed with the origin, or both
+const (
+	NamingNew    = "new"
+	NamingLegacy = "legacy"
+	NamingBoth   = "both"
+)
+
+var validNamingModes = []string{NamingNew, NamingLegacy, NamingBoth}
+
+var validAggregations = []string{"last", "min", "max", "sum", "count", "avg"}
+
+// DefaultMetricAliases are the aliases used when none are configured
+var DefaultMetricAliases = []MetricAlias{
+	{Prefix: "bosh-hm-forwarder", Replacement: "bosh.healthmonitor", Unprefixed: true},
+}
+
+var validCounterTypes = []string{"count", "rate", "gauge"}
+
+// Types of the sinks the metrics can be sent to, next to Datadog
+const (
+	SinkJSONLines             = "jsonlines"
+	SinkOTLP                  = "otlp"
+	SinkPrometheusRemoteWrite = "prometheus_remote_write"
+)
+
+var validSinkTypes = []string{SinkJSONLines, SinkOTLP, SinkPrometheusRemoteWrite}
+
+var validSourceTypes = []string{"firehose", "rlp_gateway"}
+
+// Versions of the series API the metrics are posted to, and encodings of the payloads of the v2 series API
+const (
+	SeriesAPIV1            = "v1"
+	SeriesAPIV2            = "v2"
+	SeriesEncodingProtobuf = "protobuf"
+	SeriesEncodingJSON     = "json"
+)
+
+var validSeriesAPIVersions = []string{SeriesAPIV1, SeriesAPIV2}
+
+var validSeriesEncodings = []string{SeriesEncodingProtobuf, SeriesEncodingJSON}
+
 // Config contains all the config parameters
 type Config struct {
 	UAAURL                     string
@@ -26,6 +89,9 @@ type Config struct {
 	DataDogURL                 string
 	DataDogAPIKey              string
 	DataDogAdditionalEndpoints map[string][]string
+	DogStatsDAddress           string
+	DataDogSeriesAPIVersion    string
+	DataDogSeriesEncoding      string
 	HTTPProxyURL               string
 	HTTPSProxyURL              string
 	NoProxy                    []string
@@ -33,6 +99,7 @@ type Config struct {
 	DataDogTimeoutSeconds      uint32
 	FlushDurationSeconds       uint32
 	FlushMaxBytes              uint32
+	SendQueueSize              int
 	InsecureSSLSkipVerify      bool
 	MetricPrefix               string
 	Deployment                 string
@@ -43,9 +110,149 @@ type Config struct {
 	NumWorkers                 int
 	NumCacheWorkers            int
 	GrabInterval               int
+	FullResyncInterval         int
+	AppCacheFile               string
+	AppLookupsPerSecond        int
+	UnknownAppTTLSeconds       uint32
 	CustomTags                 []string
 	EnvironmentName            string
 	WorkerTimeoutSeconds       uint32
+	CounterType                string
+	SpoolDirectory             string
+	SpoolMaxBytes              uint32
+	SpoolSegmentMaxBytes       uint32
+	SpoolMaxAgeSeconds         uint32
+	LogsEnabled                bool
+	DataDogLogsURL             string
+	LogsFlushDurationSeconds   uint32
+	LogsFlushMaxBytes          uint32
+	LogsBufferSize             int
+	HTTPMetricsEnabled         bool
+	EventsEnabled              bool
+	DataDogEventsURL           string
+	EventsDedupWindowSeconds   uint32
+	SourceType                 string
+	RLPGatewayURL              string
+	MonitoringAddress          string
+	MetricFilters              MetricFilters
+	MetricRewrites             []MetricRewriteRule
+	MetricNaming               MetricNaming
+	MetricAggregations         []MetricAggregation
+	ContainerMetrics           ContainerMetrics
+	MetadataTags               MetadataTags
+	MetricRoutes               MetricRoutes
+	Sinks                      []Sink
+}
+
+// Sink is an output the metrics are sent to next to Datadog, e.g. to ship them to two backends during a migration.
+// Path is the file of the jsonlines sinks, URL the endpoint of the otlp and prometheus_remote_write sinks, which are
+// sent the Headers, e.g. for authentication. TimeoutSeconds defaults to DataDogTimeoutSeconds, or to
+// 10 seconds when that is 0.
+type Sink struct {
+	Type           string
+	Path           string
+	URL            string
+	Headers        map[string]string
+	TimeoutSeconds uint32
+}
+
+// MetadataTags selects the labels and annotations of the apps, and of their space and org, that tag the app metrics.
+// Labels and Annotations are patterns like in MetricFilterRule, matched against the keys, e.g. `team` or `mycompany.com/*`.
+// The tag name is the key without its prefix, e.g. `team:payments` for `mycompany.com/team: payments`, prepended with TagPrefix.
+type MetadataTags struct {
+	Labels      []string
+	Annotations []string
+	TagPrefix   string
+}
+
+// ContainerMetrics chooses how the app container metrics are sent. Distributions sends their values across all the
+// instances of an app as distribution metrics, DisableInstanceGauges stops sending a gauge per instance.
+// MemoryMBPerCPU is the memory entitled to a whole CPU on the cells, used to compute the CPU entitlement of the apps.
+type ContainerMetrics struct {
+	Distributions         bool
+	DisableInstanceGauges bool
+	MemoryMBPerCPU        int
+}
+
+// MetricNaming chooses the names of the infra metrics.
+// Mode is the default naming mode, Origins overrides it for some origins.
+type MetricNaming struct {
+	Mode    string
+	Origins map[string]string
+	Aliases []MetricAlias
+}
+
+// MetricAggregation replaces the points received during a flush interval by a single point, for the metrics whose name
+// matches Name (a pattern like in MetricFilterRule). Function is one of last, min, max, sum, count or avg.
+type MetricAggregation struct {
+	Name     string
+	Function string
+}
+
+// MetricAlias adds a copy of the infra metrics whose name starts with Prefix, with Prefix replaced by Replacement.
+// An Unprefixed alias is not prefixed with the MetricPrefix.
+type MetricAlias struct {
+	Prefix      string
+	Replacement string
+	Unprefixed  bool
+}
+
+// MetricFilters selects the metric envelopes that are processed: an envelope is kept if it matches
+// one of the Allow rules (or if there are none), and none of the Deny rules
+type MetricFilters struct {
+	Allow []MetricFilterRule
+	Deny  []MetricFilterRule
+}
+
+// MetricFilterRule matches an envelope if all its non empty fields match.
+// Values are globs (`*` and `?`), or regular expressions when wrapped in slashes, e.g. `/^gorouter\.(.*)$/`.
+type MetricFilterRule struct {
+	Name       string
+	Origin     string
+	Job        string
+	Deployment string
+	Tags       map[string]string
+}
+
+// MetricRewriteRule changes the name and the tags of the metrics whose name matches Name and whose tags match Tags,
+// both are patterns like in MetricFilterRule, and match all metrics when empty.
+// Rename is the new name: $1 or ${name} are replaced by the groups captured by Name, {tag:<tag name>} by the value of a tag.
+// The tag operations are applied in this order: MapTagValues (tag name -> old value -> new value), RenameTags (old name -> new name),
+// DropTags (tag name patterns) and AddTags.
+type MetricRewriteRule struct {
+	Name         string
+	Tags         map[string]string
+	Rename       string
+	MapTagValues map[string]map[string]string
+	RenameTags   map[string]string
+	DropTags     []string
+	AddTags      []string
+}
+
+// MetricRoutes selects the metrics sent to the DataDogAdditionalEndpoints, the main endpoint gets all of them.
+// An endpoint without route gets all the metrics too.
+type MetricRoutes struct {
+	// Platform are the rules of the metrics shared with the endpoints whose route has IncludePlatform set
+	Platform  []MetricRouteRule
+	Endpoints []EndpointRoute
+}
+
+// EndpointRoute sends to an additional Endpoint the metrics matching one of its Rules, and the Platform metrics if
+// IncludePlatform is set. APIKey restricts the route to one of the API keys of the endpoint, all of them when empty.
+type EndpointRoute struct {
+	Endpoint        string
+	APIKey          string
+	Rules           []MetricRouteRule
+	IncludePlatform bool
+}
+
+// MetricRouteRule matches a metric if all its non empty fields match, they are patterns like in MetricFilterRule.
+// Name is matched against the metric name without the MetricPrefix, the other fields against the tags of the metric.
+type MetricRouteRule struct {
+	Name       string
+	OrgName    string
+	SpaceName  string
+	Deployment string
 }
 
 // Parse parses the config from the json configuration and environment variables
@@ -69,6 +276,9 @@ func Parse(configPath string) (*Config, error) {
 	overrideWithEnvVar("NOZZLE_DATADOGURL", &config.DataDogURL)
 	overrideWithEnvVar("NOZZLE_DATADOGAPIKEY", &config.DataDogAPIKey)
 	//NOTE: Override of DataDogAdditionalEndpoints not supported
+	overrideWithEnvVar("NOZZLE_DOGSTATSD_ADDRESS", &config.DogStatsDAddress)
+	overrideWithEnvVar("NOZZLE_DATADOG_SERIES_API_VERSION", &config.DataDogSeriesAPIVersion)
+	overrideWithEnvVar("NOZZLE_DATADOG_SERIES_ENCODING", &config.DataDogSeriesEncoding)
 
 	overrideWithEnvVar("HTTP_PROXY", &config.HTTPProxyURL)
 	overrideWithEnvVar("HTTPS_PROXY", &config.HTTPSProxyURL)
@@ -79,7 +289,12 @@ func Parse(configPath string) (*Config, error) {
 
 	overrideWithEnvUint32("NOZZLE_FLUSHDURATIONSECONDS", &config.FlushDurationSeconds)
 	overrideWithEnvUint32("NOZZLE_FLUSHMAXBYTES", &config.FlushMaxBytes)
+	overrideWithEnvInt("NOZZLE_SEND_QUEUE_SIZE", &config.SendQueueSize)
 	overrideWithEnvInt("NOZZLE_GRAB_INTERVAL", &config.GrabInterval)
+	overrideWithEnvInt("NOZZLE_FULL_RESYNC_INTERVAL", &config.FullResyncInterval)
+	overrideWithEnvVar("NOZZLE_APP_CACHE_FILE", &config.AppCacheFile)
+	overrideWithEnvInt("NOZZLE_APP_LOOKUPS_PER_SECOND", &config.AppLookupsPerSecond)
+	overrideWithEnvUint32("NOZZLE_UNKNOWN_APP_TTL_SECONDS", &config.UnknownAppTTLSeconds)
 
 	overrideWithEnvBool("NOZZLE_INSECURESSLSKIPVERIFY", &config.InsecureSSLSkipVerify)
 	overrideWithEnvBool("NOZZLE_DISABLEACCESSCONTROL", &config.DisableAccessControl)
@@ -87,6 +302,28 @@ func Parse(configPath string) (*Config, error) {
 	overrideWithEnvUint32("NOZZLE_WORKERTIMEOUTSECONDS", &config.WorkerTimeoutSeconds)
 	overrideWithEnvSliceStrings("NO_PROXY", &config.NoProxy)
 	overrideWithEnvVar("NOZZLE_ENVIRONMENT_NAME", &config.EnvironmentName)
+	overrideWithEnvVar("NOZZLE_COUNTER_TYPE", &config.CounterType)
+	overrideWithEnvVar("NOZZLE_SPOOL_DIRECTORY", &config.SpoolDirectory)
+	overrideWithEnvUint32("NOZZLE_SPOOL_MAX_BYTES", &config.SpoolMaxBytes)
+	overrideWithEnvUint32("NOZZLE_SPOOL_SEGMENT_MAX_BYTES", &config.SpoolSegmentMaxBytes)
+	overrideWithEnvUint32("NOZZLE_SPOOL_MAX_AGE_SECONDS", &config.SpoolMaxAgeSeconds)
+	overrideWithEnvBool("NOZZLE_LOGS_ENABLED", &config.LogsEnabled)
+	overrideWithEnvVar("NOZZLE_DATADOG_LOGS_URL", &config.DataDogLogsURL)
+	overrideWithEnvUint32("NOZZLE_LOGS_FLUSH_DURATION_SECONDS", &config.LogsFlushDurationSeconds)
+	overrideWithEnvUint32("NOZZLE_LOGS_FLUSH_MAX_BYTES", &config.LogsFlushMaxBytes)
+	overrideWithEnvInt("NOZZLE_LOGS_BUFFER_SIZE", &config.LogsBufferSize)
+	overrideWithEnvBool("NOZZLE_HTTP_METRICS_ENABLED", &config.HTTPMetricsEnabled)
+	overrideWithEnvBool("NOZZLE_EVENTS_ENABLED", &config.EventsEnabled)
+	overrideWithEnvVar("NOZZLE_DATADOG_EVENTS_URL", &config.DataDogEventsURL)
+	overrideWithEnvUint32("NOZZLE_EVENTS_DEDUP_WINDOW_SECONDS", &config.EventsDedupWindowSeconds)
+	overrideWithEnvVar("NOZZLE_SOURCE_TYPE", &config.SourceType)
+	overrideWithEnvVar("NOZZLE_RLP_GATEWAY_URL", &config.RLPGatewayURL)
+	overrideWithEnvVar("NOZZLE_MONITORING_ADDRESS", &config.MonitoringAddress)
+	//NOTE: Override of MetricFilters, MetricRewrites, MetricAggregations, MetadataTags, MetricRoutes and Sinks not supported
+	overrideWithEnvVar("NOZZLE_METRIC_NAMING_MODE", &config.MetricNaming.Mode)
+	overrideWithEnvBool("NOZZLE_CONTAINER_METRICS_DISTRIBUTIONS", &config.ContainerMetrics.Distributions)
+	overrideWithEnvBool("NOZZLE_CONTAINER_METRICS_DISABLE_INSTANCE_GAUGES", &config.ContainerMetrics.DisableInstanceGauges)
+	overrideWithEnvInt("NOZZLE_CONTAINER_METRICS_MEMORY_MB_PER_CPU", &config.ContainerMetrics.MemoryMBPerCPU)
 
 	if config.MetricPrefix == "" {
 		config.MetricPrefix = "cloudfoundry.nozzle."
@@ -96,6 +333,22 @@ func Parse(configPath string) (*Config, error) {
 		config.GrabInterval = defaultGrabInterval
 	}
 
+	if config.FullResyncInterval == 0 {
+		config.FullResyncInterval = defaultFullResyncInterval
+	}
+
+	if config.AppLookupsPerSecond == 0 {
+		config.AppLookupsPerSecond = defaultAppLookupsPerSecond
+	}
+
+	if config.UnknownAppTTLSeconds == 0 {
+		config.UnknownAppTTLSeconds = defaultUnknownAppTTL
+	}
+
+	if config.SendQueueSize <= 0 {
+		config.SendQueueSize = defaultSendQueueSize
+	}
+
 	if config.NumWorkers == 0 {
 		config.NumWorkers = defaultWorkers
 	}
@@ -112,12 +365,225 @@ func Parse(configPath string) (*Config, error) {
 		config.WorkerTimeoutSeconds = defaultWorkerTimeoutSeconds
 	}
 
+	if config.SpoolMaxBytes == 0 {
+		config.SpoolMaxBytes = defaultSpoolMaxBytes
+	}
+
+	if config.SpoolSegmentMaxBytes == 0 {
+		config.SpoolSegmentMaxBytes = defaultSpoolSegmentMaxBytes
+	}
+
+	if config.SpoolMaxAgeSeconds == 0 {
+		config.SpoolMaxAgeSeconds = defaultSpoolMaxAgeSeconds
+	}
+
+	if config.DataDogLogsURL == "" {
+		config.DataDogLogsURL = defaultLogsURL
+	}
+
+	if config.LogsFlushDurationSeconds == 0 {
+		config.LogsFlushDurationSeconds = defaultLogsFlushSeconds
+	}
+
+	if config.LogsFlushMaxBytes == 0 {
+		config.LogsFlushMaxBytes = defaultLogsFlushMaxBytes
+	}
+
+	if config.LogsBufferSize == 0 {
+		config.LogsBufferSize = defaultLogsBufferSize
+	}
+
+	if config.DataDogEventsURL == "" {
+		config.DataDogEventsURL = defaultEventsURL
+	}
+
+	if config.EventsDedupWindowSeconds == 0 {
+		config.EventsDedupWindowSeconds = defaultEventsDedupWindow
+	}
+
+	if config.ContainerMetrics.MemoryMBPerCPU == 0 {
+		config.ContainerMetrics.MemoryMBPerCPU = defaultMemoryMBPerCPU
+	}
+
+	if config.CounterType == "" {
+		config.CounterType = defaultCounterType
+	}
+	if !isValidCounterType(config.CounterType) {
+		return nil, fmt.Errorf("Invalid CounterType %s, must be one of %v", config.CounterType, validCounterTypes)
+	}
+
+	if config.SourceType == "" {
+		config.SourceType = defaultSourceType
+	}
+	if !isValidSourceType(config.SourceType) {
+		return nil, fmt.Errorf("Invalid SourceType %s, must be one of %v", config.SourceType, validSourceTypes)
+	}
+
+	if config.MetricNaming.Mode == "" {
+		config.MetricNaming.Mode = NamingBoth
+	}
+	if !isValidNamingMode(config.MetricNaming.Mode) {
+		return nil, fmt.Errorf("Invalid MetricNaming Mode %s, must be one of %v", config.MetricNaming.Mode, validNamingModes)
+	}
+	for origin, mode := range config.MetricNaming.Origins {
+		if !isValidNamingMode(mode) {
+			return nil, fmt.Errorf("Invalid MetricNaming mode %s for origin %s, must be one of %v", mode, origin, validNamingModes)
+		}
+	}
+	for _, aggregation := range config.MetricAggregations {
+		if !isValidAggregation(aggregation.Function) {
+			return nil, fmt.Errorf("Invalid MetricAggregations Function %s, must be one of %v", aggregation.Function, validAggregations)
+		}
+	}
+
+	if config.DogStatsDAddress != "" && !isValidDogStatsDAddress(config.DogStatsDAddress) {
+		return nil, fmt.Errorf("Invalid DogStatsDAddress %s, must be udp://host:port or unix:///path/to/socket", config.DogStatsDAddress)
+	}
+
+	if config.DataDogSeriesAPIVersion == "" {
+		config.DataDogSeriesAPIVersion = SeriesAPIV1
+	}
+	if !isValidSeriesAPIVersion(config.DataDogSeriesAPIVersion) {
+		return nil, fmt.Errorf("Invalid DataDogSeriesAPIVersion %s, must be one of %v", config.DataDogSeriesAPIVersion, validSeriesAPIVersions)
+	}
+	if config.DataDogSeriesEncoding == "" {
+		config.DataDogSeriesEncoding = SeriesEncodingProtobuf
+	}
+	if !isValidSeriesEncoding(config.DataDogSeriesEncoding) {
+		return nil, fmt.Errorf("Invalid DataDogSeriesEncoding %s, must be one of %v", config.DataDogSeriesEncoding, validSeriesEncodings)
+	}
+
+	for i, sink := range config.Sinks {
+		if err := validateSink(sink); err != nil {
+			return nil, err
+		}
+		if sink.TimeoutSeconds == 0 {
+			config.Sinks[i].TimeoutSeconds = config.DataDogTimeoutSeconds
+		}
+		if config.Sinks[i].TimeoutSeconds == 0 {
+			config.Sinks[i].TimeoutSeconds = defaultSinkTimeoutSeconds
+		}
+	}
+
+	for _, route := range config.MetricRoutes.Endpoints {
+		if !isAdditionalEndpoint(config.DataDogAdditionalEndpoints, route.Endpoint, route.APIKey) {
+			return nil, fmt.Errorf("Invalid MetricRoutes Endpoint %s, it must be one of the DataDogAdditionalEndpoints with one of its keys", route.Endpoint)
+		}
+	}
+
+	// An empty list disables the aliases
+	if config.MetricNaming.Aliases == nil {
+		config.MetricNaming.Aliases = DefaultMetricAliases
+	}
+
 	overrideWithEnvInt("NOZZLE_NUM_WORKERS", &config.NumWorkers)
 	overrideWithEnvInt("NOZZLE_NUM_CACHE_WORKERS", &config.NumCacheWorkers)
 
 	return &config, nil
 }
 
+func isValidCounterType(counterType string) bool {
+	for _, t := range validCounterTypes {
+		if counterType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func validateSink(sink Sink) error {
+	switch sink.Type {
+	case SinkJSONLines:
+		if sink.Path == "" {
+			return fmt.Errorf("Invalid %s Sink, its Path is missing", sink.Type)
+		}
+	case SinkOTLP, SinkPrometheusRemoteWrite:
+		if sink.URL == "" {
+			return fmt.Errorf("Invalid %s Sink, its URL is missing", sink.Type)
+		}
+	default:
+		return fmt.Errorf("Invalid Sink Type %s, must be one of %v", sink.Type, validSinkTypes)
+	}
+	return nil
+}
+
+func isValidDogStatsDAddress(address string) bool {
+	u, err := url.Parse(address)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "udp" && u.Host != "") || (u.Scheme == "unix" && u.Path != "")
+}
+
+func isValidSourceType(sourceType string) bool {
+	for _, t := range validSourceTypes {
+		if sourceType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidSeriesAPIVersion(version string) bool {
+	for _, v := range validSeriesAPIVersions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidSeriesEncoding(encoding string) bool {
+	for _, e := range validSeriesEncodings {
+		if encoding == e {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidNamingMode(mode string) bool {
+	for _, m := range validNamingModes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+func isAdditionalEndpoint(endpoints map[string][]string, endpoint string, apiKey string) bool {
+	keys, ok := endpoints[endpoint]
+	if !ok || apiKey == "" {
+		return ok
+	}
+	for _, key := range keys {
+		if key == apiKey {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidAggregation(function string) bool {
+	for _, f := range validAggregations {
+		if function == f {
+			return true
+		}
+	}
+	return false
+}
+
+// UnprefixedNames returns the name prefixes of the metrics sent without the MetricPrefix
+func (n MetricNaming) UnprefixedNames() []string {
+	names := []string{}
+	for _, alias := range n.Aliases {
+		if alias.Unprefixed {
+			names = append(names, alias.Replacement)
+		}
+	}
+	return names
+}
+
 func overrideWithEnvVar(name string, value *string) {
 	envValue := os.Getenv(name)
 	if envValue != "" {
@@ -25,6 +25,7 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.DataDogTimeoutSeconds).To(BeEquivalentTo(5))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
 		Expect(conf.FlushMaxBytes).To(BeEquivalentTo(57671680))
+		Expect(conf.SendQueueSize).To(Equal(5))
 		Expect(conf.InsecureSSLSkipVerify).To(Equal(true))
 		Expect(conf.MetricPrefix).To(Equal("datadogclient"))
 		Expect(conf.Deployment).To(Equal("deployment-name"))
@@ -41,6 +42,69 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.NumWorkers).To(Equal(1))
 		Expect(conf.NumCacheWorkers).To(Equal(2))
 		Expect(conf.GrabInterval).To(Equal(50))
+		Expect(conf.FullResyncInterval).To(Equal(120))
+		Expect(conf.AppCacheFile).To(Equal("/var/vcap/data/nozzle/app_cache.json"))
+		Expect(conf.AppLookupsPerSecond).To(Equal(20))
+		Expect(conf.UnknownAppTTLSeconds).To(BeEquivalentTo(600))
+		Expect(conf.CounterType).To(Equal("rate"))
+		Expect(conf.SpoolDirectory).To(Equal("/var/vcap/data/nozzle/spool"))
+		Expect(conf.SpoolMaxBytes).To(BeEquivalentTo(104857600))
+		Expect(conf.SpoolSegmentMaxBytes).To(BeEquivalentTo(1048576))
+		Expect(conf.SpoolMaxAgeSeconds).To(BeEquivalentTo(1800))
+		Expect(conf.LogsEnabled).To(BeTrue())
+		Expect(conf.DataDogLogsURL).To(Equal("https://http-intake.logs.datadoghq.eu/v1/input"))
+		Expect(conf.LogsFlushDurationSeconds).To(BeEquivalentTo(10))
+		Expect(conf.LogsFlushMaxBytes).To(BeEquivalentTo(1048576))
+		Expect(conf.LogsBufferSize).To(Equal(500))
+		Expect(conf.HTTPMetricsEnabled).To(BeTrue())
+		Expect(conf.EventsEnabled).To(BeTrue())
+		Expect(conf.DataDogEventsURL).To(Equal("https://app.datadoghq.eu/api/v1/events"))
+		Expect(conf.EventsDedupWindowSeconds).To(BeEquivalentTo(600))
+		Expect(conf.SourceType).To(Equal("rlp_gateway"))
+		Expect(conf.RLPGatewayURL).To(Equal("https://log-stream.walnut.cf-app.com"))
+		Expect(conf.MonitoringAddress).To(Equal(":9090"))
+		Expect(conf.MetricFilters.Allow).To(Equal([]MetricFilterRule{{Deployment: "cf-*"}}))
+		Expect(conf.MetricFilters.Deny).To(Equal([]MetricFilterRule{
+			{Origin: "gorouter", Name: `/^latency\./`},
+			{Tags: map[string]string{"source_id": "system_*"}},
+		}))
+		Expect(conf.MetricRewrites).To(Equal([]MetricRewriteRule{{
+			Name:         "gorouter.*",
+			Rename:       "router.{tag:job}.$1",
+			MapTagValues: map[string]map[string]string{"env": {"prd": "production"}},
+			RenameTags:   map[string]string{"job": "service"},
+			DropTags:     []string{"ip"},
+			AddTags:      []string{"team:platform"},
+		}}))
+		Expect(conf.MetricRoutes).To(Equal(MetricRoutes{
+			Platform: []MetricRouteRule{{Deployment: "cf-*"}},
+			Endpoints: []EndpointRoute{{
+				Endpoint:        "https://app.datadoghq.com/api/v1/series",
+				APIKey:          "<apikey2>",
+				Rules:           []MetricRouteRule{{OrgName: "tenant", SpaceName: "prod-*"}},
+				IncludePlatform: true,
+			}},
+		}))
+		Expect(conf.Sinks).To(Equal([]Sink{
+			{Type: SinkJSONLines, Path: "/var/vcap/data/nozzle/metrics.jsonl", TimeoutSeconds: 5},
+			{Type: SinkOTLP, URL: "http://otel-collector:4318/v1/metrics", Headers: map[string]string{"Authorization": "Bearer token"}, TimeoutSeconds: 10},
+		}))
+		Expect(conf.MetricNaming.Mode).To(Equal(NamingNew))
+		Expect(conf.MetricNaming.Origins).To(Equal(map[string]string{"gorouter": NamingBoth}))
+		Expect(conf.MetricNaming.Aliases).To(BeEmpty())
+		Expect(conf.MetricNaming.UnprefixedNames()).To(BeEmpty())
+		Expect(conf.MetricAggregations).To(Equal([]MetricAggregation{
+			{Name: "gorouter.*", Function: "avg"},
+			{Name: `/^rep\.Capacity.*/`, Function: "last"},
+		}))
+		Expect(conf.ContainerMetrics.Distributions).To(BeTrue())
+		Expect(conf.ContainerMetrics.DisableInstanceGauges).To(BeTrue())
+		Expect(conf.ContainerMetrics.MemoryMBPerCPU).To(Equal(4096))
+		Expect(conf.MetadataTags).To(Equal(MetadataTags{
+			Labels:      []string{"team", "mycompany.com/*"},
+			Annotations: []string{"cost-center"},
+			TagPrefix:   "cf_",
+		}))
 	})
 
 	It("successfully sets default configuration values", func() {
@@ -52,6 +116,98 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(60))
 		Expect(conf.WorkerTimeoutSeconds).To(BeEquivalentTo(10))
 		Expect(conf.GrabInterval).To(Equal(10))
+		Expect(conf.FullResyncInterval).To(Equal(60))
+		Expect(conf.AppLookupsPerSecond).To(Equal(10))
+		Expect(conf.UnknownAppTTLSeconds).To(BeEquivalentTo(300))
+		Expect(conf.CounterType).To(Equal("count"))
+		Expect(conf.SpoolDirectory).To(Equal(""))
+		Expect(conf.SpoolMaxBytes).To(BeEquivalentTo(1073741824))
+		Expect(conf.SpoolSegmentMaxBytes).To(BeEquivalentTo(16777216))
+		Expect(conf.SpoolMaxAgeSeconds).To(BeEquivalentTo(3600))
+		Expect(conf.LogsEnabled).To(BeFalse())
+		Expect(conf.DataDogLogsURL).To(Equal("https://http-intake.logs.datadoghq.com/v1/input"))
+		Expect(conf.LogsFlushDurationSeconds).To(BeEquivalentTo(5))
+		Expect(conf.LogsFlushMaxBytes).To(BeEquivalentTo(4194304))
+		Expect(conf.SendQueueSize).To(Equal(10))
+		Expect(conf.DogStatsDAddress).To(Equal(""))
+		Expect(conf.DataDogSeriesAPIVersion).To(Equal(SeriesAPIV1))
+		Expect(conf.DataDogSeriesEncoding).To(Equal(SeriesEncodingProtobuf))
+		Expect(conf.LogsBufferSize).To(Equal(10000))
+		Expect(conf.HTTPMetricsEnabled).To(BeFalse())
+		Expect(conf.EventsEnabled).To(BeFalse())
+		Expect(conf.DataDogEventsURL).To(Equal("https://app.datadoghq.com/api/v1/events"))
+		Expect(conf.EventsDedupWindowSeconds).To(BeEquivalentTo(300))
+		Expect(conf.SourceType).To(Equal("firehose"))
+		Expect(conf.RLPGatewayURL).To(Equal(""))
+		Expect(conf.MonitoringAddress).To(Equal(""))
+		Expect(conf.MetricFilters.Allow).To(BeEmpty())
+		Expect(conf.MetricFilters.Deny).To(BeEmpty())
+		Expect(conf.MetricRewrites).To(BeEmpty())
+		Expect(conf.MetricRoutes.Platform).To(BeEmpty())
+		Expect(conf.MetricRoutes.Endpoints).To(BeEmpty())
+		Expect(conf.Sinks).To(BeEmpty())
+		Expect(conf.MetricNaming.Mode).To(Equal(NamingBoth))
+		Expect(conf.MetricNaming.Aliases).To(Equal(DefaultMetricAliases))
+		Expect(conf.MetricNaming.UnprefixedNames()).To(Equal([]string{"bosh.healthmonitor"}))
+		Expect(conf.MetricAggregations).To(BeEmpty())
+		Expect(conf.ContainerMetrics.Distributions).To(BeFalse())
+		Expect(conf.ContainerMetrics.DisableInstanceGauges).To(BeFalse())
+		Expect(conf.ContainerMetrics.MemoryMBPerCPU).To(Equal(8192))
+		Expect(conf.MetadataTags.Labels).To(BeEmpty())
+		Expect(conf.MetadataTags.Annotations).To(BeEmpty())
+	})
+
+	It("fails on an unknown counter type", func() {
+		os.Setenv("NOZZLE_COUNTER_TYPE", "histogram")
+		_, err := Parse("testdata/test_config.json")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on an unknown source type", func() {
+		os.Setenv("NOZZLE_SOURCE_TYPE", "syslog")
+		_, err := Parse("testdata/test_config.json")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on an unknown naming mode", func() {
+		os.Setenv("NOZZLE_METRIC_NAMING_MODE", "short")
+		_, err := Parse("testdata/test_config.json")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on an unsupported DogStatsD address", func() {
+		os.Setenv("NOZZLE_DOGSTATSD_ADDRESS", "tcp://localhost:8125")
+		_, err := Parse("testdata/test_config.json")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on an unknown series API version", func() {
+		os.Setenv("NOZZLE_DATADOG_SERIES_API_VERSION", "v3")
+		_, err := Parse("testdata/test_config.json")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on an unknown series encoding", func() {
+		os.Setenv("NOZZLE_DATADOG_SERIES_ENCODING", "msgpack")
+		_, err := Parse("testdata/test_config.json")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails on an invalid sink", func() {
+		_, err := Parse("testdata/test_config_invalid_sink.json")
+		Expect(err).To(MatchError("Invalid prometheus_remote_write Sink, its URL is missing"))
+	})
+
+	It("doesn't let the sinks go without a timeout", func() {
+		os.Setenv("NOZZLE_DATADOGTIMEOUTSECONDS", "0")
+		conf, err := Parse("testdata/test_config.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Sinks[0].TimeoutSeconds).To(BeEquivalentTo(10))
+	})
+
+	It("fails on a route to an endpoint which isn't an additional endpoint", func() {
+		_, err := Parse("testdata/test_config_invalid_route.json")
+		Expect(err).To(MatchError(ContainSubstring("Invalid MetricRoutes Endpoint https://app.datadoghq.eu/api/v1/series")))
 	})
 
 	It("successfully overwrites file config values with environmental variables", func() {
@@ -65,6 +221,10 @@ var _ = Describe("NozzleConfig", func() {
 		os.Setenv("NOZZLE_DATADOGTIMEOUTSECONDS", "10")
 		os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "25")
 		os.Setenv("NOZZLE_FLUSHMAXBYTES", "12345678")
+		os.Setenv("NOZZLE_SEND_QUEUE_SIZE", "20")
+		os.Setenv("NOZZLE_DOGSTATSD_ADDRESS", "unix:///var/run/datadog/dsd.socket")
+		os.Setenv("NOZZLE_DATADOG_SERIES_API_VERSION", "v2")
+		os.Setenv("NOZZLE_DATADOG_SERIES_ENCODING", "json")
 		os.Setenv("NOZZLE_INSECURESSLSKIPVERIFY", "false")
 		os.Setenv("NOZZLE_METRICPREFIX", "env-datadogclient")
 		os.Setenv("NOZZLE_DEPLOYMENT", "env-deployment-name")
@@ -77,6 +237,11 @@ var _ = Describe("NozzleConfig", func() {
 		os.Setenv("NOZZLE_NUM_WORKERS", "3")
 		os.Setenv("NOZZLE_NUM_CACHE_WORKERS", "5")
 		os.Setenv("NOZZLE_GRAB_INTERVAL", "50")
+		os.Setenv("NOZZLE_FULL_RESYNC_INTERVAL", "500")
+		os.Setenv("NOZZLE_APP_CACHE_FILE", "/tmp/app_cache.json")
+		os.Setenv("NOZZLE_APP_LOOKUPS_PER_SECOND", "-1")
+		os.Setenv("NOZZLE_UNKNOWN_APP_TTL_SECONDS", "60")
+		os.Setenv("NOZZLE_COUNTER_TYPE", "gauge")
 		conf, err := Parse("testdata/test_config.json")
 		Expect(err).ToNot(HaveOccurred())
 		Expect(conf.UAAURL).To(Equal("https://uaa.walnut-env.cf-app.com"))
@@ -90,6 +255,10 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.DataDogTimeoutSeconds).To(BeEquivalentTo(10))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(25))
 		Expect(conf.FlushMaxBytes).To(BeEquivalentTo(12345678))
+		Expect(conf.SendQueueSize).To(Equal(20))
+		Expect(conf.DogStatsDAddress).To(Equal("unix:///var/run/datadog/dsd.socket"))
+		Expect(conf.DataDogSeriesAPIVersion).To(Equal(SeriesAPIV2))
+		Expect(conf.DataDogSeriesEncoding).To(Equal(SeriesEncodingJSON))
 		Expect(conf.InsecureSSLSkipVerify).To(Equal(false))
 		Expect(conf.MetricPrefix).To(Equal("env-datadogclient"))
 		Expect(conf.Deployment).To(Equal("env-deployment-name"))
@@ -100,5 +269,10 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.NumWorkers).To(Equal(3))
 		Expect(conf.NumCacheWorkers).To(Equal(5))
 		Expect(conf.GrabInterval).To(Equal(50))
+		Expect(conf.FullResyncInterval).To(Equal(500))
+		Expect(conf.AppCacheFile).To(Equal("/tmp/app_cache.json"))
+		Expect(conf.AppLookupsPerSecond).To(Equal(-1))
+		Expect(conf.UnknownAppTTLSeconds).To(BeEquivalentTo(60))
+		Expect(conf.CounterType).To(Equal("gauge"))
 	})
 })
@@ -0,0 +1,14 @@
+package event
+
+// Event is an event as expected by the Datadog events API
+type Event struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	Timestamp      int64    `json:"date_happened"`
+	Priority       string   `json:"priority,omitempty"`
+	Host           string   `json:"host,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	AlertType      string   `json:"alert_type,omitempty"`
+	AggregationKey string   `json:"aggregation_key,omitempty"`
+	SourceTypeName string   `json:"source_type_name,omitempty"`
+}
@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Filter decides which metric envelopes are processed, from allow and deny rules
+type Filter struct {
+	allow []rule
+	deny  []rule
+}
+
+type rule struct {
+	name       *Pattern
+	origin     *Pattern
+	job        *Pattern
+	deployment *Pattern
+	tags       map[string]*Pattern
+}
+
+// New compiles the rules of the configuration
+func New(filters config.MetricFilters) (*Filter, error) {
+	allow, err := compileRules(filters.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := compileRules(filters.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{allow: allow, deny: deny}, nil
+}
+
+// Enabled returns true if there is at least one rule
+func (f *Filter) Enabled() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+// Keep returns true if the envelope matches an allow rule, or if there are none, and doesn't match any deny rule.
+// The rules with a name only apply to the envelopes having one, so that e.g. allowing some value metrics by name
+// doesn't drop the container metrics.
+func (f *Filter) Keep(envelope *events.Envelope) bool {
+	name, named := metricName(envelope)
+	allowed, applied := false, false
+	for _, r := range f.allow {
+		if r.name != nil && !named {
+			continue
+		}
+		applied = true
+		if r.match(envelope, name) {
+			allowed = true
+			break
+		}
+	}
+	if applied && !allowed {
+		return false
+	}
+
+	for _, r := range f.deny {
+		if r.name != nil && !named {
+			continue
+		}
+		if r.match(envelope, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r rule) match(envelope *events.Envelope, name string) bool {
+	if r.name != nil && !r.name.Match(name) {
+		return false
+	}
+	if r.origin != nil && !r.origin.Match(envelope.GetOrigin()) {
+		return false
+	}
+	if r.job != nil && !r.job.Match(envelope.GetJob()) {
+		return false
+	}
+	if r.deployment != nil && !r.deployment.Match(envelope.GetDeployment()) {
+		return false
+	}
+	for name, pattern := range r.tags {
+		value, ok := envelope.GetTags()[name]
+		if !ok || !pattern.Match(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// metricName returns the name of a ValueMetric or CounterEvent envelope, the other envelopes don't have one
+func metricName(envelope *events.Envelope) (string, bool) {
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		return envelope.GetValueMetric().GetName(), true
+	case events.Envelope_CounterEvent:
+		return envelope.GetCounterEvent().GetName(), true
+	default:
+		return "", false
+	}
+}
+
+func compileRules(configs []config.MetricFilterRule) ([]rule, error) {
+	rules := make([]rule, 0, len(configs))
+	for _, c := range configs {
+		var r rule
+		var err error
+		if r.name, err = CompileOptional(c.Name); err != nil {
+			return nil, err
+		}
+		if r.origin, err = CompileOptional(c.Origin); err != nil {
+			return nil, err
+		}
+		if r.job, err = CompileOptional(c.Job); err != nil {
+			return nil, err
+		}
+		if r.deployment, err = CompileOptional(c.Deployment); err != nil {
+			return nil, err
+		}
+		if len(c.Tags) > 0 {
+			r.tags = make(map[string]*Pattern, len(c.Tags))
+			for name, value := range c.Tags {
+				if r.tags[name], err = CompilePattern(value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
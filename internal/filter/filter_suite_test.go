@@ -0,0 +1,13 @@
+package filter
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Filter Suite")
+}
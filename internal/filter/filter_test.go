@@ -0,0 +1,145 @@
+package filter
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+)
+
+var _ = Describe("Filter", func() {
+	valueMetric := func(origin string, name string, job string, tags map[string]string) *events.Envelope {
+		return &events.Envelope{
+			Origin:     proto.String(origin),
+			EventType:  events.Envelope_ValueMetric.Enum(),
+			Deployment: proto.String("cf"),
+			Job:        proto.String(job),
+			Tags:       tags,
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(1),
+				Unit:  proto.String("gauge"),
+			},
+		}
+	}
+
+	Describe("patterns", func() {
+		It("matches globs on the whole value", func() {
+			p, err := CompilePattern("gorouter.*.latency")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Match("gorouter.requests.latency")).To(BeTrue())
+			Expect(p.Match("gorouter.latency")).To(BeFalse())
+			Expect(p.Match("x.gorouter.requests.latency")).To(BeFalse())
+
+			p, err = CompilePattern("job_?")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Match("job_1")).To(BeTrue())
+			Expect(p.Match("job_12")).To(BeFalse())
+		})
+
+		It("matches regular expressions between slashes", func() {
+			p, err := CompilePattern(`/^(diego|router)_\d+$/`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Match("router_42")).To(BeTrue())
+			Expect(p.Match("router_z1")).To(BeFalse())
+		})
+
+		It("rejects invalid regular expressions", func() {
+			_, err := CompilePattern("/(/")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("keeps everything without rules", func() {
+		f, err := New(config.MetricFilters{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Enabled()).To(BeFalse())
+		Expect(f.Keep(valueMetric("gorouter", "latency", "router", nil))).To(BeTrue())
+	})
+
+	It("only keeps the envelopes matching an allow rule", func() {
+		f, err := New(config.MetricFilters{
+			Allow: []config.MetricFilterRule{
+				{Origin: "gorouter", Name: "total_*"},
+				{Job: "/^diego_cell/"},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Enabled()).To(BeTrue())
+
+		Expect(f.Keep(valueMetric("gorouter", "total_requests", "router", nil))).To(BeTrue())
+		Expect(f.Keep(valueMetric("gorouter", "latency", "router", nil))).To(BeFalse())
+		Expect(f.Keep(valueMetric("rep", "CapacityRemainingMemory", "diego_cell_z1", nil))).To(BeTrue())
+		Expect(f.Keep(valueMetric("rep", "CapacityRemainingMemory", "router", nil))).To(BeFalse())
+	})
+
+	It("drops the envelopes matching a deny rule, even when allowed", func() {
+		f, err := New(config.MetricFilters{
+			Allow: []config.MetricFilterRule{{Deployment: "cf"}},
+			Deny:  []config.MetricFilterRule{{Name: "*.debug.*"}, {Tags: map[string]string{"source_id": "system_*"}}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(f.Keep(valueMetric("uaa", "requests.global.completed.count", "uaa", nil))).To(BeTrue())
+		Expect(f.Keep(valueMetric("uaa", "jvm.debug.heap", "uaa", nil))).To(BeFalse())
+		Expect(f.Keep(valueMetric("uaa", "requests", "uaa", map[string]string{"source_id": "system_metrics"}))).To(BeFalse())
+		Expect(f.Keep(valueMetric("uaa", "requests", "uaa", map[string]string{"source_id": "uaa"}))).To(BeTrue())
+	})
+
+	It("requires the tags of a rule to be set on the envelope", func() {
+		f, err := New(config.MetricFilters{
+			Deny: []config.MetricFilterRule{{Tags: map[string]string{"placement_tag": "*"}}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(f.Keep(valueMetric("rep", "ContainerCount", "diego_cell", nil))).To(BeTrue())
+		Expect(f.Keep(valueMetric("rep", "ContainerCount", "diego_cell", map[string]string{"placement_tag": "isolated"}))).To(BeFalse())
+	})
+
+	Context("with envelopes without a name", func() {
+		container := &events.Envelope{
+			Origin:          proto.String("rep"),
+			EventType:       events.Envelope_ContainerMetric.Enum(),
+			ContainerMetric: &events.ContainerMetric{ApplicationId: proto.String("app")},
+		}
+
+		It("matches the name of counter events, and ignores the denied names for the other envelopes", func() {
+			f, err := New(config.MetricFilters{
+				Deny: []config.MetricFilterRule{{Name: "*"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			counter := &events.Envelope{
+				Origin:       proto.String("doppler"),
+				EventType:    events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{Name: proto.String("dropped"), Delta: proto.Uint64(1)},
+			}
+			Expect(f.Keep(counter)).To(BeFalse())
+			Expect(f.Keep(container)).To(BeTrue())
+		})
+
+		It("keeps them when only names are allowed", func() {
+			f, err := New(config.MetricFilters{
+				Allow: []config.MetricFilterRule{{Name: "latency"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Keep(valueMetric("gorouter", "requests", "router", nil))).To(BeFalse())
+			Expect(f.Keep(container)).To(BeTrue())
+		})
+
+		It("applies the rules without a name to them", func() {
+			f, err := New(config.MetricFilters{
+				Allow: []config.MetricFilterRule{{Name: "latency"}, {Origin: "gorouter"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Keep(container)).To(BeFalse())
+		})
+	})
+
+	It("fails on invalid rules", func() {
+		_, err := New(config.MetricFilters{Deny: []config.MetricFilterRule{{Origin: "/[/"}}})
+		Expect(err).To(HaveOccurred())
+	})
+})
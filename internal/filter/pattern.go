@@ -0,0 +1,67 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern matches strings against a glob, or a regular expression when written between slashes
+type Pattern struct {
+	regex *regexp.Regexp
+}
+
+// CompilePattern compiles a glob where `*` matches any sequence of characters and `?` any single character,
+// or a regular expression if the pattern is wrapped in slashes, e.g. `/^gorouter\.(.*)$/`.
+// The wildcards of a glob are capture groups, numbered from 1.
+func CompilePattern(pattern string) (*Pattern, error) {
+	var expr string
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expr = pattern[1 : len(pattern)-1]
+	} else {
+		expr = globToRegex(pattern)
+	}
+
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+	return &Pattern{regex: regex}, nil
+}
+
+// CompileOptional compiles a pattern of a rule field which can be left out. It returns a nil pattern for an empty
+// value, which the rules take as matching anything.
+func CompileOptional(pattern string) (*Pattern, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return CompilePattern(pattern)
+}
+
+// Match returns true if the whole value matches a glob, or if a regular expression matches the value
+func (p *Pattern) Match(value string) bool {
+	return p.regex.MatchString(value)
+}
+
+// Regexp returns the compiled form of the pattern, globs are anchored regular expressions
+func (p *Pattern) Regexp() *regexp.Regexp {
+	return p.regex
+}
+
+func globToRegex(glob string) string {
+	var expr bytes.Buffer
+	expr.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString("(.*)")
+		case '?':
+			expr.WriteString("(.)")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
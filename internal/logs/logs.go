@@ -0,0 +1,12 @@
+package logs
+
+// Log is a log entry as expected by the Datadog logs intake
+type Log struct {
+	Message   string `json:"message"`
+	Source    string `json:"ddsource"`
+	Service   string `json:"service,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+	Status    string `json:"status"`
+	Tags      string `json:"ddtags,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
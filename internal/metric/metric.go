@@ -1,12 +1,22 @@
 package metric
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
+// Datadog metric types
+const (
+	Gauge = "gauge"
+	Count = "count"
+	Rate  = "rate"
+	// Distribution points are sent to the distribution endpoint, which computes percentiles over all their values
+	Distribution = "distribution"
+)
+
 type Point struct {
 	Timestamp int64
 	Value     float64
@@ -44,6 +54,9 @@ type MetricValue struct {
 	Tags   []string
 	Points []Point
 	Host   string
+	Type   string
+	// Unit is the Datadog unit of the metric, e.g. millisecond, only sent to the v2 series API
+	Unit string
 }
 
 type MetricPackage struct {
@@ -64,9 +77,66 @@ func (m MetricsMap) Add(key MetricKey, newVal MetricValue) {
 }
 
 type Series struct {
-	Metric string   `json:"metric"`
-	Points []Point  `json:"points"`
-	Type   string   `json:"type"`
-	Host   string   `json:"host,omitempty"`
-	Tags   []string `json:"tags,omitempty"`
+	Metric   string   `json:"metric"`
+	Points   []Point  `json:"points"`
+	Type     string   `json:"type"`
+	Interval int64    `json:"interval,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// SeriesV2 is a series of the v2 series API, its points keep the full precision of their value
+type SeriesV2 struct {
+	Metric    string       `json:"metric"`
+	Type      int          `json:"type"`
+	Interval  int64        `json:"interval,omitempty"`
+	Unit      string       `json:"unit,omitempty"`
+	Points    []PointV2    `json:"points"`
+	Resources []ResourceV2 `json:"resources,omitempty"`
+	Tags      []string     `json:"tags,omitempty"`
+}
+
+// Metric types of the v2 series API
+const (
+	TypeV2Unspecified = 0
+	TypeV2Count       = 1
+	TypeV2Rate        = 2
+	TypeV2Gauge       = 3
+)
+
+type PointV2 struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// ResourceV2 is a resource a series is attached to, e.g. its host
+type ResourceV2 struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type DistributionSeries struct {
+	Metric string              `json:"metric"`
+	Points []DistributionPoint `json:"points"`
+	Host   string              `json:"host,omitempty"`
+	Tags   []string            `json:"tags,omitempty"`
+}
+
+// DistributionPoint holds all the values of a distribution at a timestamp
+type DistributionPoint struct {
+	Timestamp int64
+	Values    []float64
+}
+
+func (p DistributionPoint) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%d, [", p.Timestamp)
+	for i, v := range p.Values {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%f", v)
+	}
+	buf.WriteString("]]")
+	return buf.Bytes(), nil
 }
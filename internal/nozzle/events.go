@@ -0,0 +1,61 @@
+package nozzle
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// eventsBufferSize is the number of events waiting to be posted before new ones are dropped
+const eventsBufferSize = 1000
+
+func (n *Nozzle) startEventsForwarder() {
+	// Start the (one) worker which will post the events sent by the workers to n.processedEvents
+	n.log.Info("Starting events forwarder...")
+	go n.forwardEvents()
+}
+
+func (n *Nozzle) stopEventsForwarder() {
+	select {
+	case n.eventsStopper <- true:
+	case <-time.After(time.Duration(n.config.WorkerTimeoutSeconds) * time.Second):
+		n.log.Warnf("Could not stop the events forwarder after %ds", n.config.WorkerTimeoutSeconds)
+	}
+}
+
+func (n *Nozzle) forwardEvents() {
+	n.log.Info("Events forwarder started")
+	for {
+		select {
+		case e := <-n.processedEvents:
+			err := n.eventsClient.PostEvent(e)
+			if err != nil {
+				// NOTE: Events are not retried beyond what the HTTP client does, they are lost.
+				n.log.Errorf("Error posting event: %s\n\n", err)
+				continue
+			}
+			atomic.AddUint64(&n.totalEventsSent, 1)
+		case <-n.eventsStopper:
+			n.log.Info("Events forwarder shutting down...")
+			return
+		}
+	}
+}
+
+// handleEvent hands the events extracted from an envelope over to the events forwarder,
+// or drops them if the forwarder can't keep up
+func (n *Nozzle) handleEvent(envelope *events.Envelope) {
+	extracted, err := n.processor.ProcessEvent(envelope)
+	if err != nil {
+		return
+	}
+
+	for _, e := range extracted {
+		select {
+		case n.processedEvents <- e:
+		default:
+			atomic.AddUint64(&n.droppedEvents, 1)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package nozzle
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// markActivity records that a stage of the processing pipeline made progress, as a unix nano timestamp
+func markActivity(stage *int64) {
+	atomic.StoreInt64(stage, time.Now().UnixNano())
+}
+
+// livenessFailures returns the reasons why the nozzle should be restarted, if any
+func (n *Nozzle) livenessFailures() []string {
+	failures := []string{}
+	timeout := time.Duration(n.config.WorkerTimeoutSeconds) * time.Second
+	if len(n.messages) > 0 && stalled(&n.lastEnvelopeProcessed, timeout) {
+		failures = append(failures, fmt.Sprintf("the workers have not processed any envelope for %s", timeout))
+	}
+	if len(n.processedMetrics) > 0 && stalled(&n.lastMetricsAggregated, timeout) {
+		failures = append(failures, fmt.Sprintf("the processed metrics reader has not aggregated any metric for %s", timeout))
+	}
+	return failures
+}
+
+// readinessFailures returns the reasons why the nozzle is not ready yet, if any
+func (n *Nozzle) readinessFailures() []string {
+	failures := []string{}
+	if atomic.LoadUint64(&n.metricsPosted) == 0 {
+		failures = append(failures, "no metrics have been posted to Datadog yet")
+	}
+	if n.parseAppMetricsEnable && (n.processor == nil || !n.processor.AppCacheWarmedUp()) {
+		failures = append(failures, "the app cache is not warmed up yet")
+	}
+	return failures
+}
+
+// stalled returns true if the stage did not make progress during timeout
+func stalled(stage *int64, timeout time.Duration) bool {
+	last := atomic.LoadInt64(stage)
+	return last != 0 && time.Since(time.Unix(0, last)) > timeout
+}
+
+func (n *Nozzle) serveLiveness(rw http.ResponseWriter, req *http.Request) {
+	writeHealth(rw, n.livenessFailures())
+}
+
+func (n *Nozzle) serveReadiness(rw http.ResponseWriter, req *http.Request) {
+	writeHealth(rw, n.readinessFailures())
+}
+
+func writeHealth(rw http.ResponseWriter, failures []string) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failures) > 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(rw, strings.Join(failures, "\n"))
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
@@ -0,0 +1,97 @@
+package nozzle
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/sink"
+)
+
+var _ = Describe("Health checks", func() {
+	var nozzle *Nozzle
+
+	BeforeEach(func() {
+		configuration := &config.Config{
+			WorkerTimeoutSeconds: 1,
+			NumWorkers:           1,
+		}
+		nozzle = NewNozzle(configuration, nil, gosteno.NewLogger("test"))
+	})
+
+	probe := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	Context("liveness", func() {
+		It("is healthy by default", func() {
+			rec := probe(nozzle.serveLiveness)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(Equal("ok\n"))
+		})
+
+		It("fails when the workers don't consume the queued envelopes", func() {
+			messages := make(chan *events.Envelope, 1)
+			messages <- &events.Envelope{}
+			nozzle.messages = messages
+			nozzle.lastEnvelopeProcessed = time.Now().Add(-2 * time.Second).UnixNano()
+
+			rec := probe(nozzle.serveLiveness)
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Body.String()).To(ContainSubstring("workers have not processed any envelope"))
+		})
+
+		It("doesn't fail when idle workers have nothing to consume", func() {
+			nozzle.messages = make(chan *events.Envelope, 1)
+			nozzle.lastEnvelopeProcessed = time.Now().Add(-time.Hour).UnixNano()
+
+			Expect(probe(nozzle.serveLiveness).Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("readiness", func() {
+		It("is not ready until metrics are posted", func() {
+			rec := probe(nozzle.serveReadiness)
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Body.String()).To(ContainSubstring("no metrics have been posted"))
+
+			nozzle.metricsPosted = 1
+			Expect(probe(nozzle.serveReadiness).Code).To(Equal(http.StatusOK))
+		})
+
+		It("is not made ready by the metrics posted to the sinks other than Datadog", func() {
+			dir, err := ioutil.TempDir("", "nozzle-readiness")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			s := config.Sink{Type: config.SinkJSONLines, Path: filepath.Join(dir, "metrics.jsonl")}
+			sender := newMetricsSender(sink.NewJSONLines(s, nozzle.config, "127.0.0.1"), nil, 1)
+			sender.enqueue(metric.MetricsMap{})
+			close(sender.queue)
+			nozzle.send(sender)
+
+			Expect(filepath.Join(dir, "metrics.jsonl")).To(BeAnExistingFile())
+			Expect(probe(nozzle.serveReadiness).Code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("waits for the app cache when app metrics are enabled", func() {
+			nozzle.metricsPosted = 1
+			nozzle.parseAppMetricsEnable = true
+
+			rec := probe(nozzle.serveReadiness)
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Body.String()).To(ContainSubstring("app cache is not warmed up"))
+		})
+	})
+})
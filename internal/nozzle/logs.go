@@ -0,0 +1,79 @@
+package nozzle
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func (n *Nozzle) startLogsForwarder() {
+	// Start the (one) worker which will batch the logs sent by the workers to n.processedLogs
+	// and post them to the logs intake
+	n.log.Info("Starting logs forwarder...")
+	go n.forwardLogs()
+}
+
+func (n *Nozzle) stopLogsForwarder() {
+	select {
+	case n.logsStopper <- true:
+	case <-time.After(time.Duration(n.config.WorkerTimeoutSeconds) * time.Second):
+		n.log.Warnf("Could not stop the logs forwarder after %ds", n.config.WorkerTimeoutSeconds)
+	}
+}
+
+func (n *Nozzle) forwardLogs() {
+	n.log.Info("Logs forwarder started")
+	ticker := time.NewTicker(time.Duration(n.config.LogsFlushDurationSeconds) * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]logs.Log, 0, n.config.LogsBufferSize)
+	for {
+		select {
+		case l := <-n.processedLogs:
+			batch = append(batch, l)
+			if len(batch) >= n.config.LogsBufferSize {
+				// Don't wait for the next tick to keep the memory bounded
+				batch = n.postLogs(batch)
+			}
+		case <-ticker.C:
+			batch = n.postLogs(batch)
+		case <-n.logsStopper:
+			n.log.Info("Logs forwarder shutting down...")
+			n.postLogs(batch)
+			return
+		}
+	}
+}
+
+// postLogs posts a batch of logs and returns an empty batch to fill
+func (n *Nozzle) postLogs(batch []logs.Log) []logs.Log {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	err := n.logsClient.PostLogs(batch)
+	if err != nil {
+		// NOTE: Logs are not retried beyond what the HTTP client does, they are lost.
+		n.log.Errorf("Error posting logs: %s\n\n", err)
+	} else {
+		atomic.AddUint64(&n.totalLogsSent, uint64(len(batch)))
+	}
+
+	return batch[:0]
+}
+
+// handleLog hands a LogMessage envelope over to the logs forwarder, or drops it if the forwarder can't keep up
+func (n *Nozzle) handleLog(envelope *events.Envelope) {
+	l, err := n.processor.ProcessLog(envelope)
+	if err != nil {
+		return
+	}
+
+	select {
+	case n.processedLogs <- l:
+	default:
+		atomic.AddUint64(&n.droppedLogs, 1)
+	}
+}
@@ -0,0 +1,160 @@
+package nozzle
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/telemetry"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const telemetryPrefix = "datadog_firehose_nozzle_"
+
+// maxEventType bounds the envelope event types counted by the nozzle
+const maxEventType = 16
+
+// registerTelemetry creates the metrics describing the health of the nozzle itself
+func (n *Nozzle) registerTelemetry() {
+	r := telemetry.NewRegistry()
+
+	r.RegisterFunc(telemetryPrefix+"messages_received_total", "Number of processed envelopes that produced metrics.", telemetry.Counter, func() float64 {
+		n.mapLock.RLock()
+		defer n.mapLock.RUnlock()
+		return float64(n.totalMessagesReceived)
+	})
+	r.RegisterFunc(telemetryPrefix+"metrics_sent_total", "Number of metrics posted to Datadog.", telemetry.Counter, func() float64 {
+		return float64(atomic.LoadUint64(&n.totalMetricsSent))
+	})
+	r.RegisterFunc(telemetryPrefix+"slow_consumer_alert", "1 if the nozzle was reported as not keeping up since the last flush.", telemetry.Gauge, func() float64 {
+		return float64(atomic.LoadUint64(&n.slowConsumerAlert))
+	})
+	r.Register(telemetryPrefix+"envelopes_received_total", "Number of envelopes received, by event type.", telemetry.Counter, func() []telemetry.Sample {
+		samples := []telemetry.Sample{}
+		for i := range n.envelopesReceived {
+			count := atomic.LoadUint64(&n.envelopesReceived[i])
+			if count == 0 {
+				continue
+			}
+			samples = append(samples, telemetry.Sample{
+				Labels: []telemetry.Label{{Name: "event_type", Value: events.Envelope_EventType(i).String()}},
+				Value:  float64(count),
+			})
+		}
+		return samples
+	})
+	r.RegisterFunc(telemetryPrefix+"envelopes_dropped_total", "Number of metric envelopes dropped by the metric filters.", telemetry.Counter, func() float64 {
+		return float64(atomic.LoadUint64(&n.droppedEnvelopes))
+	})
+	r.RegisterFunc(telemetryPrefix+"messages_queue_length", "Number of envelopes waiting to be processed by the workers.", telemetry.Gauge, func() float64 {
+		return float64(len(n.messages))
+	})
+	r.RegisterFunc(telemetryPrefix+"processed_metrics_queue_length", "Number of processed metrics waiting to be aggregated.", telemetry.Gauge, func() float64 {
+		return float64(len(n.processedMetrics))
+	})
+	r.Register(telemetryPrefix+"send_queue_length", "Number of metrics flushes waiting to be posted, by client.", telemetry.Gauge, func() []telemetry.Sample {
+		return n.senderSamples(func(s *metricsSender) uint64 { return s.queueLength() })
+	})
+	r.Register(telemetryPrefix+"send_queue_dropped_total", "Number of metrics flushes dropped because the send queue was full, by client.", telemetry.Counter, func() []telemetry.Sample {
+		return n.senderSamples(func(s *metricsSender) uint64 { return s.droppedFlushes() })
+	})
+	n.postDuration = r.NewSummaryVec(telemetryPrefix+"post_duration_seconds", "Time spent posting metrics to Datadog, by client.", "endpoint", "account")
+	n.postFailures = r.NewCounterVec(telemetryPrefix+"post_failures_total", "Number of failed metrics posts, by client.", "endpoint", "account")
+	r.RegisterFunc(telemetryPrefix+"app_cache_size", "Number of apps in the app metadata cache.", telemetry.Gauge, func() float64 {
+		size, _ := n.processor.AppCacheStats()
+		return float64(size)
+	})
+	r.RegisterFunc(telemetryPrefix+"app_cache_warmup_duration_seconds", "Duration of the last complete warmup of the app metadata cache.", telemetry.Gauge, func() float64 {
+		_, duration := n.processor.AppCacheStats()
+		return duration.Seconds()
+	})
+	r.Register(telemetryPrefix+"app_cache_requests_total", "Number of app metrics whose app was found in the app metadata cache or not.", telemetry.Counter, func() []telemetry.Sample {
+		stats := n.processor.AppLookupStats()
+		return []telemetry.Sample{
+			{Labels: []telemetry.Label{{Name: "result", Value: "hit"}}, Value: float64(stats.Hits)},
+			{Labels: []telemetry.Label{{Name: "result", Value: "miss"}}, Value: float64(stats.Misses)},
+		}
+	})
+	r.RegisterFunc(telemetryPrefix+"app_lookups_total", "Number of cloud controller lookups of apps missing from the app metadata cache.", telemetry.Counter, func() float64 {
+		return float64(n.processor.AppLookupStats().Lookups)
+	})
+	r.RegisterFunc(telemetryPrefix+"app_lookup_errors_total", "Number of failed cloud controller lookups of apps.", telemetry.Counter, func() float64 {
+		return float64(n.processor.AppLookupStats().LookupErrors)
+	})
+	r.Register(telemetryPrefix+"app_lookups_skipped_total", "Number of cache misses not looked up, by reason.", telemetry.Counter, func() []telemetry.Sample {
+		stats := n.processor.AppLookupStats()
+		return []telemetry.Sample{
+			{Labels: []telemetry.Label{{Name: "reason", Value: "coalesced"}}, Value: float64(stats.Coalesced)},
+			{Labels: []telemetry.Label{{Name: "reason", Value: "rate_limited"}}, Value: float64(stats.RateLimited)},
+			{Labels: []telemetry.Label{{Name: "reason", Value: "unknown_app"}}, Value: float64(stats.NegativeHits)},
+		}
+	})
+	r.RegisterFunc(telemetryPrefix+"app_cache_stale", "1 while the app metadata cache only holds the apps loaded from the cache file.", telemetry.Gauge, func() float64 {
+		if !n.processor.AppCacheStale() {
+			return 0
+		}
+		return 1
+	})
+
+	n.telemetry = r
+}
+
+// senderSamples returns a value of each metrics sender, labeled with its endpoint and account
+func (n *Nozzle) senderSamples(value func(s *metricsSender) uint64) []telemetry.Sample {
+	samples := make([]telemetry.Sample, 0, len(n.senders))
+	for _, s := range n.senders {
+		samples = append(samples, telemetry.Sample{
+			Labels: []telemetry.Label{{Name: "endpoint", Value: s.sink.Endpoint()}, {Name: "account", Value: s.sink.Account()}},
+			Value:  float64(value(s)),
+		})
+	}
+	return samples
+}
+
+// countEnvelope records an envelope received from the source
+func (n *Nozzle) countEnvelope(envelope *events.Envelope) {
+	eventType := int(envelope.GetEventType())
+	if eventType >= 0 && eventType < maxEventType {
+		atomic.AddUint64(&n.envelopesReceived[eventType], 1)
+	}
+}
+
+// listenMonitoring opens the listener of the monitoring server if configured, so that a bad address fails the start
+func (n *Nozzle) listenMonitoring() (net.Listener, error) {
+	if n.config.MonitoringAddress == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", n.config.MonitoringAddress)
+}
+
+// startMonitoringServer serves the health of the nozzle on the listener. The handlers read the processor and the
+// envelopes channel without locking, it must only be called once they are set, i.e. when the workers are running.
+func (n *Nozzle) startMonitoringServer(listener net.Listener) {
+	if listener == nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", n.telemetry)
+	mux.HandleFunc("/healthz", n.serveLiveness)
+	mux.HandleFunc("/readyz", n.serveReadiness)
+	n.monitoringServer = &http.Server{Handler: mux}
+	n.log.Infof("Serving the nozzle metrics on %s", listener.Addr())
+
+	go func() {
+		if err := n.monitoringServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			n.log.Errorf("Error serving the nozzle metrics: %v", err)
+		}
+	}()
+}
+
+func (n *Nozzle) stopMonitoringServer(listener net.Listener) {
+	if n.monitoringServer != nil {
+		n.monitoringServer.Close()
+		return
+	}
+	// The nozzle stopped before serving
+	if listener != nil {
+		listener.Close()
+	}
+}
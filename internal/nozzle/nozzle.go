@@ -1,17 +1,25 @@
 package nozzle
 
 import (
-	"crypto/tls"
 	"fmt"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/aggregator"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/datadog"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/event"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/processor"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/processor/parser"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/rewrite"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/route"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/telemetry"
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/noaa/consumer"
@@ -26,20 +34,41 @@ type Nozzle struct {
 	errors                <-chan error
 	messages              <-chan *events.Envelope
 	authTokenFetcher      AuthTokenFetcher
-	consumer              *consumer.Consumer
-	ddClients             []*datadog.Client
+	source                Source
+	senders               []*metricsSender
+	logsClient            *datadog.LogsClient
+	eventsClient          *datadog.EventsClient
 	processor             *processor.Processor
+	metricFilter          *filter.Filter
+	aggregator            *aggregator.Aggregator // used by the processed metrics reader & main thread with mapLock held
 	cfClient              *cfclient.Client
 	processedMetrics      chan []metric.MetricPackage
+	processedLogs         chan logs.Log
+	processedEvents       chan event.Event
 	log                   *gosteno.Logger
 	parseAppMetricsEnable bool
 	stopper               chan bool
 	workersStopper        chan bool
+	logsStopper           chan bool
+	eventsStopper         chan bool
 	mapLock               sync.RWMutex
-	metricsMap            metric.MetricsMap // modified by workers & main thread
-	totalMessagesReceived uint64            // modified by workers, read by main thread
-	slowConsumerAlert     uint64            // modified by workers, read by main thread
-	totalMetricsSent      uint64
+	metricsMap            metric.MetricsMap    // modified by workers & main thread
+	totalMessagesReceived uint64               // modified by workers, read by main thread
+	slowConsumerAlert     uint64               // modified by workers, read by main thread
+	totalMetricsSent      uint64               // modified by main thread, read by the monitoring server
+	envelopesReceived     [maxEventType]uint64 // modified by workers, read by the monitoring server
+	droppedLogs           uint64               // modified by workers, read by main thread
+	totalLogsSent         uint64               // modified by the logs forwarder, read by main thread
+	droppedEvents         uint64               // modified by workers, read by main thread
+	totalEventsSent       uint64               // modified by the events forwarder, read by main thread
+	droppedEnvelopes      uint64               // modified by workers, read by main thread
+	metricsPosted         uint64               // modified by the senders, read by the monitoring server
+	lastEnvelopeProcessed int64                // modified by workers, read by the monitoring server
+	lastMetricsAggregated int64                // modified by the processed metrics reader, read by the monitoring server
+	telemetry             *telemetry.Registry
+	postDuration          *telemetry.SummaryVec
+	postFailures          *telemetry.CounterVec
+	monitoringServer      *http.Server
 }
 
 // AuthTokenFetcher is an interface for fetching an auth token from uaa
@@ -49,16 +78,22 @@ type AuthTokenFetcher interface {
 
 // NewNozzle creates a new nozzle
 func NewNozzle(config *config.Config, tokenFetcher AuthTokenFetcher, log *gosteno.Logger) *Nozzle {
-	return &Nozzle{
+	n := &Nozzle{
 		config:                config,
 		authTokenFetcher:      tokenFetcher,
 		metricsMap:            make(metric.MetricsMap),
 		processedMetrics:      make(chan []metric.MetricPackage, 1000),
+		processedLogs:         make(chan logs.Log, config.LogsBufferSize),
+		processedEvents:       make(chan event.Event, eventsBufferSize),
 		log:                   log,
 		parseAppMetricsEnable: config.AppMetrics,
 		stopper:               make(chan bool),
 		workersStopper:        make(chan bool),
+		logsStopper:           make(chan bool),
+		eventsStopper:         make(chan bool),
 	}
+	n.registerTelemetry()
+	return n
 }
 
 // Start starts the nozzle
@@ -69,6 +104,9 @@ func (n *Nozzle) Start() error {
 	var authToken string
 	if !n.config.DisableAccessControl {
 		authToken = n.authTokenFetcher.FetchAuthToken()
+		if authToken == "" {
+			return fmt.Errorf("could not get an oauth token from the UAA")
+		}
 	}
 
 	// Fetch Custom Tags
@@ -78,29 +116,75 @@ func (n *Nozzle) Start() error {
 
 	n.log.Info("Starting DataDog Firehose Nozzle...")
 
-	// Initialize Datadog client instances
-	var err error
-	n.ddClients, err = datadog.NewClients(n.config, n.log)
+	// Compile the metric filters
+	metricFilter, err := filter.New(n.config.MetricFilters)
+	if err != nil {
+		return err
+	}
+	n.metricFilter = metricFilter
+
+	// Compile the metric aggregation rules
+	n.aggregator, err = aggregator.New(n.config.MetricAggregations)
+	if err != nil {
+		return err
+	}
+
+	// Compile the metric rewrite rules
+	rewriter, err := rewrite.New(n.config.MetricRewrites)
+	if err != nil {
+		return err
+	}
+
+	metadataTagger, err := parser.NewMetadataTagger(n.config.MetadataTags)
 	if err != nil {
 		return err
 	}
 
+	// Compile the routes of the additional endpoints
+	router, err := route.New(n.config.MetricRoutes)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the Datadog clients and the other sinks, each posting from its own sender
+	sinks, err := NewSinks(n.config, n.log)
+	if err != nil {
+		return err
+	}
+	n.startSenders(sinks, router)
+
+	// Listen for the requests of the monitoring server, they are served once the workers are running
+	monitoringListener, err := n.listenMonitoring()
+	if err != nil {
+		return err
+	}
+	defer n.stopMonitoringServer(monitoringListener)
+
+	// Initialize Datadog logs client instance
+	if n.config.LogsEnabled {
+		n.logsClient = datadog.NewLogsClientFromConfig(n.config, n.log)
+	}
+
+	// Initialize Datadog events client instance
+	if n.config.EventsEnabled {
+		n.eventsClient = datadog.NewEventsClientFromConfig(n.config, n.log)
+	}
+
 	// Initialize Cloud Foundry client instance
 	n.cfClient, err = cloudfoundry.NewClient(n.config, n.log)
 
 	// Initialize Firehose processor
 	n.processor, n.parseAppMetricsEnable = processor.NewProcessor(
 		n.processedMetrics,
-		n.config.CustomTags,
-		n.config.EnvironmentName,
+		n.config,
 		n.parseAppMetricsEnable,
 		n.cfClient,
-		n.config.NumCacheWorkers,
-		n.config.GrabInterval,
+		rewriter,
+		metadataTagger,
 		n.log)
 
-	// Initialize the firehose consumer (with retry enable)
-	err = n.startFirehoseConsumer(authToken)
+	// Initialize the envelopes source (with retry enable)
+	err = n.startSource(authToken)
 	if err != nil {
 		return err
 	}
@@ -108,6 +192,14 @@ func (n *Nozzle) Start() error {
 	// Start multiple workers to parallelize firehose events (event.envelope) transformation into processedMetrics
 	// and then grouped into metricsMap
 	n.startWorkers()
+	if n.config.LogsEnabled {
+		n.startLogsForwarder()
+	}
+	if n.config.EventsEnabled {
+		n.startEventsForwarder()
+	}
+	// Expose the nozzle metrics
+	n.startMonitoringServer(monitoringListener)
 
 	// Execute infinite loop.
 	// This method is blocking until we get error or a stop signal
@@ -115,27 +207,35 @@ func (n *Nozzle) Start() error {
 
 	// Whenever a stop signal is received the Run methode above will return. The code below will then be executed
 	n.log.Info("DataDog Firehose Nozzle shutting down...")
-	// Close Firehose Consumer
-	n.log.Infof("Closing connection with traffic controller due to %v", err)
-	n.consumer.Close()
+	// Close the envelopes source
+	n.log.Infof("Closing connection with the envelopes source due to %v", err)
+	n.source.Close()
 	// Stop processor
 	n.stopWorkers()
+	// Submit logs left in the batch if any
+	if n.config.LogsEnabled {
+		n.stopLogsForwarder()
+	}
+	if n.config.EventsEnabled {
+		n.stopEventsForwarder()
+	}
 	// Submit metrics left in cache if any
 	n.postMetrics()
+	n.stopSenders()
 
 	return err
 }
 
-func (n *Nozzle) startFirehoseConsumer(authToken string) error {
+func (n *Nozzle) startSource(authToken string) error {
 	var err error
-	// Initialize the firehose consumer (with retry enable)
-	n.consumer, err = n.newFirehoseConsumer(authToken)
+	// Initialize the source of envelopes picked by the configuration (with retry enable)
+	n.source, err = NewSource(n.config, n.cfClient, n.authTokenFetcher, n.log)
 	if err != nil {
 		return err
 	}
-	// Run the Firehose consumer
-	// It consumes messages from the Firehose and push them to n.messages
-	n.messages, n.errors = n.consumer.FilteredFirehose(n.config.FirehoseSubscriptionID, authToken, consumer.Metrics)
+	// Run the source
+	// It consumes messages from the Firehose or the RLP gateway and push them to n.messages
+	n.messages, n.errors = n.source.Start(authToken)
 	return nil
 }
 
@@ -166,28 +266,6 @@ func (n *Nozzle) run() error {
 	}
 }
 
-func (n *Nozzle) newFirehoseConsumer(authToken string) (*consumer.Consumer, error) {
-	if n.config.TrafficControllerURL == "" {
-		if n.cfClient != nil {
-			n.config.TrafficControllerURL = n.cfClient.Endpoint.DopplerEndpoint
-		} else {
-			return nil, fmt.Errorf("either the TrafficController URL or the CC URL needs to be set")
-		}
-	}
-
-	c := consumer.New(
-		n.config.TrafficControllerURL,
-		&tls.Config{InsecureSkipVerify: n.config.InsecureSSLSkipVerify},
-		nil)
-	c.SetIdleTimeout(time.Duration(n.config.IdleTimeoutSeconds) * time.Second)
-	// retry settings
-	c.SetMaxRetryCount(5)
-	c.SetMinRetryDelay(500 * time.Millisecond)
-	c.SetMaxRetryDelay(time.Minute)
-
-	return c, nil
-}
-
 // Stop stops the Nozzle
 func (n *Nozzle) Stop() {
 	// We only push value to the `stopper` channel of the Nozzle.
@@ -197,36 +275,88 @@ func (n *Nozzle) Stop() {
 
 // PostMetrics posts metrics do to datadog
 func (n *Nozzle) postMetrics() {
+	timestamp := time.Now().Unix()
+
 	n.mapLock.Lock()
+	if n.config.HTTPMetricsEnabled {
+		for _, m := range n.processor.FlushHTTPMetrics(timestamp) {
+			n.metricsMap.Add(*m.MetricKey, *m.MetricValue)
+		}
+	}
 	// deep copy the metrics map to pass to PostMetrics so that we can unlock n.metricsMap while posting
 	metricsMap := make(metric.MetricsMap)
 	for k, v := range n.metricsMap {
 		metricsMap[k] = v
 	}
 	totalMessagesReceived := n.totalMessagesReceived
+	appLookupStats := n.processor.AppLookupStats()
 	// Reset the map
 	n.metricsMap = make(metric.MetricsMap)
+	n.aggregator.Reset()
 	n.mapLock.Unlock()
 
-	timestamp := time.Now().Unix()
-	for _, client := range n.ddClients {
+	// The internal metrics of the main endpoint are counted as sent too
+	sent := len(metricsMap)
+	for i, sender := range n.senders {
+		sink := sender.sink
+		// Each sender gets its own copy of the metrics of its route, with its own internal metrics
+		sinkMetrics := sender.route.Select(metricsMap)
+
 		// Add internal metrics
-		k, v := client.MakeInternalMetric("totalMessagesReceived", totalMessagesReceived, timestamp)
-		metricsMap[k] = v
-		k, v = client.MakeInternalMetric("totalMetricsSent", n.totalMetricsSent, timestamp)
-		metricsMap[k] = v
-		k, v = client.MakeInternalMetric("slowConsumerAlert", atomic.LoadUint64(&n.slowConsumerAlert), timestamp)
-		metricsMap[k] = v
+		k, v := sink.MakeInternalMetric("totalMessagesReceived", totalMessagesReceived, timestamp)
+		sinkMetrics[k] = v
+		k, v = sink.MakeInternalMetric("totalMetricsSent", atomic.LoadUint64(&n.totalMetricsSent), timestamp)
+		sinkMetrics[k] = v
+		k, v = sink.MakeInternalMetric("slowConsumerAlert", atomic.LoadUint64(&n.slowConsumerAlert), timestamp)
+		sinkMetrics[k] = v
+		if n.config.LogsEnabled {
+			k, v = sink.MakeInternalMetric("totalLogsSent", atomic.LoadUint64(&n.totalLogsSent), timestamp)
+			sinkMetrics[k] = v
+			k, v = sink.MakeInternalMetric("logsDropped", atomic.LoadUint64(&n.droppedLogs), timestamp)
+			sinkMetrics[k] = v
+		}
+		if n.config.EventsEnabled {
+			k, v = sink.MakeInternalMetric("totalEventsSent", atomic.LoadUint64(&n.totalEventsSent), timestamp)
+			sinkMetrics[k] = v
+			k, v = sink.MakeInternalMetric("eventsDropped", atomic.LoadUint64(&n.droppedEvents), timestamp)
+			sinkMetrics[k] = v
+		}
+		if n.parseAppMetricsEnable {
+			for name, value := range map[string]uint64{
+				"appCacheHits":          appLookupStats.Hits,
+				"appCacheMisses":        appLookupStats.Misses,
+				"appLookups":            appLookupStats.Lookups,
+				"appLookupErrors":       appLookupStats.LookupErrors,
+				"appLookupsCoalesced":   appLookupStats.Coalesced,
+				"appLookupsRateLimited": appLookupStats.RateLimited,
+				"appLookupsUnknownApp":  appLookupStats.NegativeHits,
+			} {
+				k, v = sink.MakeInternalMetric(name, value, timestamp)
+				sinkMetrics[k] = v
+			}
+		}
+		if n.metricFilter.Enabled() {
+			k, v = sink.MakeInternalMetric("envelopesDropped", atomic.LoadUint64(&n.droppedEnvelopes), timestamp)
+			sinkMetrics[k] = v
+		}
+		if spooled, ok := sink.(spooledSink); ok && spooled.HasSpool() {
+			k, v = sink.MakeInternalMetric("spoolDepth", spooled.SpoolDepth(), timestamp)
+			sinkMetrics[k] = v
+			k, v = sink.MakeInternalMetric("spoolDroppedBytes", spooled.SpoolDroppedBytes(), timestamp)
+			sinkMetrics[k] = v
+		}
+		k, v = sink.MakeInternalMetric("sendQueueLength", sender.queueLength(), timestamp)
+		sinkMetrics[k] = v
+		k, v = sink.MakeInternalMetric("sendQueueDropped", sender.droppedFlushes(), timestamp)
+		sinkMetrics[k] = v
 
-		err := client.PostMetrics(metricsMap)
-		// NOTE: We don't need to have a retry logic since we don't return error on failure.
-		// However, current metrics may be lost.
-		if err != nil {
-			n.log.Errorf("Error posting metrics: %s\n\n", err)
+		if i == 0 {
+			sent = len(sinkMetrics)
 		}
+		sender.enqueue(sinkMetrics)
 	}
 
-	n.totalMetricsSent += uint64(len(metricsMap))
+	atomic.AddUint64(&n.totalMetricsSent, uint64(sent))
 	n.ResetSlowConsumerError()
 }
 
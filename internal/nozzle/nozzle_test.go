@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -17,6 +21,7 @@ import (
 
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/datadog"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/uaatokenfetcher"
 	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
@@ -71,7 +76,10 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 				AppMetrics:           false,
 				NumWorkers:           1,
 			}
+		})
 
+		// Started once the nested contexts are done editing the configuration
+		JustBeforeEach(func() {
 			tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
 			nozzle = NewNozzle(configuration, tokenFetcher, log)
 			go nozzle.Start()
@@ -108,7 +116,7 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			var payload datadog.Payload
 			err := json.Unmarshal(helper.Decompress(contents), &payload)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(payload.Series).To(HaveLen(23)) // +3 is because of the internal metrics
+			Expect(payload.Series).To(HaveLen(25)) // +5 is because of the internal metrics
 		}, 2)
 
 		It("gets a valid authentication token", func() {
@@ -139,7 +147,7 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			var payload datadog.Payload
 			err := json.Unmarshal(helper.Decompress(contents), &payload)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(payload.Series).To(HaveLen(23))
+			Expect(payload.Series).To(HaveLen(25))
 
 			validateMetrics(payload, 10, 0)
 
@@ -147,9 +155,9 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			Eventually(fakeDatadogAPI.ReceivedContents, 15*time.Second, time.Second).Should(Receive(&contents))
 			err = json.Unmarshal(helper.Decompress(contents), &payload)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(payload.Series).To(HaveLen(3)) // only internal metrics
+			Expect(payload.Series).To(HaveLen(5)) // only internal metrics
 
-			validateMetrics(payload, 10, 23)
+			validateMetrics(payload, 10, 25)
 		}, 3)
 
 		It("reports a slow-consumer error when the server disconnects abnormally", func() {
@@ -318,6 +326,311 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 				Consistently(rxContents, 5*time.Second, time.Second).ShouldNot(Receive())
 			})
 		})
+
+		Context("with metric filters", func() {
+			BeforeEach(func() {
+				configuration.MetricFilters = config.MetricFilters{
+					Deny: []config.MetricFilterRule{{Name: "debug.*"}},
+				}
+			})
+
+			It("drops the denied metrics and reports them", func() {
+				for _, name := range []string{"requests", "debug.heap"} {
+					fakeFirehose.AddEvent(events.Envelope{
+						Origin:    proto.String("origin"),
+						Timestamp: proto.Int64(1000000000),
+						EventType: events.Envelope_ValueMetric.Enum(),
+						ValueMetric: &events.ValueMetric{
+							Name:  proto.String(name),
+							Value: proto.Float64(1),
+							Unit:  proto.String("gauge"),
+						},
+						Deployment: proto.String("deployment-name"),
+						Job:        proto.String("doppler"),
+					})
+				}
+
+				values := map[string]float64{}
+				Eventually(func() float64 {
+					var contents []byte
+					Eventually(fakeDatadogAPI.ReceivedContents, 15*time.Second, time.Second).Should(Receive(&contents))
+
+					var payload datadog.Payload
+					err := json.Unmarshal(helper.Decompress(contents), &payload)
+					Expect(err).ToNot(HaveOccurred())
+					for _, series := range payload.Series {
+						values[series.Metric] = series.Points[0].Value
+					}
+					return values["datadog.nozzle.envelopesDropped"]
+				}, 10*time.Second).Should(Equal(float64(1)))
+
+				Expect(values).To(HaveKey("datadog.nozzle.requests"))
+				Expect(values).ToNot(HaveKey("datadog.nozzle.debug.heap"))
+				Expect(values).ToNot(HaveKey("datadog.nozzle.origin.debug.heap"))
+				Expect(values).To(HaveKeyWithValue("datadog.nozzle.envelopesDropped", float64(1)))
+			})
+		})
+	})
+
+	Context("with logs enabled", func() {
+		var fakeLogsIntake *helper.FakeDatadogAPI
+
+		BeforeEach(func() {
+			fakeUAA = helper.NewFakeUAA("bearer", "123456789")
+			fakeToken := fakeUAA.AuthToken()
+			fakeFirehose = helper.NewFakeFirehose(fakeToken)
+			fakeDatadogAPI = helper.NewFakeDatadogAPI()
+			fakeLogsIntake = helper.NewFakeDatadogAPI()
+			fakeUAA.Start()
+			fakeFirehose.Start()
+			fakeDatadogAPI.Start()
+			fakeLogsIntake.Start()
+
+			configuration = &config.Config{
+				UAAURL:                   fakeUAA.URL(),
+				FlushDurationSeconds:     2,
+				FlushMaxBytes:            10240,
+				DataDogURL:               fakeDatadogAPI.URL(),
+				DataDogAPIKey:            "1234567890",
+				TrafficControllerURL:     strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
+				DisableAccessControl:     false,
+				WorkerTimeoutSeconds:     10,
+				MetricPrefix:             "datadog.nozzle.",
+				Deployment:               "nozzle-deployment",
+				AppMetrics:               false,
+				NumWorkers:               1,
+				LogsEnabled:              true,
+				DataDogLogsURL:           fakeLogsIntake.URL(),
+				LogsFlushDurationSeconds: 1,
+				LogsFlushMaxBytes:        10240,
+				LogsBufferSize:           100,
+			}
+
+			tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
+			nozzle = NewNozzle(configuration, tokenFetcher, log)
+			go nozzle.Start()
+			time.Sleep(time.Second)
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			fakeUAA.Close()
+			fakeFirehose.Close()
+			fakeDatadogAPI.Close()
+			fakeLogsIntake.Close()
+		})
+
+		It("forwards log messages to the logs intake", func() {
+			fakeFirehose.AddEvent(events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{
+					Message:     []byte("log message"),
+					MessageType: events.LogMessage_OUT.Enum(),
+					Timestamp:   proto.Int64(1000000000),
+					AppId:       proto.String("app-id"),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("diego-cell"),
+			})
+
+			var contents []byte
+			Eventually(fakeLogsIntake.ReceivedContents, 5*time.Second, 100*time.Millisecond).Should(Receive(&contents))
+
+			var payload []logs.Log
+			err := json.Unmarshal(helper.DecompressGzip(contents), &payload)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(payload).To(HaveLen(1))
+			Expect(payload[0].Message).To(Equal("log message"))
+			Expect(payload[0].Tags).To(ContainSubstring("app_id:app-id"))
+
+			Eventually(fakeDatadogAPI.ReceivedContents, 15*time.Second, time.Second).Should(Receive(&contents))
+			var metricsPayload datadog.Payload
+			err = json.Unmarshal(helper.Decompress(contents), &metricsPayload)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metricsPayload.Series).To(HaveLen(7)) // internal metrics only, including the logs ones
+		}, 2)
+	})
+
+	Context("with the monitoring server", func() {
+		// Every spec listens on its own port, the server of the previous spec may not be closed yet
+		var monitoringAddress string
+		monitoringPort := 19090
+
+		BeforeEach(func() {
+			monitoringPort++
+			monitoringAddress = fmt.Sprintf("127.0.0.1:%d", monitoringPort)
+			fakeUAA = helper.NewFakeUAA("bearer", "123456789")
+			fakeToken := fakeUAA.AuthToken()
+			fakeFirehose = helper.NewFakeFirehose(fakeToken)
+			fakeDatadogAPI = helper.NewFakeDatadogAPI()
+			fakeUAA.Start()
+			fakeFirehose.Start()
+			fakeDatadogAPI.Start()
+
+			configuration = &config.Config{
+				UAAURL:               fakeUAA.URL(),
+				FlushDurationSeconds: 1,
+				FlushMaxBytes:        10240,
+				DataDogURL:           fakeDatadogAPI.URL(),
+				DataDogAPIKey:        "1234567890",
+				TrafficControllerURL: strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
+				WorkerTimeoutSeconds: 10,
+				MetricPrefix:         "datadog.nozzle.",
+				Deployment:           "nozzle-deployment",
+				AppMetrics:           false,
+				NumWorkers:           1,
+				MonitoringAddress:    monitoringAddress,
+			}
+
+			tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
+			nozzle = NewNozzle(configuration, tokenFetcher, log)
+			go nozzle.Start()
+			time.Sleep(time.Second)
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			fakeUAA.Close()
+			fakeFirehose.Close()
+			fakeDatadogAPI.Close()
+		})
+
+		It("exposes the nozzle metrics in the Prometheus format", func() {
+			for i := 0; i < 5; i++ {
+				fakeFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String("metricName"),
+						Value: proto.Float64(float64(i)),
+						Unit:  proto.String("gauge"),
+					},
+				})
+			}
+			Eventually(fakeDatadogAPI.ReceivedContents, 5*time.Second).Should(Receive())
+
+			scrape := func() string {
+				resp, err := http.Get("http://" + monitoringAddress + "/metrics")
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				return string(body)
+			}
+
+			Eventually(scrape).Should(ContainSubstring(`datadog_firehose_nozzle_envelopes_received_total{event_type="ValueMetric"} 5`))
+			metrics := scrape()
+			Expect(metrics).To(ContainSubstring("datadog_firehose_nozzle_messages_received_total 5"))
+			Expect(metrics).To(MatchRegexp(`datadog_firehose_nozzle_metrics_sent_total \d+`))
+			Expect(metrics).To(ContainSubstring("datadog_firehose_nozzle_slow_consumer_alert 0"))
+			Expect(metrics).To(ContainSubstring("datadog_firehose_nozzle_messages_queue_length 0"))
+			Expect(metrics).To(ContainSubstring("datadog_firehose_nozzle_processed_metrics_queue_length 0"))
+			Expect(metrics).To(ContainSubstring(fmt.Sprintf(`datadog_firehose_nozzle_post_duration_seconds_count{endpoint="%s",account="7890"}`, fakeDatadogAPI.URL())))
+			Expect(metrics).To(ContainSubstring("# TYPE datadog_firehose_nozzle_post_failures_total counter"))
+			Expect(metrics).To(ContainSubstring("datadog_firehose_nozzle_app_cache_size 0"))
+			Expect(metrics).To(ContainSubstring("datadog_firehose_nozzle_app_cache_warmup_duration_seconds 0"))
+		})
+
+		It("serves the liveness and readiness probes", func() {
+			get := func(path string) func() int {
+				return func() int {
+					resp, err := http.Get("http://" + monitoringAddress + path)
+					Expect(err).ToNot(HaveOccurred())
+					resp.Body.Close()
+					return resp.StatusCode
+				}
+			}
+
+			Expect(get("/healthz")()).To(Equal(http.StatusOK))
+			Eventually(fakeDatadogAPI.ReceivedContents, 5*time.Second).Should(Receive())
+			Eventually(get("/readyz")).Should(Equal(http.StatusOK))
+		})
+	})
+
+	Context("with the RLP gateway source", func() {
+		var fakeRLPGateway *helper.FakeRLPGateway
+
+		BeforeEach(func() {
+			fakeUAA = helper.NewFakeUAA("bearer", "123456789")
+			fakeToken := fakeUAA.AuthToken()
+			fakeRLPGateway = helper.NewFakeRLPGateway(fakeToken)
+			fakeDatadogAPI = helper.NewFakeDatadogAPI()
+			fakeUAA.Start()
+			fakeRLPGateway.Start()
+			fakeDatadogAPI.Start()
+
+			configuration = &config.Config{
+				UAAURL:                 fakeUAA.URL(),
+				FlushDurationSeconds:   2,
+				FlushMaxBytes:          10240,
+				DataDogURL:             fakeDatadogAPI.URL(),
+				DataDogAPIKey:          "1234567890",
+				SourceType:             "rlp_gateway",
+				RLPGatewayURL:          fakeRLPGateway.URL(),
+				FirehoseSubscriptionID: "datadog-nozzle",
+				IdleTimeoutSeconds:     60,
+				WorkerTimeoutSeconds:   10,
+				MetricPrefix:           "datadog.nozzle.",
+				Deployment:             "nozzle-deployment",
+				AppMetrics:             false,
+				NumWorkers:             1,
+			}
+
+			tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
+			nozzle = NewNozzle(configuration, tokenFetcher, log)
+			go nozzle.Start()
+			time.Sleep(time.Second)
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			fakeUAA.Close()
+			fakeRLPGateway.Close()
+			fakeDatadogAPI.Close()
+		})
+
+		It("subscribes to the metric envelopes with a valid authentication token", func() {
+			Eventually(fakeRLPGateway.Requests).Should(Equal(1))
+			Expect(fakeRLPGateway.LastAuthorization()).To(Equal("bearer 123456789"))
+
+			query := fakeRLPGateway.LastQuery()
+			Expect(query.Get("shard_id")).To(Equal("datadog-nozzle"))
+			Expect(query).To(HaveKey("gauge"))
+			Expect(query).To(HaveKey("counter"))
+			Expect(query).ToNot(HaveKey("log"))
+			Expect(query).ToNot(HaveKey("timer"))
+			Expect(query).ToNot(HaveKey("event"))
+		})
+
+		It("receives v2 envelopes and turns them into metrics", func() {
+			Eventually(fakeRLPGateway.Requests).Should(Equal(1))
+			fakeRLPGateway.AddBatch(`{"batch":[
+				{"timestamp":"1000000000","sourceId":"doppler","tags":{"deployment":"cf","job":"doppler","index":"0"},
+				 "gauge":{"metrics":{"metricA":{"unit":"ms","value":1},"metricB":{"unit":"ms","value":2}}}},
+				{"timestamp":"1000000000","sourceId":"doppler","tags":{"deployment":"cf","job":"doppler","index":"0"},
+				 "counter":{"name":"requests","delta":"2","total":"10"}}
+			]}`)
+
+			var payload datadog.Payload
+			Eventually(func() int {
+				var contents []byte
+				Eventually(fakeDatadogAPI.ReceivedContents, 15*time.Second, time.Second).Should(Receive(&contents))
+				err := json.Unmarshal(helper.Decompress(contents), &payload)
+				Expect(err).ToNot(HaveOccurred())
+				return len(payload.Series)
+			}, 15*time.Second).Should(Equal(11)) // +5 is because of the internal metrics
+
+			names := []string{}
+			for _, series := range payload.Series {
+				names = append(names, series.Metric)
+			}
+			Expect(names).To(ContainElement("datadog.nozzle.metricA"))
+			Expect(names).To(ContainElement("datadog.nozzle.doppler.metricB"))
+			Expect(names).To(ContainElement("datadog.nozzle.requests"))
+		}, 2)
 	})
 
 	Context("when the DisableAccessControl is set to true", func() {
@@ -372,6 +685,232 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 		})
 	})
 
+	Context("with a slow additional endpoint", func() {
+		var slowDatadogAPI *helper.FakeDatadogAPI
+
+		BeforeEach(func() {
+			fakeUAA = helper.NewFakeUAA("bearer", "123456789")
+			fakeToken := fakeUAA.AuthToken()
+			fakeFirehose = helper.NewFakeFirehose(fakeToken)
+			fakeDatadogAPI = helper.NewFakeDatadogAPI()
+			slowDatadogAPI = helper.NewFakeDatadogAPI()
+			slowDatadogAPI.RequestTime = 6 * time.Second
+			fakeUAA.Start()
+			fakeFirehose.Start()
+			fakeDatadogAPI.Start()
+			slowDatadogAPI.Start()
+
+			configuration = &config.Config{
+				UAAURL:                     fakeUAA.URL(),
+				FlushDurationSeconds:       1,
+				FlushMaxBytes:              10240,
+				DataDogURL:                 fakeDatadogAPI.URL(),
+				DataDogAPIKey:              "1234567890",
+				DataDogAdditionalEndpoints: map[string][]string{slowDatadogAPI.URL(): {"0987654321"}},
+				DataDogTimeoutSeconds:      10,
+				TrafficControllerURL:       strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
+				WorkerTimeoutSeconds:       1,
+				MetricPrefix:               "datadog.nozzle.",
+				Deployment:                 "nozzle-deployment",
+				NumWorkers:                 1,
+				SendQueueSize:              1,
+			}
+
+			tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
+			nozzle = NewNozzle(configuration, tokenFetcher, log)
+			go nozzle.Start()
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			fakeUAA.Close()
+			fakeFirehose.Close()
+			fakeDatadogAPI.Close()
+			slowDatadogAPI.Close()
+		})
+
+		It("keeps posting to the other endpoints", func() {
+			for i := 0; i < 3; i++ {
+				Eventually(fakeDatadogAPI.ReceivedContents, 3*time.Second).Should(Receive())
+			}
+			Expect(slowDatadogAPI.ReceivedContents).NotTo(Receive())
+		}, 5)
+
+		It("drops the oldest flushes of the slow endpoint", func() {
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedContents, 3*time.Second).Should(Receive(&contents))
+			var payload datadog.Payload
+			Expect(json.Unmarshal(helper.Decompress(contents), &payload)).To(Succeed())
+			Expect(payload.Series).To(ContainElement(WithTransform(func(s metric.Series) string { return s.Metric }, Equal("datadog.nozzle.sendQueueDropped"))))
+
+			Eventually(func() uint64 {
+				return nozzle.senders[1].droppedFlushes()
+			}, 5*time.Second).Should(BeNumerically(">", 0))
+			Expect(nozzle.senders[0].droppedFlushes()).To(BeZero())
+		}, 7)
+	})
+
+	Context("with a routed additional endpoint", func() {
+		var tenantDatadogAPI *helper.FakeDatadogAPI
+
+		BeforeEach(func() {
+			fakeUAA = helper.NewFakeUAA("bearer", "123456789")
+			fakeToken := fakeUAA.AuthToken()
+			fakeFirehose = helper.NewFakeFirehose(fakeToken)
+			fakeDatadogAPI = helper.NewFakeDatadogAPI()
+			tenantDatadogAPI = helper.NewFakeDatadogAPI()
+			fakeUAA.Start()
+			fakeFirehose.Start()
+			fakeDatadogAPI.Start()
+			tenantDatadogAPI.Start()
+
+			configuration = &config.Config{
+				UAAURL:                     fakeUAA.URL(),
+				FlushDurationSeconds:       2,
+				FlushMaxBytes:              10240,
+				DataDogURL:                 fakeDatadogAPI.URL(),
+				DataDogAPIKey:              "1234567890",
+				DataDogAdditionalEndpoints: map[string][]string{tenantDatadogAPI.URL(): {"0987654321"}},
+				MetricRoutes: config.MetricRoutes{
+					Endpoints: []config.EndpointRoute{{
+						Endpoint: tenantDatadogAPI.URL(),
+						Rules:    []config.MetricRouteRule{{Deployment: "tenant-*"}},
+					}},
+				},
+				TrafficControllerURL: strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
+				WorkerTimeoutSeconds: 10,
+				MetricPrefix:         "datadog.nozzle.",
+				Deployment:           "nozzle-deployment",
+				NumWorkers:           1,
+			}
+
+			tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
+			nozzle = NewNozzle(configuration, tokenFetcher, log)
+			go nozzle.Start()
+			time.Sleep(time.Second)
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			fakeUAA.Close()
+			fakeFirehose.Close()
+			fakeDatadogAPI.Close()
+			tenantDatadogAPI.Close()
+		})
+
+		It("posts only the metrics of its route, and the internal metrics", func() {
+			for i, deployment := range []string{"cf", "tenant-mysql"} {
+				envelope := events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
+						Value: proto.Float64(float64(i)),
+						Unit:  proto.String("gauge"),
+					},
+					Deployment: proto.String(deployment),
+					Job:        proto.String("doppler"),
+				}
+				fakeFirehose.AddEvent(envelope)
+			}
+
+			metricNames := func(api *helper.FakeDatadogAPI) []string {
+				var contents []byte
+				Eventually(api.ReceivedContents, 15*time.Second, time.Second).Should(Receive(&contents))
+				var payload datadog.Payload
+				Expect(json.Unmarshal(helper.Decompress(contents), &payload)).To(Succeed())
+				var names []string
+				for _, series := range payload.Series {
+					names = append(names, series.Metric)
+				}
+				return names
+			}
+
+			mainNames := metricNames(fakeDatadogAPI)
+			Expect(mainNames).To(ContainElement("datadog.nozzle.origin.metricName-0"))
+			Expect(mainNames).To(ContainElement("datadog.nozzle.origin.metricName-1"))
+
+			tenantNames := metricNames(tenantDatadogAPI)
+			Expect(tenantNames).NotTo(ContainElement("datadog.nozzle.origin.metricName-0"))
+			Expect(tenantNames).To(ContainElement("datadog.nozzle.origin.metricName-1"))
+			Expect(tenantNames).To(ContainElement("datadog.nozzle.totalMetricsSent"))
+		}, 2)
+	})
+
+	Context("with a jsonlines sink", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "sinks")
+			Expect(err).ToNot(HaveOccurred())
+
+			fakeUAA = helper.NewFakeUAA("bearer", "123456789")
+			fakeToken := fakeUAA.AuthToken()
+			fakeFirehose = helper.NewFakeFirehose(fakeToken)
+			fakeDatadogAPI = helper.NewFakeDatadogAPI()
+			fakeUAA.Start()
+			fakeFirehose.Start()
+			fakeDatadogAPI.Start()
+
+			configuration = &config.Config{
+				UAAURL:               fakeUAA.URL(),
+				FlushDurationSeconds: 2,
+				FlushMaxBytes:        10240,
+				DataDogURL:           fakeDatadogAPI.URL(),
+				DataDogAPIKey:        "1234567890",
+				Sinks:                []config.Sink{{Type: config.SinkJSONLines, Path: filepath.Join(dir, "metrics.jsonl")}},
+				TrafficControllerURL: strings.Replace(fakeFirehose.URL(), "http:", "ws:", 1),
+				WorkerTimeoutSeconds: 10,
+				MetricPrefix:         "datadog.nozzle.",
+				Deployment:           "nozzle-deployment",
+				NumWorkers:           1,
+			}
+
+			tokenFetcher := uaatokenfetcher.New(fakeUAA.URL(), "un", "pwd", true, log)
+			nozzle = NewNozzle(configuration, tokenFetcher, log)
+			go nozzle.Start()
+			time.Sleep(time.Second)
+		})
+
+		AfterEach(func() {
+			nozzle.Stop()
+			fakeUAA.Close()
+			fakeFirehose.Close()
+			fakeDatadogAPI.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("sends the metrics to Datadog and to the sink", func() {
+			fakeFirehose.AddEvent(events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+					Unit:  proto.String("gauge"),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			})
+
+			var contents []byte
+			Eventually(fakeDatadogAPI.ReceivedContents, 15*time.Second, time.Second).Should(Receive(&contents))
+			var payload datadog.Payload
+			Expect(json.Unmarshal(helper.Decompress(contents), &payload)).To(Succeed())
+			Expect(payload.Series).To(ContainElement(WithTransform(func(s metric.Series) string { return s.Metric }, Equal("datadog.nozzle.origin.metricName"))))
+
+			sinkContents := func() string {
+				data, _ := ioutil.ReadFile(filepath.Join(dir, "metrics.jsonl"))
+				return string(data)
+			}
+			Eventually(sinkContents, 5*time.Second).Should(ContainSubstring(`"metric":"datadog.nozzle.origin.metricName"`))
+			Expect(sinkContents()).To(ContainSubstring(`"metric":"datadog.nozzle.totalMetricsSent"`))
+		}, 2)
+	})
+
 	Context("when workers timeout", func() {
 		BeforeEach(func() {
 			fakeUAA = helper.NewFakeUAA("bearer", "123456789")
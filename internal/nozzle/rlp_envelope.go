@@ -0,0 +1,234 @@
+package nozzle
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// The gauge values making a v2 gauge a container metric
+var containerMetricNames = []string{"cpu", "memory", "disk", "memory_quota", "disk_quota"}
+
+// The tags mapped to the fields of the v1 envelopes
+var envelopeTagNames = []string{"origin", "deployment", "job", "index", "ip"}
+
+// rlpEnvelope is the JSON encoding of a loggregator v2 envelope
+type rlpEnvelope struct {
+	Timestamp  jsonInt64         `json:"timestamp"`
+	SourceID   string            `json:"sourceId"`
+	InstanceID string            `json:"instanceId"`
+	Tags       map[string]string `json:"tags"`
+	Log        *rlpLog           `json:"log"`
+	Counter    *rlpCounter       `json:"counter"`
+	Gauge      *rlpGauge         `json:"gauge"`
+	Timer      *rlpTimer         `json:"timer"`
+	Event      *rlpEvent         `json:"event"`
+}
+
+type rlpLog struct {
+	Payload []byte `json:"payload"`
+	Type    string `json:"type"`
+}
+
+type rlpCounter struct {
+	Name  string    `json:"name"`
+	Delta jsonInt64 `json:"delta"`
+	Total jsonInt64 `json:"total"`
+}
+
+type rlpGauge struct {
+	Metrics map[string]rlpGaugeValue `json:"metrics"`
+}
+
+type rlpGaugeValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+type rlpTimer struct {
+	Name  string    `json:"name"`
+	Start jsonInt64 `json:"start"`
+	Stop  jsonInt64 `json:"stop"`
+}
+
+type rlpEvent struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// jsonInt64 decodes the 64 bits integers that protobuf encodes as JSON strings
+type jsonInt64 int64
+
+func (i *jsonInt64) UnmarshalJSON(in []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(in), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = jsonInt64(value)
+	return nil
+}
+
+// toV1 converts a v2 envelope to the v1 envelopes the processor understands, following the loggregator conversion rules.
+// A gauge with several values that isn't a container metric gives one ValueMetric envelope per value.
+func (e rlpEnvelope) toV1() []*events.Envelope {
+	switch {
+	case e.Gauge != nil && e.isContainerMetric():
+		envelope := e.base(events.Envelope_ContainerMetric)
+		envelope.ContainerMetric = &events.ContainerMetric{
+			ApplicationId:    proto.String(e.SourceID),
+			InstanceIndex:    proto.Int32(int32(e.instanceIndex())),
+			CpuPercentage:    proto.Float64(e.Gauge.Metrics["cpu"].Value),
+			MemoryBytes:      proto.Uint64(uint64(e.Gauge.Metrics["memory"].Value)),
+			DiskBytes:        proto.Uint64(uint64(e.Gauge.Metrics["disk"].Value)),
+			MemoryBytesQuota: proto.Uint64(uint64(e.Gauge.Metrics["memory_quota"].Value)),
+			DiskBytesQuota:   proto.Uint64(uint64(e.Gauge.Metrics["disk_quota"].Value)),
+		}
+		return []*events.Envelope{envelope}
+	case e.Gauge != nil:
+		envelopes := []*events.Envelope{}
+		for name, value := range e.Gauge.Metrics {
+			envelope := e.base(events.Envelope_ValueMetric)
+			envelope.ValueMetric = &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(value.Value),
+				Unit:  proto.String(value.Unit),
+			}
+			envelopes = append(envelopes, envelope)
+		}
+		return envelopes
+	case e.Counter != nil:
+		envelope := e.base(events.Envelope_CounterEvent)
+		envelope.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(e.Counter.Name),
+			Delta: proto.Uint64(uint64(e.Counter.Delta)),
+			Total: proto.Uint64(uint64(e.Counter.Total)),
+		}
+		return []*events.Envelope{envelope}
+	case e.Timer != nil && e.Timer.Name == "http":
+		envelope := e.base(events.Envelope_HttpStartStop)
+		envelope.HttpStartStop = e.httpStartStop()
+		return []*events.Envelope{envelope}
+	case e.Log != nil:
+		envelope := e.base(events.Envelope_LogMessage)
+		messageType := events.LogMessage_OUT
+		if e.Log.Type == "ERR" {
+			messageType = events.LogMessage_ERR
+		}
+		envelope.LogMessage = &events.LogMessage{
+			Message:        e.Log.Payload,
+			MessageType:    messageType.Enum(),
+			Timestamp:      proto.Int64(int64(e.Timestamp)),
+			AppId:          proto.String(e.SourceID),
+			SourceType:     proto.String(e.Tags["source_type"]),
+			SourceInstance: proto.String(e.InstanceID),
+		}
+		return []*events.Envelope{envelope}
+	case e.Event != nil:
+		// The platform events take the place of the v1 Error envelopes, the title being the source of the error
+		envelope := e.base(events.Envelope_Error)
+		code, _ := strconv.Atoi(e.Tags["code"])
+		envelope.Error = &events.Error{
+			Source:  proto.String(e.Event.Title),
+			Code:    proto.Int32(int32(code)),
+			Message: proto.String(e.Event.Body),
+		}
+		return []*events.Envelope{envelope}
+	default:
+		return nil
+	}
+}
+
+func (e rlpEnvelope) base(eventType events.Envelope_EventType) *events.Envelope {
+	origin := e.Tags["origin"]
+	if origin == "" {
+		origin = e.SourceID
+	}
+
+	tags := map[string]string{}
+	for name, value := range e.Tags {
+		tags[name] = value
+	}
+	for _, name := range envelopeTagNames {
+		delete(tags, name)
+	}
+	if eventType == events.Envelope_ValueMetric || eventType == events.Envelope_CounterEvent {
+		// Keep track of the v2 source of infra metrics, it is not part of the v1 fields
+		if e.SourceID != "" && e.SourceID != origin {
+			tags["source_id"] = e.SourceID
+		}
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	return &events.Envelope{
+		Origin:     proto.String(origin),
+		EventType:  eventType.Enum(),
+		Timestamp:  proto.Int64(int64(e.Timestamp)),
+		Deployment: proto.String(e.Tags["deployment"]),
+		Job:        proto.String(e.Tags["job"]),
+		Index:      proto.String(e.Tags["index"]),
+		Ip:         proto.String(e.Tags["ip"]),
+		Tags:       tags,
+	}
+}
+
+func (e rlpEnvelope) isContainerMetric() bool {
+	for _, name := range containerMetricNames {
+		if _, ok := e.Gauge.Metrics[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (e rlpEnvelope) instanceIndex() int {
+	index, _ := strconv.Atoi(e.InstanceID)
+	return index
+}
+
+func (e rlpEnvelope) httpStartStop() *events.HttpStartStop {
+	statusCode, _ := strconv.Atoi(e.Tags["status_code"])
+	contentLength, _ := strconv.ParseInt(e.Tags["content_length"], 10, 64)
+	peerType := events.PeerType_Client
+	if strings.EqualFold(e.Tags["peer_type"], "server") {
+		peerType = events.PeerType_Server
+	}
+	method := events.Method(events.Method_value[strings.ToUpper(e.Tags["method"])])
+
+	event := &events.HttpStartStop{
+		StartTimestamp: proto.Int64(int64(e.Timer.Start)),
+		StopTimestamp:  proto.Int64(int64(e.Timer.Stop)),
+		RequestId:      parseUUID(e.Tags["request_id"]),
+		PeerType:       peerType.Enum(),
+		Method:         method.Enum(),
+		Uri:            proto.String(e.Tags["uri"]),
+		RemoteAddress:  proto.String(e.Tags["remote_address"]),
+		UserAgent:      proto.String(e.Tags["user_agent"]),
+		StatusCode:     proto.Int32(int32(statusCode)),
+		ContentLength:  proto.Int64(contentLength),
+		ApplicationId:  parseUUID(e.SourceID),
+		InstanceIndex:  proto.Int32(int32(e.instanceIndex())),
+		InstanceId:     proto.String(e.Tags["instance_id"]),
+	}
+	if forwarded := e.Tags["forwarded"]; forwarded != "" {
+		event.Forwarded = strings.Split(forwarded, "\n")
+	}
+	return event
+}
+
+// parseUUID encodes a guid the way v1 envelopes do, it returns nil if guid isn't a valid UUID
+func parseUUID(guid string) *events.UUID {
+	b, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return nil
+	}
+	return &events.UUID{
+		Low:  proto.Uint64(binary.LittleEndian.Uint64(b[:8])),
+		High: proto.Uint64(binary.LittleEndian.Uint64(b[8:])),
+	}
+}
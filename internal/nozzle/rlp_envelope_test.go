@@ -0,0 +1,121 @@
+package nozzle
+
+import (
+	"encoding/json"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RLP gateway envelopes", func() {
+	convert := func(encoded string) []*events.Envelope {
+		var e rlpEnvelope
+		err := json.Unmarshal([]byte(encoded), &e)
+		Expect(err).ToNot(HaveOccurred())
+		return e.toV1()
+	}
+
+	It("maps the tags to the envelope fields", func() {
+		envelopes := convert(`{"timestamp":"1500000000000000000","sourceId":"gorouter","instanceId":"1",
+			"tags":{"deployment":"cf","job":"router","index":"abc","ip":"10.0.0.1","origin":"gorouter","custom":"value"},
+			"counter":{"name":"total_requests","delta":"5","total":"105"}}`)
+
+		Expect(envelopes).To(HaveLen(1))
+		envelope := envelopes[0]
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(envelope.GetTimestamp()).To(BeEquivalentTo(1500000000000000000))
+		Expect(envelope.GetOrigin()).To(Equal("gorouter"))
+		Expect(envelope.GetDeployment()).To(Equal("cf"))
+		Expect(envelope.GetJob()).To(Equal("router"))
+		Expect(envelope.GetIndex()).To(Equal("abc"))
+		Expect(envelope.GetIp()).To(Equal("10.0.0.1"))
+		Expect(envelope.GetTags()).To(Equal(map[string]string{"custom": "value"}))
+		Expect(envelope.GetCounterEvent().GetName()).To(Equal("total_requests"))
+		Expect(envelope.GetCounterEvent().GetDelta()).To(BeEquivalentTo(5))
+		Expect(envelope.GetCounterEvent().GetTotal()).To(BeEquivalentTo(105))
+	})
+
+	It("turns gauges into one value metric per value", func() {
+		envelopes := convert(`{"timestamp":"1","sourceId":"doppler",
+			"gauge":{"metrics":{"a":{"unit":"ms","value":1.5},"b":{"unit":"bytes","value":2}}}}`)
+
+		Expect(envelopes).To(HaveLen(2))
+		values := map[string]float64{}
+		for _, envelope := range envelopes {
+			Expect(envelope.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+			Expect(envelope.GetOrigin()).To(Equal("doppler"))
+			values[envelope.GetValueMetric().GetName()] = envelope.GetValueMetric().GetValue()
+		}
+		Expect(values).To(Equal(map[string]float64{"a": 1.5, "b": 2}))
+	})
+
+	It("turns app gauges into container metrics", func() {
+		envelopes := convert(`{"timestamp":"1","sourceId":"app-guid","instanceId":"3","gauge":{"metrics":{
+			"cpu":{"unit":"percentage","value":12.5},"memory":{"unit":"bytes","value":1024},"disk":{"unit":"bytes","value":2048},
+			"memory_quota":{"unit":"bytes","value":4096},"disk_quota":{"unit":"bytes","value":8192}}}}`)
+
+		Expect(envelopes).To(HaveLen(1))
+		metric := envelopes[0].GetContainerMetric()
+		Expect(envelopes[0].GetEventType()).To(Equal(events.Envelope_ContainerMetric))
+		Expect(metric.GetApplicationId()).To(Equal("app-guid"))
+		Expect(metric.GetInstanceIndex()).To(BeEquivalentTo(3))
+		Expect(metric.GetCpuPercentage()).To(Equal(12.5))
+		Expect(metric.GetMemoryBytes()).To(BeEquivalentTo(1024))
+		Expect(metric.GetDiskBytes()).To(BeEquivalentTo(2048))
+		Expect(metric.GetMemoryBytesQuota()).To(BeEquivalentTo(4096))
+		Expect(metric.GetDiskBytesQuota()).To(BeEquivalentTo(8192))
+	})
+
+	It("turns http timers into HttpStartStop events", func() {
+		envelopes := convert(`{"timestamp":"1","sourceId":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","instanceId":"0",
+			"tags":{"origin":"gorouter","peer_type":"Client","method":"POST","uri":"http://my-app.example.com/path",
+			"status_code":"503","content_length":"42","request_id":"6ba7b811-9dad-11d1-80b4-00c04fd430c8"},
+			"timer":{"name":"http","start":"100","stop":"200"}}`)
+
+		Expect(envelopes).To(HaveLen(1))
+		event := envelopes[0].GetHttpStartStop()
+		Expect(envelopes[0].GetEventType()).To(Equal(events.Envelope_HttpStartStop))
+		Expect(event.GetStartTimestamp()).To(BeEquivalentTo(100))
+		Expect(event.GetStopTimestamp()).To(BeEquivalentTo(200))
+		Expect(event.GetPeerType()).To(Equal(events.PeerType_Client))
+		Expect(event.GetMethod()).To(Equal(events.Method_POST))
+		Expect(event.GetUri()).To(Equal("http://my-app.example.com/path"))
+		Expect(event.GetStatusCode()).To(BeEquivalentTo(503))
+		Expect(event.GetContentLength()).To(BeEquivalentTo(42))
+		Expect(event.GetApplicationId().GetLow()).To(BeEquivalentTo(uint64(0xd111ad9d10b8a76b)))
+		Expect(event.GetApplicationId().GetHigh()).To(BeEquivalentTo(uint64(0xc830d44fc000b480)))
+	})
+
+	It("turns logs into log messages", func() {
+		envelopes := convert(`{"timestamp":"1","sourceId":"app-guid","instanceId":"2","tags":{"source_type":"APP/PROC/WEB"},
+			"log":{"payload":"aGVsbG8=","type":"ERR"}}`)
+
+		Expect(envelopes).To(HaveLen(1))
+		message := envelopes[0].GetLogMessage()
+		Expect(envelopes[0].GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(string(message.GetMessage())).To(Equal("hello"))
+		Expect(message.GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(message.GetAppId()).To(Equal("app-guid"))
+		Expect(message.GetSourceType()).To(Equal("APP/PROC/WEB"))
+		Expect(message.GetSourceInstance()).To(Equal("2"))
+	})
+
+	It("turns events into errors", func() {
+		envelopes := convert(`{"timestamp":"1","sourceId":"cc","tags":{"origin":"cloud_controller","code":"42"},
+			"event":{"title":"diego","body":"cell unreachable"}}`)
+
+		Expect(envelopes).To(HaveLen(1))
+		message := envelopes[0].GetError()
+		Expect(envelopes[0].GetEventType()).To(Equal(events.Envelope_Error))
+		Expect(envelopes[0].GetOrigin()).To(Equal("cloud_controller"))
+		Expect(message.GetSource()).To(Equal("diego"))
+		Expect(message.GetCode()).To(BeEquivalentTo(42))
+		Expect(message.GetMessage()).To(Equal("cell unreachable"))
+	})
+
+	It("ignores the envelopes without a v1 equivalent", func() {
+		Expect(convert(`{"timestamp":"1","sourceId":"cc"}`)).To(BeEmpty())
+		Expect(convert(`{"timestamp":"1","sourceId":"cc","timer":{"name":"other","start":"1","stop":"2"}}`)).To(BeEmpty())
+	})
+})
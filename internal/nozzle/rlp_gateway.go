@@ -0,0 +1,237 @@
+package nozzle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	rlpMaxRetryCount  = 5
+	rlpMinRetryDelay  = 500 * time.Millisecond
+	rlpMaxRetryDelay  = time.Minute
+	rlpMaxEventBytes  = 16 * 1024 * 1024
+	rlpChannelsBuffer = 1000
+)
+
+// rlpGatewaySource reads v2 envelopes from the Reverse Log Proxy gateway as server-sent events,
+// and converts them to v1 envelopes so that they go through the same processing as the firehose ones
+type rlpGatewaySource struct {
+	config       *config.Config
+	gatewayURL   string
+	httpClient   *http.Client
+	tokenFetcher AuthTokenFetcher
+	log          *gosteno.Logger
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+// rlpBatch is the payload of the server-sent events of the RLP gateway
+type rlpBatch struct {
+	Batch []rlpEnvelope `json:"batch"`
+}
+
+func newRLPGatewaySource(config *config.Config, cfClient *cfclient.Client, tokenFetcher AuthTokenFetcher, log *gosteno.Logger) (*rlpGatewaySource, error) {
+	gatewayURL := config.RLPGatewayURL
+	if gatewayURL == "" {
+		if cfClient == nil {
+			return nil, fmt.Errorf("either the RLP gateway URL or the CC URL needs to be set")
+		}
+		var err error
+		gatewayURL, err = rlpGatewayURLFromDoppler(cfClient.Endpoint.DopplerEndpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &rlpGatewaySource{
+		config:     config,
+		gatewayURL: gatewayURL,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSSLSkipVerify},
+			},
+		},
+		tokenFetcher: tokenFetcher,
+		log:          log,
+		ctx:          ctx,
+		cancel:       cancel,
+	}, nil
+}
+
+// Start connects to the RLP gateway, and reconnects with an exponential backoff when the stream breaks
+func (s *rlpGatewaySource) Start(authToken string) (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope, rlpChannelsBuffer)
+	errs := make(chan error, rlpChannelsBuffer)
+
+	go func() {
+		delay := rlpMinRetryDelay
+		retries := 0
+		for {
+			received, err := s.stream(authToken, messages)
+			if s.ctx.Err() != nil {
+				// The source was closed
+				return
+			}
+			if received {
+				// The connection was working, start over with a fresh retry budget
+				retries = 0
+				delay = rlpMinRetryDelay
+			}
+			retries++
+			if retries > rlpMaxRetryCount {
+				errs <- noaaerrors.NewRetryError(consumer.ErrMaxRetriesReached)
+				return
+			}
+			errs <- noaaerrors.NewRetryError(err)
+
+			select {
+			case <-time.After(delay):
+			case <-s.ctx.Done():
+				return
+			}
+			delay *= 2
+			if delay > rlpMaxRetryDelay {
+				delay = rlpMaxRetryDelay
+			}
+
+			// The token may have expired
+			if !s.config.DisableAccessControl && s.tokenFetcher != nil {
+				authToken = s.tokenFetcher.FetchAuthToken()
+			}
+		}
+	}()
+
+	return messages, errs
+}
+
+// Close stops reading from the RLP gateway
+func (s *rlpGatewaySource) Close() error {
+	s.cancel()
+	return nil
+}
+
+// stream reads envelopes until the connection breaks, it returns true if envelopes were received
+func (s *rlpGatewaySource) stream(authToken string, messages chan<- *events.Envelope) (bool, error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", s.readURL(), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if authToken != "" {
+		req.Header.Set("Authorization", authToken)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("RLP gateway returned HTTP response: %s\nResponse Body: %s", resp.Status, body)
+	}
+	s.log.Info("Connected to the RLP gateway")
+
+	// The gateway sends heartbeats, consider the connection dead if nothing is received for too long
+	idleTimeout := time.Duration(s.config.IdleTimeoutSeconds) * time.Second
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.AfterFunc(idleTimeout, cancel)
+		defer idleTimer.Stop()
+	}
+
+	received := false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), rlpMaxEventBytes)
+	var eventName string
+	var data bytes.Buffer
+	for scanner.Scan() {
+		if idleTimer != nil {
+			idleTimer.Reset(idleTimeout)
+		}
+
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			// A blank line ends the event
+			if eventName == "" && data.Len() > 0 {
+				if s.dispatch(data.Bytes(), messages) {
+					received = true
+				}
+			}
+			eventName = ""
+			data.Reset()
+		case bytes.HasPrefix(line, []byte("event:")):
+			eventName = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(line[len("data:"):], []byte(" ")))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return received, err
+	}
+	return received, fmt.Errorf("RLP gateway closed the connection")
+}
+
+// dispatch converts a batch of v2 envelopes and sends them to the workers
+func (s *rlpGatewaySource) dispatch(data []byte, messages chan<- *events.Envelope) bool {
+	var batch rlpBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		s.log.Errorf("Error decoding RLP gateway batch: %v", err)
+		return false
+	}
+
+	for _, v2 := range batch.Batch {
+		for _, envelope := range v2.toV1() {
+			select {
+			case messages <- envelope:
+			case <-s.ctx.Done():
+				return true
+			}
+		}
+	}
+	return true
+}
+
+func (s *rlpGatewaySource) readURL() string {
+	q := url.Values{}
+	q.Set("shard_id", s.config.FirehoseSubscriptionID)
+	q.Set("counter", "")
+	q.Set("gauge", "")
+	if s.config.HTTPMetricsEnabled {
+		q.Set("timer", "")
+	}
+	if s.config.LogsEnabled || s.config.EventsEnabled {
+		q.Set("log", "")
+	}
+	if s.config.EventsEnabled {
+		q.Set("event", "")
+	}
+	return s.gatewayURL + "/v2/read?" + q.Encode()
+}
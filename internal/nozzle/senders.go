@@ -0,0 +1,111 @@
+package nozzle
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/client/datadog"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/route"
+)
+
+// metricsSender posts the metrics flushed for one sink from its own goroutine, so that a slow or unreachable sink
+// delays neither the other sinks nor the main loop
+type metricsSender struct {
+	sink    Sink
+	route   *route.Route // nil to send all the metrics
+	queue   chan metric.MetricsMap
+	done    chan struct{}
+	dropped uint64 // modified by main thread, read by the monitoring server
+}
+
+func newMetricsSender(sink Sink, route *route.Route, queueSize int) *metricsSender {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &metricsSender{
+		sink:  sink,
+		route: route,
+		queue: make(chan metric.MetricsMap, queueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// enqueue hands metrics over to the sender. When the queue is full, the oldest metrics are dropped to make room.
+func (s *metricsSender) enqueue(metrics metric.MetricsMap) {
+	for {
+		select {
+		case s.queue <- metrics:
+			return
+		default:
+		}
+		select {
+		case <-s.queue:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+// queueLength returns the number of flushes waiting to be posted
+func (s *metricsSender) queueLength() uint64 {
+	return uint64(len(s.queue))
+}
+
+// droppedFlushes returns the number of flushes dropped because the queue was full
+func (s *metricsSender) droppedFlushes() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// startSenders starts a sender per sink. The first sink, the main endpoint, gets all the metrics, the additional
+// Datadog endpoints only get the metrics of their route, if any, and the other sinks get all the metrics.
+func (n *Nozzle) startSenders(sinks []Sink, router *route.Router) {
+	n.log.Infof("Starting %d metrics senders...", len(sinks))
+	n.senders = make([]*metricsSender, 0, len(sinks))
+	for i, sink := range sinks {
+		var r *route.Route
+		if client, ok := sink.(*datadog.Client); ok && i > 0 {
+			r = router.For(client.Endpoint(), client.APIKey())
+		}
+		sender := newMetricsSender(sink, r, n.config.SendQueueSize)
+		n.senders = append(n.senders, sender)
+		go n.send(sender)
+	}
+}
+
+// stopSenders lets the senders post the metrics left in their queue, for at most WorkerTimeoutSeconds
+func (n *Nozzle) stopSenders() {
+	for _, sender := range n.senders {
+		close(sender.queue)
+	}
+	timeout := time.After(time.Duration(n.config.WorkerTimeoutSeconds) * time.Second)
+	for _, sender := range n.senders {
+		select {
+		case <-sender.done:
+		case <-timeout:
+			n.log.Warnf("Could not post the metrics left for %s after %ds", sender.sink.Endpoint(), n.config.WorkerTimeoutSeconds)
+			return
+		}
+	}
+}
+
+func (n *Nozzle) send(sender *metricsSender) {
+	defer close(sender.done)
+
+	sink := sender.sink
+	// Only the posts to Datadog make the nozzle ready, the other sinks may well be local files
+	_, toDatadog := sink.(*datadog.Client)
+	for metrics := range sender.queue {
+		start := time.Now()
+		err := sink.PostMetrics(metrics)
+		n.postDuration.Observe(time.Since(start).Seconds(), sink.Endpoint(), sink.Account())
+		// NOTE: We don't need to have a retry logic since we don't return error on failure.
+		// However, current metrics are lost unless a spool directory is configured.
+		if err != nil {
+			n.postFailures.Inc(sink.Endpoint(), sink.Account())
+			n.log.Errorf("Error posting metrics to %s: %s\n\n", sink.Endpoint(), err)
+		} else if toDatadog {
+			atomic.StoreUint64(&n.metricsPosted, 1)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package nozzle
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/localip"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/client/datadog"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/sink"
+	"github.com/cloudfoundry/gosteno"
+)
+
+// Sink is an output of the metrics, e.g. a Datadog endpoint. Each sink is used by a single sender goroutine.
+type Sink interface {
+	PostMetrics(metrics metric.MetricsMap) error
+	// MakeInternalMetric makes the nozzle metrics added to each flush sent to the sink
+	MakeInternalMetric(name string, value uint64, timestamp int64) (metric.MetricKey, metric.MetricValue)
+	// Endpoint and Account tell the sinks apart in the logs and the monitoring metrics
+	Endpoint() string
+	Account() string
+}
+
+// spooledSink is a sink spooling the metrics it fails to send
+type spooledSink interface {
+	HasSpool() bool
+	SpoolDepth() uint64
+	SpoolDroppedBytes() uint64
+}
+
+// NewSinks creates the Datadog clients, the main endpoint first, followed by the other sinks of the config
+func NewSinks(config *config.Config, log *gosteno.Logger) ([]Sink, error) {
+	ddClients, err := datadog.NewClients(config, log)
+	if err != nil {
+		return nil, err
+	}
+	sinks := make([]Sink, 0, len(ddClients)+len(config.Sinks))
+	for _, client := range ddClients {
+		sinks = append(sinks, client)
+	}
+	if len(config.Sinks) == 0 {
+		return sinks, nil
+	}
+
+	ip, err := localip.LocalIP()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range config.Sinks {
+		switch s.Type {
+		case "jsonlines":
+			sinks = append(sinks, sink.NewJSONLines(s, config, ip))
+		case "otlp":
+			sinks = append(sinks, sink.NewOTLP(s, config, ip))
+		case "prometheus_remote_write":
+			sinks = append(sinks, sink.NewRemoteWrite(s, config, ip))
+		default:
+			return nil, fmt.Errorf("unknown sink type %s", s.Type)
+		}
+	}
+	return sinks, nil
+}
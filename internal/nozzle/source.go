@@ -0,0 +1,112 @@
+package nozzle
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Source is a stream of loggregator envelopes consumed by the nozzle.
+// Errors sent on the errors channel follow the noaa conventions: a noaaerrors.RetryError means the source
+// is reconnecting on its own, consumer.ErrMaxRetriesReached means it gave up.
+type Source interface {
+	Start(authToken string) (<-chan *events.Envelope, <-chan error)
+	Close() error
+}
+
+// NewSource creates the source of envelopes picked by the SourceType of the config
+func NewSource(config *config.Config, cfClient *cfclient.Client, tokenFetcher AuthTokenFetcher, log *gosteno.Logger) (Source, error) {
+	switch config.SourceType {
+	case "", "firehose":
+		return newFirehoseSource(config, cfClient, tokenFetcher)
+	case "rlp_gateway":
+		return newRLPGatewaySource(config, cfClient, tokenFetcher, log)
+	default:
+		return nil, fmt.Errorf("unknown source type %s", config.SourceType)
+	}
+}
+
+// allEnvelopesNeeded returns true if the nozzle needs more than the metric envelopes
+func allEnvelopesNeeded(config *config.Config) bool {
+	return config.LogsEnabled || config.HTTPMetricsEnabled || config.EventsEnabled
+}
+
+// firehoseSource reads v1 envelopes from the Traffic Controller firehose websocket
+type firehoseSource struct {
+	config        *config.Config
+	consumer      *consumer.Consumer
+	refreshTokens bool
+}
+
+func newFirehoseSource(config *config.Config, cfClient *cfclient.Client, tokenFetcher AuthTokenFetcher) (*firehoseSource, error) {
+	if config.TrafficControllerURL == "" {
+		if cfClient != nil {
+			config.TrafficControllerURL = cfClient.Endpoint.DopplerEndpoint
+		} else {
+			return nil, fmt.Errorf("either the TrafficController URL or the CC URL needs to be set")
+		}
+	}
+
+	c := consumer.New(
+		config.TrafficControllerURL,
+		&tls.Config{InsecureSkipVerify: config.InsecureSSLSkipVerify},
+		nil)
+	c.SetIdleTimeout(time.Duration(config.IdleTimeoutSeconds) * time.Second)
+	// retry settings
+	c.SetMaxRetryCount(5)
+	c.SetMinRetryDelay(500 * time.Millisecond)
+	c.SetMaxRetryDelay(time.Minute)
+
+	// Let the consumer ask for a valid token at every (re)connection, rather than reusing the first one
+	refresher, refreshTokens := tokenFetcher.(consumer.TokenRefresher)
+	refreshTokens = refreshTokens && !config.DisableAccessControl
+	if refreshTokens {
+		c.RefreshTokenFrom(refresher)
+	}
+
+	return &firehoseSource{
+		config:        config,
+		consumer:      c,
+		refreshTokens: refreshTokens,
+	}, nil
+}
+
+// Start connects to the firehose
+func (s *firehoseSource) Start(authToken string) (<-chan *events.Envelope, <-chan error) {
+	if s.refreshTokens {
+		// An empty token makes the consumer get one from the refresher
+		authToken = ""
+	}
+	if allEnvelopesNeeded(s.config) {
+		// Subscribe to all the envelopes, LogMessage, HttpStartStop and Error envelopes included
+		return s.consumer.Firehose(s.config.FirehoseSubscriptionID, authToken)
+	}
+	return s.consumer.FilteredFirehose(s.config.FirehoseSubscriptionID, authToken, consumer.Metrics)
+}
+
+// Close closes the connection to the firehose
+func (s *firehoseSource) Close() error {
+	return s.consumer.Close()
+}
+
+// rlpGatewayURLFromDoppler guesses the RLP gateway URL of a foundation from its doppler endpoint,
+// both are served on the system domain: wss://doppler.<system domain>:443 -> https://log-stream.<system domain>
+func rlpGatewayURLFromDoppler(dopplerEndpoint string) (string, error) {
+	u, err := url.Parse(dopplerEndpoint)
+	if err != nil {
+		return "", err
+	}
+	host := u.Hostname()
+	if !strings.HasPrefix(host, "doppler.") {
+		return "", fmt.Errorf("can't guess the RLP gateway URL from the doppler endpoint %s", dopplerEndpoint)
+	}
+	return "https://log-stream." + strings.TrimPrefix(host, "doppler."), nil
+}
@@ -1,6 +1,7 @@
 package nozzle
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry/sonde-go/events"
@@ -11,6 +12,8 @@ func (d *Nozzle) startWorkers() {
 	// create metricPackages and send them to p.processedMetrics channel
 	// NOTE: Worker are used to process infra or app event envelopes to metricPackages
 	d.log.Infof("Starting processed metrics reader and %d workers...", d.config.NumWorkers)
+	markActivity(&d.lastEnvelopeProcessed)
+	markActivity(&d.lastMetricsAggregated)
 	for i := 0; i < d.config.NumWorkers; i++ {
 		go d.work()
 	}
@@ -47,10 +50,34 @@ func (d *Nozzle) work() {
 	for {
 		select {
 		case envelope := <-d.messages:
+			markActivity(&d.lastEnvelopeProcessed)
+			d.countEnvelope(envelope)
 			if !d.keepMessage(envelope) {
 				continue
 			}
 			d.handleMessage(envelope)
+			if envelope.GetEventType() == events.Envelope_LogMessage {
+				if d.config.LogsEnabled {
+					d.handleLog(envelope)
+				}
+				if d.config.EventsEnabled {
+					d.handleEvent(envelope)
+				}
+				continue
+			}
+			if envelope.GetEventType() == events.Envelope_Error {
+				if d.config.EventsEnabled {
+					d.handleEvent(envelope)
+				}
+				continue
+			}
+			if envelope.GetEventType() == events.Envelope_HttpStartStop && !d.config.HTTPMetricsEnabled {
+				continue
+			}
+			if !d.metricFilter.Keep(envelope) {
+				atomic.AddUint64(&d.droppedEnvelopes, 1)
+				continue
+			}
 			d.processor.ProcessMetric(envelope)
 		case <-d.workersStopper:
 			d.log.Info("Worker shutting down...")
@@ -64,10 +91,11 @@ func (d *Nozzle) readProcessedMetrics() {
 	for {
 		select {
 		case pkg := <-d.processedMetrics:
+			markActivity(&d.lastMetricsAggregated)
 			d.mapLock.Lock()
 			d.totalMessagesReceived++
 			for _, m := range pkg {
-				d.metricsMap.Add(*m.MetricKey, *m.MetricValue)
+				d.aggregator.Add(d.metricsMap, *m.MetricKey, *m.MetricValue)
 			}
 			d.mapLock.Unlock()
 		case <-d.workersStopper:
@@ -7,9 +7,12 @@ import (
 	"math"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
 	"github.com/cloudfoundry-community/go-cfclient"
@@ -18,10 +21,19 @@ import (
 	"github.com/pkg/errors"
 )
 
+// refreshOverlap is how far before the last refresh the changes are requested
+const refreshOverlap = time.Minute
+
+// instanceExpiry is how long an instance is counted as running after its last container metric
+const instanceExpiry = 2 * time.Minute
+
 type appCache struct {
 	apps     map[string]*App
 	warmedUp bool
-	lock     sync.RWMutex
+	// stale is true while the cache only holds the apps loaded from the cache file
+	stale          bool
+	warmupDuration time.Duration
+	lock           sync.RWMutex
 }
 
 func newAppCache() appCache {
@@ -32,19 +44,37 @@ func newAppCache() appCache {
 }
 
 // Add inserts or update a new app in the cache, and returns it
-func (c *appCache) Add(cfApp cfclient.App) *App {
+func (c *appCache) Add(resolvedApp ccApp, metadataTags []string) *App {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if app := c.apps[cfApp.Guid]; app != nil {
-		app.setAppData(cfApp)
-	} else {
-		app := newApp(cfApp.Guid)
-		app.setAppData(cfApp)
-		c.apps[cfApp.Guid] = app
+	if app := c.apps[resolvedApp.Guid]; app != nil {
+		// The workers read the app under its own lock
+		app.lock.Lock()
+		defer app.lock.Unlock()
+		app.setAppData(resolvedApp, metadataTags)
+		return app
 	}
 
-	return c.apps[cfApp.Guid]
+	app := newApp(resolvedApp.Guid)
+	app.setAppData(resolvedApp, metadataTags)
+	c.apps[resolvedApp.Guid] = app
+	return app
+}
+
+// Retain removes the apps missing from guids, and returns how many were removed
+func (c *appCache) Retain(guids map[string]bool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+	for guid := range c.apps {
+		if !guids[guid] {
+			delete(c.apps, guid)
+			removed++
+		}
+	}
+	return removed
 }
 
 // Delete removes an app from the cache
@@ -71,6 +101,44 @@ func (c *appCache) IsWarmedUp() bool {
 	return c.warmedUp
 }
 
+// IsStale returns true if the cache was loaded from the cache file and not resynced since
+func (c *appCache) IsStale() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.stale
+}
+
+func (c *appCache) setSynced() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stale = false
+}
+
+// Size returns the number of apps in the cache
+func (c *appCache) Size() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.apps)
+}
+
+// WarmupDuration returns how long the last complete warmup cycle took
+func (c *appCache) WarmupDuration() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.warmupDuration
+}
+
+func (c *appCache) setWarmupDuration(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.warmupDuration = d
+}
+
 // setWarmedUp signals to the cache that it's ready to be used
 func (c *appCache) SetWarmedUp() {
 	c.lock.Lock()
@@ -86,34 +154,58 @@ type AppParser struct {
 	AppCache     appCache
 	cacheWorkers int
 	grabInterval int
-	customTags   []string
-	stopper      chan bool
+	// fullResyncInterval is the number of minutes between two full resyncs, the other refreshes are incremental
+	fullResyncInterval int
+	customTags         []string
+	// containerMetrics chooses between per instance gauges and distributions for the container metrics
+	containerMetrics config.ContainerMetrics
+	metadataTagger   *MetadataTagger
+	stopper          chan bool
+	// ccV2Only is set to 1 when the cloud controller doesn't serve the v3 API
+	ccV2Only int32
+	// lastSync and lastFullSync are the start times of the last successful refresh and full resync of the cache
+	lastSync     time.Time
+	lastFullSync time.Time
+	// cacheFile is where the cache is saved after every refresh and loaded from at startup, if set
+	cacheFile     string
+	cacheFileLock sync.Mutex
+	// lookups fetches the apps missing from the cache from the cloud controller
+	lookups *appLookups
 }
 
 // NewAppParser create a new AppParser
 func NewAppParser(
 	cfClient *cfclient.Client,
-	cacheWorkers int,
-	grabInterval int,
+	cfg *config.Config,
+	metadataTagger *MetadataTagger,
 	log *gosteno.Logger,
-	customTags []string,
-	environment string,
 ) (*AppParser, error) {
 
 	if cfClient == nil {
 		return nil, fmt.Errorf("The CF Client needs to be properly set up to use appmetrics")
 	}
-	if environment != "" {
-		customTags = append(customTags, fmt.Sprintf("%s:%s", "env", environment))
+	customTags := append([]string{}, cfg.CustomTags...)
+	if cfg.EnvironmentName != "" {
+		customTags = append(customTags, fmt.Sprintf("%s:%s", "env", cfg.EnvironmentName))
 	}
 	appMetrics := &AppParser{
-		CFClient:     cfClient,
-		log:          log,
-		AppCache:     newAppCache(),
-		cacheWorkers: cacheWorkers,
-		grabInterval: grabInterval,
-		customTags:   customTags,
-		stopper:      make(chan bool, 1),
+		CFClient:           cfClient,
+		log:                log,
+		AppCache:           newAppCache(),
+		cacheWorkers:       cfg.NumCacheWorkers,
+		grabInterval:       cfg.GrabInterval,
+		fullResyncInterval: cfg.FullResyncInterval,
+		cacheFile:          cfg.AppCacheFile,
+		lookups:            newAppLookups(cfg.AppLookupsPerSecond, time.Duration(cfg.UnknownAppTTLSeconds)*time.Second),
+		customTags:         customTags,
+		containerMetrics:   cfg.ContainerMetrics,
+		metadataTagger:     metadataTagger,
+		stopper:            make(chan bool, 1),
+	}
+
+	// The apps of the last run are used until the first warmup completes
+	if appMetrics.cacheFile != "" {
+		appMetrics.loadCacheFile()
 	}
 
 	// start the background loop to keep the cache up to date
@@ -122,10 +214,11 @@ func NewAppParser(
 	return appMetrics, nil
 }
 
-// updateCacheLoop periodically refreshes the entire cache
+// updateCacheLoop periodically refreshes the cache, with a full resync every fullResyncInterval
 func (am *AppParser) updateCacheLoop() {
 	// Run first cache warmup
 	am.warmupCache()
+	am.saveCacheFile()
 
 	// Start a ticker to update the cache at regular intervals
 	ticker := time.NewTicker(time.Duration(am.grabInterval) * time.Minute)
@@ -133,46 +226,103 @@ func (am *AppParser) updateCacheLoop() {
 	for {
 		select {
 		case <-ticker.C:
-			am.warmupCache()
+			if am.needsFullResync() {
+				am.warmupCache()
+			} else {
+				am.refreshCache()
+			}
+			am.saveCacheFile()
 		case <-am.stopper:
 			return
 		}
 	}
 }
 
+// needsFullResync returns true if the last full resync is too old or failed, or if the cache can't be refreshed
+// incrementally from the v2 API
+func (am *AppParser) needsFullResync() bool {
+	return am.lastFullSync.IsZero() ||
+		time.Since(am.lastFullSync) >= time.Duration(am.fullResyncInterval)*time.Minute ||
+		atomic.LoadInt32(&am.ccV2Only) == 1
+}
+
+// warmupCache lists all the apps, and evicts the apps missing from the list
 func (am *AppParser) warmupCache() {
 	am.log.Infof("Warming up cache...")
+	start := time.Now()
 
-	apps, err := listApps(am.CFClient, am.cacheWorkers, am.log)
+	apps, complete, err := am.listApps()
 	if err != nil {
 		am.log.Errorf("Error warming up cache, couldn't get list of apps: %v", err)
 		return
 	}
 
+	guids := make(map[string]bool, len(apps))
 	for _, resolvedApp := range apps {
-		am.AppCache.Add(resolvedApp)
+		am.AppCache.Add(resolvedApp, am.metadataTagger.Tags(resolvedApp.Labels, resolvedApp.Annotations))
+		guids[resolvedApp.Guid] = true
 	}
+	// Apps missing from an incomplete list may still exist
+	if complete {
+		if evicted := am.AppCache.Retain(guids); evicted > 0 {
+			am.log.Infof("Evicted %d deleted apps from the cache", evicted)
+		}
+		am.lastFullSync = start
+		am.AppCache.setSynced()
+	}
+	am.lastSync = start
+	am.AppCache.setWarmupDuration(time.Since(start))
 	if !am.AppCache.IsWarmedUp() {
 		am.AppCache.SetWarmedUp()
 	}
 	am.log.Infof("Done warming up cache")
 }
 
+// refreshCache updates the apps changed since the last refresh, and evicts the deleted ones
+func (am *AppParser) refreshCache() {
+	start := time.Now()
+	// Overlap with the previous refresh, in case the clock of the cloud controller is behind
+	since := am.lastSync.Add(-refreshOverlap)
+
+	apps, deleted, err := listChangedAppsV3(am.CFClient, am.cacheWorkers, am.metadataTagger.Enabled(), since, am.log)
+	if err != nil {
+		am.log.Errorf("Error refreshing cache, couldn't get the apps changed since %s: %v", since, err)
+		return
+	}
+
+	for _, resolvedApp := range apps {
+		am.AppCache.Add(resolvedApp, am.metadataTagger.Tags(resolvedApp.Labels, resolvedApp.Annotations))
+	}
+	for _, guid := range deleted {
+		am.AppCache.Delete(guid)
+	}
+	am.lastSync = start
+	am.log.Infof("Refreshed cache: %d apps updated and %d deleted since %s", len(apps), len(deleted), since)
+}
+
 func (am *AppParser) getAppData(guid string) (*App, error) {
 	app := am.AppCache.Get(guid)
 	if app != nil {
 		// If it exists in the cache, use the cache
+		atomic.AddUint64(&am.lookups.stats.Hits, 1)
 		return app, nil
 	}
+	atomic.AddUint64(&am.lookups.stats.Misses, 1)
 
-	// Otherwise it's a new app so fetch it via the API
-	resolvedApp, err := am.CFClient.AppByGuid(guid)
-	if err != nil {
-		am.log.Errorf("there was an error grabbing the instance data for app %v: %v", resolvedApp.Guid, err)
-		return nil, err
-	}
+	// Otherwise it's a new app so fetch it via the API, unless it's already being fetched
+	return am.lookups.get(guid, func() (*App, error) {
+		resolvedApp, err := am.appByGUID(guid)
+		if err != nil {
+			am.log.Errorf("there was an error grabbing the instance data for app %v: %v", guid, err)
+			return nil, err
+		}
+		return am.AppCache.Add(resolvedApp, am.metadataTagger.Tags(resolvedApp.Labels, resolvedApp.Annotations)), nil
+	})
+}
 
-	return am.AppCache.Add(resolvedApp), nil
+// LookupStats returns the cache hits and misses of the app metrics, and the lookups of the missed apps
+func (am *AppParser) LookupStats() AppLookupStats {
+	return am.lookups.Stats()
 }
 
 // Parse takes an envelope, and extract app metrics from it
@@ -193,7 +343,7 @@ func (am *AppParser) Parse(envelope *events.Envelope) ([]metric.MetricPackage, e
 	app.Host = envelope.GetOrigin()
 
 	metricsPackages = app.getMetrics(am.customTags)
-	containerMetrics, err := app.parseContainerMetric(message, am.customTags)
+	containerMetrics, err := app.parseContainerMetric(message, am.customTags, am.containerMetrics)
 	if err != nil {
 		return metricsPackages, err
 	}
@@ -202,22 +352,89 @@ func (am *AppParser) Parse(envelope *events.Envelope) ([]metric.MetricPackage, e
 	return metricsPackages, nil
 }
 
-// listApps is meant to replace the function from the go-cfclient and allow fetching apps in parallel tasks
+// ccApp is an app from the cloud controller, with the labels and annotations of its org, its space and itself merged
+// in this order. Labels and annotations are only available from the v3 API.
+type ccApp struct {
+	cfclient.App
+	Labels      map[string]string
+	Annotations map[string]string
+	// The v3 lists hide the commands of the processes and don't give the images of the docker apps, the values
+	// already known are kept for the apps of the lists
+	CommandHidden bool
+	ImageHidden   bool
+}
+
+// listApps lists the apps from the v3 API, or from the v2 API when the cloud controller doesn't serve v3.
+// complete is false when some pages couldn't be fetched.
 // The apps returned by this are just missing a reference to the client (unexported property) so don't use the Space() and Summary() methods
-func listApps(c *cfclient.Client, numWorkers int, log *gosteno.Logger) ([]cfclient.App, error) {
+func (am *AppParser) listApps() (apps []ccApp, complete bool, err error) {
+	apps, complete, err = listAppsV3(am.CFClient, am.cacheWorkers, am.metadataTagger.Enabled(), am.log)
+	if errors.Cause(err) == errV3Unavailable {
+		if atomic.SwapInt32(&am.ccV2Only, 1) == 0 {
+			am.log.Infof("The cloud controller v3 API is not available, falling back to the v2 API")
+		}
+		return listAppsV2(am.CFClient, am.cacheWorkers, am.log)
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Error listing v3 apps, skipping cache warmup")
+	}
+	atomic.StoreInt32(&am.ccV2Only, 0)
+	return apps, complete, nil
+}
+
+// appByGUID gets an app from the API used by the last cache warmup
+func (am *AppParser) appByGUID(guid string) (ccApp, error) {
+	if atomic.LoadInt32(&am.ccV2Only) == 1 {
+		app, err := am.CFClient.AppByGuid(guid)
+		return ccApp{App: app}, err
+	}
+	return appByGUIDV3(am.CFClient, guid)
+}
+
+// listAppsV2 is meant to replace the function from the go-cfclient and allow fetching apps in parallel tasks
+func listAppsV2(c *cfclient.Client, numWorkers int, log *gosteno.Logger) ([]ccApp, bool, error) {
 
 	// Query the first page to get the total number of pages.
 	resp, err := getAppsPage(c, 1)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error requesting apps page 1, skipping cache warmup")
+		return nil, false, errors.Wrap(err, "Error requesting apps page 1, skipping cache warmup")
 	}
 	appResources := resp.Resources
 
 	var mutex sync.Mutex
+	complete := getPages(resp.Pages, numWorkers, func(pageNb int) error {
+		resp, err := getAppsPage(c, pageNb)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		mutex.Lock()
+		appResources = append(appResources, resp.Resources...)
+		mutex.Unlock()
+		return nil
+	})
+
+	apps := []ccApp{}
+	for _, app := range appResources {
+		// Taken from https://github.com/cloudfoundry-community/go-cfclient/blob/16c98753d3152f9d80d3c121523536858095a3da/apps.go#L643
+		app.Entity.Guid = app.Meta.Guid
+		app.Entity.CreatedAt = app.Meta.CreatedAt
+		app.Entity.UpdatedAt = app.Meta.UpdatedAt
+		app.Entity.SpaceData.Entity.Guid = app.Entity.SpaceData.Meta.Guid
+		app.Entity.SpaceData.Entity.OrgData.Entity.Guid = app.Entity.SpaceData.Entity.OrgData.Meta.Guid
+		apps = append(apps, ccApp{App: app.Entity})
+	}
+	return apps, complete, nil
+}
+
+// getPages calls getPage for the pages 2 to totalPages, the first page being already fetched, spread over numWorkers
+// workers. It returns once all the pages are fetched, false if getPage failed for some of them.
+func getPages(totalPages int, numWorkers int, getPage func(pageNb int) error) bool {
 	var wg sync.WaitGroup
+	var failed int32
 
 	// Page 1 already fetched
-	pages := resp.Pages - 1
+	pages := totalPages - 1
 	// No need for more workers than pages left
 	numWorkers = int(math.Min(float64(numWorkers), float64(pages)))
 	var pagesPerWorker int
@@ -230,31 +447,21 @@ func listApps(c *cfclient.Client, numWorkers int, log *gosteno.Logger) ([]cfclie
 			defer wg.Done()
 			// Offset 2 because no page 0 and page 1 already fetched
 			pageStart := i*pagesPerWorker + 2
-			// Stop at page resp.Pages + 1, to get the last one
-			pageEnd := int(math.Min(float64((i+1)*pagesPerWorker+2), float64(resp.Pages)))
-			if pageEnd == resp.Pages {
-				// Add one so the last page can be obtained since getAppResourcesPageRange queries pages strictly less than pageEnd
+			// Stop at page totalPages + 1, to get the last one
+			pageEnd := int(math.Min(float64((i+1)*pagesPerWorker+2), float64(totalPages)))
+			if pageEnd == totalPages {
+				// Add one so the last page can be obtained since pages strictly less than pageEnd are queried
 				pageEnd++
 			}
-			resources := getAppResourcesPageRange(c, pageStart, pageEnd, log)
-			mutex.Lock()
-			appResources = append(appResources, resources...)
-			mutex.Unlock()
+			for pageNb := pageStart; pageNb < pageEnd; pageNb++ {
+				if err := getPage(pageNb); err != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
 		}(i)
 	}
 	wg.Wait()
-
-	apps := []cfclient.App{}
-	for _, app := range appResources {
-		// Taken from https://github.com/cloudfoundry-community/go-cfclient/blob/16c98753d3152f9d80d3c121523536858095a3da/apps.go#L643
-		app.Entity.Guid = app.Meta.Guid
-		app.Entity.CreatedAt = app.Meta.CreatedAt
-		app.Entity.UpdatedAt = app.Meta.UpdatedAt
-		app.Entity.SpaceData.Entity.Guid = app.Entity.SpaceData.Meta.Guid
-		app.Entity.SpaceData.Entity.OrgData.Entity.Guid = app.Entity.SpaceData.Entity.OrgData.Meta.Guid
-		apps = append(apps, app.Entity)
-	}
-	return apps, nil
+	return failed == 0
 }
 
 func getAppsPage(c *cfclient.Client, pageNb int) (*cfclient.AppResponse, error) {
@@ -284,22 +491,10 @@ func getAppsPage(c *cfclient.Client, pageNb int) (*cfclient.AppResponse, error)
 	return &appResp, nil
 }
 
-func getAppResourcesPageRange(c *cfclient.Client, pageStart, pageEnd int, log *gosteno.Logger) []cfclient.AppResource {
-	appResources := []cfclient.AppResource{}
-	for i := pageStart; i < pageEnd; i++ {
-		resp, err := getAppsPage(c, i)
-		if err != nil {
-			log.Error(err.Error())
-			continue
-		}
-		appResources = append(appResources, resp.Resources...)
-	}
-	return appResources
-}
-
-// Stop sends a message on the stopper channel to quit the goroutine refreshing the cache
+// Stop sends a message on the stopper channel to quit the goroutine refreshing the cache, and saves the cache
 func (am *AppParser) Stop() {
 	am.stopper <- true
+	am.saveCacheFile()
 }
 
 // App holds all the needed attribute from an app
@@ -322,13 +517,54 @@ type App struct {
 	TotalMemoryConfigured  int
 	TotalDiskProvisioned   int
 	TotalMemoryProvisioned int
-	Tags                   []string
-	lock                   sync.RWMutex
+	// MetadataTags are the tags of the labels and annotations of the app, its space and org
+	MetadataTags []string
+	Tags         []string
+	// instances holds the last usage reported by each instance, to compute the app wide metrics
+	instances map[int32]*instanceUsage
+	lock      sync.RWMutex
+}
+
+// instanceUsage is the last usage reported by an app instance
+type instanceUsage struct {
+	memoryBytes uint64
+	diskBytes   uint64
+	reportedAt  time.Time
+}
+
+// snapshot returns a copy of the exported fields of the app, holding its lock
+func (a *App) snapshot() *App {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return &App{
+		Name:                   a.Name,
+		Host:                   a.Host,
+		Buildpack:              a.Buildpack,
+		Command:                a.Command,
+		Diego:                  a.Diego,
+		OrgName:                a.OrgName,
+		OrgID:                  a.OrgID,
+		Routes:                 append([]string(nil), a.Routes...),
+		SpaceID:                a.SpaceID,
+		SpaceName:              a.SpaceName,
+		SpaceURL:               a.SpaceURL,
+		GUID:                   a.GUID,
+		DockerImage:            a.DockerImage,
+		NumberOfInstances:      a.NumberOfInstances,
+		TotalDiskConfigured:    a.TotalDiskConfigured,
+		TotalMemoryConfigured:  a.TotalMemoryConfigured,
+		TotalDiskProvisioned:   a.TotalDiskProvisioned,
+		TotalMemoryProvisioned: a.TotalMemoryProvisioned,
+		MetadataTags:           append([]string(nil), a.MetadataTags...),
+		Tags:                   append([]string(nil), a.Tags...),
+	}
 }
 
 func newApp(guid string) *App {
 	return &App{
-		GUID: guid,
+		GUID:      guid,
+		instances: make(map[int32]*instanceUsage),
 	}
 }
 
@@ -352,7 +588,7 @@ func (a *App) getMetrics(customTags []string) []metric.MetricPackage {
 	return a.mkMetrics(names, ms, customTags)
 }
 
-func (a *App) parseContainerMetric(message *events.ContainerMetric, customTags []string) ([]metric.MetricPackage, error) {
+func (a *App) parseContainerMetric(message *events.ContainerMetric, customTags []string, options config.ContainerMetrics) ([]metric.MetricPackage, error) {
 	var names = []string{
 		"app.cpu.pct",
 		"app.disk.used",
@@ -367,10 +603,105 @@ func (a *App) parseContainerMetric(message *events.ContainerMetric, customTags [
 		float64(message.GetMemoryBytes()),
 		float64(message.GetMemoryBytesQuota()),
 	}
-	tags := []string{fmt.Sprintf("instance:%v", message.GetInstanceIndex())}
-	tags = append(tags, customTags...)
+	derivedNames, derivedMs := a.utilization(message, options.MemoryMBPerCPU)
+	names = append(names, derivedNames...)
+	ms = append(ms, derivedMs...)
+
+	metricsPackages := []metric.MetricPackage{}
+	if !options.DisableInstanceGauges {
+		tags := []string{fmt.Sprintf("instance:%v", message.GetInstanceIndex())}
+		tags = append(tags, customTags...)
+		metricsPackages = append(metricsPackages, a.mkMetrics(names, ms, tags)...)
+	}
+	if options.Distributions {
+		metricsPackages = append(metricsPackages, a.mkDistributions(names, ms, customTags)...)
+	}
+
+	a.updateInstance(message, time.Now())
+	metricsPackages = append(metricsPackages, a.getInstancesMetrics(customTags)...)
+
+	return metricsPackages, nil
+}
+
+// utilization derives the usage of an instance relative to its quotas. The CPU entitlement is the CPU usage relative
+// to the share of the CPU of the instance, which is proportional to its memory: memoryMBPerCPU MB of memory are
+// entitled to a whole CPU (100%).
+func (a *App) utilization(message *events.ContainerMetric, memoryMBPerCPU int) ([]string, []float64) {
+	var names []string
+	var ms []float64
+	if quota := message.GetMemoryBytesQuota(); quota > 0 {
+		names = append(names, "app.memory.utilization")
+		ms = append(ms, 100*float64(message.GetMemoryBytes())/float64(quota))
+	}
+	if quota := message.GetDiskBytesQuota(); quota > 0 {
+		names = append(names, "app.disk.utilization")
+		ms = append(ms, 100*float64(message.GetDiskBytes())/float64(quota))
+	}
+	if a.TotalMemoryConfigured > 0 && memoryMBPerCPU > 0 {
+		entitlement := 100 * float64(a.TotalMemoryConfigured) / float64(memoryMBPerCPU)
+		names = append(names, "app.cpu.entitlement")
+		ms = append(ms, 100*message.GetCpuPercentage()/entitlement)
+	}
+	return names, ms
+}
+
+// updateInstance records the usage of an instance, and forgets the instances that are gone
+func (a *App) updateInstance(message *events.ContainerMetric, now time.Time) {
+	if a.instances == nil {
+		a.instances = make(map[int32]*instanceUsage)
+	}
+	a.instances[message.GetInstanceIndex()] = &instanceUsage{
+		memoryBytes: message.GetMemoryBytes(),
+		diskBytes:   message.GetDiskBytes(),
+		reportedAt:  now,
+	}
 
-	return a.mkMetrics(names, ms, tags), nil
+	for index, usage := range a.instances {
+		// Instances above the number of instances are left from a scale down
+		scaledDown := a.NumberOfInstances > 0 && int(index) >= a.NumberOfInstances
+		if scaledDown || now.Sub(usage.reportedAt) > instanceExpiry {
+			delete(a.instances, index)
+		}
+	}
+}
+
+// getInstancesMetrics returns the app wide metrics computed from the usage of all its running instances
+func (a *App) getInstancesMetrics(customTags []string) []metric.MetricPackage {
+	var memoryBytes, diskBytes uint64
+	for _, usage := range a.instances {
+		memoryBytes += usage.memoryBytes
+		diskBytes += usage.diskBytes
+	}
+
+	var names = []string{
+		"app.memory.used.total",
+		"app.disk.used.total",
+		"app.instances.running",
+	}
+	var ms = []float64{
+		float64(memoryBytes),
+		float64(diskBytes),
+		float64(len(a.instances)),
+	}
+
+	return a.mkMetrics(names, ms, customTags)
+}
+
+// mkDistributions makes a distribution point for each value. They are not tagged with the instance nor sent with a host,
+// so that the points of all the instances of the app end up in the same distribution.
+// A metric can't be both a gauge and a distribution, hence the app.distribution prefix.
+func (a *App) mkDistributions(names []string, ms []float64, moreTags []string) []metric.MetricPackage {
+	distributionNames := make([]string, len(names))
+	for i, name := range names {
+		distributionNames[i] = "app.distribution." + strings.TrimPrefix(name, "app.")
+	}
+
+	metricsPackages := a.mkMetrics(distributionNames, ms, moreTags)
+	for _, m := range metricsPackages {
+		m.MetricValue.Type = metric.Distribution
+		m.MetricValue.Host = ""
+	}
+	return metricsPackages
 }
 
 func (a *App) mkMetrics(names []string, ms []float64, moreTags []string) []metric.MetricPackage {
@@ -382,7 +713,10 @@ func (a *App) mkMetrics(names []string, ms []float64, moreTags []string) []metri
 		host = a.GUID
 	}
 
-	tags := a.getTags()
+	// Copy the app tags, appending to them could overwrite the tags of other metrics sharing their array
+	appTags := a.getTags()
+	tags := make([]string, 0, len(appTags)+len(moreTags))
+	tags = append(tags, appTags...)
 	tags = append(tags, moreTags...)
 
 	for i, name := range names {
@@ -452,11 +786,12 @@ func (a *App) generateTags() []string {
 	if a.DockerImage != "" {
 		tags = append(tags, fmt.Sprintf("image:%v", a.DockerImage))
 	}
+	tags = append(tags, a.MetadataTags...)
 
 	return tags
 }
 
-func (a *App) setAppData(resolvedApp cfclient.App) {
+func (a *App) setAppData(resolvedApp ccApp, metadataTags []string) {
 	// See https://apidocs.cloudfoundry.org/9.0.0/apps/retrieve_a_particular_app.html for the description of attributes
 	a.Name = resolvedApp.Name
 	if resolvedApp.Buildpack != "" {
@@ -464,8 +799,12 @@ func (a *App) setAppData(resolvedApp cfclient.App) {
 	} else if resolvedApp.DetectedBuildpack != "" {
 		a.Buildpack = resolvedApp.DetectedBuildpack
 	}
-	a.Command = resolvedApp.Command
-	a.DockerImage = resolvedApp.DockerImage
+	if !resolvedApp.CommandHidden {
+		a.Command = resolvedApp.Command
+	}
+	if !resolvedApp.ImageHidden {
+		a.DockerImage = resolvedApp.DockerImage
+	}
 	a.Diego = resolvedApp.Diego
 	a.SpaceID = resolvedApp.SpaceGuid
 	a.NumberOfInstances = resolvedApp.Instances
@@ -478,6 +817,7 @@ func (a *App) setAppData(resolvedApp cfclient.App) {
 	a.SpaceName = resolvedApp.SpaceData.Entity.Name
 	a.OrgName = resolvedApp.SpaceData.Entity.OrgData.Entity.Name
 	a.OrgID = resolvedApp.SpaceData.Entity.OrgData.Entity.Guid
+	a.MetadataTags = metadataTags
 
 	a.Tags = a.generateTags()
 }
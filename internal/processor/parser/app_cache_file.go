@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheSnapshotVersion is bumped when the format of the snapshots changes, older snapshots are ignored
+const cacheSnapshotVersion = 1
+
+// cacheSnapshot is the content of the app cache file
+type cacheSnapshot struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	Apps    []*App    `json:"apps"`
+}
+
+// marshalSnapshot encodes the apps of the cache, holding the lock so that none is added or removed meanwhile. The
+// apps are updated under their own lock, by the workers and when they are added again, so each app is copied under
+// it before being encoded.
+func (c *appCache) marshalSnapshot(savedAt time.Time) ([]byte, int, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	snapshot := cacheSnapshot{
+		Version: cacheSnapshotVersion,
+		SavedAt: savedAt,
+		Apps:    make([]*App, 0, len(c.apps)),
+	}
+	for _, app := range c.apps {
+		snapshot.Apps = append(snapshot.Apps, app.snapshot())
+	}
+	data, err := json.Marshal(snapshot)
+	return data, len(snapshot.Apps), err
+}
+
+// load fills the cache with the apps of a snapshot, and marks it as usable but stale until the next full resync
+func (c *appCache) load(apps []*App) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, app := range apps {
+		if app == nil || app.GUID == "" {
+			continue
+		}
+		app.instances = make(map[int32]*instanceUsage)
+		c.apps[app.GUID] = app
+	}
+	c.warmedUp = true
+	c.stale = true
+}
+
+// saveCacheFile writes the cache to the cache file. The file is replaced atomically, so that a nozzle stopped
+// in the middle of a snapshot still finds the previous one.
+func (am *AppParser) saveCacheFile() {
+	if am.cacheFile == "" || !am.AppCache.IsWarmedUp() {
+		return
+	}
+	am.cacheFileLock.Lock()
+	defer am.cacheFileLock.Unlock()
+
+	data, size, err := am.AppCache.marshalSnapshot(time.Now())
+	if err != nil {
+		am.log.Errorf("Error encoding the app cache snapshot: %v", err)
+		return
+	}
+	if err := writeFileAtomic(am.cacheFile, data); err != nil {
+		am.log.Errorf("Error writing the app cache snapshot to %s: %v", am.cacheFile, err)
+		return
+	}
+	am.log.Debugf("Saved %d apps to %s", size, am.cacheFile)
+}
+
+// loadCacheFile fills the cache from the cache file, if any
+func (am *AppParser) loadCacheFile() {
+	data, err := ioutil.ReadFile(am.cacheFile)
+	if os.IsNotExist(err) {
+		am.log.Infof("No app cache snapshot found at %s", am.cacheFile)
+		return
+	}
+	if err != nil {
+		am.log.Errorf("Error reading the app cache snapshot %s: %v", am.cacheFile, err)
+		return
+	}
+
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		am.log.Errorf("Error decoding the app cache snapshot %s: %v", am.cacheFile, err)
+		return
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		am.log.Warnf("Ignoring the app cache snapshot %s of version %d, expected version %d", am.cacheFile, snapshot.Version, cacheSnapshotVersion)
+		return
+	}
+
+	am.AppCache.load(snapshot.Apps)
+	am.log.Infof("Loaded %d apps saved %s ago from %s, refreshing them in the background",
+		am.AppCache.Size(), time.Since(snapshot.SavedAt).Round(time.Second), am.cacheFile)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error replacing %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package parser
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/pkg/errors"
+)
+
+// errAppNotFound is returned by the cloud controller lookups of apps that don't exist
+var errAppNotFound = errors.New("the app could not be found")
+
+// errUnknownApp is returned for the apps recently found missing from the cloud controller
+var errUnknownApp = errors.New("the app was not found by a recent lookup")
+
+// errLookupRateLimited is returned when too many apps were looked up recently
+var errLookupRateLimited = errors.New("too many app lookups, try again later")
+
+// AppLookupStats counts the cache hits and misses of the app metrics, and the cloud controller lookups of the
+// missed apps since the start of the nozzle
+type AppLookupStats struct {
+	Hits uint64
+	// Misses are the app metrics of apps missing from the cache
+	Misses uint64
+	// Lookups are the requests sent to the cloud controller, LookupErrors the ones which failed
+	Lookups      uint64
+	LookupErrors uint64
+	// Coalesced are the misses which waited for the lookup of the same app by another worker
+	Coalesced uint64
+	// RateLimited are the misses which weren't looked up because of the rate limit
+	RateLimited uint64
+	// NegativeHits are the misses of apps found missing from the cloud controller by a recent lookup
+	NegativeHits uint64
+}
+
+// appLookup is a lookup of an app in progress, shared by the workers missing the same app
+type appLookup struct {
+	done chan struct{}
+	app  *App
+	err  error
+}
+
+// appLookups looks up the apps missing from the cache, at most once at a time per app, and at most rate times per
+// second overall. The apps which don't exist are not looked up again before negativeTTL.
+type appLookups struct {
+	// stats is first to keep its counters 64-bit aligned for the atomic operations
+	stats       AppLookupStats
+	lock        sync.Mutex
+	inFlight    map[string]*appLookup
+	unknown     map[string]time.Time
+	negativeTTL time.Duration
+	limiter     *rateLimiter
+	now         func() time.Time
+}
+
+func newAppLookups(rate int, negativeTTL time.Duration) *appLookups {
+	return &appLookups{
+		inFlight:    make(map[string]*appLookup),
+		unknown:     make(map[string]time.Time),
+		negativeTTL: negativeTTL,
+		limiter:     newRateLimiter(rate, time.Now),
+		now:         time.Now,
+	}
+}
+
+// get returns the app looked up by lookup, or the result of the lookup of the same app already in progress
+func (l *appLookups) get(guid string, lookup func() (*App, error)) (*App, error) {
+	l.lock.Lock()
+	if expiry, ok := l.unknown[guid]; ok {
+		if l.now().Before(expiry) {
+			l.lock.Unlock()
+			atomic.AddUint64(&l.stats.NegativeHits, 1)
+			return nil, errUnknownApp
+		}
+		delete(l.unknown, guid)
+	}
+	if call, ok := l.inFlight[guid]; ok {
+		l.lock.Unlock()
+		atomic.AddUint64(&l.stats.Coalesced, 1)
+		<-call.done
+		return call.app, call.err
+	}
+	if !l.limiter.Allow() {
+		l.lock.Unlock()
+		atomic.AddUint64(&l.stats.RateLimited, 1)
+		return nil, errLookupRateLimited
+	}
+	call := &appLookup{done: make(chan struct{})}
+	l.inFlight[guid] = call
+	l.lock.Unlock()
+
+	atomic.AddUint64(&l.stats.Lookups, 1)
+	call.app, call.err = lookup()
+
+	l.lock.Lock()
+	delete(l.inFlight, guid)
+	if call.err != nil {
+		atomic.AddUint64(&l.stats.LookupErrors, 1)
+		if isAppNotFound(call.err) {
+			l.unknown[guid] = l.now().Add(l.negativeTTL)
+		}
+	}
+	l.lock.Unlock()
+	close(call.done)
+
+	return call.app, call.err
+}
+
+// Stats returns a copy of the counters
+func (l *appLookups) Stats() AppLookupStats {
+	return AppLookupStats{
+		Hits:         atomic.LoadUint64(&l.stats.Hits),
+		Misses:       atomic.LoadUint64(&l.stats.Misses),
+		Lookups:      atomic.LoadUint64(&l.stats.Lookups),
+		LookupErrors: atomic.LoadUint64(&l.stats.LookupErrors),
+		Coalesced:    atomic.LoadUint64(&l.stats.Coalesced),
+		RateLimited:  atomic.LoadUint64(&l.stats.RateLimited),
+		NegativeHits: atomic.LoadUint64(&l.stats.NegativeHits),
+	}
+}
+
+func isAppNotFound(err error) bool {
+	return errors.Cause(err) == errAppNotFound || cfclient.IsAppNotFoundError(err)
+}
+
+// rateLimiter is a token bucket holding up to one second of tokens
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate events per second, or any number of events if rate is 0
+func newRateLimiter(rate int, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// Allow takes a token if there is one. It isn't safe for concurrent use.
+func (r *rateLimiter) Allow() bool {
+	if r.rate <= 0 {
+		return true
+	}
+
+	now := r.now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
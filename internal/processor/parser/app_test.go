@@ -3,9 +3,15 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
 	. "github.com/DataDog/datadog-firehose-nozzle/test/helper"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	"github.com/gogo/protobuf/proto"
@@ -24,6 +30,7 @@ var _ = Describe("AppMetrics", func() {
 		fakeCloudControllerAPI *FakeCloudControllerAPI
 		ccAPIURL               string
 		fakeCfClient           *cfclient.Client
+		parserConfig           *config.Config
 	)
 
 	BeforeEach(func() {
@@ -40,16 +47,22 @@ var _ = Describe("AppMetrics", func() {
 			UserAgent:         "datadog-firehose-nozzle",
 		}
 		fakeCfClient, _ = cfclient.NewClient(&cfg)
+		parserConfig = &config.Config{
+			NumCacheWorkers:      5,
+			GrabInterval:         10,
+			FullResyncInterval:   60,
+			UnknownAppTTLSeconds: 60,
+		}
 	}, 0)
 
 	Context("generator function", func() {
 		It("errors out properly when it cannot connect", func() {
-			_, err := NewAppParser(nil, 5, 10, log, []string{}, "")
+			_, err := NewAppParser(nil, parserConfig, nil, log)
 			Expect(err).NotTo(BeNil())
 		})
 
 		It("generates it properly when it can connect", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "")
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
 		})
@@ -57,7 +70,8 @@ var _ = Describe("AppMetrics", func() {
 
 	Context("cache warmup", func() {
 		It("requests all the apps directly at startup", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "")
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
@@ -68,7 +82,8 @@ var _ = Describe("AppMetrics", func() {
 		})
 		It("requests all the apps when there are less runners than pages", func() {
 			fakeCloudControllerAPI.AppNumber = 10
-			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "")
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
@@ -79,7 +94,8 @@ var _ = Describe("AppMetrics", func() {
 		})
 		It("requests all the apps when there are more runners than pages", func() {
 			fakeCloudControllerAPI.AppNumber = 2
-			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "")
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
@@ -90,7 +106,9 @@ var _ = Describe("AppMetrics", func() {
 		})
 		It("requests all the apps when there are as many runners as pages", func() {
 			fakeCloudControllerAPI.AppNumber = 3
-			a, err := NewAppParser(fakeCfClient, 3, 999, log, []string{}, "")
+			parserConfig.NumCacheWorkers = 3
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
@@ -99,9 +117,82 @@ var _ = Describe("AppMetrics", func() {
 				Expect(a.AppCache.apps).To(HaveKey(fmt.Sprintf("app-%d", i)))
 			}
 		})
+		It("lists the apps and their web processes from the v3 API", func() {
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			app := a.AppCache.Get("app-3")
+			Expect(app).NotTo(BeNil())
+			Expect(app.Name).To(Equal("app-3"))
+			Expect(app.Buildpack).To(Equal("ruby_buildpack"))
+			Expect(app.Diego).To(BeTrue())
+			Expect(app.SpaceID).To(Equal("417b893e-291e-48ec-94c7-7b2348604365"))
+			Expect(app.SpaceName).To(Equal("system"))
+			Expect(app.OrgID).To(Equal("671557cf-edcd-49df-9863-ee14513d13c7"))
+			Expect(app.OrgName).To(Equal("system"))
+			Expect(app.NumberOfInstances).To(Equal(1))
+			Expect(app.TotalMemoryConfigured).To(Equal(1024))
+			Expect(app.TotalDiskConfigured).To(Equal(1024))
+			// The commands are hidden in the lists of processes
+			Expect(app.Command).To(BeEmpty())
+
+			var appsRequest *http.Request
+			for appsRequest == nil {
+				var req *http.Request
+				Eventually(fakeCloudControllerAPI.ReceivedRequests).Should(Receive(&req))
+				if req.URL.Path == "/v3/apps" {
+					appsRequest = req
+				}
+			}
+			query := appsRequest.URL.Query()
+			Expect(query.Get("include")).To(Equal("space.organization"))
+			Expect(query.Get("per_page")).To(Equal("5000"))
+			Expect(query.Get("fields[space]")).To(Equal("guid,name,relationships.organization"))
+			Expect(query.Get("fields[space.organization]")).To(Equal("guid,name"))
+		})
+
+		It("falls back to the v2 API when v3 is not available", func() {
+			fakeCloudControllerAPI.DisableV3 = true
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			Expect(len(a.AppCache.apps)).To(Equal(4))
+			Expect(a.AppCache.Get("app-1").Command).To(Equal("bundle exec rake scheduler:start"))
+
+			a.getAppData("app-5")
+			Eventually(requestedPaths(fakeCloudControllerAPI)).Should(ContainElement("/v2/apps/app-5"))
+		})
+
+		It("tags the docker apps with the image of their current droplet", func() {
+			fakeCloudControllerAPI.DockerApps = []string{"app-2"}
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			Expect(a.AppCache.Get("app-2").Tags).To(ContainElement("image:cloudfoundry/app-2:latest"))
+			Expect(a.AppCache.Get("app-1").DockerImage).To(BeEmpty())
+
+			// The droplets are listed with the apps, not requested app by app
+			var droplets []url.Values
+			for len(fakeCloudControllerAPI.ReceivedRequests) > 0 {
+				req := <-fakeCloudControllerAPI.ReceivedRequests
+				Expect(req.URL.Path).NotTo(Equal("/v3/apps/app-2/droplets/current"))
+				if req.URL.Path == "/v3/droplets" {
+					droplets = append(droplets, req.URL.Query())
+				}
+			}
+			Expect(droplets).To(HaveLen(1))
+			Expect(droplets[0].Get("current")).To(Equal("true"))
+			Expect(droplets[0].Get("app_guids")).To(Equal("app-2"))
+		})
+
 		It("does not block while warming cache", func() {
 			fakeCloudControllerAPI.RequestTime = 100
-			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "")
+			parserConfig.GrabInterval = 999
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			// Assertions are done while cache is warming up in the background
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
@@ -111,20 +202,268 @@ var _ = Describe("AppMetrics", func() {
 		})
 	})
 
+	Context("cache refresh", func() {
+		var a *AppParser
+
+		BeforeEach(func() {
+			var err error
+			parserConfig.GrabInterval = 999
+			a, err = NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+		})
+
+		It("only lists the apps and processes updated since the last refresh", func() {
+			fakeCloudControllerAPI.AppInstances = 3
+			fakeCloudControllerAPI.UpdatedProcesses = []string{"app-2"}
+			for len(fakeCloudControllerAPI.ReceivedRequests) > 0 {
+				<-fakeCloudControllerAPI.ReceivedRequests
+			}
+
+			a.refreshCache()
+			Expect(a.AppCache.Get("app-2").NumberOfInstances).To(Equal(3))
+			Expect(a.AppCache.Get("app-1").NumberOfInstances).To(Equal(1))
+
+			var queries []url.Values
+			for len(fakeCloudControllerAPI.ReceivedRequests) > 0 {
+				req := <-fakeCloudControllerAPI.ReceivedRequests
+				if req.URL.Path == "/v3/apps" || req.URL.Path == "/v3/processes" {
+					queries = append(queries, req.URL.Query())
+				}
+			}
+			Expect(queries).To(HaveLen(3))
+			for _, query := range queries[:2] {
+				Expect(query.Get("updated_ats[gt]")).NotTo(BeEmpty())
+			}
+			// The app of the updated process is requested by guid
+			Expect(queries[2].Get("guids")).To(Equal("app-2"))
+		})
+
+		It("keeps the commands and the images hidden by the lists", func() {
+			fakeCloudControllerAPI.DockerApps = []string{"app-2"}
+			a.AppCache.Delete("app-2")
+			app, err := a.getAppData("app-2")
+			Expect(err).To(BeNil())
+			Expect(app.Command).To(Equal("bundle exec rake scheduler:start"))
+			Expect(app.DockerImage).To(Equal("cloudfoundry/app-2:latest"))
+
+			a.warmupCache()
+			fakeCloudControllerAPI.UpdatedApps = []string{"app-2"}
+			a.refreshCache()
+			app = a.AppCache.Get("app-2")
+			Expect(app.Tags).To(ContainElement("command:bundle exec rake scheduler:start"))
+			Expect(app.Tags).To(ContainElement("image:cloudfoundry/app-2:latest"))
+
+			// The image is dropped once the app doesn't run on docker anymore
+			fakeCloudControllerAPI.DockerApps = nil
+			a.warmupCache()
+			app = a.AppCache.Get("app-2")
+			Expect(app.DockerImage).To(BeEmpty())
+			Expect(app.Command).To(Equal("bundle exec rake scheduler:start"))
+		})
+
+		It("evicts the deleted apps", func() {
+			fakeCloudControllerAPI.DeletedApps = []string{"app-3"}
+			a.refreshCache()
+			Expect(a.AppCache.Get("app-3")).To(BeNil())
+			Expect(a.AppCache.Size()).To(Equal(3))
+		})
+
+		It("evicts the apps missing from a full resync", func() {
+			fakeCloudControllerAPI.AppNumber = 2
+			a.warmupCache()
+			Expect(a.AppCache.Size()).To(Equal(2))
+			Expect(a.AppCache.Get("app-3")).To(BeNil())
+		})
+
+		It("resyncs the whole cache every full resync interval", func() {
+			Expect(a.needsFullResync()).To(BeFalse())
+			a.lastFullSync = time.Now().Add(-61 * time.Minute)
+			Expect(a.needsFullResync()).To(BeTrue())
+		})
+
+		It("always resyncs the whole cache from the v2 API", func() {
+			fakeCloudControllerAPI.DisableV3 = true
+			a.warmupCache()
+			Expect(a.needsFullResync()).To(BeTrue())
+		})
+	})
+
+	Context("cache file", func() {
+		var cacheFile string
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "app-cache")
+			Expect(err).To(BeNil())
+			cacheFile = filepath.Join(dir, "app_cache.json")
+			parserConfig.GrabInterval = 999
+			parserConfig.AppCacheFile = cacheFile
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(cacheFile))
+		})
+
+		It("saves the cache after the warmup and when stopped", func() {
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(func() error {
+				_, err := os.Stat(cacheFile)
+				return err
+			}).Should(Succeed())
+
+			os.Remove(cacheFile)
+			a.Stop()
+			_, err = os.Stat(cacheFile)
+			Expect(err).To(BeNil())
+		})
+
+		It("loads the saved cache as stale, and resyncs it in the background", func() {
+			fakeCloudControllerAPI.AppNumber = 5
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			a.Stop()
+
+			// app-5 was deleted while the nozzle was stopped
+			fakeCloudControllerAPI.AppNumber = 4
+			fakeCloudControllerAPI.RequestTime = 100
+			b, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Expect(b.AppCache.IsWarmedUp()).To(BeTrue())
+			Expect(b.AppCache.IsStale()).To(BeTrue())
+			Expect(b.AppCache.Size()).To(Equal(5))
+			app := b.AppCache.Get("app-3")
+			Expect(app).NotTo(BeNil())
+			Expect(app.Name).To(Equal("app-3"))
+			Expect(app.OrgName).To(Equal("system"))
+			Expect(app.Tags).To(ContainElement("app_name:app-3"))
+
+			Eventually(b.AppCache.IsStale, 10*time.Second).Should(BeFalse())
+			Expect(b.AppCache.Size()).To(Equal(4))
+			Expect(b.AppCache.Get("app-5")).To(BeNil())
+		})
+
+		It("copies the apps under their lock while the workers update them", func() {
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					a.Parse(&events.Envelope{
+						Origin:    proto.String("test-origin"),
+						Timestamp: proto.Int64(1000000000),
+						EventType: events.Envelope_ContainerMetric.Enum(),
+						ContainerMetric: &events.ContainerMetric{
+							ApplicationId: proto.String("app-1"),
+							InstanceIndex: proto.Int32(int32(i % 3)),
+							MemoryBytes:   proto.Uint64(uint64(i)),
+							DiskBytes:     proto.Uint64(uint64(i)),
+						},
+						Ip: proto.String(fmt.Sprintf("10.0.1.%d", i)),
+					})
+				}
+			}()
+			for i := 0; i < 100; i++ {
+				_, count, err := a.AppCache.marshalSnapshot(time.Now())
+				Expect(err).To(BeNil())
+				Expect(count).To(Equal(a.AppCache.Size()))
+			}
+			<-done
+		})
+
+		It("updates the apps under their lock when they are added again", func() {
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					a.AppCache.Add(ccApp{App: cfclient.App{Guid: "app-1", Name: fmt.Sprintf("app-1-%d", i)}}, nil)
+				}
+			}()
+			for i := 0; i < 100; i++ {
+				_, err := a.Parse(&events.Envelope{
+					Origin:    proto.String("test-origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ContainerMetric.Enum(),
+					ContainerMetric: &events.ContainerMetric{
+						ApplicationId: proto.String("app-1"),
+						InstanceIndex: proto.Int32(0),
+						MemoryBytes:   proto.Uint64(uint64(i)),
+					},
+				})
+				Expect(err).To(BeNil())
+				_, _, err = a.AppCache.marshalSnapshot(time.Now())
+				Expect(err).To(BeNil())
+			}
+			<-done
+		})
+
+		It("starts with an empty cache when the file can't be read", func() {
+			Expect(ioutil.WriteFile(cacheFile, []byte("{not json"), 0600)).To(Succeed())
+			fakeCloudControllerAPI.RequestTime = 100
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Expect(a.AppCache.IsWarmedUp()).To(BeFalse())
+			Expect(a.AppCache.IsStale()).To(BeFalse())
+			Eventually(a.AppCache.IsWarmedUp, 10*time.Second).Should(BeTrue())
+		})
+	})
+
 	Context("app metrics test", func() {
 		It("tries to get it from the cloud controller when not in the cache", func() {
-			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "")
+			a, _ := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			_, err := a.getAppData("app-5")
-			Expect(err).ToNot(BeNil()) // error expected because fake CC won't return an app, so unmarshalling will fail
-			var req *http.Request
-			Eventually(fakeCloudControllerAPI.ReceivedRequests).Should(Receive()) // /v2/info
-			Eventually(fakeCloudControllerAPI.ReceivedRequests).Should(Receive()) // /oauth/token
-			Eventually(fakeCloudControllerAPI.ReceivedRequests).Should(Receive(&req))
-			Expect(req.URL.Path).To(Equal("/v2/apps/app-5"))
+			Expect(err).ToNot(BeNil()) // error expected because fake CC doesn't know app-5
+			Eventually(requestedPaths(fakeCloudControllerAPI)).Should(ContainElement("/v3/apps/app-5"))
+		})
+
+		It("gets the app, its space, org and web process from the v3 API", func() {
+			a, _ := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			a.AppCache.Delete("app-2")
+
+			app, err := a.getAppData("app-2")
+			Expect(err).To(BeNil())
+			Expect(app.Name).To(Equal("app-2"))
+			Expect(app.Command).To(Equal("bundle exec rake scheduler:start"))
+			Expect(app.SpaceName).To(Equal("system"))
+			Expect(app.OrgName).To(Equal("system"))
+			Expect(app.NumberOfInstances).To(Equal(1))
+			Expect(app.TotalMemoryConfigured).To(Equal(1024))
+			Expect(app.TotalDiskConfigured).To(Equal(1024))
+		})
+
+		It("keeps the apps without a web process or a current droplet", func() {
+			fakeCloudControllerAPI.WorkerApps = []string{"app-2"}
+			fakeCloudControllerAPI.DockerApps = []string{"app-3"}
+			fakeCloudControllerAPI.UnstagedApps = []string{"app-3"}
+			a, _ := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			a.AppCache.Delete("app-2")
+			a.AppCache.Delete("app-3")
+
+			app, err := a.getAppData("app-2")
+			Expect(err).To(BeNil())
+			Expect(app.Name).To(Equal("app-2"))
+			Expect(app.NumberOfInstances).To(Equal(0))
+
+			app, err = a.getAppData("app-3")
+			Expect(err).To(BeNil())
+			Expect(app.Name).To(Equal("app-3"))
+			Expect(app.DockerImage).To(BeEmpty())
+			Expect(a.lookups.Stats().LookupErrors).To(BeZero())
+			Expect(a.lookups.unknown).To(BeEmpty())
 		})
 
 		It("grabs from the cache when it present", func() {
-			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "")
+			a, _ := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
 			Expect(a.AppCache.apps).To(HaveKey("app-4"))
 			app, err := a.getAppData("app-4")
@@ -133,9 +472,117 @@ var _ = Describe("AppMetrics", func() {
 		})
 	})
 
+	Context("cache misses", func() {
+		var a *AppParser
+
+		countRequests := func(path string) int {
+			count := 0
+			for len(fakeCloudControllerAPI.ReceivedRequests) > 0 {
+				if req := <-fakeCloudControllerAPI.ReceivedRequests; req.URL.Path == path {
+					count++
+				}
+			}
+			return count
+		}
+
+		BeforeEach(func() {
+			var err error
+			parserConfig.GrabInterval = 999
+			parserConfig.AppLookupsPerSecond = 2
+			a, err = NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			countRequests("")
+		})
+
+		It("looks up an app once for the concurrent misses", func() {
+			fakeCloudControllerAPI.AppNumber = 5
+			fakeCloudControllerAPI.RequestTime = 200
+
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					app, err := a.getAppData("app-5")
+					Expect(err).To(BeNil())
+					Expect(app.Name).To(Equal("app-5"))
+				}()
+			}
+			wg.Wait()
+
+			Expect(countRequests("/v3/apps/app-5")).To(Equal(1))
+			stats := a.LookupStats()
+			Expect(stats.Misses).To(BeEquivalentTo(5))
+			Expect(stats.Lookups).To(BeEquivalentTo(1))
+			Expect(stats.Coalesced).To(BeEquivalentTo(4))
+		})
+
+		It("does not look up the unknown apps again before the TTL", func() {
+			_, err := a.getAppData("app-9")
+			Expect(err).NotTo(BeNil())
+			_, err = a.getAppData("app-9")
+			Expect(err).To(Equal(errUnknownApp))
+			Expect(countRequests("/v3/apps/app-9")).To(Equal(1))
+
+			a.lookups.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+			_, err = a.getAppData("app-9")
+			Expect(err).NotTo(Equal(errUnknownApp))
+			Expect(countRequests("/v3/apps/app-9")).To(Equal(1))
+			Expect(a.LookupStats().NegativeHits).To(BeEquivalentTo(1))
+		})
+
+		It("limits the rate of the lookups", func() {
+			for _, guid := range []string{"app-7", "app-8"} {
+				_, err := a.getAppData(guid)
+				Expect(err).NotTo(Equal(errLookupRateLimited))
+			}
+			_, err := a.getAppData("app-9")
+			Expect(err).To(Equal(errLookupRateLimited))
+			Expect(countRequests("/v3/apps/app-9")).To(Equal(0))
+			Expect(a.LookupStats().RateLimited).To(BeEquivalentTo(1))
+		})
+
+		It("counts the cache hits", func() {
+			_, err := a.getAppData("app-1")
+			Expect(err).To(BeNil())
+			stats := a.LookupStats()
+			Expect(stats.Hits).To(BeEquivalentTo(1))
+			Expect(stats.Misses).To(BeEquivalentTo(0))
+		})
+	})
+
+	Context("rate limiter", func() {
+		It("refills the tokens over time, up to one second of tokens", func() {
+			now := time.Now()
+			limiter := newRateLimiter(2, func() time.Time { return now })
+			Expect(limiter.Allow()).To(BeTrue())
+			Expect(limiter.Allow()).To(BeTrue())
+			Expect(limiter.Allow()).To(BeFalse())
+
+			now = now.Add(500 * time.Millisecond)
+			Expect(limiter.Allow()).To(BeTrue())
+			Expect(limiter.Allow()).To(BeFalse())
+
+			now = now.Add(time.Hour)
+			Expect(limiter.Allow()).To(BeTrue())
+			Expect(limiter.Allow()).To(BeTrue())
+			Expect(limiter.Allow()).To(BeFalse())
+		})
+
+		It("does not limit without a rate", func() {
+			limiter := newRateLimiter(0, time.Now)
+			for i := 0; i < 100; i++ {
+				Expect(limiter.Allow()).To(BeTrue())
+			}
+		})
+	})
+
 	Context("metric evaluation test", func() {
 		It("parses an event properly", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name")
+			parserConfig.EnvironmentName = "env_name"
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Expect(err).To(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
 
@@ -163,7 +610,7 @@ var _ = Describe("AppMetrics", func() {
 			metrics, err := a.Parse(event)
 
 			Expect(err).To(BeNil())
-			Expect(metrics).To(HaveLen(10))
+			Expect(metrics).To(HaveLen(15))
 
 			Expect(metrics).To(ContainMetric("app.disk.configured"))
 			Expect(metrics).To(ContainMetric("app.disk.provisioned"))
@@ -175,6 +622,11 @@ var _ = Describe("AppMetrics", func() {
 			Expect(metrics).To(ContainMetric("app.disk.quota"))
 			Expect(metrics).To(ContainMetric("app.memory.used"))
 			Expect(metrics).To(ContainMetric("app.memory.quota"))
+			Expect(metrics).To(ContainMetric("app.memory.utilization"))
+			Expect(metrics).To(ContainMetric("app.disk.utilization"))
+			Expect(metrics).To(ContainMetric("app.memory.used.total"))
+			Expect(metrics).To(ContainMetric("app.disk.used.total"))
+			Expect(metrics).To(ContainMetric("app.instances.running"))
 
 			for _, metric := range metrics {
 				Expect(metric.MetricValue.Tags).To(ContainElement("app_name:app-1"))
@@ -184,9 +636,262 @@ var _ = Describe("AppMetrics", func() {
 		})
 	})
 
+	Context("logs", func() {
+		It("enriches logs with the cached app metadata", func() {
+			parserConfig.EnvironmentName = "env_name"
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			logParser := NewLogParser("env_name", []string{"custom:tag"}, a)
+			l, err := logParser.Parse(&events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{
+					Message:     []byte("log message"),
+					MessageType: events.LogMessage_OUT.Enum(),
+					Timestamp:   proto.Int64(1000000000),
+					AppId:       proto.String("app-1"),
+				},
+			})
+
+			Expect(err).To(BeNil())
+			Expect(l.Service).To(Equal("app-1"))
+			Expect(l.Status).To(Equal("info"))
+			Expect(l.Tags).To(ContainSubstring("app_name:app-1"))
+			Expect(l.Tags).To(ContainSubstring("org_name:system"))
+			Expect(l.Tags).To(ContainSubstring("space_name:system"))
+			Expect(l.Tags).To(ContainSubstring("custom:tag"))
+			Expect(l.Tags).To(ContainSubstring("env:env_name"))
+		})
+
+		It("does not look up the cloud controller for apps missing from the cache", func() {
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			logParser := NewLogParser("", []string{}, a)
+			l, err := logParser.Parse(&events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{
+					Message:     []byte("log message"),
+					MessageType: events.LogMessage_OUT.Enum(),
+					Timestamp:   proto.Int64(1000000000),
+					AppId:       proto.String("unknown-app"),
+				},
+			})
+
+			Expect(err).To(BeNil())
+			Expect(l.Service).To(Equal("rep"))
+			Expect(l.Tags).ToNot(ContainSubstring("app_name"))
+		})
+	})
+
+	Context("container metrics", func() {
+		containerMetric := func(instance int32, cpu float64) *events.Envelope {
+			return &events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ContainerMetric.Enum(),
+				ContainerMetric: &events.ContainerMetric{
+					CpuPercentage:    proto.Float64(cpu),
+					DiskBytes:        proto.Uint64(uint64(1)),
+					DiskBytesQuota:   proto.Uint64(uint64(1)),
+					MemoryBytes:      proto.Uint64(uint64(1)),
+					MemoryBytesQuota: proto.Uint64(uint64(1)),
+					ApplicationId:    proto.String("app-1"),
+					InstanceIndex:    proto.Int32(instance),
+				},
+			}
+		}
+
+		It("sends distributions across the instances", func() {
+			parserConfig.CustomTags = []string{"custom:tag"}
+			parserConfig.ContainerMetrics = config.ContainerMetrics{Distributions: true}
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			metrics := metric.MetricsMap{}
+			for i, cpu := range []float64{10, 20, 30} {
+				packages, err := a.Parse(containerMetric(int32(i), cpu))
+				Expect(err).To(BeNil())
+				Expect(packages).To(HaveLen(22))
+				for _, p := range packages {
+					metrics.Add(*p.MetricKey, *p.MetricValue)
+				}
+			}
+
+			var cpu *metric.MetricValue
+			for k, v := range metrics {
+				if k.Name == "app.distribution.cpu.pct" {
+					value := v
+					cpu = &value
+				}
+			}
+			Expect(cpu).NotTo(BeNil())
+			Expect(cpu.Type).To(Equal(metric.Distribution))
+			Expect(cpu.Host).To(BeEmpty())
+			Expect(cpu.Tags).To(ContainElement("app_name:app-1"))
+			Expect(cpu.Tags).To(ContainElement("custom:tag"))
+			Expect(cpu.Tags).NotTo(ContainElement(HavePrefix("instance:")))
+			Expect(cpu.Points).To(HaveLen(3))
+			Expect(cpu.Points[0].Value).To(Equal(10.0))
+			Expect(cpu.Points[1].Value).To(Equal(20.0))
+			Expect(cpu.Points[2].Value).To(Equal(30.0))
+		})
+
+		It("does not send the per instance gauges when they are disabled", func() {
+			parserConfig.ContainerMetrics = config.ContainerMetrics{Distributions: true, DisableInstanceGauges: true}
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			metrics, err := a.Parse(containerMetric(0, 10))
+
+			Expect(err).To(BeNil())
+			Expect(metrics).To(HaveLen(15))
+			Expect(metrics).To(ContainMetric("app.instances"))
+			Expect(metrics).To(ContainMetric("app.distribution.cpu.pct"))
+			Expect(metrics).To(ContainMetric("app.distribution.memory.used"))
+			Expect(metrics).NotTo(ContainMetric("app.cpu.pct"))
+			Expect(metrics).NotTo(ContainMetric("app.memory.used"))
+		})
+	})
+
+	Context("derived metrics", func() {
+		var a *AppParser
+
+		containerMetric := func(instance int32, cpu float64, memory uint64, disk uint64) *events.Envelope {
+			return &events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ContainerMetric.Enum(),
+				ContainerMetric: &events.ContainerMetric{
+					CpuPercentage:    proto.Float64(cpu),
+					DiskBytes:        proto.Uint64(disk),
+					DiskBytesQuota:   proto.Uint64(uint64(2000)),
+					MemoryBytes:      proto.Uint64(memory),
+					MemoryBytesQuota: proto.Uint64(uint64(1000)),
+					ApplicationId:    proto.String("app-1"),
+					InstanceIndex:    proto.Int32(instance),
+				},
+			}
+		}
+
+		values := func(packages []metric.MetricPackage) map[string]float64 {
+			values := make(map[string]float64)
+			for _, p := range packages {
+				values[p.MetricKey.Name] = p.MetricValue.Points[0].Value
+			}
+			return values
+		}
+
+		BeforeEach(func() {
+			var err error
+			parserConfig.ContainerMetrics = config.ContainerMetrics{MemoryMBPerCPU: 8192}
+			a, err = NewAppParser(fakeCfClient, parserConfig, nil, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+		})
+
+		It("computes the utilization of the instance", func() {
+			metrics, err := a.Parse(containerMetric(0, 25, 250, 1000))
+			Expect(err).To(BeNil())
+
+			v := values(metrics)
+			Expect(v["app.memory.utilization"]).To(Equal(25.0))
+			Expect(v["app.disk.utilization"]).To(Equal(50.0))
+			// 1024MB of memory are entitled to 12.5% of a CPU
+			Expect(v["app.cpu.entitlement"]).To(Equal(200.0))
+		})
+
+		It("sums the usage of the running instances", func() {
+			app := a.AppCache.Get("app-1")
+			app.NumberOfInstances = 3
+
+			a.Parse(containerMetric(0, 10, 100, 1000))
+			a.Parse(containerMetric(1, 10, 200, 1000))
+			metrics, err := a.Parse(containerMetric(0, 10, 300, 1000))
+			Expect(err).To(BeNil())
+
+			v := values(metrics)
+			Expect(v["app.memory.used.total"]).To(Equal(500.0))
+			Expect(v["app.disk.used.total"]).To(Equal(2000.0))
+			Expect(v["app.instances.running"]).To(Equal(2.0))
+		})
+
+		It("forgets the instances that are gone", func() {
+			app := a.AppCache.Get("app-1")
+			app.NumberOfInstances = 3
+
+			a.Parse(containerMetric(1, 10, 100, 1000))
+			a.Parse(containerMetric(2, 10, 100, 1000))
+			app.instances[1].reportedAt = time.Now().Add(-instanceExpiry - time.Second)
+			// Scaled down to 2 instances
+			app.NumberOfInstances = 2
+			metrics, err := a.Parse(containerMetric(0, 10, 100, 1000))
+			Expect(err).To(BeNil())
+
+			v := values(metrics)
+			Expect(v["app.memory.used.total"]).To(Equal(100.0))
+			Expect(v["app.instances.running"]).To(Equal(1.0))
+		})
+	})
+
+	Context("metadata tags", func() {
+		It("tags the apps with the selected labels and annotations of the app, its space and org", func() {
+			tagger, err := NewMetadataTagger(config.MetadataTags{
+				Labels:      []string{"team", "env", "mycompany.com/*"},
+				Annotations: []string{"cost-center"},
+			})
+			Expect(err).To(BeNil())
+			a, err := NewAppParser(fakeCfClient, parserConfig, tagger, log)
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			tags := a.AppCache.Get("app-1").getTags()
+			// The labels of the app take precedence over the ones of the space, and the ones of the space over the org
+			Expect(tags).To(ContainElement("team:payments"))
+			Expect(tags).To(ContainElement("env:prod"))
+			Expect(tags).To(ContainElement("tier:gold"))
+			Expect(tags).To(ContainElement("cost-center:1234"))
+			Expect(tags).NotTo(ContainElement("business-unit:retail"))
+			Expect(tags).NotTo(ContainElement("team:platform"))
+		})
+
+		It("requests the whole spaces and orgs to get their metadata", func() {
+			Expect(appsQuery(1, false, url.Values{}).Get("fields[space]")).NotTo(BeEmpty())
+			Expect(appsQuery(1, true, url.Values{}).Get("fields[space]")).To(BeEmpty())
+			Expect(appsQuery(1, true, url.Values{}).Get("fields[space.organization]")).To(BeEmpty())
+		})
+
+		It("prefixes the tag names", func() {
+			tagger, err := NewMetadataTagger(config.MetadataTags{Labels: []string{"/^mycompany\\.com\\//"}, TagPrefix: "cf_"})
+			Expect(err).To(BeNil())
+			Expect(tagger.Tags(map[string]string{"mycompany.com/team": "payments", "team": "platform"}, nil)).To(Equal([]string{"cf_team:payments"}))
+		})
+
+		It("fails on invalid patterns", func() {
+			_, err := NewMetadataTagger(config.MetadataTags{Annotations: []string{"/[/"}})
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("does not tag without a tagger", func() {
+			var tagger *MetadataTagger
+			Expect(tagger.Enabled()).To(BeFalse())
+			Expect(tagger.Tags(map[string]string{"team": "payments"}, nil)).To(BeEmpty())
+		})
+	})
+
 	Context("custom tags", func() {
 		It("attaches custom tags if present", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{"custom:tag", "foo:bar"}, "env_name")
+			parserConfig.CustomTags = []string{"custom:tag", "foo:bar"}
+			parserConfig.EnvironmentName = "env_name"
+			a, err := NewAppParser(fakeCfClient, parserConfig, nil, log)
 			Expect(err).To(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
 
@@ -214,7 +919,7 @@ var _ = Describe("AppMetrics", func() {
 			metrics, err := a.Parse(event)
 
 			Expect(err).To(BeNil())
-			Expect(metrics).To(HaveLen(10))
+			Expect(metrics).To(HaveLen(15))
 
 			for _, metric := range metrics {
 				Expect(metric.MetricValue.Tags).To(ContainElement("app_name:app-1"))
@@ -228,6 +933,19 @@ var _ = Describe("AppMetrics", func() {
 
 })
 
+// requestedPaths returns a function reading the requests received by the cloud controller, for use with Eventually
+func requestedPaths(api *FakeCloudControllerAPI) func() []string {
+	paths := []string{}
+	return func() []string {
+		select {
+		case req := <-api.ReceivedRequests:
+			paths = append(paths, req.URL.Path)
+		default:
+		}
+		return paths
+	}
+}
+
 type containMetric struct {
 	needle   string
 	haystack []metric.MetricPackage
@@ -0,0 +1,558 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry/gosteno"
+	"github.com/pkg/errors"
+)
+
+// v3PerPage is the maximum page size of the v3 API
+const v3PerPage = 5000
+
+// v3MaxGUIDs is the number of guids filtered by a request, to keep its URL short
+const v3MaxGUIDs = 100
+
+// hiddenCommand replaces the commands of the processes in the v3 lists
+const hiddenCommand = "[PRIVATE DATA HIDDEN IN LISTS]"
+
+// errIncompleteList is returned when some pages of a list couldn't be fetched
+var errIncompleteList = errors.New("some pages couldn't be fetched")
+
+// errV3Unavailable is returned when the cloud controller doesn't serve the v3 API
+var errV3Unavailable = errors.New("the cloud controller v3 API is not available")
+
+// errV3NotFound is returned when a v3 resource doesn't exist
+var errV3NotFound = errors.New("the v3 resource could not be found")
+
+type v3Pagination struct {
+	TotalResults int `json:"total_results"`
+	TotalPages   int `json:"total_pages"`
+}
+
+type v3Relationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+type v3Metadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type v3App struct {
+	GUID      string     `json:"guid"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	CreatedAt string     `json:"created_at"`
+	UpdatedAt string     `json:"updated_at"`
+	Metadata  v3Metadata `json:"metadata"`
+	Lifecycle struct {
+		Type string `json:"type"`
+		Data struct {
+			Buildpacks []string `json:"buildpacks"`
+		} `json:"data"`
+	} `json:"lifecycle"`
+	Relationships struct {
+		Space v3Relationship `json:"space"`
+	} `json:"relationships"`
+}
+
+type v3Space struct {
+	GUID          string     `json:"guid"`
+	Name          string     `json:"name"`
+	Metadata      v3Metadata `json:"metadata"`
+	Relationships struct {
+		Organization v3Relationship `json:"organization"`
+	} `json:"relationships"`
+}
+
+type v3Organization struct {
+	GUID     string     `json:"guid"`
+	Name     string     `json:"name"`
+	Metadata v3Metadata `json:"metadata"`
+}
+
+// v3Included holds the resources included with include=space.organization
+type v3Included struct {
+	Spaces        []v3Space        `json:"spaces"`
+	Organizations []v3Organization `json:"organizations"`
+}
+
+// v3IncludedIndex holds the included spaces and orgs by guid
+type v3IncludedIndex struct {
+	spaces        map[string]v3Space
+	organizations map[string]v3Organization
+}
+
+type v3AppsPage struct {
+	Pagination v3Pagination `json:"pagination"`
+	Resources  []v3App      `json:"resources"`
+	Included   v3Included   `json:"included"`
+}
+
+// v3AppResponse is a single app, with the included resources
+type v3AppResponse struct {
+	v3App
+	Included v3Included `json:"included"`
+}
+
+type v3Process struct {
+	GUID          string `json:"guid"`
+	Type          string `json:"type"`
+	Command       string `json:"command"`
+	Instances     int    `json:"instances"`
+	MemoryInMB    int    `json:"memory_in_mb"`
+	DiskInMB      int    `json:"disk_in_mb"`
+	Relationships struct {
+		App v3Relationship `json:"app"`
+	} `json:"relationships"`
+}
+
+type v3Droplet struct {
+	Image         string `json:"image"`
+	Relationships struct {
+		App v3Relationship `json:"app"`
+	} `json:"relationships"`
+}
+
+type v3DropletsPage struct {
+	Pagination v3Pagination `json:"pagination"`
+	Resources  []v3Droplet  `json:"resources"`
+}
+
+type v3ProcessesPage struct {
+	Pagination v3Pagination `json:"pagination"`
+	Resources  []v3Process  `json:"resources"`
+}
+
+type v3AuditEventsPage struct {
+	Pagination v3Pagination `json:"pagination"`
+	Resources  []struct {
+		Type   string `json:"type"`
+		Target struct {
+			GUID string `json:"guid"`
+			Type string `json:"type"`
+			Name string `json:"name"`
+		} `json:"target"`
+	} `json:"resources"`
+}
+
+// listAppsV3 lists the apps with their space and org from /v3/apps, their instances, memory and disk from the web
+// processes, and the images of the docker apps from their current droplets. The metadata of the spaces and orgs is only requested withMetadata. complete is false if some pages
+// couldn't be fetched. Returns errV3Unavailable if the cloud controller doesn't serve the v3 API.
+func listAppsV3(c *cfclient.Client, numWorkers int, withMetadata bool, log *gosteno.Logger) (apps []ccApp, complete bool, err error) {
+	var processes map[string]v3Process
+	var appsComplete, processesComplete bool
+	var appsErr, processesErr error
+
+	// Apps and processes are listed at the same time, each with numWorkers workers
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		apps, appsComplete, appsErr = getV3Apps(c, numWorkers, withMetadata, url.Values{}, log)
+	}()
+	go func() {
+		defer wg.Done()
+		processes, processesComplete, processesErr = getV3WebProcesses(c, numWorkers, url.Values{}, log)
+	}()
+	wg.Wait()
+
+	if appsErr != nil {
+		return nil, false, appsErr
+	}
+	if processesErr != nil {
+		return nil, false, processesErr
+	}
+
+	for i := range apps {
+		if process, ok := processes[apps[i].Guid]; ok {
+			setProcessData(&apps[i], process)
+		}
+	}
+	if err := setV3CurrentImages(c, apps); err != nil {
+		// The images of the apps already in the cache are kept
+		log.Errorf("Error requesting the current droplets of the docker apps: %v", err)
+	}
+	return apps, appsComplete && processesComplete, nil
+}
+
+// listChangedAppsV3 lists the apps updated after since, or whose web process was updated after since, and the guids
+// of the apps deleted after since
+func listChangedAppsV3(c *cfclient.Client, numWorkers int, withMetadata bool, since time.Time, log *gosteno.Logger) ([]ccApp, []string, error) {
+	updated := url.Values{}
+	updated.Set("updated_ats[gt]", since.UTC().Format(time.RFC3339))
+
+	apps, complete, err := getV3Apps(c, numWorkers, withMetadata, updated, log)
+	if err := pagesError(err, complete); err != nil {
+		return nil, nil, errors.Wrap(err, "Error listing the updated apps")
+	}
+	processes, complete, err := getV3WebProcesses(c, numWorkers, updated, log)
+	if err := pagesError(err, complete); err != nil {
+		return nil, nil, errors.Wrap(err, "Error listing the updated processes")
+	}
+
+	// Get the processes of the updated apps, and the apps of the updated processes
+	changed := make(map[string]bool)
+	var missingProcesses, missingApps []string
+	for _, app := range apps {
+		changed[app.Guid] = true
+		if _, ok := processes[app.Guid]; !ok {
+			missingProcesses = append(missingProcesses, app.Guid)
+		}
+	}
+	for guid := range processes {
+		if !changed[guid] {
+			missingApps = append(missingApps, guid)
+		}
+	}
+
+	for _, guids := range chunk(missingProcesses, v3MaxGUIDs) {
+		q := url.Values{}
+		q.Set("app_guids", strings.Join(guids, ","))
+		chunkProcesses, complete, err := getV3WebProcesses(c, numWorkers, q, log)
+		if err := pagesError(err, complete); err != nil {
+			return nil, nil, errors.Wrap(err, "Error requesting the processes of the updated apps")
+		}
+		for guid, process := range chunkProcesses {
+			processes[guid] = process
+		}
+	}
+	for _, guids := range chunk(missingApps, v3MaxGUIDs) {
+		q := url.Values{}
+		q.Set("guids", strings.Join(guids, ","))
+		chunkApps, complete, err := getV3Apps(c, numWorkers, withMetadata, q, log)
+		if err := pagesError(err, complete); err != nil {
+			return nil, nil, errors.Wrap(err, "Error requesting the apps of the updated processes")
+		}
+		apps = append(apps, chunkApps...)
+	}
+
+	for i := range apps {
+		if process, ok := processes[apps[i].Guid]; ok {
+			setProcessData(&apps[i], process)
+		}
+	}
+	if err := setV3CurrentImages(c, apps); err != nil {
+		return nil, nil, errors.Wrap(err, "Error requesting the current droplets of the updated apps")
+	}
+
+	deleted, err := getV3DeletedApps(c, since)
+	if err != nil {
+		return nil, nil, err
+	}
+	return apps, deleted, nil
+}
+
+// getV3Apps lists the apps matching the filter
+func getV3Apps(c *cfclient.Client, numWorkers int, withMetadata bool, filter url.Values, log *gosteno.Logger) ([]ccApp, bool, error) {
+	var firstPage v3AppsPage
+	if err := getV3(c, "/v3/apps", appsQuery(1, withMetadata, filter), &firstPage); err != nil {
+		return nil, false, errors.Wrap(err, "Error requesting v3 apps page 1")
+	}
+	apps := firstPage.toCCApps()
+
+	var mutex sync.Mutex
+	complete := getPages(firstPage.Pagination.TotalPages, numWorkers, func(pageNb int) error {
+		var page v3AppsPage
+		if err := getV3(c, "/v3/apps", appsQuery(pageNb, withMetadata, filter), &page); err != nil {
+			log.Errorf("Error requesting v3 apps page %d: %v", pageNb, err)
+			return err
+		}
+		mutex.Lock()
+		apps = append(apps, page.toCCApps()...)
+		mutex.Unlock()
+		return nil
+	})
+	return apps, complete, nil
+}
+
+// getV3WebProcesses returns the web process of each app matching the filter, by app guid
+func getV3WebProcesses(c *cfclient.Client, numWorkers int, filter url.Values, log *gosteno.Logger) (map[string]v3Process, bool, error) {
+	var firstPage v3ProcessesPage
+	if err := getV3(c, "/v3/processes", processesQuery(1, filter), &firstPage); err != nil {
+		return nil, false, errors.Wrap(err, "Error requesting v3 processes page 1")
+	}
+	processes := make(map[string]v3Process)
+	for _, process := range firstPage.Resources {
+		processes[process.Relationships.App.Data.GUID] = process
+	}
+
+	var mutex sync.Mutex
+	complete := getPages(firstPage.Pagination.TotalPages, numWorkers, func(pageNb int) error {
+		var page v3ProcessesPage
+		if err := getV3(c, "/v3/processes", processesQuery(pageNb, filter), &page); err != nil {
+			log.Errorf("Error requesting v3 processes page %d: %v", pageNb, err)
+			return err
+		}
+		mutex.Lock()
+		for _, process := range page.Resources {
+			processes[process.Relationships.App.Data.GUID] = process
+		}
+		mutex.Unlock()
+		return nil
+	})
+	return processes, complete, nil
+}
+
+// getV3DeletedApps returns the guids of the apps deleted after since, from the audit events
+func getV3DeletedApps(c *cfclient.Client, since time.Time) ([]string, error) {
+	var deleted []string
+	for pageNb, totalPages := 1, 1; pageNb <= totalPages; pageNb++ {
+		q := url.Values{}
+		q.Set("types", "audit.app.delete-request")
+		q.Set("created_ats[gt]", since.UTC().Format(time.RFC3339))
+		q.Set("per_page", strconv.Itoa(v3PerPage))
+		q.Set("page", strconv.Itoa(pageNb))
+
+		var page v3AuditEventsPage
+		if err := getV3(c, "/v3/audit_events", q, &page); err != nil {
+			return nil, errors.Wrapf(err, "Error requesting v3 audit events page %d", pageNb)
+		}
+		for _, event := range page.Resources {
+			deleted = append(deleted, event.Target.GUID)
+		}
+		totalPages = page.Pagination.TotalPages
+	}
+	return deleted, nil
+}
+
+// setV3CurrentImages sets the images of the docker apps from their current droplet, requested for v3MaxGUIDs apps at a
+// time. The images of the apps whose droplets couldn't be requested stay hidden.
+func setV3CurrentImages(c *cfclient.Client, apps []ccApp) error {
+	indexes := make(map[string]int)
+	var guids []string
+	for i, app := range apps {
+		if app.ImageHidden {
+			indexes[app.Guid] = i
+			guids = append(guids, app.Guid)
+		}
+	}
+
+	for _, chunkGUIDs := range chunk(guids, v3MaxGUIDs) {
+		for pageNb, totalPages := 1, 1; pageNb <= totalPages; pageNb++ {
+			q := url.Values{}
+			q.Set("current", "true")
+			q.Set("app_guids", strings.Join(chunkGUIDs, ","))
+			var page v3DropletsPage
+			if err := getV3(c, "/v3/droplets", pageQuery(pageNb, q), &page); err != nil {
+				return errors.Wrapf(err, "Error requesting v3 droplets page %d", pageNb)
+			}
+			for _, droplet := range page.Resources {
+				if i, ok := indexes[droplet.Relationships.App.Data.GUID]; ok {
+					apps[i].DockerImage = droplet.Image
+					apps[i].ImageHidden = false
+				}
+			}
+			totalPages = page.Pagination.TotalPages
+		}
+	}
+	return nil
+}
+
+// appByGUIDV3 gets an app, its space and org, its web process and the image of its current droplet for docker apps.
+// Only a missing app returns errAppNotFound, the apps without a web process or a current droplet are kept without
+// their process data or image.
+func appByGUIDV3(c *cfclient.Client, guid string) (ccApp, error) {
+	q := url.Values{}
+	q.Set("include", "space.organization")
+	var resp v3AppResponse
+	if err := getV3(c, "/v3/apps/"+url.PathEscape(guid), q, &resp); err != nil {
+		if err == errV3NotFound {
+			err = errAppNotFound
+		}
+		return ccApp{}, errors.Wrapf(err, "Error requesting v3 app %s", guid)
+	}
+	app := resp.Included.index().toCCApp(resp.v3App)
+
+	// e.g. the worker apps have no web process
+	var process v3Process
+	err := getV3(c, "/v3/apps/"+url.PathEscape(guid)+"/processes/web", url.Values{}, &process)
+	if err != nil && err != errV3NotFound {
+		return ccApp{}, errors.Wrapf(err, "Error requesting the web process of v3 app %s", guid)
+	}
+	if err == nil {
+		setProcessData(&app, process)
+	}
+
+	if app.ImageHidden {
+		// e.g. the docker apps which were never staged have no current droplet
+		var droplet v3Droplet
+		err := getV3(c, "/v3/apps/"+url.PathEscape(guid)+"/droplets/current", url.Values{}, &droplet)
+		if err != nil && err != errV3NotFound {
+			return ccApp{}, errors.Wrapf(err, "Error requesting the current droplet of v3 app %s", guid)
+		}
+		app.DockerImage = droplet.Image
+		app.ImageHidden = false
+	}
+	return app, nil
+}
+
+func appsQuery(pageNb int, withMetadata bool, filter url.Values) url.Values {
+	q := pageQuery(pageNb, filter)
+	q.Set("include", "space.organization")
+	// Only the fields used by the cache are requested, unless the metadata is needed too
+	if !withMetadata {
+		q.Set("fields[space]", "guid,name,relationships.organization")
+		q.Set("fields[space.organization]", "guid,name")
+	}
+	return q
+}
+
+func processesQuery(pageNb int, filter url.Values) url.Values {
+	q := pageQuery(pageNb, filter)
+	q.Set("types", "web")
+	return q
+}
+
+func pageQuery(pageNb int, filter url.Values) url.Values {
+	q := url.Values{}
+	for k, v := range filter {
+		q[k] = v
+	}
+	q.Set("per_page", strconv.Itoa(v3PerPage))
+	q.Set("page", strconv.Itoa(pageNb))
+	return q
+}
+
+// pagesError returns the error of a listing, or an error if some of its pages couldn't be fetched
+func pagesError(err error, complete bool) error {
+	if err == nil && !complete {
+		return errIncompleteList
+	}
+	return err
+}
+
+// chunk splits a list of guids in lists of at most size guids
+func chunk(guids []string, size int) [][]string {
+	var chunks [][]string
+	for len(guids) > size {
+		chunks = append(chunks, guids[:size])
+		guids = guids[size:]
+	}
+	if len(guids) > 0 {
+		chunks = append(chunks, guids)
+	}
+	return chunks
+}
+
+// getV3 requests a v3 endpoint and decodes its JSON response in v. It doesn't use the DoRequest method of the
+// cfclient, whose errors lose the status code telling whether the v3 API is available.
+func getV3(c *cfclient.Client, path string, q url.Values, v interface{}) error {
+	u := c.Config.ApiAddress + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", c.Config.UserAgent)
+
+	resp, err := c.Config.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "Error reading %s response", path)
+	}
+	if resp.StatusCode == http.StatusNotFound && path == "/v3/apps" {
+		return errV3Unavailable
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errV3NotFound
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s returned HTTP %s: %s", path, resp.Status, body)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.Wrapf(err, "Error unmarshalling %s response", path)
+	}
+	return nil
+}
+
+func (p v3AppsPage) toCCApps() []ccApp {
+	included := p.Included.index()
+	apps := make([]ccApp, 0, len(p.Resources))
+	for _, app := range p.Resources {
+		apps = append(apps, included.toCCApp(app))
+	}
+	return apps
+}
+
+// index maps the included resources by guid, so that the space and org of each app of a page are found at once
+func (i v3Included) index() v3IncludedIndex {
+	index := v3IncludedIndex{
+		spaces:        make(map[string]v3Space, len(i.Spaces)),
+		organizations: make(map[string]v3Organization, len(i.Organizations)),
+	}
+	for _, s := range i.Spaces {
+		index.spaces[s.GUID] = s
+	}
+	for _, o := range i.Organizations {
+		index.organizations[o.GUID] = o
+	}
+	return index
+}
+
+// toCCApp converts a v3 app to the v2 model used by the cache, with its space and org found in the included resources
+func (i v3IncludedIndex) toCCApp(v3 v3App) ccApp {
+	app := cfclient.App{
+		Guid:      v3.GUID,
+		Name:      v3.Name,
+		State:     v3.State,
+		CreatedAt: v3.CreatedAt,
+		UpdatedAt: v3.UpdatedAt,
+		SpaceGuid: v3.Relationships.Space.Data.GUID,
+		// Every v3 app runs on diego
+		Diego: true,
+	}
+	// The last buildpack is the one running the app
+	if buildpacks := v3.Lifecycle.Data.Buildpacks; len(buildpacks) > 0 {
+		app.Buildpack = buildpacks[len(buildpacks)-1]
+	}
+
+	space := i.spaces[app.SpaceGuid]
+	org := i.organizations[space.Relationships.Organization.Data.GUID]
+	app.SpaceData.Meta.Guid = space.GUID
+	app.SpaceData.Entity.Guid = space.GUID
+	app.SpaceData.Entity.Name = space.Name
+	app.SpaceData.Entity.OrgData.Meta.Guid = org.GUID
+	app.SpaceData.Entity.OrgData.Entity.Guid = org.GUID
+	app.SpaceData.Entity.OrgData.Entity.Name = org.Name
+
+	return ccApp{
+		App:         app,
+		Labels:      mergeMetadata(org.Metadata.Labels, space.Metadata.Labels, v3.Metadata.Labels),
+		Annotations: mergeMetadata(org.Metadata.Annotations, space.Metadata.Annotations, v3.Metadata.Annotations),
+		// The command is given by the web process, and the image of a docker app by its droplet
+		CommandHidden: true,
+		ImageHidden:   v3.Lifecycle.Type == "docker",
+	}
+}
+
+func setProcessData(app *ccApp, process v3Process) {
+	app.Instances = process.Instances
+	app.Memory = process.MemoryInMB
+	app.DiskQuota = process.DiskInMB
+	app.Command = process.Command
+	app.CommandHidden = process.Command == hiddenCommand
+	if app.CommandHidden {
+		app.Command = ""
+	}
+}
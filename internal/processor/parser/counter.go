@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// counterStateTTL is how long the total of a counter series is kept after its last event, e.g. after the instance
+// emitting it is gone
+const counterStateTTL = 15 * time.Minute
+
+type counterState struct {
+	total     uint64
+	timestamp int64
+	lastSeen  time.Time
+}
+
+// CounterTracker keeps the last total seen for every counter series so that CounterEvents can be turned into deltas
+type CounterTracker struct {
+	counters  map[string]counterState
+	ttl       time.Duration
+	now       func() time.Time
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+// NewCounterTracker creates a new CounterTracker
+func NewCounterTracker() *CounterTracker {
+	return &CounterTracker{
+		counters:  make(map[string]counterState),
+		ttl:       counterStateTTL,
+		now:       time.Now,
+		lastSweep: time.Now(),
+	}
+}
+
+// Delta returns how much the counter identified by key increased since the previous event of the same series,
+// and the number of seconds between both events.
+// ok is false when the event is older than the last one seen for the series: its increase is then already
+// accounted for by the newer total.
+func (t *CounterTracker) Delta(key string, counter *events.CounterEvent, timestamp int64) (delta uint64, elapsed float64, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+
+	total := counter.GetTotal()
+	previous, seen := t.counters[key]
+	if seen && timestamp < previous.timestamp {
+		return 0, 0, false
+	}
+	t.counters[key] = counterState{
+		total:     total,
+		timestamp: timestamp,
+		lastSeen:  now,
+	}
+
+	if !seen {
+		// First time we see this series, rely on the delta computed by the emitter
+		return counter.GetDelta(), 0, true
+	}
+
+	elapsed = float64(timestamp-previous.timestamp) / float64(time.Second)
+	if total < previous.total {
+		// The counter has been reset (e.g. the component restarted), it started again from 0
+		return total, elapsed, true
+	}
+	return total - previous.total, elapsed, true
+}
+
+// Size returns the number of counter series tracked
+func (t *CounterTracker) Size() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.counters)
+}
+
+// sweep forgets the series not seen for the TTL, at most once per TTL, to bound memory
+func (t *CounterTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.ttl {
+		return
+	}
+	t.lastSweep = now
+	for key, state := range t.counters {
+		if now.Sub(state.lastSeen) >= t.ttl {
+			delete(t.counters, key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("CounterTracker", func() {
+	var (
+		tracker *CounterTracker
+		now     time.Time
+	)
+
+	counter := func(delta, total uint64) *events.CounterEvent {
+		return &events.CounterEvent{
+			Name:  proto.String("counterName"),
+			Delta: proto.Uint64(delta),
+			Total: proto.Uint64(total),
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		tracker = NewCounterTracker()
+		tracker.now = func() time.Time { return now }
+		tracker.lastSweep = now
+	})
+
+	It("forgets the series not seen for the TTL", func() {
+		tracker.Delta("gone", counter(5, 100), 1)
+		now = now.Add(counterStateTTL / 2)
+		tracker.Delta("active", counter(5, 100), 2)
+		Expect(tracker.Size()).To(Equal(2))
+
+		now = now.Add(counterStateTTL / 2)
+		tracker.Delta("active", counter(5, 110), 3)
+		Expect(tracker.Size()).To(Equal(1))
+
+		// A forgotten series starts again from the delta of the emitter
+		delta, _, ok := tracker.Delta("gone", counter(7, 200), 4)
+		Expect(ok).To(BeTrue())
+		Expect(delta).To(Equal(uint64(7)))
+	})
+
+	It("keeps the series still seen", func() {
+		for i := 1; i <= 4; i++ {
+			now = now.Add(counterStateTTL / 2)
+			tracker.Delta("active", counter(5, uint64(100+10*i)), int64(i))
+		}
+
+		delta, _, ok := tracker.Delta("active", counter(5, 150), 5)
+		Expect(ok).To(BeTrue())
+		Expect(delta).To(Equal(uint64(10)))
+	})
+})
@@ -0,0 +1,204 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/event"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const eventSourceTypeName = "cloudfoundry"
+
+var (
+	// Logged by the Cloud Controller when an app instance exits, e.g.
+	// App instance exited with guid 4e4b... payload: {"instance"=>"...", "index"=>0, "reason"=>"CRASHED", ...}
+	appExitedPattern       = regexp.MustCompile(`^App instance exited with guid \S+ payload: (.*)$`)
+	processCrashedPattern  = regexp.MustCompile(`^Process has crashed with type: "([^"]*)"`)
+	appStateChangedPattern = regexp.MustCompile(`^Updated app with guid \S+ \(.*"state"\s*=>\s*"(\w+)".*\)`)
+	// The fields of the payload of the app exits
+	payloadReasonPattern = payloadFieldPattern("reason")
+	payloadIndexPattern  = payloadFieldPattern("index")
+)
+
+// EventParser turns Error envelopes and app lifecycle logs into Datadog events.
+// Events sharing the same aggregation key are only emitted once per de-duplication window.
+type EventParser struct {
+	Environment string
+	CustomTags  []string
+	AppParser   *AppParser
+	DedupWindow time.Duration
+
+	lock       sync.Mutex
+	lastSent   map[string]int64
+	suppressed map[string]int
+	lastSweep  int64
+}
+
+// NewEventParser creates a new EventParser, appParser can be nil if app metrics are disabled,
+// in which case events are not enriched with app metadata
+func NewEventParser(environment string, customTags []string, appParser *AppParser, dedupWindow time.Duration) *EventParser {
+	return &EventParser{
+		Environment: environment,
+		CustomTags:  customTags,
+		AppParser:   appParser,
+		DedupWindow: dedupWindow,
+		lastSent:    make(map[string]int64),
+		suppressed:  make(map[string]int),
+	}
+}
+
+// Parse takes an envelope, and extracts events from it. No event is returned when the envelope
+// doesn't describe anything worth an event, or when a similar event was sent during the de-duplication window.
+func (p *EventParser) Parse(envelope *events.Envelope) ([]event.Event, error) {
+	var e *event.Event
+	switch envelope.GetEventType() {
+	case events.Envelope_Error:
+		e = p.parseError(envelope)
+	case events.Envelope_LogMessage:
+		e = p.parseAppLifecycle(envelope)
+	default:
+		return nil, fmt.Errorf("not an event")
+	}
+
+	if e == nil || !p.keep(e) {
+		return []event.Event{}, nil
+	}
+	return []event.Event{*e}, nil
+}
+
+func (p *EventParser) parseError(envelope *events.Envelope) *event.Event {
+	message := envelope.GetError()
+
+	tags := p.envelopeTags(envelope)
+	tags = appendTagIfNotEmpty(tags, "source", message.GetSource())
+	tags = appendTagIfNotEmpty(tags, "code", fmt.Sprintf("%d", message.GetCode()))
+
+	return &event.Event{
+		Title:          fmt.Sprintf("%s error: %s", envelope.GetOrigin(), message.GetSource()),
+		Text:           message.GetMessage(),
+		Timestamp:      envelope.GetTimestamp() / int64(time.Second),
+		Host:           parseHost(envelope),
+		Tags:           tags,
+		AlertType:      "error",
+		AggregationKey: fmt.Sprintf("error:%s:%s:%d", envelope.GetOrigin(), message.GetSource(), message.GetCode()),
+		SourceTypeName: eventSourceTypeName,
+	}
+}
+
+// parseAppLifecycle turns the crash and state change logs of the Cloud Controller into events
+func (p *EventParser) parseAppLifecycle(envelope *events.Envelope) *event.Event {
+	message := envelope.GetLogMessage()
+	if message.GetSourceType() != "API" || message.GetAppId() == "" {
+		return nil
+	}
+	text := string(message.GetMessage())
+	guid := message.GetAppId()
+
+	tags := p.envelopeTags(envelope)
+	tags = appendTagIfNotEmpty(tags, "app_id", guid)
+	name := guid
+	if p.AppParser != nil {
+		if app := p.AppParser.AppCache.Get(guid); app != nil {
+			app.lock.Lock()
+			tags = append(tags, app.getTags()...)
+			name = app.Name
+			app.lock.Unlock()
+		}
+	}
+
+	e := &event.Event{
+		Text:           text,
+		Timestamp:      message.GetTimestamp() / int64(time.Second),
+		Host:           parseHost(envelope),
+		SourceTypeName: eventSourceTypeName,
+	}
+
+	if match := appExitedPattern.FindStringSubmatch(text); match != nil {
+		if payloadField(match[1], payloadReasonPattern) != "CRASHED" {
+			return nil
+		}
+		tags = appendTagIfNotEmpty(tags, "instance_index", payloadField(match[1], payloadIndexPattern))
+		e.Title = fmt.Sprintf("App %s crashed", name)
+		e.AlertType = "error"
+		e.AggregationKey = "crash:" + guid
+	} else if match := processCrashedPattern.FindStringSubmatch(text); match != nil {
+		tags = appendTagIfNotEmpty(tags, "process_type", match[1])
+		e.Title = fmt.Sprintf("App %s crashed", name)
+		e.AlertType = "error"
+		e.AggregationKey = "crash:" + guid
+	} else if match := appStateChangedPattern.FindStringSubmatch(text); match != nil {
+		e.Title = fmt.Sprintf("App %s %s", name, strings.ToLower(match[1]))
+		e.AlertType = "info"
+		e.Priority = "low"
+		e.AggregationKey = "state:" + guid
+	} else {
+		return nil
+	}
+
+	e.Tags = tags
+	return e
+}
+
+func (p *EventParser) envelopeTags(envelope *events.Envelope) []string {
+	tags := appendTagIfNotEmpty(nil, "deployment", envelope.GetDeployment())
+	tags = appendTagIfNotEmpty(tags, "job", envelope.GetJob())
+	tags = appendTagIfNotEmpty(tags, "index", envelope.GetIndex())
+	tags = appendTagIfNotEmpty(tags, "ip", envelope.GetIp())
+	tags = appendTagIfNotEmpty(tags, "origin", envelope.GetOrigin())
+	tags = appendTagIfNotEmpty(tags, "env", p.Environment)
+	return append(tags, p.CustomTags...)
+}
+
+// keep returns false if an event with the same aggregation key was sent during the de-duplication window.
+// The number of events suppressed in the meantime is added to the text of the next one.
+func (p *EventParser) keep(e *event.Event) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	window := int64(p.DedupWindow / time.Second)
+	p.sweep(e.Timestamp, window)
+
+	if last, ok := p.lastSent[e.AggregationKey]; ok && e.Timestamp-last < window {
+		p.suppressed[e.AggregationKey]++
+		return false
+	}
+
+	if suppressed := p.suppressed[e.AggregationKey]; suppressed > 0 {
+		e.Text = fmt.Sprintf("%s\n\n%d similar events were suppressed since the previous one", e.Text, suppressed)
+	}
+	p.lastSent[e.AggregationKey] = e.Timestamp
+	delete(p.suppressed, e.AggregationKey)
+	return true
+}
+
+// sweep forgets the keys whose window has been over for a whole window, to bound memory
+func (p *EventParser) sweep(now int64, window int64) {
+	if now-p.lastSweep < window {
+		return
+	}
+	p.lastSweep = now
+	for key, last := range p.lastSent {
+		if now-last >= 2*window {
+			delete(p.lastSent, key)
+			delete(p.suppressed, key)
+		}
+	}
+}
+
+// payloadFieldPattern matches a field of the ruby hash logged by the Cloud Controller
+func payloadFieldPattern(field string) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf(`"%s"\s*=>\s*"?([^",}]*)"?`, regexp.QuoteMeta(field)))
+}
+
+// payloadField extracts the field matched by pattern from the payload
+func payloadField(payload string, pattern *regexp.Regexp) string {
+	match := pattern.FindStringSubmatch(payload)
+	if match == nil {
+		return ""
+	}
+	return strings.TrimSpace(match[1])
+}
@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// maxLatencySamples bounds the number of latencies kept per series between two flushes,
+// the percentiles are computed on a uniform sample of the requests above that
+const maxLatencySamples = 10000
+
+var latencyPercentiles = []float64{0.5, 0.95, 0.99}
+
+type httpRequests struct {
+	name  string
+	tags  []string
+	host  string
+	count uint64
+}
+
+type httpLatencies struct {
+	tags    []string
+	host    string
+	count   uint64
+	sum     float64
+	max     float64
+	samples []float64
+}
+
+// HTTPParser aggregates the HttpStartStop envelopes emitted by the routers into per app request metrics.
+// Envelopes are only recorded by Parse, the metrics are computed over the flush interval by Flush.
+type HTTPParser struct {
+	Environment string
+	CustomTags  []string
+	AppParser   *AppParser
+
+	lock      sync.Mutex
+	requests  map[string]*httpRequests
+	latencies map[string]*httpLatencies
+}
+
+// NewHTTPParser creates a new HTTPParser, appParser can be nil if app metrics are disabled,
+// in which case the metrics are not tagged with the app metadata
+func NewHTTPParser(environment string, customTags []string, appParser *AppParser) *HTTPParser {
+	return &HTTPParser{
+		Environment: environment,
+		CustomTags:  customTags,
+		AppParser:   appParser,
+		requests:    make(map[string]*httpRequests),
+		latencies:   make(map[string]*httpLatencies),
+	}
+}
+
+// Parse takes an envelope, and records the request it describes until the next flush
+func (p *HTTPParser) Parse(envelope *events.Envelope) ([]metric.MetricPackage, error) {
+	metrics := []metric.MetricPackage{}
+	if envelope.GetEventType() != events.Envelope_HttpStartStop {
+		return metrics, fmt.Errorf("not an http metric")
+	}
+
+	event := envelope.GetHttpStartStop()
+	// Only keep the requests seen by the routers: the apps emitting their own events would count them twice
+	if event.GetPeerType() != events.PeerType_Client || event.GetApplicationId() == nil {
+		return metrics, nil
+	}
+
+	guid := formatUUID(event.GetApplicationId())
+	tags := appendTagIfNotEmpty(nil, "app_id", guid)
+	tags = appendTagIfNotEmpty(tags, "route", parseRoute(event.GetUri()))
+	tags = appendTagIfNotEmpty(tags, "method", event.GetMethod().String())
+	tags = appendTagIfNotEmpty(tags, "env", p.Environment)
+	tags = append(tags, p.CustomTags...)
+
+	// Only use the apps already cached, looking up the Cloud Controller for every request would be too expensive
+	if p.AppParser != nil {
+		if app := p.AppParser.AppCache.Get(guid); app != nil {
+			app.lock.Lock()
+			tags = append(tags, app.getTags()...)
+			app.lock.Unlock()
+		}
+	}
+
+	latency := float64(event.GetStopTimestamp()-event.GetStartTimestamp()) / float64(time.Millisecond)
+	statusTags := appendTagIfNotEmpty(append([]string{}, tags...), "status_class", statusClass(event.GetStatusCode()))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.addRequest("app.http.requests", statusTags, guid)
+	if event.GetStatusCode() >= 400 {
+		p.addRequest("app.http.errors", statusTags, guid)
+	}
+	if latency >= 0 {
+		p.addLatency(latency, tags, guid)
+	}
+
+	return metrics, nil
+}
+
+// Flush returns the metrics of the requests recorded since the previous flush, and resets them
+func (p *HTTPParser) Flush(timestamp int64) []metric.MetricPackage {
+	p.lock.Lock()
+	requests, latencies := p.requests, p.latencies
+	p.requests = make(map[string]*httpRequests)
+	p.latencies = make(map[string]*httpLatencies)
+	p.lock.Unlock()
+
+	metrics := []metric.MetricPackage{}
+	for _, r := range requests {
+		metrics = append(metrics, mkHTTPMetric(r.name, metric.Count, float64(r.count), r.tags, r.host, timestamp))
+	}
+	for _, l := range latencies {
+		sort.Float64s(l.samples)
+		metrics = append(metrics,
+			mkHTTPMetric("app.http.latency.avg", metric.Gauge, l.sum/float64(l.count), l.tags, l.host, timestamp),
+			mkHTTPMetric("app.http.latency.max", metric.Gauge, l.max, l.tags, l.host, timestamp),
+		)
+		for _, percentile := range latencyPercentiles {
+			name := fmt.Sprintf("app.http.latency.p%d", int(percentile*100))
+			metrics = append(metrics, mkHTTPMetric(name, metric.Gauge, percentileOf(l.samples, percentile), l.tags, l.host, timestamp))
+		}
+	}
+
+	return metrics
+}
+
+func (p *HTTPParser) addRequest(name string, tags []string, host string) {
+	key := name + util.HashTags(tags)
+	r, ok := p.requests[key]
+	if !ok {
+		r = &httpRequests{name: name, tags: tags, host: host}
+		p.requests[key] = r
+	}
+	r.count++
+}
+
+func (p *HTTPParser) addLatency(latency float64, tags []string, host string) {
+	key := util.HashTags(tags)
+	l, ok := p.latencies[key]
+	if !ok {
+		l = &httpLatencies{tags: tags, host: host}
+		p.latencies[key] = l
+	}
+	l.count++
+	l.sum += latency
+	l.max = math.Max(l.max, latency)
+
+	// Reservoir sampling, so that every request has the same chance to be part of the samples
+	if len(l.samples) < maxLatencySamples {
+		l.samples = append(l.samples, latency)
+	} else if i := rand.Int63n(int64(l.count)); i < maxLatencySamples {
+		l.samples[i] = latency
+	}
+}
+
+func mkHTTPMetric(name string, metricType string, value float64, tags []string, host string, timestamp int64) metric.MetricPackage {
+	return metric.MetricPackage{
+		MetricKey: &metric.MetricKey{
+			EventType: events.Envelope_HttpStartStop,
+			Name:      name,
+			TagsHash:  util.HashTags(tags),
+		},
+		MetricValue: &metric.MetricValue{
+			Tags:   tags,
+			Host:   host,
+			Type:   metricType,
+			Points: []metric.Point{{Timestamp: timestamp, Value: value}},
+		},
+	}
+}
+
+// percentileOf returns the nearest-rank percentile of sorted samples
+func percentileOf(sorted []float64, percentile float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(percentile*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func statusClass(statusCode int32) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// parseRoute returns the host the request was routed with, the path is left out to bound the number of series
+func parseRoute(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		return u.Host
+	}
+	// The routers may report the uri without a scheme
+	return strings.SplitN(uri, "/", 2)[0]
+}
+
+// formatUUID formats the UUID of an envelope the same way the Cloud Controller formats app guids
+func formatUUID(uuid *events.UUID) string {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], uuid.GetLow())
+	binary.LittleEndian.PutUint64(b[8:], uuid.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -3,7 +3,6 @@ package parser
 import (
 	"fmt"
 	"regexp"
-	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
@@ -16,18 +15,27 @@ type InfraParser struct {
 	DeploymentUUIDRegex   *regexp.Regexp
 	JobPartitionUUIDRegex *regexp.Regexp
 	CustomTags            []string
+	CounterType           string
+	CounterTracker        *CounterTracker
+	Naming                *Naming
 }
 
 func NewInfraParser(
 	environment string,
 	deploymentUUIDRegex *regexp.Regexp,
 	jobPartitionUUIDRegex *regexp.Regexp,
-	customTags []string) (*InfraParser, error) {
+	customTags []string,
+	counterType string,
+	counterTracker *CounterTracker,
+	naming *Naming) (*InfraParser, error) {
 	return &InfraParser{
 		Environment:           environment,
 		DeploymentUUIDRegex:   deploymentUUIDRegex,
 		JobPartitionUUIDRegex: jobPartitionUUIDRegex,
 		CustomTags:            customTags,
+		CounterType:           counterType,
+		CounterTracker:        counterTracker,
+		Naming:                naming,
 	}, nil
 }
 
@@ -49,22 +57,26 @@ func (p InfraParser) Parse(envelope *events.Envelope) ([]metric.MetricPackage, e
 	metricValues := metric.MetricValue{}
 	metricValues.Host = host
 	metricValues.Tags = tags
+	metricValues.Type = metric.Gauge
+	if eventType == events.Envelope_ValueMetric {
+		metricValues.Unit = datadogUnits[envelope.GetValueMetric().GetUnit()]
+	}
 	value := getValue(envelope)
+	if eventType == events.Envelope_CounterEvent && p.CounterType != metric.Gauge {
+		var ok bool
+		value, ok = p.getCounterValue(envelope, name+tagsHash)
+		if !ok {
+			return metrics, nil
+		}
+		metricValues.Type = p.CounterType
+	}
 	// NOTE: Value only has one point!!!!!!!!
 	metricValues.Points = append(metricValues.Points, metric.Point{
 		Timestamp: envelope.GetTimestamp() / int64(time.Second),
 		Value:     value,
 	})
 
-	var names []string
-	// Basic metric name
-	names = append(names, name)
-	// Legacy metric name
-	names = append(names, envelope.GetOrigin()+"."+name)
-	// BOSH alias metric name
-	if strings.HasPrefix(name, "bosh-hm-forwarder") {
-		names = append(names, strings.Replace(name, "bosh-hm-forwarder", "bosh.healthmonitor", 1))
-	}
+	names := p.Naming.Names(envelope.GetOrigin(), name)
 
 	// Create metric for each names with same values
 	for i := 0; i < len(names); i++ {
@@ -81,6 +93,27 @@ func (p InfraParser) Parse(envelope *events.Envelope) ([]metric.MetricPackage, e
 	return metrics, nil
 }
 
+// datadogUnits maps the units of the ValueMetrics emitted by the Cloud Foundry components to the Datadog units, the
+// other units are not sent
+var datadogUnits = map[string]string{
+	"ns":         "nanosecond",
+	"nanos":      "nanosecond",
+	"us":         "microsecond",
+	"ms":         "millisecond",
+	"s":          "second",
+	"b":          "byte",
+	"B":          "byte",
+	"bytes":      "byte",
+	"KiB":        "kibibyte",
+	"MiB":        "mebibyte",
+	"GiB":        "gibibyte",
+	"%":          "percent",
+	"percent":    "percent",
+	"percentage": "percent",
+	"req":        "request",
+	"conn":       "connection",
+}
+
 func getName(envelope *events.Envelope) string {
 	switch envelope.GetEventType() {
 	case events.Envelope_ValueMetric:
@@ -103,6 +136,24 @@ func getValue(envelope *events.Envelope) float64 {
 	}
 }
 
+// getCounterValue turns the total of a CounterEvent into a count or a rate, depending on the configured counter type
+func (p InfraParser) getCounterValue(envelope *events.Envelope, key string) (float64, bool) {
+	delta, elapsed, ok := p.CounterTracker.Delta(key, envelope.GetCounterEvent(), envelope.GetTimestamp())
+	if !ok {
+		return 0, false
+	}
+
+	if p.CounterType == metric.Rate {
+		// A rate can only be computed once two events of the same series have been seen
+		if elapsed <= 0 {
+			return 0, false
+		}
+		return float64(delta) / elapsed, true
+	}
+
+	return float64(delta), true
+}
+
 func parseTags(
 	envelope *events.Envelope,
 	environment string,
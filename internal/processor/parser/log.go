@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const logSource = "cloudfoundry"
+
+// LogParser turns LogMessage envelopes into Datadog logs
+type LogParser struct {
+	Environment string
+	CustomTags  []string
+	AppParser   *AppParser
+}
+
+// NewLogParser creates a new LogParser, appParser can be nil if app metrics are disabled,
+// in which case logs are not enriched with app metadata
+func NewLogParser(environment string, customTags []string, appParser *AppParser) *LogParser {
+	return &LogParser{
+		Environment: environment,
+		CustomTags:  customTags,
+		AppParser:   appParser,
+	}
+}
+
+// Parse takes an envelope, and extract a log from it
+func (p LogParser) Parse(envelope *events.Envelope) (logs.Log, error) {
+	if envelope.GetEventType() != events.Envelope_LogMessage {
+		return logs.Log{}, fmt.Errorf("not a log message")
+	}
+	message := envelope.GetLogMessage()
+
+	tags := appendTagIfNotEmpty(nil, "deployment", envelope.GetDeployment())
+	tags = appendTagIfNotEmpty(tags, "job", envelope.GetJob())
+	tags = appendTagIfNotEmpty(tags, "index", envelope.GetIndex())
+	tags = appendTagIfNotEmpty(tags, "ip", envelope.GetIp())
+	tags = appendTagIfNotEmpty(tags, "origin", envelope.GetOrigin())
+	tags = appendTagIfNotEmpty(tags, "source_type", message.GetSourceType())
+	tags = appendTagIfNotEmpty(tags, "source_instance", message.GetSourceInstance())
+	tags = appendTagIfNotEmpty(tags, "app_id", message.GetAppId())
+	tags = appendTagIfNotEmpty(tags, "env", p.Environment)
+	tags = append(tags, p.CustomTags...)
+
+	log := logs.Log{
+		Message:   string(message.GetMessage()),
+		Source:    logSource,
+		Service:   envelope.GetOrigin(),
+		Hostname:  parseHost(envelope),
+		Status:    "info",
+		Timestamp: message.GetTimestamp() / int64(time.Millisecond),
+	}
+	if message.GetMessageType() == events.LogMessage_ERR {
+		log.Status = "error"
+	}
+
+	// Only use the apps already cached, looking up the Cloud Controller for every log line would be too expensive
+	if p.AppParser != nil && message.GetAppId() != "" {
+		if app := p.AppParser.AppCache.Get(message.GetAppId()); app != nil {
+			app.lock.Lock()
+			tags = append(tags, app.getTags()...)
+			log.Service = app.Name
+			app.lock.Unlock()
+		}
+	}
+
+	log.Tags = strings.Join(tags, ",")
+	return log, nil
+}
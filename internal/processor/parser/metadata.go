@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+)
+
+// MetadataTagger turns the labels and annotations of the apps into tags
+type MetadataTagger struct {
+	labels      []*filter.Pattern
+	annotations []*filter.Pattern
+	tagPrefix   string
+}
+
+// NewMetadataTagger compiles the patterns of the labels and annotations to turn into tags
+func NewMetadataTagger(c config.MetadataTags) (*MetadataTagger, error) {
+	labels, err := compilePatterns(c.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata label pattern: %v", err)
+	}
+	annotations, err := compilePatterns(c.Annotations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata annotation pattern: %v", err)
+	}
+	return &MetadataTagger{
+		labels:      labels,
+		annotations: annotations,
+		tagPrefix:   c.TagPrefix,
+	}, nil
+}
+
+// Enabled returns true if some labels or annotations are turned into tags
+func (t *MetadataTagger) Enabled() bool {
+	return t != nil && (len(t.labels) > 0 || len(t.annotations) > 0)
+}
+
+// Tags returns the tags of the selected labels and annotations, sorted by key.
+// An annotation with the same tag name as a label is ignored.
+func (t *MetadataTagger) Tags(labels map[string]string, annotations map[string]string) []string {
+	if !t.Enabled() {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	tags := t.tags(t.labels, labels, names)
+	return append(tags, t.tags(t.annotations, annotations, names)...)
+}
+
+func (t *MetadataTagger) tags(patterns []*filter.Pattern, metadata map[string]string, names map[string]bool) []string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var tags []string
+	for _, key := range keys {
+		if !matchAny(patterns, key) {
+			continue
+		}
+		name := t.tagPrefix + key[strings.LastIndex(key, "/")+1:]
+		if names[name] {
+			continue
+		}
+		names[name] = true
+		tags = append(tags, fmt.Sprintf("%s:%s", name, metadata[key]))
+	}
+	return tags
+}
+
+func compilePatterns(patterns []string) ([]*filter.Pattern, error) {
+	compiled := make([]*filter.Pattern, 0, len(patterns))
+	for _, p := range patterns {
+		c, err := filter.CompilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func matchAny(patterns []*filter.Pattern, value string) bool {
+	for _, p := range patterns {
+		if p.Match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeMetadata merges the labels or annotations of an org, a space and an app, the ones of the app taking precedence
+func mergeMetadata(levels ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, level := range levels {
+		for k, v := range level {
+			merged[k] = v
+		}
+	}
+	return merged
+}
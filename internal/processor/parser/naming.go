@@ -0,0 +1,57 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+)
+
+// Naming computes the names of the infra metrics from the configured naming modes and aliases
+type Naming struct {
+	mode    string
+	origins map[string]string
+	aliases []config.MetricAlias
+}
+
+// NewNaming creates a Naming, the default mode is to send both the new-style and the legacy names
+func NewNaming(c config.MetricNaming) *Naming {
+	mode := c.Mode
+	if mode == "" {
+		mode = config.NamingBoth
+	}
+	return &Naming{
+		mode:    mode,
+		origins: c.Origins,
+		aliases: c.Aliases,
+	}
+}
+
+// Names returns the names under which a metric of an origin is sent
+func (n *Naming) Names(origin string, name string) []string {
+	mode := config.NamingBoth
+	var aliases []config.MetricAlias
+	if n != nil {
+		mode = n.mode
+		if originMode, ok := n.origins[origin]; ok {
+			mode = originMode
+		}
+		aliases = n.aliases
+	}
+
+	var names []string
+	// Basic metric name
+	if mode != config.NamingLegacy {
+		names = append(names, name)
+	}
+	// Legacy metric name
+	if mode != config.NamingNew {
+		names = append(names, origin+"."+name)
+	}
+	// Alias metric names, e.g. the BOSH health monitor ones
+	for _, alias := range aliases {
+		if strings.HasPrefix(name, alias.Prefix) {
+			names = append(names, alias.Replacement+strings.TrimPrefix(name, alias.Prefix))
+		}
+	}
+	return names
+}
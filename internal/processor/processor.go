@@ -3,9 +3,14 @@ package processor
 import (
 	"fmt"
 	"regexp"
+	"time"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/event"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/processor/parser"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/rewrite"
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/sonde-go/events"
@@ -20,41 +25,49 @@ const (
 type Processor struct {
 	processedMetrics      chan<- []metric.MetricPackage
 	appMetrics            parser.Parser
+	logParser             *parser.LogParser
+	httpParser            *parser.HTTPParser
+	eventParser           *parser.EventParser
 	customTags            []string
 	environment           string
+	counterType           string
+	counterTracker        *parser.CounterTracker
+	rewriter              *rewrite.Rewriter
+	naming                *parser.Naming
 	deploymentUUIDRegex   *regexp.Regexp
 	jobPartitionUUIDRegex *regexp.Regexp
 }
 
-// NewProcessor creates a new processor
+// NewProcessor creates a new processor from the configuration of the nozzle
 func NewProcessor(
 	pm chan<- []metric.MetricPackage,
-	customTags []string,
-	environment string,
+	cfg *config.Config,
 	parseAppMetricsEnable bool,
 	cfClient *cfclient.Client,
-	numCacheWorkers int,
-	grabInterval int,
+	rewriter *rewrite.Rewriter,
+	metadataTagger *parser.MetadataTagger,
 	log *gosteno.Logger,
 ) (*Processor, bool) {
 
+	counterType := cfg.CounterType
+	if counterType == "" {
+		counterType = metric.Count
+	}
+
 	processor := &Processor{
 		processedMetrics:      pm,
-		customTags:            customTags,
-		environment:           environment,
+		customTags:            cfg.CustomTags,
+		environment:           cfg.EnvironmentName,
+		counterType:           counterType,
+		counterTracker:        parser.NewCounterTracker(),
+		rewriter:              rewriter,
+		naming:                parser.NewNaming(cfg.MetricNaming),
 		deploymentUUIDRegex:   regexp.MustCompile(deploymentUUIDPattern),
 		jobPartitionUUIDRegex: regexp.MustCompile(jobPartitionUUIDPattern),
 	}
 
 	if parseAppMetricsEnable {
-		appMetrics, err := parser.NewAppParser(
-			cfClient,
-			numCacheWorkers,
-			grabInterval,
-			log,
-			customTags,
-			environment,
-		)
+		appMetrics, err := parser.NewAppParser(cfClient, cfg, metadataTagger, log)
 		if err != nil {
 			parseAppMetricsEnable = false
 			log.Warnf("error setting up appMetrics, continuing without application metrics: %v", err)
@@ -64,6 +77,15 @@ func NewProcessor(
 		}
 	}
 
+	var appParser *parser.AppParser
+	if processor.appMetrics != nil {
+		appParser = processor.appMetrics.(*parser.AppParser)
+	}
+	processor.logParser = parser.NewLogParser(cfg.EnvironmentName, cfg.CustomTags, appParser)
+	processor.httpParser = parser.NewHTTPParser(cfg.EnvironmentName, cfg.CustomTags, appParser)
+	dedupWindow := time.Duration(cfg.EventsDedupWindowSeconds) * time.Second
+	processor.eventParser = parser.NewEventParser(cfg.EnvironmentName, cfg.CustomTags, appParser, dedupWindow)
+
 	return processor, parseAppMetricsEnable
 }
 
@@ -78,19 +100,87 @@ func (p *Processor) ProcessMetric(envelope *events.Envelope) {
 		p.deploymentUUIDRegex,
 		p.jobPartitionUUIDRegex,
 		p.customTags,
+		p.counterType,
+		p.counterTracker,
+		p.naming,
 	)
 	metricsPackages, err = infraParser.Parse(envelope)
 	if err == nil {
-		p.processedMetrics <- metricsPackages
+		// e.g. the first event of a counter only sets the total the next ones are computed from
+		if len(metricsPackages) > 0 {
+			p.processedMetrics <- p.rewriter.Apply(metricsPackages)
+		}
 		// it can only be one or the other
 		return
 	}
 
+	// HttpStartStop envelopes are aggregated until the next flush
+	if _, err = p.httpParser.Parse(envelope); err == nil {
+		return
+	}
+
 	// Parse application type of envelopes
 	metricsPackages, err = p.parseAppMetric(envelope)
-	if err == nil {
-		p.processedMetrics <- metricsPackages
+	if err == nil && len(metricsPackages) > 0 {
+		p.processedMetrics <- p.rewriter.Apply(metricsPackages)
+	}
+}
+
+// ProcessLog takes a LogMessage envelope and turns it into a log enriched with the app metadata
+func (p *Processor) ProcessLog(envelope *events.Envelope) (logs.Log, error) {
+	return p.logParser.Parse(envelope)
+}
+
+// ProcessEvent takes an Error envelope or an app lifecycle LogMessage envelope and turns it into events
+func (p *Processor) ProcessEvent(envelope *events.Envelope) ([]event.Event, error) {
+	return p.eventParser.Parse(envelope)
+}
+
+// FlushHTTPMetrics returns the request metrics aggregated from the HttpStartStop envelopes since the previous flush
+func (p *Processor) FlushHTTPMetrics(timestamp int64) []metric.MetricPackage {
+	return p.rewriter.Apply(p.httpParser.Flush(timestamp))
+}
+
+// AppCacheStats returns the number of apps in the cache and how long its last warmup took,
+// both are zero if app metrics are disabled
+func (p *Processor) AppCacheStats() (int, time.Duration) {
+	if p.appMetrics == nil {
+		return 0, 0
 	}
+
+	appParser := p.appMetrics.(*parser.AppParser)
+	return appParser.AppCache.Size(), appParser.AppCache.WarmupDuration()
+}
+
+// AppCacheWarmedUp returns true once the apps cache is loaded, or if app metrics are disabled
+func (p *Processor) AppCacheWarmedUp() bool {
+	if p.appMetrics == nil {
+		return true
+	}
+
+	appParser := p.appMetrics.(*parser.AppParser)
+	return appParser.AppCache.IsWarmedUp()
+}
+
+// AppCacheStale returns true while the apps cache only holds the apps loaded from the cache file
+func (p *Processor) AppCacheStale() bool {
+	if p.appMetrics == nil {
+		return false
+	}
+
+	appParser := p.appMetrics.(*parser.AppParser)
+	return appParser.AppCache.IsStale()
+}
+
+// AppLookupStats returns the cache hits and misses of the app metrics, and the cloud controller lookups of the
+// missed apps, all zero if app metrics are disabled
+func (p *Processor) AppLookupStats() parser.AppLookupStats {
+	if p.appMetrics == nil {
+		return parser.AppLookupStats{}
+	}
+
+	appParser := p.appMetrics.(*parser.AppParser)
+	return appParser.LookupStats()
 }
 
 // StopAppMetrics stops the goroutine refreshing the apps cache
@@ -1,7 +1,9 @@
 package processor
 
 import (
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/rewrite"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
 
@@ -17,8 +19,7 @@ var (
 var _ = Describe("MetricProcessor", func() {
 	BeforeEach(func() {
 		mchan = make(chan []metric.MetricPackage, 1500)
-		p, _ = NewProcessor(mchan, []string{}, "", false,
-			nil, 4, 0, nil)
+		p, _ = NewProcessor(mchan, &config.Config{CounterType: metric.Count}, false, nil, nil, nil, nil)
 	})
 
 	It("processes value & counter metrics", func() {
@@ -56,15 +57,112 @@ var _ = Describe("MetricProcessor", func() {
 		Expect(metricPkgs).To(HaveLen(4))
 		for _, m := range metricPkgs {
 			if m.MetricKey.Name == "valueName" || m.MetricKey.Name == "origin.valueName" {
+				Expect(m.MetricValue.Type).To(Equal(metric.Gauge))
 				Expect(m.MetricValue.Points).To(Equal([]metric.Point{{Timestamp: 1, Value: 5.0}}))
 			} else if m.MetricKey.Name == "counterName" || m.MetricKey.Name == "origin.counterName" {
-				Expect(m.MetricValue.Points).To(Equal([]metric.Point{{Timestamp: 2, Value: 11.0}}))
+				// First time the counter is seen, the delta of the event is used
+				Expect(m.MetricValue.Type).To(Equal(metric.Count))
+				Expect(m.MetricValue.Points).To(Equal([]metric.Point{{Timestamp: 2, Value: 6.0}}))
 			} else {
 				panic("unknown metric in package: " + m.MetricKey.Name)
 			}
 		}
 	})
 
+	It("maps the units of the value metrics to Datadog units", func() {
+		for _, unit := range []string{"ms", "gauge"} {
+			p.ProcessMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(unit + "Metric"),
+					Value: proto.Float64(5),
+					Unit:  proto.String(unit),
+				},
+			})
+		}
+
+		var metricPkgs []metric.MetricPackage
+		Eventually(mchan).Should(Receive(&metricPkgs))
+		Expect(metricPkgs[0].MetricValue.Unit).To(Equal("millisecond"))
+		Eventually(mchan).Should(Receive(&metricPkgs))
+		Expect(metricPkgs[0].MetricValue.Unit).To(BeEmpty())
+	})
+
+	Context("counter events", func() {
+		counterEnvelope := func(timestamp int64, delta, total uint64) *events.Envelope {
+			return &events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(timestamp),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String("counterName"),
+					Delta: proto.Uint64(delta),
+					Total: proto.Uint64(total),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			}
+		}
+
+		receiveValue := func() float64 {
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+			Expect(metricPkg).To(HaveLen(2))
+			return metricPkg[0].MetricValue.Points[0].Value
+		}
+
+		It("computes counts from the previous total", func() {
+			p.ProcessMetric(counterEnvelope(1000000000, 5, 100))
+			Expect(receiveValue()).To(Equal(5.0))
+
+			p.ProcessMetric(counterEnvelope(2000000000, 5, 110))
+			Expect(receiveValue()).To(Equal(10.0))
+		})
+
+		It("handles counter resets", func() {
+			p.ProcessMetric(counterEnvelope(1000000000, 5, 100))
+			Expect(receiveValue()).To(Equal(5.0))
+
+			p.ProcessMetric(counterEnvelope(2000000000, 3, 3))
+			Expect(receiveValue()).To(Equal(3.0))
+		})
+
+		It("ignores events older than the last one seen", func() {
+			p.ProcessMetric(counterEnvelope(2000000000, 5, 100))
+			Expect(receiveValue()).To(Equal(5.0))
+
+			p.ProcessMetric(counterEnvelope(1000000000, 5, 95))
+			Consistently(mchan).ShouldNot(Receive())
+		})
+
+		It("computes rates once two events have been seen", func() {
+			p, _ = NewProcessor(mchan, &config.Config{CounterType: metric.Rate}, false, nil, nil, nil, nil)
+
+			p.ProcessMetric(counterEnvelope(1000000000, 5, 100))
+			Consistently(mchan).ShouldNot(Receive())
+
+			p.ProcessMetric(counterEnvelope(5000000000, 5, 120))
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+			Expect(metricPkg).To(HaveLen(2))
+			Expect(metricPkg[0].MetricValue.Type).To(Equal(metric.Rate))
+			Expect(metricPkg[0].MetricValue.Points[0].Value).To(Equal(5.0))
+		})
+
+		It("sends the total as a gauge in legacy mode", func() {
+			p, _ = NewProcessor(mchan, &config.Config{CounterType: metric.Gauge}, false, nil, nil, nil, nil)
+
+			p.ProcessMetric(counterEnvelope(1000000000, 5, 100))
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+			Expect(metricPkg).To(HaveLen(2))
+			Expect(metricPkg[0].MetricValue.Type).To(Equal(metric.Gauge))
+			Expect(metricPkg[0].MetricValue.Points[0].Value).To(Equal(100.0))
+		})
+	})
+
 	It("generates metrics twice: once with origin in name, once without", func() {
 		p.ProcessMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -97,6 +195,8 @@ var _ = Describe("MetricProcessor", func() {
 	})
 
 	It("adds a new alias for `bosh-hm-forwarder` metrics", func() {
+		naming := config.MetricNaming{Aliases: config.DefaultMetricAliases}
+		p, _ = NewProcessor(mchan, &config.Config{CounterType: metric.Count, MetricNaming: naming}, false, nil, nil, nil, nil)
 		p.ProcessMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
 			Timestamp: proto.Int64(1000000000),
@@ -131,6 +231,50 @@ var _ = Describe("MetricProcessor", func() {
 		Expect(boshAliasFound).To(BeTrue())
 	})
 
+	Context("with naming modes", func() {
+		BeforeEach(func() {
+			naming := config.MetricNaming{
+				Mode:    config.NamingNew,
+				Origins: map[string]string{"legacy-origin": config.NamingLegacy, "both-origin": config.NamingBoth},
+				Aliases: []config.MetricAlias{{Prefix: "bosh-hm-forwarder", Replacement: "bosh.healthmonitor"}},
+			}
+			p, _ = NewProcessor(mchan, &config.Config{CounterType: metric.Count, MetricNaming: naming}, false, nil, nil, nil, nil)
+		})
+
+		names := func(origin string, name string) []string {
+			p.ProcessMetric(&events.Envelope{
+				Origin:    proto.String(origin),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String(name),
+					Value: proto.Float64(5),
+				},
+			})
+
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+			result := []string{}
+			for _, m := range metricPkg {
+				result = append(result, m.MetricKey.Name)
+			}
+			return result
+		}
+
+		It("uses the default mode", func() {
+			Expect(names("origin", "fooMetric")).To(Equal([]string{"fooMetric"}))
+		})
+
+		It("uses the mode of the origin", func() {
+			Expect(names("legacy-origin", "fooMetric")).To(Equal([]string{"legacy-origin.fooMetric"}))
+			Expect(names("both-origin", "fooMetric")).To(Equal([]string{"fooMetric", "both-origin.fooMetric"}))
+		})
+
+		It("adds the aliases", func() {
+			Expect(names("origin", "bosh-hm-forwarder.foo")).To(Equal([]string{"bosh-hm-forwarder.foo", "bosh.healthmonitor.foo"}))
+		})
+	})
+
 	It("ignores messages that aren't value metrics or counter events", func() {
 		p.ProcessMetric(&events.Envelope{
 			Origin:    proto.String("origin"),
@@ -163,6 +307,236 @@ var _ = Describe("MetricProcessor", func() {
 		Consistently(mchan).ShouldNot(Receive())
 	})
 
+	Context("http start stop events", func() {
+		// 6ba7b810-9dad-11d1-80b4-00c04fd430c8 encoded the way the routers encode app guids
+		appID := &events.UUID{
+			Low:  proto.Uint64(0xd111ad9d10b8a76b),
+			High: proto.Uint64(0xc830d44fc000b480),
+		}
+
+		request := func(peerType events.PeerType, status int32, latencyMs int64) *events.Envelope {
+			start := int64(1000000000)
+			return &events.Envelope{
+				Origin:    proto.String("gorouter"),
+				Timestamp: proto.Int64(start),
+				EventType: events.Envelope_HttpStartStop.Enum(),
+				HttpStartStop: &events.HttpStartStop{
+					StartTimestamp: proto.Int64(start),
+					StopTimestamp:  proto.Int64(start + latencyMs*1000000),
+					RequestId:      &events.UUID{Low: proto.Uint64(1), High: proto.Uint64(2)},
+					PeerType:       peerType.Enum(),
+					Method:         events.Method_GET.Enum(),
+					Uri:            proto.String("http://my-app.example.com/some/path"),
+					RemoteAddress:  proto.String("10.0.0.1"),
+					UserAgent:      proto.String("curl"),
+					StatusCode:     proto.Int32(status),
+					ContentLength:  proto.Int64(42),
+					ApplicationId:  appID,
+				},
+			}
+		}
+
+		find := func(metrics []metric.MetricPackage, name string, tag string) *metric.MetricValue {
+			for _, m := range metrics {
+				if m.MetricKey.Name != name {
+					continue
+				}
+				for _, t := range m.MetricValue.Tags {
+					if t == tag {
+						return m.MetricValue
+					}
+				}
+			}
+			return nil
+		}
+
+		It("aggregates requests until the next flush", func() {
+			for i := int64(1); i <= 100; i++ {
+				p.ProcessMetric(request(events.PeerType_Client, 200, i))
+			}
+			p.ProcessMetric(request(events.PeerType_Client, 404, 10))
+			p.ProcessMetric(request(events.PeerType_Client, 502, 1000))
+			Consistently(mchan).ShouldNot(Receive())
+
+			metrics := p.FlushHTTPMetrics(10)
+
+			requests := find(metrics, "app.http.requests", "status_class:2xx")
+			Expect(requests).NotTo(BeNil())
+			Expect(requests.Type).To(Equal(metric.Count))
+			Expect(requests.Points).To(Equal([]metric.Point{{Timestamp: 10, Value: 100}}))
+			Expect(requests.Tags).To(ContainElement("app_id:6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+			Expect(requests.Tags).To(ContainElement("route:my-app.example.com"))
+			Expect(requests.Tags).To(ContainElement("method:GET"))
+			Expect(find(metrics, "app.http.requests", "status_class:4xx").Points[0].Value).To(Equal(1.0))
+			Expect(find(metrics, "app.http.requests", "status_class:5xx").Points[0].Value).To(Equal(1.0))
+			Expect(find(metrics, "app.http.errors", "status_class:2xx")).To(BeNil())
+			Expect(find(metrics, "app.http.errors", "status_class:4xx").Points[0].Value).To(Equal(1.0))
+			Expect(find(metrics, "app.http.errors", "status_class:5xx").Points[0].Value).To(Equal(1.0))
+
+			route := "route:my-app.example.com"
+			Expect(find(metrics, "app.http.latency.p50", route).Points[0].Value).To(Equal(50.0))
+			Expect(find(metrics, "app.http.latency.p95", route).Points[0].Value).To(Equal(96.0))
+			Expect(find(metrics, "app.http.latency.p99", route).Points[0].Value).To(Equal(100.0))
+			Expect(find(metrics, "app.http.latency.max", route).Points[0].Value).To(Equal(1000.0))
+			Expect(find(metrics, "app.http.latency.avg", route).Points[0].Value).To(Equal(6060.0 / 102))
+			Expect(find(metrics, "app.http.latency.p50", route).Type).To(Equal(metric.Gauge))
+			Expect(find(metrics, "app.http.latency.p50", "status_class:2xx")).To(BeNil())
+
+			Expect(p.FlushHTTPMetrics(20)).To(BeEmpty())
+		})
+
+		It("ignores the requests reported by the apps", func() {
+			p.ProcessMetric(request(events.PeerType_Server, 200, 10))
+			Expect(p.FlushHTTPMetrics(10)).To(BeEmpty())
+		})
+	})
+
+	Context("events", func() {
+		BeforeEach(func() {
+			p, _ = NewProcessor(mchan, &config.Config{CounterType: metric.Count, EventsDedupWindowSeconds: 60}, false, nil, nil, nil, nil)
+		})
+
+		apiLog := func(message string, timestamp int64) *events.Envelope {
+			return &events.Envelope{
+				Origin:    proto.String("cloud_controller"),
+				Timestamp: proto.Int64(timestamp),
+				EventType: events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{
+					Message:     []byte(message),
+					MessageType: events.LogMessage_OUT.Enum(),
+					Timestamp:   proto.Int64(timestamp),
+					AppId:       proto.String("app-id"),
+					SourceType:  proto.String("API"),
+				},
+			}
+		}
+		crash := `App instance exited with guid app-id payload: {"instance"=>"abc", "index"=>2, "reason"=>"CRASHED", "exit_description"=>"APP/PROC/WEB: Exited with status 1", "crash_count"=>1}`
+
+		It("turns error envelopes into events", func() {
+			evts, err := p.ProcessEvent(&events.Envelope{
+				Origin:    proto.String("doppler"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_Error.Enum(),
+				Error: &events.Error{
+					Source:  proto.String("syslog_drain"),
+					Code:    proto.Int32(42),
+					Message: proto.String("something went wrong"),
+				},
+				Deployment: proto.String("cf"),
+				Job:        proto.String("doppler"),
+			})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(evts).To(HaveLen(1))
+			Expect(evts[0].Title).To(Equal("doppler error: syslog_drain"))
+			Expect(evts[0].Text).To(Equal("something went wrong"))
+			Expect(evts[0].Timestamp).To(BeEquivalentTo(1))
+			Expect(evts[0].AlertType).To(Equal("error"))
+			Expect(evts[0].Tags).To(ConsistOf("deployment:cf", "job:doppler", "origin:doppler", "source:syslog_drain", "code:42"))
+		})
+
+		It("turns app crashes into events", func() {
+			evts, err := p.ProcessEvent(apiLog(crash, 1000000000))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(evts).To(HaveLen(1))
+			Expect(evts[0].Title).To(Equal("App app-id crashed"))
+			Expect(evts[0].Text).To(Equal(crash))
+			Expect(evts[0].AlertType).To(Equal("error"))
+			Expect(evts[0].AggregationKey).To(Equal("crash:app-id"))
+			Expect(evts[0].Tags).To(ContainElement("app_id:app-id"))
+			Expect(evts[0].Tags).To(ContainElement("instance_index:2"))
+
+			evts, err = p.ProcessEvent(apiLog(`Process has crashed with type: "web"`, 1000000000000))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(evts).To(HaveLen(1))
+			Expect(evts[0].Tags).To(ContainElement("process_type:web"))
+		})
+
+		It("turns app state changes into events", func() {
+			evts, err := p.ProcessEvent(apiLog(`Updated app with guid app-id ({"state"=>"STOPPED"})`, 1000000000))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(evts).To(HaveLen(1))
+			Expect(evts[0].Title).To(Equal("App app-id stopped"))
+			Expect(evts[0].AlertType).To(Equal("info"))
+		})
+
+		It("ignores the other logs", func() {
+			evts, err := p.ProcessEvent(apiLog(`Updated app with guid app-id ({"instances"=>2})`, 1000000000))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(evts).To(BeEmpty())
+
+			evts, err = p.ProcessEvent(apiLog(`App instance exited with guid app-id payload: {"index"=>0, "reason"=>"STOPPED"}`, 1000000000))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(evts).To(BeEmpty())
+
+			appLog := apiLog(crash, 1000000000)
+			appLog.LogMessage.SourceType = proto.String("APP/PROC/WEB")
+			evts, err = p.ProcessEvent(appLog)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(evts).To(BeEmpty())
+		})
+
+		It("de-duplicates events within the window", func() {
+			evts, _ := p.ProcessEvent(apiLog(crash, 1000000000))
+			Expect(evts).To(HaveLen(1))
+
+			for i := int64(2); i < 60; i += 10 {
+				evts, _ = p.ProcessEvent(apiLog(crash, i*1000000000))
+				Expect(evts).To(BeEmpty())
+			}
+
+			evts, _ = p.ProcessEvent(apiLog(crash, 61*1000000000))
+			Expect(evts).To(HaveLen(1))
+			Expect(evts[0].Text).To(HaveSuffix("6 similar events were suppressed since the previous one"))
+
+			evts, _ = p.ProcessEvent(apiLog(`Updated app with guid app-id ({"state"=>"STARTED"})`, 62*1000000000))
+			Expect(evts).To(HaveLen(1))
+		})
+	})
+
+	It("turns log messages into logs", func() {
+		l, err := p.ProcessLog(&events.Envelope{
+			Origin:    proto.String("rep"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message:        []byte("log message"),
+				MessageType:    events.LogMessage_ERR.Enum(),
+				Timestamp:      proto.Int64(2000000000),
+				AppId:          proto.String("app-id"),
+				SourceType:     proto.String("APP/PROC/WEB"),
+				SourceInstance: proto.String("0"),
+			},
+			Deployment: proto.String("deployment-name"),
+			Job:        proto.String("diego-cell"),
+			Index:      proto.String("1"),
+		})
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(l.Message).To(Equal("log message"))
+		Expect(l.Source).To(Equal("cloudfoundry"))
+		Expect(l.Service).To(Equal("rep"))
+		Expect(l.Hostname).To(Equal("1"))
+		Expect(l.Status).To(Equal("error"))
+		Expect(l.Timestamp).To(BeEquivalentTo(2000))
+		Expect(l.Tags).To(Equal("deployment:deployment-name,job:diego-cell,index:1,origin:rep,source_type:APP/PROC/WEB,source_instance:0,app_id:app-id"))
+	})
+
+	It("does not turn other envelopes into logs", func() {
+		_, err := p.ProcessLog(&events.Envelope{
+			Origin:    proto.String("origin"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("valueName"),
+				Value: proto.Float64(5),
+			},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
 	It("adds tags", func() {
 		p.ProcessMetric(&events.Envelope{
 			Origin:    proto.String("test-origin"),
@@ -243,8 +617,7 @@ var _ = Describe("MetricProcessor", func() {
 	Context("custom tags", func() {
 		BeforeEach(func() {
 			mchan = make(chan []metric.MetricPackage, 1500)
-			p, _ = NewProcessor(mchan, []string{"environment:foo", "foundry:bar"}, "", false,
-				nil, 4, 0, nil)
+			p, _ = NewProcessor(mchan, &config.Config{CustomTags: []string{"environment:foo", "foundry:bar"}, CounterType: metric.Count}, false, nil, nil, nil, nil)
 		})
 
 		It("adds custom tags to infra metrics", func() {
@@ -288,4 +661,39 @@ var _ = Describe("MetricProcessor", func() {
 		// custom tags on app metrics tested in app_metrics_test
 		// custom tags on internal metrics tested in datadogclient_test
 	})
+
+	Context("with rewrite rules", func() {
+		BeforeEach(func() {
+			rewriter, err := rewrite.New([]config.MetricRewriteRule{
+				{Name: "origin.*", Rename: "{tag:job}.$1", DropTags: []string{"ip"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			mchan = make(chan []metric.MetricPackage, 1500)
+			p, _ = NewProcessor(mchan, &config.Config{CounterType: metric.Count}, false, nil, rewriter, nil, nil)
+		})
+
+		It("rewrites the infra metrics", func() {
+			p.ProcessMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				Job:       proto.String("doppler"),
+				Ip:        proto.String("10.0.1.2"),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("valueName"),
+					Value: proto.Float64(5),
+				},
+			})
+
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+
+			Expect(metricPkg).To(HaveLen(2))
+			Expect(metricPkg[0].MetricKey.Name).To(Equal("valueName"))
+			Expect(metricPkg[0].MetricValue.Tags).To(ContainElement("ip:10.0.1.2"))
+			Expect(metricPkg[1].MetricKey.Name).To(Equal("doppler.valueName"))
+			Expect(metricPkg[1].MetricValue.Tags).ToNot(ContainElement("ip:10.0.1.2"))
+			Expect(metricPkg[1].MetricValue.Points[0].Value).To(Equal(5.0))
+		})
+	})
 })
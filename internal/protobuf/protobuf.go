@@ -0,0 +1,58 @@
+package protobuf
+
+import (
+	"math"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// The wire types of the protobuf fields
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+)
+
+// The encoders of the scalar fields leave out the zero values, like proto3 does. Both the Datadog series API v2
+// and the Prometheus remote write protocol use proto3 messages.
+
+// EncodeString encodes a string field
+func EncodeString(buf *proto.Buffer, field int, s string) error {
+	if s == "" {
+		return nil
+	}
+	if err := buf.EncodeVarint(uint64(field<<3 | WireBytes)); err != nil {
+		return err
+	}
+	return buf.EncodeStringBytes(s)
+}
+
+// EncodeInt encodes an int64 or an enum field
+func EncodeInt(buf *proto.Buffer, field int, i int64) error {
+	if i == 0 {
+		return nil
+	}
+	if err := buf.EncodeVarint(uint64(field<<3 | WireVarint)); err != nil {
+		return err
+	}
+	return buf.EncodeVarint(uint64(i))
+}
+
+// EncodeDouble encodes a double field
+func EncodeDouble(buf *proto.Buffer, field int, f float64) error {
+	if f == 0 {
+		return nil
+	}
+	if err := buf.EncodeVarint(uint64(field<<3 | WireFixed64)); err != nil {
+		return err
+	}
+	return buf.EncodeFixed64(math.Float64bits(f))
+}
+
+// EncodeMessage encodes an embedded message, even an empty one, e.g. an element of a repeated field
+func EncodeMessage(buf *proto.Buffer, field int, message *proto.Buffer) error {
+	if err := buf.EncodeVarint(uint64(field<<3 | WireBytes)); err != nil {
+		return err
+	}
+	return buf.EncodeRawBytes(message.Bytes())
+}
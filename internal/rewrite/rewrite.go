@@ -0,0 +1,202 @@
+package rewrite
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+// tagPlaceholder is a reference to the value of a tag in the new name of a metric
+var tagPlaceholder = regexp.MustCompile(`\{tag:([^}]+)\}`)
+
+// Rewriter renames metrics and rewrites their tags, following rules applied one after the other
+type Rewriter struct {
+	rules []rule
+}
+
+type rule struct {
+	name         *filter.Pattern
+	tags         map[string]*filter.Pattern
+	rename       string
+	mapTagValues map[string]map[string]string
+	renameTags   map[string]string
+	dropTags     []*filter.Pattern
+	addTags      []string
+}
+
+// New compiles the rewrite rules of the configuration
+func New(configs []config.MetricRewriteRule) (*Rewriter, error) {
+	rules := make([]rule, 0, len(configs))
+	for _, c := range configs {
+		r := rule{
+			rename:       c.Rename,
+			mapTagValues: c.MapTagValues,
+			renameTags:   c.RenameTags,
+			addTags:      c.AddTags,
+		}
+
+		var err error
+		if c.Name != "" {
+			if r.name, err = filter.CompilePattern(c.Name); err != nil {
+				return nil, err
+			}
+		}
+		if len(c.Tags) > 0 {
+			r.tags = make(map[string]*filter.Pattern, len(c.Tags))
+			for name, value := range c.Tags {
+				if r.tags[name], err = filter.CompilePattern(value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, drop := range c.DropTags {
+			pattern, err := filter.CompilePattern(drop)
+			if err != nil {
+				return nil, err
+			}
+			r.dropTags = append(r.dropTags, pattern)
+		}
+		if r.rename == "" && r.mapTagValues == nil && r.renameTags == nil && r.dropTags == nil && r.addTags == nil {
+			return nil, fmt.Errorf("metric rewrite rule %+v doesn't change anything", c)
+		}
+
+		rules = append(rules, r)
+	}
+	return &Rewriter{rules: rules}, nil
+}
+
+// Apply rewrites the metric packages, the packages left untouched by the rules are returned as is
+func (r *Rewriter) Apply(packages []metric.MetricPackage) []metric.MetricPackage {
+	if r == nil || len(r.rules) == 0 {
+		return packages
+	}
+
+	rewritten := make([]metric.MetricPackage, 0, len(packages))
+	for _, pkg := range packages {
+		name := pkg.MetricKey.Name
+		tags := pkg.MetricValue.Tags
+		changed := false
+		for _, rule := range r.rules {
+			if !rule.match(name, tags) {
+				continue
+			}
+			name, tags = rule.apply(name, tags)
+			changed = true
+		}
+		if !changed {
+			rewritten = append(rewritten, pkg)
+			continue
+		}
+
+		// The value may be shared with the other names of the envelope, copy it
+		value := *pkg.MetricValue
+		value.Tags = tags
+		key := *pkg.MetricKey
+		key.Name = name
+		key.TagsHash = util.HashTags(tags)
+		rewritten = append(rewritten, metric.MetricPackage{MetricKey: &key, MetricValue: &value})
+	}
+	return rewritten
+}
+
+func (r rule) match(name string, tags []string) bool {
+	if r.name != nil && !r.name.Match(name) {
+		return false
+	}
+	for tagName, pattern := range r.tags {
+		value, ok := tagValue(tags, tagName)
+		if !ok || !pattern.Match(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the new name and a new slice of tags
+func (r rule) apply(name string, tags []string) (string, []string) {
+	if r.rename != "" {
+		name = r.newName(name, tags)
+	}
+
+	rewritten := make([]string, 0, len(tags)+len(r.addTags))
+	for _, tag := range tags {
+		tagName, value := splitTag(tag)
+		if values, ok := r.mapTagValues[tagName]; ok {
+			if newValue, ok := values[value]; ok {
+				value = newValue
+			}
+		}
+		if newName, ok := r.renameTags[tagName]; ok {
+			tagName = newName
+		}
+		if r.drop(tagName) {
+			continue
+		}
+		rewritten = append(rewritten, joinTag(tagName, value))
+	}
+	rewritten = append(rewritten, r.addTags...)
+
+	return name, rewritten
+}
+
+// newName expands the rename template, the name is left unchanged if the template refers to a missing tag
+func (r rule) newName(name string, tags []string) string {
+	newName := r.rename
+	if r.name != nil {
+		regex := r.name.Regexp()
+		submatches := regex.FindStringSubmatchIndex(name)
+		newName = string(regex.ExpandString(nil, r.rename, name, submatches))
+	}
+
+	missing := false
+	newName = tagPlaceholder.ReplaceAllStringFunc(newName, func(placeholder string) string {
+		value, ok := tagValue(tags, tagPlaceholder.FindStringSubmatch(placeholder)[1])
+		if !ok {
+			missing = true
+		}
+		return value
+	})
+	if missing {
+		return name
+	}
+	return newName
+}
+
+func (r rule) drop(tagName string) bool {
+	for _, pattern := range r.dropTags {
+		if pattern.Match(tagName) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValue returns the value of the first tag with the given name
+func tagValue(tags []string, name string) (string, bool) {
+	for _, tag := range tags {
+		if tagName, value := splitTag(tag); tagName == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func splitTag(tag string) (string, string) {
+	parts := strings.SplitN(tag, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func joinTag(name string, value string) string {
+	if value == "" {
+		return name
+	}
+	return name + ":" + value
+}
@@ -0,0 +1,13 @@
+package rewrite
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Rewrite Suite")
+}
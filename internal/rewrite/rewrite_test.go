@@ -0,0 +1,117 @@
+package rewrite
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+var _ = Describe("Rewriter", func() {
+	pkg := func(name string, tags ...string) metric.MetricPackage {
+		return metric.MetricPackage{
+			MetricKey: &metric.MetricKey{
+				EventType: events.Envelope_ValueMetric,
+				Name:      name,
+				TagsHash:  util.HashTags(append([]string{}, tags...)),
+			},
+			MetricValue: &metric.MetricValue{
+				Tags:   tags,
+				Points: []metric.Point{{Timestamp: 1, Value: 2}},
+				Host:   "host",
+				Type:   metric.Gauge,
+			},
+		}
+	}
+
+	rewrite := func(rules []config.MetricRewriteRule, packages ...metric.MetricPackage) []metric.MetricPackage {
+		r, err := New(rules)
+		Expect(err).ToNot(HaveOccurred())
+		return r.Apply(packages)
+	}
+
+	It("leaves the metrics alone without rules", func() {
+		original := pkg("requests", "job:router")
+		Expect(rewrite(nil, original)).To(Equal([]metric.MetricPackage{original}))
+
+		var r *Rewriter
+		Expect(r.Apply([]metric.MetricPackage{original})).To(Equal([]metric.MetricPackage{original}))
+	})
+
+	It("renames metrics with the groups captured by a regular expression", func() {
+		rewritten := rewrite([]config.MetricRewriteRule{
+			{Name: `/^gorouter\.(?P<metric>.*)$/`, Rename: "router.${metric}"},
+		}, pkg("gorouter.latency", "job:router"), pkg("rep.latency", "job:diego_cell"))
+
+		Expect(rewritten[0].MetricKey.Name).To(Equal("router.latency"))
+		Expect(rewritten[1].MetricKey.Name).To(Equal("rep.latency"))
+	})
+
+	It("renames metrics with the wildcards captured by a glob", func() {
+		rewritten := rewrite([]config.MetricRewriteRule{
+			{Name: "bosh-hm-forwarder.*", Rename: "bosh.healthmonitor.$1"},
+		}, pkg("bosh-hm-forwarder.system.cpu.user"))
+
+		Expect(rewritten[0].MetricKey.Name).To(Equal("bosh.healthmonitor.system.cpu.user"))
+	})
+
+	It("turns tags into name segments", func() {
+		rewritten := rewrite([]config.MetricRewriteRule{
+			{Name: "latency", Rename: "{tag:origin}.{tag:job}.latency"},
+		}, pkg("latency", "origin:gorouter", "job:router"), pkg("latency", "origin:gorouter"))
+
+		Expect(rewritten[0].MetricKey.Name).To(Equal("gorouter.router.latency"))
+		// The job tag is missing, the metric keeps its name
+		Expect(rewritten[1].MetricKey.Name).To(Equal("latency"))
+	})
+
+	It("adds, drops, renames and maps tags", func() {
+		original := pkg("requests", "job:router", "ip:10.0.0.1", "index:0", "env:prd")
+		rewritten := rewrite([]config.MetricRewriteRule{{
+			MapTagValues: map[string]map[string]string{"env": {"prd": "production"}},
+			RenameTags:   map[string]string{"job": "service"},
+			DropTags:     []string{"ip", "ind*"},
+			AddTags:      []string{"team:platform"},
+		}}, original)
+
+		Expect(rewritten).To(HaveLen(1))
+		Expect(rewritten[0].MetricValue.Tags).To(ConsistOf("service:router", "env:production", "team:platform"))
+		Expect(rewritten[0].MetricKey.TagsHash).To(Equal(util.HashTags([]string{"service:router", "env:production", "team:platform"})))
+		Expect(rewritten[0].MetricValue.Points).To(Equal(original.MetricValue.Points))
+		Expect(rewritten[0].MetricValue.Host).To(Equal("host"))
+
+		// The original package is untouched, its value may be shared with other names
+		Expect(original.MetricValue.Tags).To(ConsistOf("job:router", "ip:10.0.0.1", "index:0", "env:prd"))
+	})
+
+	It("only rewrites the metrics with matching tags", func() {
+		rewritten := rewrite([]config.MetricRewriteRule{
+			{Tags: map[string]string{"job": "diego_cell*"}, AddTags: []string{"tier:compute"}},
+		}, pkg("rep.latency", "job:diego_cell_z1"), pkg("gorouter.latency", "job:router"), pkg("uaa.latency"))
+
+		Expect(rewritten[0].MetricValue.Tags).To(ContainElement("tier:compute"))
+		Expect(rewritten[1].MetricValue.Tags).ToNot(ContainElement("tier:compute"))
+		Expect(rewritten[2].MetricValue.Tags).To(BeEmpty())
+	})
+
+	It("applies the rules one after the other", func() {
+		rewritten := rewrite([]config.MetricRewriteRule{
+			{Name: "gorouter.*", Rename: "router.$1"},
+			{Name: "router.*", AddTags: []string{"renamed"}},
+		}, pkg("gorouter.latency"))
+
+		Expect(rewritten[0].MetricKey.Name).To(Equal("router.latency"))
+		Expect(rewritten[0].MetricValue.Tags).To(Equal([]string{"renamed"}))
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := New([]config.MetricRewriteRule{{Name: "/(/", Rename: "x"}})
+		Expect(err).To(HaveOccurred())
+
+		_, err = New([]config.MetricRewriteRule{{Name: "requests"}})
+		Expect(err).To(HaveOccurred())
+	})
+})
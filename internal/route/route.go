@@ -0,0 +1,140 @@
+package route
+
+import (
+	"strings"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+// Router holds the routes of the additional endpoints
+type Router struct {
+	routes []endpointRoute
+}
+
+// Route selects the metrics sent to an endpoint, a nil Route selects all of them
+type Route struct {
+	rules []rule
+}
+
+type endpointRoute struct {
+	endpoint string
+	apiKey   string
+	rules    []rule
+}
+
+type rule struct {
+	name       *filter.Pattern
+	orgName    *filter.Pattern
+	spaceName  *filter.Pattern
+	deployment *filter.Pattern
+}
+
+// New compiles the routes of the configuration
+func New(c config.MetricRoutes) (*Router, error) {
+	platform, err := compileRules(c.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]endpointRoute, 0, len(c.Endpoints))
+	for _, e := range c.Endpoints {
+		rules, err := compileRules(e.Rules)
+		if err != nil {
+			return nil, err
+		}
+		if e.IncludePlatform {
+			rules = append(rules, platform...)
+		}
+		routes = append(routes, endpointRoute{endpoint: e.Endpoint, apiKey: e.APIKey, rules: rules})
+	}
+	return &Router{routes: routes}, nil
+}
+
+// For returns the route of an endpoint and API key, merging the routes configured for it, or nil if there are none
+func (r *Router) For(endpoint string, apiKey string) *Route {
+	if r == nil {
+		return nil
+	}
+
+	var route *Route
+	for _, e := range r.routes {
+		if e.endpoint != endpoint || (e.apiKey != "" && e.apiKey != apiKey) {
+			continue
+		}
+		if route == nil {
+			route = &Route{}
+		}
+		route.rules = append(route.rules, e.rules...)
+	}
+	return route
+}
+
+// Select returns a new map of the metrics matching one of the rules of the route, or of all the metrics for a nil route
+func (r *Route) Select(metrics metric.MetricsMap) metric.MetricsMap {
+	selected := make(metric.MetricsMap, len(metrics))
+	for k, v := range metrics {
+		if r.match(k.Name, v.Tags) {
+			selected[k] = v
+		}
+	}
+	return selected
+}
+
+func (r *Route) match(name string, tags []string) bool {
+	if r == nil {
+		return true
+	}
+	for _, rule := range r.rules {
+		if rule.match(name, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) match(name string, tags []string) bool {
+	if r.name != nil && !r.name.Match(name) {
+		return false
+	}
+	return matchTag(r.orgName, "org_name", tags) &&
+		matchTag(r.spaceName, "space_name", tags) &&
+		matchTag(r.deployment, "deployment", tags)
+}
+
+// matchTag returns true if the pattern is nil, or if it matches the value of one of the tags with the given name
+func matchTag(pattern *filter.Pattern, tagName string, tags []string) bool {
+	if pattern == nil {
+		return true
+	}
+	prefix := tagName + ":"
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) && pattern.Match(tag[len(prefix):]) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileRules(configs []config.MetricRouteRule) ([]rule, error) {
+	rules := make([]rule, 0, len(configs))
+	for _, c := range configs {
+		var r rule
+		var err error
+		if r.name, err = filter.CompileOptional(c.Name); err != nil {
+			return nil, err
+		}
+		if r.orgName, err = filter.CompileOptional(c.OrgName); err != nil {
+			return nil, err
+		}
+		if r.spaceName, err = filter.CompileOptional(c.SpaceName); err != nil {
+			return nil, err
+		}
+		if r.deployment, err = filter.CompileOptional(c.Deployment); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,159 @@
+package route
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+var _ = Describe("Router", func() {
+	const endpoint = "https://app.datadoghq.com/api/v1/series"
+
+	var metrics metric.MetricsMap
+
+	add := func(name string, tags ...string) {
+		metrics[metric.MetricKey{
+			EventType: events.Envelope_ValueMetric,
+			Name:      name,
+			TagsHash:  util.HashTags(append([]string{}, tags...)),
+		}] = metric.MetricValue{
+			Tags:   tags,
+			Points: []metric.Point{{Timestamp: 1, Value: 2}},
+			Type:   metric.Gauge,
+		}
+	}
+
+	names := func(selected metric.MetricsMap) []string {
+		var names []string
+		for k := range selected {
+			names = append(names, k.Name)
+		}
+		return names
+	}
+
+	route := func(routes config.MetricRoutes, apiKey string) *Route {
+		r, err := New(routes)
+		Expect(err).ToNot(HaveOccurred())
+		return r.For(endpoint, apiKey)
+	}
+
+	BeforeEach(func() {
+		metrics = make(metric.MetricsMap)
+		add("app.cpu", "org_name:tenant", "space_name:prod")
+		add("app.memory", "org_name:tenant", "space_name:dev")
+		add("app.disk", "org_name:other", "space_name:prod")
+		add("gorouter.latency", "deployment:cf-prod", "deployment:cf")
+		add("rep.capacity", "deployment:cf-diego")
+		add("mysql.connections", "deployment:mysql")
+	})
+
+	It("selects all the metrics of an endpoint without route", func() {
+		r := route(config.MetricRoutes{
+			Endpoints: []config.EndpointRoute{{
+				Endpoint: "https://app.datadoghq.eu/api/v1/series",
+				Rules:    []config.MetricRouteRule{{OrgName: "tenant"}},
+			}},
+		}, "key")
+		Expect(r).To(BeNil())
+		Expect(r.Select(metrics)).To(Equal(metrics))
+
+		var router *Router
+		Expect(router.For(endpoint, "key")).To(BeNil())
+	})
+
+	It("selects the app metrics of a tenant org", func() {
+		r := route(config.MetricRoutes{
+			Endpoints: []config.EndpointRoute{{
+				Endpoint: endpoint,
+				Rules:    []config.MetricRouteRule{{OrgName: "tenant"}},
+			}},
+		}, "key")
+		Expect(names(r.Select(metrics))).To(ConsistOf("app.cpu", "app.memory"))
+	})
+
+	It("requires all the fields of a rule to match", func() {
+		r := route(config.MetricRoutes{
+			Endpoints: []config.EndpointRoute{{
+				Endpoint: endpoint,
+				Rules:    []config.MetricRouteRule{{OrgName: "tenant", SpaceName: "prod", Name: "app.*"}},
+			}},
+		}, "key")
+		Expect(names(r.Select(metrics))).To(ConsistOf("app.cpu"))
+	})
+
+	It("matches any of the tags with the same name", func() {
+		r := route(config.MetricRoutes{
+			Endpoints: []config.EndpointRoute{{
+				Endpoint: endpoint,
+				Rules:    []config.MetricRouteRule{{Deployment: "/^cf$/"}},
+			}},
+		}, "key")
+		Expect(names(r.Select(metrics))).To(ConsistOf("gorouter.latency"))
+	})
+
+	It("adds the platform metrics to the routes including them", func() {
+		routes := config.MetricRoutes{
+			Platform: []config.MetricRouteRule{{Deployment: "cf-*"}},
+			Endpoints: []config.EndpointRoute{
+				{
+					Endpoint:        endpoint,
+					APIKey:          "tenant-key",
+					Rules:           []config.MetricRouteRule{{OrgName: "tenant"}},
+					IncludePlatform: true,
+				},
+				{
+					Endpoint: endpoint,
+					APIKey:   "other-key",
+					Rules:    []config.MetricRouteRule{{OrgName: "other"}},
+				},
+			},
+		}
+		Expect(names(route(routes, "tenant-key").Select(metrics))).To(
+			ConsistOf("app.cpu", "app.memory", "gorouter.latency", "rep.capacity"))
+		Expect(names(route(routes, "other-key").Select(metrics))).To(ConsistOf("app.disk"))
+		Expect(route(routes, "unrouted-key")).To(BeNil())
+	})
+
+	It("merges the routes of the same endpoint", func() {
+		r := route(config.MetricRoutes{
+			Endpoints: []config.EndpointRoute{
+				{Endpoint: endpoint, Rules: []config.MetricRouteRule{{OrgName: "other"}}},
+				{Endpoint: endpoint, APIKey: "key", Rules: []config.MetricRouteRule{{Name: "mysql.*"}}},
+			},
+		}, "key")
+		Expect(names(r.Select(metrics))).To(ConsistOf("app.disk", "mysql.connections"))
+	})
+
+	It("selects nothing for a route without rules", func() {
+		r := route(config.MetricRoutes{
+			Endpoints: []config.EndpointRoute{{Endpoint: endpoint}},
+		}, "key")
+		Expect(r.Select(metrics)).To(BeEmpty())
+	})
+
+	It("returns a copy of the metrics", func() {
+		var r *Route
+		selected := r.Select(metrics)
+		add("new.metric")
+		Expect(selected).To(HaveLen(6))
+	})
+
+	It("fails on an invalid pattern", func() {
+		_, err := New(config.MetricRoutes{
+			Platform: []config.MetricRouteRule{{Name: "/(/"}},
+		})
+		Expect(err).To(HaveOccurred())
+
+		_, err = New(config.MetricRoutes{
+			Endpoints: []config.EndpointRoute{{
+				Endpoint: endpoint,
+				Rules:    []config.MetricRouteRule{{SpaceName: "/[/"}},
+			}},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
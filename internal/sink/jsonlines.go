@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+// JSONLines appends the metrics to a local file, one JSON object per point
+type JSONLines struct {
+	base
+	path string
+}
+
+// jsonLine is a point of a metric in the file
+type jsonLine struct {
+	Metric    string   `json:"metric"`
+	Type      string   `json:"type"`
+	Timestamp int64    `json:"timestamp"`
+	Value     float64  `json:"value"`
+	Unit      string   `json:"unit,omitempty"`
+	Host      string   `json:"host,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// NewJSONLines creates a sink appending to the Path of the sink config
+func NewJSONLines(sink config.Sink, c *config.Config, ip string) *JSONLines {
+	return &JSONLines{
+		base: newBase(c, ip),
+		path: sink.Path,
+	}
+}
+
+// PostMetrics appends the points of the metrics to the file. The file is opened on each flush, so that it can be
+// rotated by moving it away.
+func (j *JSONLines) PostMetrics(metrics metric.MetricsMap) error {
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+
+	for _, key := range sortedKeys(metrics) {
+		value := metrics[key]
+		line := jsonLine{
+			Metric: j.metricName(key.Name),
+			Type:   value.Type,
+			Unit:   value.Unit,
+			Host:   value.Host,
+			Tags:   value.Tags,
+		}
+		if line.Type == "" {
+			line.Type = metric.Gauge
+		}
+		for _, point := range value.Points {
+			if math.IsNaN(point.Value) || math.IsInf(point.Value, 0) {
+				continue
+			}
+			line.Timestamp = point.Timestamp
+			line.Value = point.Value
+			if err := encoder.Encode(line); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Endpoint returns the path of the file
+func (j *JSONLines) Endpoint() string {
+	return j.path
+}
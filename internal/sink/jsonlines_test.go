@@ -0,0 +1,100 @@
+package sink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+var _ = Describe("JSONLines", func() {
+	var (
+		dir  string
+		path string
+		sink *JSONLines
+	)
+
+	readLines := func() []jsonLine {
+		data, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		var lines []jsonLine
+		for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var line jsonLine
+			Expect(json.Unmarshal([]byte(l), &line)).To(Succeed())
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "jsonlines")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "metrics.jsonl")
+		sink = NewJSONLines(config.Sink{Type: config.SinkJSONLines, Path: path}, &config.Config{
+			MetricPrefix: "cloudfoundry.nozzle.",
+			Deployment:   "nozzle",
+		}, "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("appends a line per point", func() {
+		Expect(sink.PostMetrics(metric.MetricsMap{
+			{Name: "gorouter.latency", TagsHash: "a"}: {
+				Tags:   []string{"deployment:cf"},
+				Points: []metric.Point{{Timestamp: 1, Value: 0.000001}, {Timestamp: 2, Value: math.NaN()}},
+				Host:   "router-0",
+				Unit:   "millisecond",
+			},
+		})).To(Succeed())
+		k, v := sink.MakeInternalMetric("totalMetricsSent", 5, 3)
+		Expect(sink.PostMetrics(metric.MetricsMap{k: v})).To(Succeed())
+
+		Expect(readLines()).To(Equal([]jsonLine{
+			{
+				Metric:    "cloudfoundry.nozzle.gorouter.latency",
+				Type:      metric.Gauge,
+				Timestamp: 1,
+				Value:     0.000001,
+				Unit:      "millisecond",
+				Host:      "router-0",
+				Tags:      []string{"deployment:cf"},
+			},
+			{
+				Metric:    "cloudfoundry.nozzle.totalMetricsSent",
+				Type:      metric.Gauge,
+				Timestamp: 3,
+				Value:     5,
+				Tags:      []string{"deployment:nozzle", "ip:10.0.0.1"},
+			},
+		}))
+		Expect(sink.Endpoint()).To(Equal(path))
+		Expect(sink.Account()).To(BeEmpty())
+	})
+
+	It("starts a new file when the file is moved away", func() {
+		metrics := metric.MetricsMap{{Name: "count", TagsHash: "a"}: {Points: []metric.Point{{Timestamp: 1, Value: 2}}, Type: metric.Count}}
+		Expect(sink.PostMetrics(metrics)).To(Succeed())
+		Expect(os.Rename(path, path+".1")).To(Succeed())
+		Expect(sink.PostMetrics(metrics)).To(Succeed())
+
+		Expect(readLines()).To(HaveLen(1))
+		Expect(readLines()[0].Type).To(Equal(metric.Count))
+	})
+
+	It("fails when the file can't be written", func() {
+		sink.path = filepath.Join(dir, "missing", "metrics.jsonl")
+		Expect(sink.PostMetrics(metric.MetricsMap{})).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,275 @@
+package sink
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+// aggregationTemporalityDelta is the temporality of the counts and distributions, reported over the flush interval
+const aggregationTemporalityDelta = 1
+
+// otlpUnits maps the Datadog units to the UCUM units of OpenTelemetry
+var otlpUnits = map[string]string{
+	"nanosecond":  "ns",
+	"microsecond": "us",
+	"millisecond": "ms",
+	"second":      "s",
+	"byte":        "By",
+	"kibibyte":    "KiBy",
+	"mebibyte":    "MiBy",
+	"gibibyte":    "GiBy",
+	"percent":     "%",
+	"request":     "{request}",
+	"connection":  "{connection}",
+}
+
+// OTLP exports the metrics to an OpenTelemetry collector with OTLP/HTTP, using the JSON encoding
+type OTLP struct {
+	base
+	url        string
+	headers    map[string]string
+	interval   int64
+	httpClient *http.Client
+}
+
+// The OTLP/HTTP JSON encoding of the ExportMetricsServiceRequest. The 64 bits integers are strings.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+// otlpHistogramDataPoint summarizes the values of a distribution at a timestamp, in a single bucket
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	Min               float64        `json:"min"`
+	Max               float64        `json:"max"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// NewOTLP creates a sink posting to the URL of the sink config, e.g. http://otel-collector:4318/v1/metrics
+func NewOTLP(sink config.Sink, c *config.Config, ip string) *OTLP {
+	return &OTLP{
+		base:       newBase(c, ip),
+		url:        sink.URL,
+		headers:    sink.Headers,
+		interval:   int64(c.FlushDurationSeconds),
+		httpClient: newHTTPClient(sink.TimeoutSeconds),
+	}
+}
+
+// PostMetrics exports the metrics, at most maxSeriesPerRequest series per request. Gauges and rates are gauges,
+// counts are delta sums, distributions are delta histograms with a single bucket. The host of a metric is the
+// host.name attribute of its resource, its tags are the attributes of its data points.
+func (o *OTLP) PostMetrics(metrics metric.MetricsMap) error {
+	for _, keys := range chunks(sortedKeys(metrics)) {
+		body, err := json.Marshal(o.makeRequest(metrics, keys))
+		if err != nil {
+			return err
+		}
+		err = post(o.httpClient, o.url, body, o.headers, map[string]string{"Content-Type": "application/json"})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Endpoint returns the URL metrics are exported to
+func (o *OTLP) Endpoint() string {
+	return o.url
+}
+
+func (o *OTLP) makeRequest(metrics metric.MetricsMap, keys []metric.MetricKey) otlpRequest {
+	byHost := make(map[string][]otlpMetric)
+	for _, key := range keys {
+		value := metrics[key]
+		m := o.makeMetric(key, value)
+		if m == nil {
+			continue
+		}
+		byHost[value.Host] = append(byHost[value.Host], *m)
+	}
+
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	request := otlpRequest{ResourceMetrics: make([]otlpResourceMetrics, 0, len(hosts))}
+	for _, host := range hosts {
+		var resource otlpResource
+		if host != "" {
+			resource.Attributes = []otlpKeyValue{{Key: "host.name", Value: otlpAnyValue{StringValue: host}}}
+		}
+		request.ResourceMetrics = append(request.ResourceMetrics, otlpResourceMetrics{
+			Resource: resource,
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "datadog-firehose-nozzle"},
+				Metrics: byHost[host],
+			}},
+		})
+	}
+	return request
+}
+
+// makeMetric returns the OTLP metric of a series, or nil if it has no valid point
+func (o *OTLP) makeMetric(key metric.MetricKey, value metric.MetricValue) *otlpMetric {
+	attributes := otlpAttributes(value.Tags)
+	m := &otlpMetric{
+		Name: o.metricName(key.Name),
+		Unit: otlpUnits[value.Unit],
+	}
+
+	if value.Type == metric.Distribution {
+		points := o.histogramPoints(value.Points, attributes)
+		if len(points) == 0 {
+			return nil
+		}
+		m.Histogram = &otlpHistogram{DataPoints: points, AggregationTemporality: aggregationTemporalityDelta}
+		return m
+	}
+
+	var points []otlpNumberDataPoint
+	for _, p := range value.Points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		point := otlpNumberDataPoint{
+			Attributes:   attributes,
+			TimeUnixNano: unixNano(p.Timestamp),
+			AsDouble:     p.Value,
+		}
+		if value.Type == metric.Count {
+			point.StartTimeUnixNano = unixNano(p.Timestamp - o.interval)
+		}
+		points = append(points, point)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	if value.Type == metric.Count {
+		m.Sum = &otlpSum{DataPoints: points, AggregationTemporality: aggregationTemporalityDelta, IsMonotonic: true}
+	} else {
+		m.Gauge = &otlpGauge{DataPoints: points}
+	}
+	return m
+}
+
+// histogramPoints groups the values of a distribution by timestamp
+func (o *OTLP) histogramPoints(points []metric.Point, attributes []otlpKeyValue) []otlpHistogramDataPoint {
+	var result []otlpHistogramDataPoint
+	var counts []uint64
+	indexes := make(map[int64]int)
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		i, ok := indexes[p.Timestamp]
+		if !ok {
+			i = len(result)
+			indexes[p.Timestamp] = i
+			result = append(result, otlpHistogramDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: unixNano(p.Timestamp - o.interval),
+				TimeUnixNano:      unixNano(p.Timestamp),
+				Min:               p.Value,
+				Max:               p.Value,
+				ExplicitBounds:    []float64{},
+			})
+			counts = append(counts, 0)
+		}
+		counts[i]++
+		result[i].Sum += p.Value
+		result[i].Min = math.Min(result[i].Min, p.Value)
+		result[i].Max = math.Max(result[i].Max, p.Value)
+	}
+	for i := range result {
+		count := strconv.FormatUint(counts[i], 10)
+		result[i].Count = count
+		result[i].BucketCounts = []string{count}
+	}
+	return result
+}
+
+func otlpAttributes(tags []string) []otlpKeyValue {
+	labels := tagLabels(tags)
+	attributes := make([]otlpKeyValue, 0, len(labels))
+	for _, l := range labels {
+		attributes = append(attributes, otlpKeyValue{Key: l.name, Value: otlpAnyValue{StringValue: l.value}})
+	}
+	return attributes
+}
+
+func unixNano(timestamp int64) string {
+	return strconv.FormatInt(timestamp*int64(time.Second), 10)
+}
@@ -0,0 +1,160 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+var _ = Describe("OTLP", func() {
+	var (
+		ts           *httptest.Server
+		requests     []*http.Request
+		bodies       []otlpRequest
+		responseCode int
+		sink         *OTLP
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		bodies = nil
+		responseCode = http.StatusOK
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, err := ioutil.ReadAll(r.Body)
+			Expect(err).ToNot(HaveOccurred())
+			var body otlpRequest
+			Expect(json.Unmarshal(data, &body)).To(Succeed())
+			requests = append(requests, r)
+			bodies = append(bodies, body)
+			w.WriteHeader(responseCode)
+		}))
+		sink = NewOTLP(config.Sink{
+			Type:    config.SinkOTLP,
+			URL:     ts.URL + "/v1/metrics",
+			Headers: map[string]string{"Authorization": "Bearer token"},
+		}, &config.Config{MetricPrefix: "cf.", FlushDurationSeconds: 10}, "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("exports the gauges, counts and distributions grouped by host", func() {
+		Expect(sink.PostMetrics(metric.MetricsMap{
+			{Name: "gorouter.latency", TagsHash: "a"}: {
+				Tags:   []string{"deployment:cf", "deployment:cf-prod", "job:router"},
+				Points: []metric.Point{{Timestamp: 1, Value: 1.5}},
+				Host:   "router-0",
+				Type:   metric.Gauge,
+				Unit:   "millisecond",
+			},
+			{Name: "gorouter.requests", TagsHash: "b"}: {
+				Points: []metric.Point{{Timestamp: 20, Value: 3}},
+				Host:   "router-0",
+				Type:   metric.Count,
+			},
+			{Name: "app.distribution.cpu", TagsHash: "c"}: {
+				Tags:   []string{"app_name:web"},
+				Points: []metric.Point{{Timestamp: 20, Value: 1}, {Timestamp: 20, Value: 3}, {Timestamp: 30, Value: 2}},
+				Type:   metric.Distribution,
+			},
+		})).To(Succeed())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].URL.Path).To(Equal("/v1/metrics"))
+		Expect(requests[0].Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(requests[0].Header.Get("Authorization")).To(Equal("Bearer token"))
+
+		resourceMetrics := bodies[0].ResourceMetrics
+		Expect(resourceMetrics).To(HaveLen(2))
+
+		Expect(resourceMetrics[0].Resource.Attributes).To(BeEmpty())
+		Expect(resourceMetrics[0].ScopeMetrics[0].Metrics).To(Equal([]otlpMetric{{
+			Name: "cf.app.distribution.cpu",
+			Histogram: &otlpHistogram{
+				AggregationTemporality: aggregationTemporalityDelta,
+				DataPoints: []otlpHistogramDataPoint{
+					{
+						Attributes:        []otlpKeyValue{{Key: "app_name", Value: otlpAnyValue{StringValue: "web"}}},
+						StartTimeUnixNano: "10000000000",
+						TimeUnixNano:      "20000000000",
+						Count:             "2",
+						Sum:               4,
+						Min:               1,
+						Max:               3,
+						BucketCounts:      []string{"2"},
+						ExplicitBounds:    []float64{},
+					},
+					{
+						Attributes:        []otlpKeyValue{{Key: "app_name", Value: otlpAnyValue{StringValue: "web"}}},
+						StartTimeUnixNano: "20000000000",
+						TimeUnixNano:      "30000000000",
+						Count:             "1",
+						Sum:               2,
+						Min:               2,
+						Max:               2,
+						BucketCounts:      []string{"1"},
+						ExplicitBounds:    []float64{},
+					},
+				},
+			},
+		}}))
+
+		Expect(resourceMetrics[1].Resource.Attributes).To(Equal([]otlpKeyValue{{Key: "host.name", Value: otlpAnyValue{StringValue: "router-0"}}}))
+		Expect(resourceMetrics[1].ScopeMetrics[0].Scope.Name).To(Equal("datadog-firehose-nozzle"))
+		Expect(resourceMetrics[1].ScopeMetrics[0].Metrics).To(Equal([]otlpMetric{
+			{
+				Name: "cf.gorouter.latency",
+				Unit: "ms",
+				Gauge: &otlpGauge{DataPoints: []otlpNumberDataPoint{{
+					Attributes: []otlpKeyValue{
+						{Key: "deployment", Value: otlpAnyValue{StringValue: "cf"}},
+						{Key: "job", Value: otlpAnyValue{StringValue: "router"}},
+					},
+					TimeUnixNano: "1000000000",
+					AsDouble:     1.5,
+				}}},
+			},
+			{
+				Name: "cf.gorouter.requests",
+				Sum: &otlpSum{
+					AggregationTemporality: aggregationTemporalityDelta,
+					IsMonotonic:            true,
+					DataPoints: []otlpNumberDataPoint{{
+						StartTimeUnixNano: "10000000000",
+						TimeUnixNano:      "20000000000",
+						AsDouble:          3,
+					}},
+				},
+			},
+		}))
+	})
+
+	It("splits the metrics in several requests", func() {
+		metrics := make(metric.MetricsMap)
+		for i := 0; i < maxSeriesPerRequest+1; i++ {
+			metrics[metric.MetricKey{Name: fmt.Sprintf("metric.%d", i)}] = metric.MetricValue{Points: []metric.Point{{Timestamp: 1, Value: 1}}}
+		}
+
+		Expect(sink.PostMetrics(metrics)).To(Succeed())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(bodies[0].ResourceMetrics[0].ScopeMetrics[0].Metrics).To(HaveLen(maxSeriesPerRequest))
+		Expect(bodies[1].ResourceMetrics[0].ScopeMetrics[0].Metrics).To(HaveLen(1))
+	})
+
+	It("returns an error when the collector rejects the metrics", func() {
+		responseCode = http.StatusBadRequest
+		k, v := sink.MakeInternalMetric("totalMetricsSent", 1, 1)
+		err := sink.PostMetrics(metric.MetricsMap{k: v})
+		Expect(err).To(MatchError(ContainSubstring("400 Bad Request")))
+	})
+})
@@ -0,0 +1,203 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/protobuf"
+	"github.com/gogo/protobuf/proto"
+)
+
+// The field numbers of the messages of the remote write protocol
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+// RemoteWrite sends the metrics to a Prometheus remote write endpoint, e.g. Prometheus, Cortex or Thanos
+type RemoteWrite struct {
+	base
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+// NewRemoteWrite creates a sink writing to the URL of the sink config, e.g. http://prometheus:9090/api/v1/write
+func NewRemoteWrite(sink config.Sink, c *config.Config, ip string) *RemoteWrite {
+	return &RemoteWrite{
+		base:       newBase(c, ip),
+		url:        sink.URL,
+		headers:    sink.Headers,
+		httpClient: newHTTPClient(sink.TimeoutSeconds),
+	}
+}
+
+// PostMetrics writes the metrics, at most maxSeriesPerRequest series per request. The names and tags are turned into
+// valid Prometheus names, and the host of a metric is its host label. Prometheus has no delta type, the counts are
+// sent like the gauges and rates, and the distributions are not sent.
+func (r *RemoteWrite) PostMetrics(metrics metric.MetricsMap) error {
+	for _, keys := range chunks(sortedKeys(metrics)) {
+		body, err := r.marshalWriteRequest(metrics, keys)
+		if err != nil {
+			return err
+		}
+		err = post(r.httpClient, r.url, snappyEncode(body), r.headers, map[string]string{
+			"Content-Type":                      "application/x-protobuf",
+			"Content-Encoding":                  "snappy",
+			"X-Prometheus-Remote-Write-Version": "0.1.0",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Endpoint returns the URL metrics are written to
+func (r *RemoteWrite) Endpoint() string {
+	return r.url
+}
+
+// marshalWriteRequest encodes a prometheus.WriteRequest holding the time series of the keys
+func (r *RemoteWrite) marshalWriteRequest(metrics metric.MetricsMap, keys []metric.MetricKey) ([]byte, error) {
+	request := proto.NewBuffer(nil)
+	for _, key := range keys {
+		value := metrics[key]
+		if value.Type == metric.Distribution {
+			continue
+		}
+
+		series := proto.NewBuffer(nil)
+		for _, l := range r.labels(key.Name, value) {
+			labelBuf := proto.NewBuffer(nil)
+			if err := protobuf.EncodeString(labelBuf, labelName, l.name); err != nil {
+				return nil, err
+			}
+			if err := protobuf.EncodeString(labelBuf, labelValue, l.value); err != nil {
+				return nil, err
+			}
+			if err := protobuf.EncodeMessage(series, timeSeriesLabels, labelBuf); err != nil {
+				return nil, err
+			}
+		}
+
+		var samples int
+		for _, p := range samplePoints(value.Points) {
+			sample := proto.NewBuffer(nil)
+			if err := protobuf.EncodeDouble(sample, sampleValue, p.Value); err != nil {
+				return nil, err
+			}
+			// Timestamps are in milliseconds
+			if err := protobuf.EncodeInt(sample, sampleTimestamp, p.Timestamp*1000); err != nil {
+				return nil, err
+			}
+			if err := protobuf.EncodeMessage(series, timeSeriesSamples, sample); err != nil {
+				return nil, err
+			}
+			samples++
+		}
+		if samples == 0 {
+			continue
+		}
+
+		if err := protobuf.EncodeMessage(request, writeRequestTimeseries, series); err != nil {
+			return nil, err
+		}
+	}
+	return request.Bytes(), nil
+}
+
+// labels returns the labels of a series sorted by name, as required by the remote write protocol
+func (r *RemoteWrite) labels(name string, value metric.MetricValue) []label {
+	labels := []label{{name: "__name__", value: prometheusName(r.metricName(name), true)}}
+	seen := map[string]bool{"__name__": true}
+	for _, l := range tagLabels(value.Tags) {
+		l.name = prometheusName(l.name, false)
+		if seen[l.name] || strings.HasPrefix(l.name, "__") || l.value == "" {
+			continue
+		}
+		seen[l.name] = true
+		labels = append(labels, l)
+	}
+	if value.Host != "" && !seen["host"] {
+		labels = append(labels, label{name: "host", value: value.Host})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// prometheusName replaces the characters not allowed in the metric names, or in the label names which can't have
+// colons, by underscores
+func prometheusName(name string, allowColons bool) string {
+	var b bytes.Buffer
+	for i, c := range name {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9' && i > 0) || (c == ':' && allowColons)
+		if valid {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// samplePoints returns the valid points sorted by timestamp, keeping the last point of each timestamp: the timestamps
+// only have a second precision, and Prometheus rejects the whole write request when two samples of a series share one
+func samplePoints(points []metric.Point) []metric.Point {
+	var sorted []metric.Point
+	for _, p := range points {
+		if !math.IsNaN(p.Value) && !math.IsInf(p.Value, 0) {
+			sorted = append(sorted, p)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp < sorted[j].Timestamp })
+
+	samples := sorted[:0]
+	for i, p := range sorted {
+		if i+1 < len(sorted) && sorted[i+1].Timestamp == p.Timestamp {
+			continue
+		}
+		samples = append(samples, p)
+	}
+	return samples
+}
+
+// maxSnappyLiteral is the size of the literals of the snappy blocks, the size of the blocks of the reference encoder
+const maxSnappyLiteral = 65536
+
+// snappyEncode frames the data as a snappy block made of literals only. The remote write protocol requires the
+// snappy block format, this keeps the nozzle free of a compression library at the cost of not compressing.
+func snappyEncode(data []byte) []byte {
+	encoded := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data)+(len(data)/maxSnappyLiteral+1)*3)
+	encoded = encoded[:binary.PutUvarint(encoded, uint64(len(data)))]
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxSnappyLiteral {
+			n = maxSnappyLiteral
+		}
+		// The tag holds the length minus one, in the next bytes when it doesn't fit in the 6 upper bits
+		switch l := n - 1; {
+		case l < 60:
+			encoded = append(encoded, byte(l<<2))
+		case l < 1<<8:
+			encoded = append(encoded, 60<<2, byte(l))
+		default:
+			encoded = append(encoded, 61<<2, byte(l), byte(l>>8))
+		}
+		encoded = append(encoded, data[:n]...)
+		data = data[n:]
+	}
+	return encoded
+}
@@ -0,0 +1,180 @@
+package sink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
+)
+
+// testSeries is a decoded time series of a write request
+type testSeries struct {
+	labels  []label
+	samples []metric.Point
+}
+
+// snappyDecode decodes the snappy blocks made of literals only
+func snappyDecode(data []byte) []byte {
+	length, n := binary.Uvarint(data)
+	Expect(n).To(BeNumerically(">", 0))
+	data = data[n:]
+	var decoded []byte
+	for len(data) > 0 {
+		tag := data[0]
+		Expect(tag&3).To(BeZero(), "only literals are expected")
+		l := int(tag >> 2)
+		data = data[1:]
+		switch l {
+		case 60:
+			l = int(data[0])
+			data = data[1:]
+		case 61:
+			l = int(data[0]) | int(data[1])<<8
+			data = data[2:]
+		}
+		decoded = append(decoded, data[:l+1]...)
+		data = data[l+1:]
+	}
+	Expect(decoded).To(HaveLen(int(length)))
+	return decoded
+}
+
+// uint64Field returns a varint or fixed64 field, the zero values are left out of the messages
+func uint64Field(fields map[uint64][]interface{}, field uint64) uint64 {
+	if len(fields[field]) == 0 {
+		return 0
+	}
+	return fields[field][0].(uint64)
+}
+
+func decodeWriteRequest(body []byte) []testSeries {
+	var series []testSeries
+	for _, s := range helper.DecodeProtobufFields(snappyDecode(body))[writeRequestTimeseries] {
+		var ts testSeries
+		fields := helper.DecodeProtobufFields(s.([]byte))
+		for _, l := range fields[timeSeriesLabels] {
+			labelFields := helper.DecodeProtobufFields(l.([]byte))
+			ts.labels = append(ts.labels, label{
+				name:  string(labelFields[labelName][0].([]byte)),
+				value: string(labelFields[labelValue][0].([]byte)),
+			})
+		}
+		for _, sample := range fields[timeSeriesSamples] {
+			sampleFields := helper.DecodeProtobufFields(sample.([]byte))
+			ts.samples = append(ts.samples, metric.Point{
+				Timestamp: int64(uint64Field(sampleFields, sampleTimestamp)),
+				Value:     math.Float64frombits(uint64Field(sampleFields, sampleValue)),
+			})
+		}
+		series = append(series, ts)
+	}
+	return series
+}
+
+var _ = Describe("RemoteWrite", func() {
+	var (
+		ts       *httptest.Server
+		requests []*http.Request
+		bodies   [][]byte
+		sink     *RemoteWrite
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		bodies = nil
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			Expect(err).ToNot(HaveOccurred())
+			requests = append(requests, r)
+			bodies = append(bodies, body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		sink = NewRemoteWrite(config.Sink{
+			Type:    config.SinkPrometheusRemoteWrite,
+			URL:     ts.URL + "/api/v1/write",
+			Headers: map[string]string{"X-Scope-OrgID": "tenant"},
+		}, &config.Config{MetricPrefix: "cloudfoundry.nozzle."}, "10.0.0.1")
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("writes the series with valid names, sorted labels and samples in milliseconds", func() {
+		Expect(sink.PostMetrics(metric.MetricsMap{
+			{Name: "gorouter.latency", TagsHash: "a"}: {
+				Tags:   []string{"job:router", "deployment:cf", "deployment:cf-prod", "bosh-id:1", "__name__:x", "noValue"},
+				Points: []metric.Point{{Timestamp: 2, Value: 0.25}, {Timestamp: 1, Value: 1}, {Timestamp: 3, Value: math.NaN()}},
+				Host:   "router-0",
+				Type:   metric.Gauge,
+			},
+			{Name: "app.distribution.cpu", TagsHash: "b"}: {
+				Points: []metric.Point{{Timestamp: 1, Value: 1}},
+				Type:   metric.Distribution,
+			},
+		})).To(Succeed())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].URL.Path).To(Equal("/api/v1/write"))
+		Expect(requests[0].Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+		Expect(requests[0].Header.Get("Content-Encoding")).To(Equal("snappy"))
+		Expect(requests[0].Header.Get("X-Prometheus-Remote-Write-Version")).To(Equal("0.1.0"))
+		Expect(requests[0].Header.Get("X-Scope-OrgID")).To(Equal("tenant"))
+
+		Expect(decodeWriteRequest(bodies[0])).To(Equal([]testSeries{{
+			labels: []label{
+				{name: "__name__", value: "cloudfoundry_nozzle_gorouter_latency"},
+				{name: "bosh_id", value: "1"},
+				{name: "deployment", value: "cf"},
+				{name: "host", value: "router-0"},
+				{name: "job", value: "router"},
+			},
+			samples: []metric.Point{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0.25}},
+		}}))
+	})
+
+	It("keeps the last point of the series reported several times in a second", func() {
+		Expect(sink.PostMetrics(metric.MetricsMap{
+			{Name: "app.instances.running", TagsHash: "a"}: {
+				Points: []metric.Point{{Timestamp: 2, Value: 3}, {Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 4}, {Timestamp: 2, Value: math.NaN()}},
+				Type:   metric.Gauge,
+			},
+		})).To(Succeed())
+
+		series := decodeWriteRequest(bodies[0])
+		Expect(series).To(HaveLen(1))
+		Expect(series[0].samples).To(Equal([]metric.Point{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 4}}))
+	})
+
+	It("splits the metrics in several requests", func() {
+		metrics := make(metric.MetricsMap)
+		for i := 0; i < maxSeriesPerRequest+1; i++ {
+			metrics[metric.MetricKey{Name: fmt.Sprintf("metric.%d", i)}] = metric.MetricValue{Points: []metric.Point{{Timestamp: 1, Value: 1}}}
+		}
+
+		Expect(sink.PostMetrics(metrics)).To(Succeed())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(decodeWriteRequest(bodies[0])).To(HaveLen(maxSeriesPerRequest))
+		Expect(decodeWriteRequest(bodies[1])).To(HaveLen(1))
+	})
+
+	It("frames large payloads in several snappy literals", func() {
+		data := make([]byte, 3*maxSnappyLiteral+100)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		Expect(snappyDecode(snappyEncode(data))).To(Equal(data))
+		Expect(snappyDecode(snappyEncode(data[:200]))).To(Equal(data[:200]))
+		Expect(snappyDecode(snappyEncode(data[:10]))).To(Equal(data[:10]))
+	})
+})
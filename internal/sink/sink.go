@@ -0,0 +1,160 @@
+// Package sink holds the outputs the metrics can be sent to next to Datadog
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+// maxSeriesPerRequest is the maximum number of series sent in a single request by the HTTP sinks
+const maxSeriesPerRequest = 1000
+
+// base holds what the sinks share: the names of the metrics, and the tags of the internal metrics
+type base struct {
+	prefix     string
+	unprefixed []string
+	deployment string
+	ip         string
+	customTags []string
+}
+
+func newBase(c *config.Config, ip string) base {
+	return base{
+		prefix:     c.MetricPrefix,
+		unprefixed: c.MetricNaming.UnprefixedNames(),
+		deployment: c.Deployment,
+		ip:         ip,
+		customTags: c.CustomTags,
+	}
+}
+
+// metricName adds the metric prefix, except to the metrics named after an unprefixed alias
+func (b base) metricName(name string) string {
+	for _, unprefixed := range b.unprefixed {
+		if strings.HasPrefix(name, unprefixed) {
+			return name
+		}
+	}
+	return b.prefix + name
+}
+
+// MakeInternalMetric makes a nozzle metric tagged like the internal metrics sent to Datadog
+func (b base) MakeInternalMetric(name string, value uint64, timestamp int64) (metric.MetricKey, metric.MetricValue) {
+	tags := []string{
+		fmt.Sprintf("deployment:%s", b.deployment),
+		fmt.Sprintf("ip:%s", b.ip),
+	}
+	tags = append(tags, b.customTags...)
+
+	key := metric.MetricKey{
+		Name:     name,
+		TagsHash: util.HashTags(tags),
+	}
+	mValue := metric.MetricValue{
+		Tags:   tags,
+		Points: []metric.Point{{Timestamp: timestamp, Value: float64(value)}},
+	}
+	return key, mValue
+}
+
+// Account is empty, the sinks aren't tied to a Datadog account
+func (b base) Account() string {
+	return ""
+}
+
+// label is a tag split into its name and value
+type label struct {
+	name  string
+	value string
+}
+
+// tagLabels splits the tags into labels. Only the first of the tags with the same name is kept, e.g. the first
+// deployment tag, as the other backends don't accept several values per label.
+func tagLabels(tags []string) []label {
+	labels := make([]label, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		l := label{name: tag}
+		if i := strings.Index(tag, ":"); i >= 0 {
+			l = label{name: tag[:i], value: tag[i+1:]}
+		}
+		if seen[l.name] {
+			continue
+		}
+		seen[l.name] = true
+		labels = append(labels, l)
+	}
+	return labels
+}
+
+// sortedKeys returns the keys of the metrics in a stable order, so that they can be sent in chunks
+func sortedKeys(metrics metric.MetricsMap) []metric.MetricKey {
+	keys := make([]metric.MetricKey, 0, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].TagsHash < keys[j].TagsHash
+	})
+	return keys
+}
+
+// chunks splits the keys in chunks of at most maxSeriesPerRequest keys
+func chunks(keys []metric.MetricKey) [][]metric.MetricKey {
+	var result [][]metric.MetricKey
+	for len(keys) > maxSeriesPerRequest {
+		result = append(result, keys[:maxSeriesPerRequest])
+		keys = keys[maxSeriesPerRequest:]
+	}
+	if len(keys) > 0 {
+		result = append(result, keys)
+	}
+	return result
+}
+
+func newHTTPClient(timeoutSeconds uint32) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(timeoutSeconds) * time.Second,
+	}
+}
+
+// post sends a payload with the configured headers and the headers of its encoding
+func post(client *http.Client, url string, body []byte, headers map[string]string, encodingHeaders map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range encodingHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			respBody = []byte("failed to read body")
+		}
+		return fmt.Errorf("%s request returned HTTP response: %s\nResponse Body: %s", url, resp.Status, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentExtension = ".seg"
+	cursorFile       = "cursor"
+	// A record is made of the write timestamp (8 bytes), the payload length (4 bytes) and the payload
+	recordHeaderSize = 12
+)
+
+// Spool is a bounded, disk-backed FIFO queue of payloads.
+// Payloads are appended to segment files, the oldest segments are dropped when the spool grows over its max size,
+// and payloads older than the max age are dropped instead of being read back.
+type Spool struct {
+	dir             string
+	maxBytes        int64
+	maxSegmentBytes int64
+	maxAge          time.Duration
+	log             *gosteno.Logger
+
+	lock         sync.Mutex
+	segments     []*segment // oldest first, the last one is the one being written
+	writer       segmentWriter
+	nextID       uint64
+	droppedBytes uint64
+}
+
+// segmentWriter appends the records to the segment being written
+type segmentWriter interface {
+	io.WriteCloser
+	Truncate(size int64) error
+}
+
+type segment struct {
+	id          uint64
+	size        int64
+	records     int
+	readOffset  int64
+	readRecords int
+	modTime     time.Time
+}
+
+// New creates a spool storing its segments in dir, and loads the segments left by a previous run
+func New(dir string, maxBytes int64, maxSegmentBytes int64, maxAge time.Duration, log *gosteno.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "Error creating spool directory %s", dir)
+	}
+
+	s := &Spool{
+		dir:             dir,
+		maxBytes:        maxBytes,
+		maxSegmentBytes: maxSegmentBytes,
+		maxAge:          maxAge,
+		log:             log,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Write appends a payload at the end of the spool
+func (s *Spool) Write(payload []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	recordSize := int64(len(payload) + recordHeaderSize)
+	if recordSize > s.maxBytes {
+		s.droppedBytes += uint64(len(payload))
+		return fmt.Errorf("payload of %d bytes exceeds the spool max size of %d bytes", len(payload), s.maxBytes)
+	}
+
+	s.expire()
+	// Make room for the new record by dropping the oldest segments
+	for s.size()+recordSize > s.maxBytes && len(s.segments) > 0 {
+		s.dropOldest()
+	}
+
+	current := s.current()
+	if current == nil || (current.size > 0 && current.size+recordSize > s.maxSegmentBytes) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		current = s.current()
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint64(record[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(payload)))
+	copy(record[recordHeaderSize:], payload)
+	if _, err := s.writer.Write(record); err != nil {
+		s.discardPartialRecord(current)
+		return errors.Wrapf(err, "Error writing to spool segment %s", s.segmentPath(current.id))
+	}
+
+	current.size += recordSize
+	current.records++
+	current.modTime = time.Now()
+	return nil
+}
+
+// discardPartialRecord removes what a failed write left at the end of the segment, so that the next record isn't
+// appended after a partial one. The segment is closed and a new one is started if it can't be truncated.
+func (s *Spool) discardPartialRecord(current *segment) {
+	err := s.writer.Truncate(current.size)
+	if err == nil {
+		return
+	}
+	s.log.Errorf("Error truncating spool segment %s, starting a new one: %v", s.segmentPath(current.id), err)
+	if current.records == 0 {
+		// Nothing to read from it
+		s.closeWriter()
+		if err := os.Remove(s.segmentPath(current.id)); err != nil && !os.IsNotExist(err) {
+			s.log.Errorf("Error removing spool segment %s: %v", s.segmentPath(current.id), err)
+		}
+		s.segments = s.segments[:len(s.segments)-1]
+	}
+	if err := s.rotate(); err != nil {
+		s.log.Errorf("Error creating a new spool segment: %v", err)
+	}
+}
+
+// Peek returns the oldest payload of the spool without removing it, or nil if the spool is empty
+func (s *Spool) Peek() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire()
+	for len(s.segments) > 0 {
+		head := s.segments[0]
+		if head.readRecords == head.records {
+			if head == s.current() {
+				return nil, nil
+			}
+			s.removeHead()
+			continue
+		}
+
+		timestamp, payload, err := s.readRecord(head)
+		if err != nil {
+			// The segment is unreadable, there is no way to recover the payloads it contains
+			s.log.Errorf("Error reading spool segment %s, dropping it: %v", s.segmentPath(head.id), err)
+			s.dropOldest()
+			continue
+		}
+		if time.Since(time.Unix(0, timestamp)) > s.maxAge {
+			s.droppedBytes += uint64(len(payload))
+			s.advance(head, int64(len(payload)+recordHeaderSize))
+			continue
+		}
+		return payload, nil
+	}
+
+	return nil, nil
+}
+
+// Ack removes the oldest payload of the spool, it should be called once the payload returned by Peek has been handled
+func (s *Spool) Ack() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.segments) == 0 {
+		return nil
+	}
+	head := s.segments[0]
+	if head.readRecords == head.records {
+		return nil
+	}
+
+	_, payload, err := s.readRecord(head)
+	if err != nil {
+		return err
+	}
+	s.advance(head, int64(len(payload)+recordHeaderSize))
+	return nil
+}
+
+// Depth returns the number of payloads held by the spool
+func (s *Spool) Depth() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var depth uint64
+	for _, seg := range s.segments {
+		depth += uint64(seg.records - seg.readRecords)
+	}
+	return depth
+}
+
+// DroppedBytes returns the number of payload bytes dropped because of the spool size or age limits
+func (s *Spool) DroppedBytes() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.droppedBytes
+}
+
+// Close closes the segment being written
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
+
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrapf(err, "Error listing spool directory %s", s.dir)
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, err := s.scanSegment(id, f.ModTime())
+		if err != nil {
+			s.log.Errorf("Error reading spool segment %s, dropping it: %v", f.Name(), err)
+			os.Remove(s.segmentPath(id))
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	s.loadCursor()
+
+	// Always start writing to a new segment
+	return s.rotate()
+}
+
+// scanSegment counts the records of a segment, and truncates a record left incomplete by a crash
+func (s *Spool) scanSegment(id uint64, modTime time.Time) (*segment, error) {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seg := &segment{id: id, modTime: modTime}
+	reader := bufio.NewReader(f)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header[8:12]))
+		if _, err := reader.Discard(int(length)); err != nil {
+			break
+		}
+		seg.size += recordHeaderSize + length
+		seg.records++
+	}
+
+	return seg, f.Truncate(seg.size)
+}
+
+func (s *Spool) loadCursor() {
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, cursorFile))
+	if err != nil || len(s.segments) == 0 {
+		return
+	}
+
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(content), "%d %d", &id, &offset); err != nil {
+		return
+	}
+	// Drop the segments that have been read entirely
+	for len(s.segments) > 0 && s.segments[0].id < id {
+		s.removeHead()
+	}
+	if len(s.segments) == 0 || s.segments[0].id != id {
+		return
+	}
+
+	// Skip the records already read in the head segment
+	head := s.segments[0]
+	for head.readRecords < head.records && head.readOffset < offset {
+		_, payload, err := s.readRecord(head)
+		if err != nil {
+			return
+		}
+		head.readOffset += int64(len(payload) + recordHeaderSize)
+		head.readRecords++
+	}
+}
+
+func (s *Spool) saveCursor(seg *segment) {
+	path := filepath.Join(s.dir, cursorFile)
+	content := []byte(fmt.Sprintf("%d %d", seg.id, seg.readOffset))
+	if err := ioutil.WriteFile(path+".tmp", content, 0600); err != nil {
+		s.log.Errorf("Error saving the spool cursor: %v", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		s.log.Errorf("Error saving the spool cursor: %v", err)
+	}
+}
+
+func (s *Spool) readRecord(seg *segment) (int64, []byte, error) {
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, seg.readOffset); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := f.ReadAt(payload, seg.readOffset+recordHeaderSize); err != nil {
+		return 0, nil, err
+	}
+	return int64(binary.BigEndian.Uint64(header[0:8])), payload, nil
+}
+
+// advance moves the read cursor of seg past the record being read
+func (s *Spool) advance(seg *segment, recordSize int64) {
+	seg.readOffset += recordSize
+	seg.readRecords++
+	if seg.readRecords == seg.records && seg != s.current() {
+		s.removeHead()
+		return
+	}
+	s.saveCursor(seg)
+}
+
+// expire drops the segments only holding payloads older than the max age
+func (s *Spool) expire() {
+	for len(s.segments) > 0 && s.segments[0].records > 0 && time.Since(s.segments[0].modTime) > s.maxAge {
+		s.dropOldest()
+	}
+}
+
+// dropOldest removes the oldest segment and accounts for the payloads it still held
+func (s *Spool) dropOldest() {
+	head := s.segments[0]
+	unread := head.size - head.readOffset - int64(recordHeaderSize*(head.records-head.readRecords))
+	if unread > 0 {
+		s.droppedBytes += uint64(unread)
+	}
+	if head == s.current() {
+		// Start over with a fresh segment
+		s.closeWriter()
+		s.removeHead()
+		if err := s.rotate(); err != nil {
+			s.log.Errorf("Error creating a new spool segment: %v", err)
+		}
+		return
+	}
+	s.removeHead()
+}
+
+func (s *Spool) removeHead() {
+	head := s.segments[0]
+	if head == s.current() {
+		s.closeWriter()
+	}
+	if err := os.Remove(s.segmentPath(head.id)); err != nil && !os.IsNotExist(err) {
+		s.log.Errorf("Error removing spool segment %s: %v", s.segmentPath(head.id), err)
+	}
+	s.segments = s.segments[1:]
+}
+
+// rotate closes the segment being written and creates a new one
+func (s *Spool) rotate() error {
+	s.closeWriter()
+
+	id := s.nextID
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Error creating spool segment %s", s.segmentPath(id))
+	}
+	s.nextID++
+	s.writer = f
+	s.segments = append(s.segments, &segment{id: id, modTime: time.Now()})
+	return nil
+}
+
+func (s *Spool) closeWriter() {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+}
+
+// current returns the segment being written
+func (s *Spool) current() *segment {
+	if s.writer == nil || len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) size() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExtension))
+}
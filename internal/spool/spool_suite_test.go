@@ -0,0 +1,13 @@
+package spool
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spool Suite")
+}
@@ -0,0 +1,191 @@
+package spool
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spool", func() {
+	var (
+		dir string
+		log *gosteno.Logger
+		s   *Spool
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).ToNot(HaveOccurred())
+		log = gosteno.NewLogger("spool test")
+
+		s, err = New(dir, 1024, 100, time.Hour, log)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	readAll := func(s *Spool) []string {
+		var payloads []string
+		for {
+			payload, err := s.Peek()
+			Expect(err).ToNot(HaveOccurred())
+			if payload == nil {
+				return payloads
+			}
+			payloads = append(payloads, string(payload))
+			Expect(s.Ack()).To(Succeed())
+		}
+	}
+
+	It("returns nothing when empty", func() {
+		payload, err := s.Peek()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(payload).To(BeNil())
+		Expect(s.Depth()).To(BeEquivalentTo(0))
+	})
+
+	It("returns payloads in order", func() {
+		Expect(s.Write([]byte("first"))).To(Succeed())
+		Expect(s.Write([]byte("second"))).To(Succeed())
+		Expect(s.Write([]byte("third"))).To(Succeed())
+		Expect(s.Depth()).To(BeEquivalentTo(3))
+
+		payload, err := s.Peek()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(payload)).To(Equal("first"))
+		// Peek does not remove the payload
+		payload, err = s.Peek()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(payload)).To(Equal("first"))
+
+		Expect(readAll(s)).To(Equal([]string{"first", "second", "third"}))
+		Expect(s.Depth()).To(BeEquivalentTo(0))
+	})
+
+	It("rotates segments and removes them once read", func() {
+		for i := 0; i < 10; i++ {
+			Expect(s.Write(make([]byte, 40))).To(Succeed())
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+		Expect(len(files)).To(BeNumerically(">", 1))
+
+		Expect(readAll(s)).To(HaveLen(10))
+		files, _ = filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+		Expect(files).To(HaveLen(1))
+	})
+
+	It("drops the oldest payloads when full", func() {
+		for i := 0; i < 30; i++ {
+			Expect(s.Write([]byte{byte(i)})).To(Succeed())
+			Expect(s.Write(make([]byte, 87))).To(Succeed())
+		}
+
+		Expect(s.DroppedBytes()).To(BeNumerically(">", 0))
+		payloads := readAll(s)
+		Expect(len(payloads)).To(BeNumerically("<", 60))
+		// The newest payloads are kept
+		Expect(payloads[len(payloads)-2]).To(Equal(string([]byte{29})))
+	})
+
+	It("refuses payloads bigger than the spool", func() {
+		Expect(s.Write(make([]byte, 2048))).ToNot(Succeed())
+		Expect(s.DroppedBytes()).To(BeEquivalentTo(2048))
+		Expect(s.Depth()).To(BeEquivalentTo(0))
+	})
+
+	It("drops payloads older than the max age", func() {
+		var err error
+		s, err = New(dir, 1024, 100, 50*time.Millisecond, log)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(s.Write([]byte("old"))).To(Succeed())
+		time.Sleep(100 * time.Millisecond)
+		Expect(s.Write([]byte("new"))).To(Succeed())
+
+		Expect(readAll(s)).To(Equal([]string{"new"}))
+		Expect(s.DroppedBytes()).To(BeEquivalentTo(3))
+	})
+
+	It("keeps payloads across restarts", func() {
+		Expect(s.Write([]byte("first"))).To(Succeed())
+		Expect(s.Write([]byte("second"))).To(Succeed())
+		Expect(s.Write([]byte("third"))).To(Succeed())
+
+		_, err := s.Peek()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Ack()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+
+		s, err = New(dir, 1024, 100, time.Hour, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Depth()).To(BeEquivalentTo(2))
+		Expect(readAll(s)).To(Equal([]string{"second", "third"}))
+	})
+
+	It("ignores a record left incomplete by a crash", func() {
+		Expect(s.Write([]byte("first"))).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+		Expect(files).To(HaveLen(1))
+		f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0600)
+		Expect(err).ToNot(HaveOccurred())
+		f.Write([]byte{0, 0, 0})
+		f.Close()
+
+		s, err = New(dir, 1024, 100, time.Hour, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readAll(s)).To(Equal([]string{"first"}))
+	})
+
+	It("discards a record left incomplete by a failed write", func() {
+		Expect(s.Write([]byte("first"))).To(Succeed())
+		s.writer = &failingWriter{segmentWriter: s.writer}
+		Expect(s.Write([]byte("second"))).ToNot(Succeed())
+		Expect(s.Write([]byte("third"))).To(Succeed())
+
+		Expect(readAll(s)).To(Equal([]string{"first", "third"}))
+	})
+
+	It("starts a new segment when a failed write can't be undone", func() {
+		Expect(s.Write([]byte("first"))).To(Succeed())
+		s.writer = &failingWriter{segmentWriter: s.writer, failTruncate: true}
+		Expect(s.Write([]byte("second"))).ToNot(Succeed())
+		Expect(s.Write([]byte("third"))).To(Succeed())
+
+		Expect(readAll(s)).To(Equal([]string{"first", "third"}))
+	})
+})
+
+// failingWriter writes half of the first record it gets, then fails
+type failingWriter struct {
+	segmentWriter
+	failTruncate bool
+	failed       bool
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return w.segmentWriter.Write(p)
+	}
+	w.failed = true
+	n, _ := w.segmentWriter.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (w *failingWriter) Truncate(size int64) error {
+	if w.failTruncate {
+		return errors.New("read-only file system")
+	}
+	return w.segmentWriter.Truncate(size)
+}
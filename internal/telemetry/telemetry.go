@@ -0,0 +1,245 @@
+package telemetry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types of the Prometheus text format
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+	Summary = "summary"
+)
+
+// Label is a label of a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value of a metric family, identified by its labels.
+// Suffix is appended to the family name, e.g. _sum and _count for summaries.
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	collect func() []Sample
+}
+
+// Registry holds metric families and renders them in the Prometheus text format
+type Registry struct {
+	lock     sync.RWMutex
+	families []*family
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a metric family whose samples are collected by calling collect at every scrape
+func (r *Registry) Register(name string, help string, kind string, collect func() []Sample) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.families = append(r.families, &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		collect: collect,
+	})
+}
+
+// RegisterFunc adds a metric family made of a single unlabelled sample
+func (r *Registry) RegisterFunc(name string, help string, kind string, value func() float64) {
+	r.Register(name, help, kind, func() []Sample {
+		return []Sample{{Value: value()}}
+	})
+}
+
+// NewCounterVec adds a counter family with the given label names
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		labelNames: labelNames,
+		values:     make(map[string]*labelledValue),
+	}
+	r.Register(name, help, Counter, c.collect)
+	return c
+}
+
+// NewSummaryVec adds a summary family, without quantiles, with the given label names
+func (r *Registry) NewSummaryVec(name string, help string, labelNames ...string) *SummaryVec {
+	s := &SummaryVec{
+		sums:   &CounterVec{labelNames: labelNames, values: make(map[string]*labelledValue)},
+		counts: &CounterVec{labelNames: labelNames, values: make(map[string]*labelledValue)},
+	}
+	r.Register(name, help, Summary, s.collect)
+	return s
+}
+
+// WriteTo renders all the families in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.RLock()
+	families := make([]*family, len(r.families))
+	copy(families, r.families)
+	r.lock.RUnlock()
+
+	var buffer bytes.Buffer
+	for _, f := range families {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(&buffer, "# TYPE %s %s\n", f.name, f.kind)
+		for _, sample := range f.collect() {
+			buffer.WriteString(f.name)
+			buffer.WriteString(sample.Suffix)
+			writeLabels(&buffer, sample.Labels)
+			buffer.WriteByte(' ')
+			buffer.WriteString(formatValue(sample.Value))
+			buffer.WriteByte('\n')
+		}
+	}
+
+	return buffer.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(rw)
+}
+
+type labelledValue struct {
+	labels []Label
+	value  float64
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	lock       sync.Mutex
+	labelNames []string
+	values     map[string]*labelledValue
+}
+
+// Add adds delta to the counter identified by the label values, given in the order of the label names
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	v, ok := c.values[key]
+	if !ok {
+		v = &labelledValue{labels: makeLabels(c.labelNames, labelValues)}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+// Inc adds one to the counter identified by the label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) collect() []Sample {
+	return c.collectWithSuffix("")
+}
+
+func (c *CounterVec) collectWithSuffix(suffix string) []Sample {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	samples := make([]Sample, 0, len(c.values))
+	for _, v := range c.values {
+		samples = append(samples, Sample{Suffix: suffix, Labels: v.labels, Value: v.value})
+	}
+	sortSamples(samples)
+	return samples
+}
+
+// SummaryVec is a summary partitioned by labels, it only exposes the sum and the count of the observations
+type SummaryVec struct {
+	sums   *CounterVec
+	counts *CounterVec
+}
+
+// Observe records an observation for the summary identified by the label values
+func (s *SummaryVec) Observe(value float64, labelValues ...string) {
+	s.sums.Add(value, labelValues...)
+	s.counts.Add(1, labelValues...)
+}
+
+func (s *SummaryVec) collect() []Sample {
+	return append(s.sums.collectWithSuffix("_sum"), s.counts.collectWithSuffix("_count")...)
+}
+
+func makeLabels(names []string, values []string) []Label {
+	labels := make([]Label, len(names))
+	for i, name := range names {
+		labels[i].Name = name
+		if i < len(values) {
+			labels[i].Value = values[i]
+		}
+	}
+	return labels
+}
+
+// sortSamples sorts samples by labels so that the output is stable between scrapes
+func sortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].Labels, samples[j].Labels
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k].Value != b[k].Value {
+				return a[k].Value < b[k].Value
+			}
+		}
+		return len(a) < len(b)
+	})
+}
+
+func writeLabels(buffer *bytes.Buffer, labels []Label) {
+	if len(labels) == 0 {
+		return
+	}
+	buffer.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		fmt.Fprintf(buffer, `%s="%s"`, label.Name, escape(label.Value, true))
+	}
+	buffer.WriteByte('}')
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
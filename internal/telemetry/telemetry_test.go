@@ -0,0 +1,76 @@
+package telemetry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var registry *Registry
+
+	render := func() string {
+		var buffer bytes.Buffer
+		_, err := registry.WriteTo(&buffer)
+		Expect(err).ToNot(HaveOccurred())
+		return buffer.String()
+	}
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+	})
+
+	It("renders unlabelled metrics", func() {
+		value := 1.0
+		registry.RegisterFunc("queue_length", "Number of queued items", Gauge, func() float64 { return value })
+		value = 42
+
+		Expect(render()).To(Equal("# HELP queue_length Number of queued items\n# TYPE queue_length gauge\nqueue_length 42\n"))
+	})
+
+	It("renders counters by label", func() {
+		counter := registry.NewCounterVec("posts_total", "Number of posts", "endpoint", "status")
+		counter.Inc("https://b", "ok")
+		counter.Inc("https://a", "ok")
+		counter.Add(2, "https://a", "ok")
+
+		Expect(render()).To(Equal("# HELP posts_total Number of posts\n# TYPE posts_total counter\n" +
+			"posts_total{endpoint=\"https://a\",status=\"ok\"} 3\n" +
+			"posts_total{endpoint=\"https://b\",status=\"ok\"} 1\n"))
+	})
+
+	It("renders the sum and count of summaries", func() {
+		summary := registry.NewSummaryVec("post_duration_seconds", "Post duration", "endpoint")
+		summary.Observe(0.5, "a")
+		summary.Observe(1.25, "a")
+
+		Expect(render()).To(Equal("# HELP post_duration_seconds Post duration\n# TYPE post_duration_seconds summary\n" +
+			"post_duration_seconds_sum{endpoint=\"a\"} 1.75\n" +
+			"post_duration_seconds_count{endpoint=\"a\"} 2\n"))
+	})
+
+	It("escapes label values", func() {
+		counter := registry.NewCounterVec("errors_total", "Errors", "message")
+		counter.Inc("a \"quoted\"\nvalue\\")
+
+		Expect(render()).To(ContainSubstring(`errors_total{message="a \"quoted\"\nvalue\\"} 1`))
+	})
+
+	It("serves the metrics over HTTP", func() {
+		registry.RegisterFunc("up", "Up", Gauge, func() float64 { return 1 })
+		server := httptest.NewServer(registry)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		Expect(resp.Header.Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		Expect(string(body)).To(ContainSubstring("up 1\n"))
+	})
+})
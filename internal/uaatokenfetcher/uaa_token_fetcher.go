@@ -1,16 +1,40 @@
 package uaatokenfetcher
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/cloudfoundry-incubator/uaago"
 	"github.com/cloudfoundry/gosteno"
 )
 
+const (
+	// refreshMargin is how long before its expiry a token is replaced
+	refreshMargin = time.Minute
+	maxRetryCount = 5
+	minRetryDelay = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+// UAATokenFetcher fetches tokens from the UAA and caches them until they are about to expire.
+// It implements the noaa consumer.TokenRefresher interface so that the firehose reconnects with a valid token.
 type UAATokenFetcher struct {
 	uaaUrl                string
 	username              string
 	password              string
 	insecureSSLSkipVerify bool
 	log                   *gosteno.Logger
+
+	lock          sync.Mutex
+	token         string
+	expiresAt     time.Time
+	minRetryDelay time.Duration
+	maxRetryDelay time.Duration
+	now           func() time.Time
 }
 
 func New(uaaUrl string, username string, password string, sslSkipVerify bool, logger *gosteno.Logger) *UAATokenFetcher {
@@ -20,19 +44,105 @@ func New(uaaUrl string, username string, password string, sslSkipVerify bool, lo
 		password:              password,
 		insecureSSLSkipVerify: sslSkipVerify,
 		log:                   logger,
+		minRetryDelay:         minRetryDelay,
+		maxRetryDelay:         maxRetryDelay,
+		now:                   time.Now,
 	}
 }
 
+// FetchAuthToken returns a valid token, or an empty string if the UAA couldn't be reached
 func (uaa *UAATokenFetcher) FetchAuthToken() string {
+	token, err := uaa.RefreshAuthToken()
+	if err != nil {
+		uaa.log.Errorf("Error getting oauth token: %s. Please check your username and password.", err.Error())
+		return ""
+	}
+	return token
+}
+
+// RefreshAuthToken returns the cached token, or fetches a new one if it expires soon
+func (uaa *UAATokenFetcher) RefreshAuthToken() (string, error) {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+
+	if uaa.token != "" && uaa.now().Add(refreshMargin).Before(uaa.expiresAt) {
+		return uaa.token, nil
+	}
+
+	token, expiresAt, err := uaa.fetchWithRetries()
+	if err != nil {
+		return "", err
+	}
+	uaa.token = token
+	uaa.expiresAt = expiresAt
+	uaa.log.Debugf("Fetched a new oauth token, valid until %s", expiresAt)
+	return token, nil
+}
+
+// fetchWithRetries fetches a token, retrying with an exponential backoff when the UAA fails
+func (uaa *UAATokenFetcher) fetchWithRetries() (string, time.Time, error) {
+	delay := uaa.minRetryDelay
+	var err error
+	for i := 0; i <= maxRetryCount; i++ {
+		if i > 0 {
+			uaa.log.Warnf("Error getting oauth token: %s, retrying in %s", err.Error(), delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > uaa.maxRetryDelay {
+				delay = uaa.maxRetryDelay
+			}
+		}
+
+		var token string
+		var expiresAt time.Time
+		token, expiresAt, err = uaa.fetch()
+		if err == nil {
+			return token, expiresAt, nil
+		}
+	}
+	return "", time.Time{}, err
+}
+
+func (uaa *UAATokenFetcher) fetch() (string, time.Time, error) {
 	uaaClient, err := uaago.NewClient(uaa.uaaUrl)
 	if err != nil {
-		uaa.log.Fatalf("Error creating uaa client: %s", err.Error())
+		return "", time.Time{}, fmt.Errorf("error creating uaa client: %s", err.Error())
 	}
 
-	var authToken string
-	authToken, err = uaaClient.GetAuthToken(uaa.username, uaa.password, uaa.insecureSSLSkipVerify)
+	fetchedAt := uaa.now()
+	token, expiresIn, err := uaaClient.GetAuthTokenWithExpiresIn(uaa.username, uaa.password, uaa.insecureSSLSkipVerify)
 	if err != nil {
-		uaa.log.Fatalf("Error getting oauth token: %s. Please check your username and password.", err.Error())
+		return "", time.Time{}, err
+	}
+
+	// The exp claim of the JWT is authoritative, expires_in is a fallback for opaque tokens.
+	// A token without any expiry is not cached.
+	if exp, ok := jwtExpiry(token); ok {
+		return token, exp, nil
+	}
+	return token, fetchedAt.Add(time.Duration(expiresIn) * time.Second), nil
+}
+
+// jwtExpiry reads the exp claim of a "bearer <jwt>" token
+func jwtExpiry(token string) (time.Time, bool) {
+	fields := strings.Fields(token)
+	if len(fields) == 0 {
+		return time.Time{}, false
+	}
+	parts := strings.Split(fields[len(fields)-1], ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
 	}
-	return authToken
+	return time.Unix(claims.Exp, 0), true
 }
@@ -1,7 +1,12 @@
 package uaatokenfetcher
 
 import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
 	"github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/noaa/consumer"
 
 	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
 	. "github.com/onsi/ginkgo"
@@ -23,6 +28,12 @@ var _ = Describe("UaaTokenFetcher", func() {
 		fakeUAA.Start()
 
 		tokenFetcher = New(fakeUAA.URL(), "username", "password", true, fakeLogger)
+		tokenFetcher.minRetryDelay = time.Millisecond
+		tokenFetcher.maxRetryDelay = time.Millisecond
+	})
+
+	AfterEach(func() {
+		fakeUAA.Close()
 	})
 
 	It("fetches a token from the UAA", func() {
@@ -30,4 +41,79 @@ var _ = Describe("UaaTokenFetcher", func() {
 		Expect(fakeUAA.Requested()).To(BeTrue())
 		Expect(receivedAuthToken).To(Equal(fakeToken))
 	})
+
+	It("is a token refresher for the firehose consumer", func() {
+		var refresher consumer.TokenRefresher = tokenFetcher
+		token, err := refresher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal(fakeToken))
+	})
+
+	It("doesn't cache tokens without expiry", func() {
+		tokenFetcher.FetchAuthToken()
+		tokenFetcher.FetchAuthToken()
+		Expect(fakeUAA.RequestCount()).To(Equal(2))
+	})
+
+	It("caches tokens until their expires_in is almost reached", func() {
+		now := time.Now()
+		tokenFetcher.now = func() time.Time { return now }
+		fakeUAA.SetExpiresIn(600)
+
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		now = now.Add(8 * time.Minute)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		Expect(fakeUAA.RequestCount()).To(Equal(1))
+
+		now = now.Add(90 * time.Second)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		Expect(fakeUAA.RequestCount()).To(Equal(2))
+	})
+
+	Context("with JWT tokens", func() {
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Unix(1500000000, 0)
+			tokenFetcher.now = func() time.Time { return now }
+
+			claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, now.Add(time.Hour).Unix())))
+			fakeUAA.Close()
+			fakeUAA = helper.NewFakeUAA("bearer", "eyJhbGciOiJSUzI1NiJ9."+claims+".signature")
+			fakeUAA.Start()
+			// The exp claim takes precedence over expires_in
+			fakeUAA.SetExpiresIn(60)
+			tokenFetcher.uaaUrl = fakeUAA.URL()
+		})
+
+		It("refreshes the token before its exp claim", func() {
+			token := tokenFetcher.FetchAuthToken()
+			Expect(token).To(Equal(fakeUAA.AuthToken()))
+
+			now = now.Add(58 * time.Minute)
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(token))
+			Expect(fakeUAA.RequestCount()).To(Equal(1))
+
+			now = now.Add(90 * time.Second)
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(token))
+			Expect(fakeUAA.RequestCount()).To(Equal(2))
+		})
+	})
+
+	Context("when the UAA fails", func() {
+		It("retries with a backoff", func() {
+			fakeUAA.FailNextRequests(3)
+			Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+			Expect(fakeUAA.RequestCount()).To(Equal(4))
+		})
+
+		It("gives up after too many retries, without exiting", func() {
+			fakeUAA.FailNextRequests(100)
+			_, err := tokenFetcher.RefreshAuthToken()
+			Expect(err).To(HaveOccurred())
+			Expect(fakeUAA.RequestCount()).To(Equal(maxRetryCount + 1))
+
+			Expect(tokenFetcher.FetchAuthToken()).To(BeEmpty())
+		})
+	})
 })
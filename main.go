@@ -47,9 +47,15 @@ func main() {
 	go dumpGoRoutine(threadDumpChan)
 
 	// Initialize and start Nozzle
-	log.Infof("Targeting datadog API URL: %s \n", config.DataDogURL)
+	if config.DogStatsDAddress != "" {
+		log.Infof("Targeting DogStatsD: %s \n", config.DogStatsDAddress)
+	} else {
+		log.Infof("Targeting datadog API URL: %s \n", config.DataDogURL)
+	}
 	datadog_nozzle := nozzle.NewNozzle(config, tokenFetcher, log)
-	datadog_nozzle.Start()
+	if err := datadog_nozzle.Start(); err != nil {
+		log.Fatalf("Error running the nozzle: %s", err.Error())
+	}
 }
 
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
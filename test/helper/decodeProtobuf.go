@@ -0,0 +1,45 @@
+package helper
+
+import (
+	"encoding/binary"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/protobuf"
+)
+
+// DecodeProtobufFields returns the fields of a protobuf message by field number: the varints and the fixed64 as
+// uint64, the length-delimited fields as []byte. The decoding stops at the first malformed field.
+func DecodeProtobufFields(data []byte) map[uint64][]interface{} {
+	fields := make(map[uint64][]interface{})
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fields
+		}
+		data = data[n:]
+		switch key & 7 {
+		case protobuf.WireVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fields
+			}
+			fields[key>>3] = append(fields[key>>3], value)
+			data = data[n:]
+		case protobuf.WireFixed64:
+			if len(data) < 8 {
+				return fields
+			}
+			fields[key>>3] = append(fields[key>>3], binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case protobuf.WireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fields
+			}
+			fields[key>>3] = append(fields[key>>3], data[n:n+int(length)])
+			data = data[n+int(length):]
+		default:
+			return fields
+		}
+	}
+	return fields
+}
@@ -0,0 +1,14 @@
+package helper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+func DecompressGzip(src []byte) []byte {
+	r, _ := gzip.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	dst, _ := ioutil.ReadAll(r)
+	return dst
+}
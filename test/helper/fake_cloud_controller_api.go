@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,6 +37,24 @@ type FakeCloudControllerAPI struct {
 
 	// Number of apps
 	AppNumber int
+
+	// Used to make the controller answer 404 to the v3 API, like before it was available
+	DisableV3 bool
+
+	// Number of instances of the web processes
+	AppInstances int
+
+	// Apps running a docker image, whose current droplet gives the image
+	DockerApps []string
+
+	// Apps without a web process, e.g. worker apps, and apps without a current droplet, e.g. never staged
+	WorkerApps   []string
+	UnstagedApps []string
+
+	// Apps and processes returned when filtering on updated_ats, and apps returned by the audit events as deleted
+	UpdatedApps      []string
+	UpdatedProcesses []string
+	DeletedApps      []string
 }
 
 // NewFakeCloudControllerAPI create a new cloud controller
@@ -47,6 +66,7 @@ func NewFakeCloudControllerAPI(tokenType string, accessToken string) *FakeCloudC
 		accessToken:      accessToken,
 		RequestTime:      0,
 		AppNumber:        4,
+		AppInstances:     1,
 	}
 }
 
@@ -91,6 +111,11 @@ func (f *FakeCloudControllerAPI) AuthToken() string {
 }
 
 func (f *FakeCloudControllerAPI) writeResponse(rw http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/v3/") {
+		f.writeV3Response(rw, r)
+		return
+	}
+
 	switch r.URL.Path {
 	case "/v2/info":
 		rw.Write([]byte(fmt.Sprintf(`
@@ -254,3 +279,221 @@ func (f *FakeCloudControllerAPI) writeResponse(rw http.ResponseWriter, r *http.R
 		`, f.tokenType, f.accessToken)))
 	}
 }
+
+// writeV3Response serves one app and its web process per page, like the v2 API
+func (f *FakeCloudControllerAPI) writeV3Response(rw http.ResponseWriter, r *http.Request) {
+	if f.DisableV3 {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(`{"code": 10000, "description": "Unknown request", "error_code": "CF-NotFound"}`))
+		return
+	}
+
+	params, _ := url.ParseQuery(r.URL.RawQuery)
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/v3/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "apps" && isFiltered(params):
+		var apps []string
+		for _, guid := range f.filteredGUIDs(params, "guids", f.UpdatedApps) {
+			apps = append(apps, f.v3App(guid))
+		}
+		rw.Write([]byte(fmt.Sprintf(`{ %s, "resources": [ %s ], "included": %s }`,
+			v3SinglePage(len(apps)), strings.Join(apps, ","), v3Included)))
+	case len(path) == 1 && path[0] == "processes" && isFiltered(params):
+		var processes []string
+		for _, guid := range f.filteredGUIDs(params, "app_guids", f.UpdatedProcesses) {
+			processes = append(processes, v3WebProcess(guid, "[PRIVATE DATA HIDDEN IN LISTS]", f.AppInstances))
+		}
+		rw.Write([]byte(fmt.Sprintf(`{ %s, "resources": [ %s ] }`, v3SinglePage(len(processes)), strings.Join(processes, ","))))
+	case len(path) == 1 && path[0] == "droplets" && params.Get("current") == "true":
+		var droplets []string
+		for _, guid := range f.filteredGUIDs(params, "app_guids", nil) {
+			if f.isDockerApp(guid) {
+				droplets = append(droplets, v3DockerDroplet(guid))
+			}
+		}
+		rw.Write([]byte(fmt.Sprintf(`{ %s, "resources": [ %s ] }`, v3SinglePage(len(droplets)), strings.Join(droplets, ","))))
+	case len(path) == 1 && path[0] == "apps":
+		page := params.Get("page")
+		rw.Write([]byte(fmt.Sprintf(`
+		{
+			"pagination": {
+				"total_results": %d,
+				"total_pages": %d,
+				"first": { "href": "/v3/apps?page=1" },
+				"last": { "href": "/v3/apps?page=%d" },
+				"next": null,
+				"previous": null
+			},
+			"resources": [ %s ],
+			"included": %s
+		}`, f.AppNumber, f.AppNumber, f.AppNumber, f.v3App("app-"+page), v3Included)))
+	case len(path) == 1 && path[0] == "processes":
+		page := params.Get("page")
+		rw.Write([]byte(fmt.Sprintf(`
+		{
+			"pagination": {
+				"total_results": %d,
+				"total_pages": %d,
+				"first": { "href": "/v3/processes?page=1" },
+				"last": { "href": "/v3/processes?page=%d" },
+				"next": null,
+				"previous": null
+			},
+			"resources": [ %s ]
+		}`, f.AppNumber, f.AppNumber, f.AppNumber, v3WebProcess("app-"+page, "[PRIVATE DATA HIDDEN IN LISTS]", f.AppInstances))))
+	case len(path) == 1 && path[0] == "audit_events":
+		var events []string
+		for _, guid := range f.DeletedApps {
+			events = append(events, fmt.Sprintf(`{
+				"type": "audit.app.delete-request",
+				"target": { "guid": "%s", "type": "app", "name": "%s" }
+			}`, guid, guid))
+		}
+		rw.Write([]byte(fmt.Sprintf(`{ %s, "resources": [ %s ] }`, v3SinglePage(len(events)), strings.Join(events, ","))))
+	case len(path) >= 2 && path[0] == "apps" && f.hasApp(path[1]):
+		switch {
+		case len(path) == 2:
+			app := strings.TrimSuffix(f.v3App(path[1]), "}")
+			rw.Write([]byte(fmt.Sprintf(`%s, "included": %s }`, app, v3Included)))
+		case path[2] == "droplets" && containsGUID(f.UnstagedApps, path[1]),
+			path[2] == "processes" && containsGUID(f.WorkerApps, path[1]):
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"errors": [{"code": 10010, "title": "CF-ResourceNotFound", "detail": "Resource not found"}]}`))
+		case path[2] == "droplets" && f.isDockerApp(path[1]):
+			rw.Write([]byte(v3DockerDroplet(path[1])))
+		case path[2] == "droplets":
+			rw.Write([]byte(fmt.Sprintf(`{ "guid": "droplet-%s", "state": "STAGED", "image": null }`, path[1])))
+		default:
+			rw.Write([]byte(v3WebProcess(path[1], "bundle exec rake scheduler:start", f.AppInstances)))
+		}
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(`{"errors": [{"code": 10010, "title": "CF-ResourceNotFound", "detail": "App not found"}]}`))
+	}
+}
+
+// hasApp returns true for the guids of the served apps, app-1 to app-<AppNumber>
+func (f *FakeCloudControllerAPI) hasApp(guid string) bool {
+	var i int
+	_, err := fmt.Sscanf(guid, "app-%d", &i)
+	return err == nil && i >= 1 && i <= f.AppNumber
+}
+
+// isFiltered returns true for the lists filtered on guids or on the update time
+func isFiltered(params url.Values) bool {
+	return params.Get("updated_ats[gt]") != "" || params.Get("guids") != "" || params.Get("app_guids") != ""
+}
+
+// filteredGUIDs returns the served guids listed in the guidsParam parameter, or the updated guids
+func (f *FakeCloudControllerAPI) filteredGUIDs(params url.Values, guidsParam string, updated []string) []string {
+	guids := updated
+	if params.Get(guidsParam) != "" {
+		guids = strings.Split(params.Get(guidsParam), ",")
+	}
+	var served []string
+	for _, guid := range guids {
+		if f.hasApp(guid) {
+			served = append(served, guid)
+		}
+	}
+	return served
+}
+
+func v3SinglePage(totalResults int) string {
+	return fmt.Sprintf(`"pagination": {
+		"total_results": %d,
+		"total_pages": 1,
+		"next": null,
+		"previous": null
+	}`, totalResults)
+}
+
+// isDockerApp returns true for the guids of the DockerApps
+func (f *FakeCloudControllerAPI) isDockerApp(guid string) bool {
+	return containsGUID(f.DockerApps, guid)
+}
+
+func containsGUID(guids []string, guid string) bool {
+	for _, g := range guids {
+		if g == guid {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FakeCloudControllerAPI) v3App(guid string) string {
+	lifecycle := `{
+			"type": "buildpack",
+			"data": { "buildpacks": [ "ruby_buildpack" ], "stack": "cflinuxfs3" }
+		}`
+	if f.isDockerApp(guid) {
+		lifecycle = `{ "type": "docker", "data": {} }`
+	}
+	return fmt.Sprintf(`{
+		"guid": "%s",
+		"name": "%s",
+		"state": "STARTED",
+		"created_at": "2019-05-17T15:02:39Z",
+		"updated_at": "2019-05-21T13:51:14Z",
+		"lifecycle": %s,
+		"relationships": {
+			"space": { "data": { "guid": "417b893e-291e-48ec-94c7-7b2348604365" } }
+		},
+		"metadata": {
+			"labels": { "team": "payments", "mycompany.com/tier": "gold" },
+			"annotations": { "cost-center": "1234" }
+		}
+	}`, guid, guid, lifecycle)
+}
+
+func v3DockerDroplet(appGUID string) string {
+	return fmt.Sprintf(`{
+		"guid": "droplet-%s",
+		"state": "STAGED",
+		"image": "cloudfoundry/%s:latest",
+		"relationships": {
+			"app": { "data": { "guid": "%s" } }
+		}
+	}`, appGUID, appGUID, appGUID)
+}
+
+func v3WebProcess(appGUID string, command string, instances int) string {
+	return fmt.Sprintf(`{
+		"guid": "%s",
+		"type": "web",
+		"command": "%s",
+		"instances": %d,
+		"memory_in_mb": 1024,
+		"disk_in_mb": 1024,
+		"relationships": {
+			"app": { "data": { "guid": "%s" } }
+		}
+	}`, appGUID, command, instances, appGUID)
+}
+
+const v3Included = `{
+	"spaces": [
+		{
+			"guid": "417b893e-291e-48ec-94c7-7b2348604365",
+			"name": "system",
+			"metadata": {
+				"labels": { "team": "platform", "env": "prod" },
+				"annotations": {}
+			},
+			"relationships": {
+				"organization": { "data": { "guid": "671557cf-edcd-49df-9863-ee14513d13c7" } }
+			}
+		}
+	],
+	"organizations": [
+		{
+			"guid": "671557cf-edcd-49df-9863-ee14513d13c7",
+			"name": "system",
+			"metadata": {
+				"labels": { "env": "staging", "business-unit": "retail" },
+				"annotations": {}
+			}
+		}
+	]
+}`
@@ -4,11 +4,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"time"
 )
 
 type FakeDatadogAPI struct {
 	server           *httptest.Server
 	ReceivedContents chan []byte
+
+	// Used to make the API slow to answer
+	RequestTime time.Duration
 }
 
 func NewFakeDatadogAPI() *FakeDatadogAPI {
@@ -33,6 +37,7 @@ func (f *FakeDatadogAPI) URL() string {
 func (f *FakeDatadogAPI) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	contents, _ := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
+	time.Sleep(f.RequestTime)
 
 	go func() {
 		f.ReceivedContents <- contents
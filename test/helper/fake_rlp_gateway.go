@@ -0,0 +1,107 @@
+package helper
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type FakeRLPGateway struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	validToken string
+
+	lastAuthorization string
+	lastQuery         url.Values
+	requests          int
+
+	batches chan string
+	closed  chan struct{}
+}
+
+func NewFakeRLPGateway(validToken string) *FakeRLPGateway {
+	return &FakeRLPGateway{
+		validToken: validToken,
+		batches:    make(chan string, 100),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (f *FakeRLPGateway) Start() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Start()
+}
+
+func (f *FakeRLPGateway) Close() {
+	close(f.closed)
+	f.server.Close()
+}
+
+func (f *FakeRLPGateway) URL() string {
+	return f.server.URL
+}
+
+func (f *FakeRLPGateway) LastAuthorization() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastAuthorization
+}
+
+func (f *FakeRLPGateway) LastQuery() url.Values {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastQuery
+}
+
+func (f *FakeRLPGateway) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+// AddBatch sends a batch of JSON encoded v2 envelopes, e.g. `{"batch":[...]}`, to the connected client
+func (f *FakeRLPGateway) AddBatch(batch string) {
+	f.batches <- batch
+}
+
+func (f *FakeRLPGateway) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.lastAuthorization = r.Header.Get("Authorization")
+	f.lastQuery = r.URL.Query()
+	f.requests++
+	f.lock.Unlock()
+
+	if r.URL.Path != "/v2/read" {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.lastAuthorization != f.validToken {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.WriteHeader(http.StatusOK)
+	flusher := rw.(http.Flusher)
+	fmt.Fprint(rw, "event: heartbeat\ndata: 1\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case batch := <-f.batches:
+			for _, line := range strings.Split(batch, "\n") {
+				fmt.Fprintf(rw, "data: %s\n", line)
+			}
+			fmt.Fprint(rw, "\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-f.closed:
+			return
+		}
+	}
+}
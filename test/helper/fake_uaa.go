@@ -14,6 +14,9 @@ type FakeUAA struct {
 	tokenType   string
 	accessToken string
 
+	expiresIn int
+	failures  int
+	requests  int
 	requested bool
 }
 
@@ -43,17 +46,46 @@ func (f *FakeUAA) Requested() bool {
 	return f.requested
 }
 
+// RequestCount returns the number of token requests received
+func (f *FakeUAA) RequestCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+// SetExpiresIn sets the expires_in field of the token responses
+func (f *FakeUAA) SetExpiresIn(seconds int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expiresIn = seconds
+}
+
+// FailNextRequests makes the next n token requests fail with a 500
+func (f *FakeUAA) FailNextRequests(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = n
+}
+
 func (f *FakeUAA) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+	if f.failures > 0 {
+		f.failures--
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	rw.Write([]byte(fmt.Sprintf(`
 		{
 			"token_type": "%s",
-			"access_token": "%s"
+			"access_token": "%s",
+			"expires_in": %d
 		}
-	`, f.tokenType, f.accessToken)))
-	f.lock.Lock()
+	`, f.tokenType, f.accessToken, f.expiresIn)))
 	f.requested = true
-	f.lock.Unlock()
 }
 
 func (f *FakeUAA) AuthToken() string {
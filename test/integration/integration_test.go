@@ -116,9 +116,8 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 		Expect(err).NotTo(HaveOccurred())
 
 		for _, m := range payload.Series {
-			Expect(m.Type).To(Equal("gauge"))
-
 			if m.Metric == "cloudfoundry.nozzle.origin.metricName" || m.Metric == "cloudfoundry.nozzle.metricName" {
+				Expect(m.Type).To(Equal("gauge"))
 				Expect(m.Tags).To(HaveLen(9))
 				Expect(m.Tags[0]).To(Equal("deployment:deployment-name"))
 				if m.Tags[5] == "job:doppler" {
@@ -133,6 +132,8 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 					panic("Unknown tag")
 				}
 			} else if m.Metric == "cloudfoundry.nozzle.origin.counterName" || m.Metric == "cloudfoundry.nozzle.counterName" {
+				Expect(m.Type).To(Equal("count"))
+				Expect(m.Interval).To(BeEquivalentTo(2))
 				Expect(m.Tags).To(HaveLen(8))
 				Expect(m.Tags[0]).To(Equal("deployment:deployment-name"))
 				Expect(m.Tags[1]).To(Equal("deployment:deployment-name-aaaaaaaaaaaaaaaaaaaa"))
@@ -144,9 +145,10 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 				Expect(m.Tags[7]).To(Equal("origin:origin"))
 
 				Expect(m.Points).To(Equal([]metric.Point{
-					{Timestamp: 3, Value: 15.0},
+					{Timestamp: 3, Value: 3.0},
 				}))
 			} else if m.Metric == "cloudfoundry.nozzle.totalMessagesReceived" {
+				Expect(m.Type).To(Equal("gauge"))
 				Expect(m.Tags).To(HaveLen(2))
 				Expect(m.Tags[0]).To(HavePrefix("deployment:"))
 				Expect(m.Tags[1]).To(HavePrefix("ip:"))
@@ -162,6 +164,9 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 				Expect(m.Points[0].Value).To(Equal(0.0))
 			} else if m.Metric == "cloudfoundry.nozzle.slowConsumerAlert" {
 
+			} else if m.Metric == "cloudfoundry.nozzle.sendQueueLength" || m.Metric == "cloudfoundry.nozzle.sendQueueDropped" {
+				Expect(m.Points).To(HaveLen(1))
+				Expect(m.Points[0].Value).To(Equal(0.0))
 			} else {
 				panic("Unknown metric " + m.Metric)
 			}